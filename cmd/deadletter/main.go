@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/internal/spool"
+)
+
+const usage = `Usage: deadletter [-dir DIR] <command> [args]
+
+Commands:
+  list              list dead letters
+  show <id>         print one dead letter with its message
+  retry <id>...     make entries due for immediate retry (--all for every entry)
+  purge <id>...     delete entries permanently (--all for every entry)
+`
+
+func main() {
+	dir := flag.String("dir", "spool/deadletter", "dead letter directory")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Policy only matters to the server's scheduler; a retry from here just
+	// marks entries due.
+	dl, err := spool.OpenDeadLetters(*dir, spool.RetryPolicy{})
+	if err != nil {
+		log.Fatal("Failed to open dead letters:", err)
+	}
+
+	switch args[0] {
+	case "list":
+		list(dl)
+	case "show":
+		if len(args) != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		show(dl, args[1])
+	case "retry":
+		ids := selectIDs(dl, args[1:])
+		for _, id := range ids {
+			if err := dl.Retry(id); err != nil {
+				log.Fatal("Failed to retry dead letter:", err)
+			}
+		}
+		fmt.Printf("✅ Marked %d dead letters for retry\n", len(ids))
+	case "purge":
+		ids := selectIDs(dl, args[1:])
+		removed, err := dl.Purge(ids...)
+		if err != nil {
+			log.Fatal("Failed to purge dead letters:", err)
+		}
+		fmt.Printf("✅ Purged %d dead letters\n", removed)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func list(dl *spool.DeadLetters) {
+	entries, err := dl.List()
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("No dead letters.")
+		return
+	}
+
+	fmt.Printf("%-37s %-8s %-20s %-30s %s\n", "ID", "ATTEMPTS", "NEXT RETRY", "RECIPIENTS", "LAST ERROR")
+	for _, e := range entries {
+		next := "parked"
+		if !e.Parked() {
+			next = e.NextRetryAt.Format(time.DateTime)
+		}
+		fmt.Printf("%-37s %-8d %-20s %-30s %s\n",
+			e.ID, e.Attempts, next, strings.Join(e.Message.To, ","), e.LastError)
+	}
+}
+
+func show(dl *spool.DeadLetters, id string) {
+	e, err := dl.Get(id)
+	if err != nil {
+		log.Fatal("Failed to read dead letter:", err)
+	}
+
+	fmt.Printf("ID:           %s\n", e.ID)
+	fmt.Printf("From:         %s\n", e.Message.From)
+	fmt.Printf("To:           %s\n", strings.Join(e.Message.To, ", "))
+	fmt.Printf("Subject:      %s\n", e.Message.Subject)
+	fmt.Printf("Size:         %d\n", e.Message.Size)
+	fmt.Printf("Attempts:     %d\n", e.Attempts)
+	fmt.Printf("First failed: %s\n", e.FirstFailedAt.Format(time.RFC3339))
+	fmt.Printf("Last attempt: %s\n", e.LastAttemptAt.Format(time.RFC3339))
+	fmt.Printf("Last error:   %s\n", e.LastError)
+	fmt.Println()
+	fmt.Print(e.Message.Body)
+}
+
+// selectIDs expands --all into every entry; otherwise the arguments are
+// taken as ids and at least one is required.
+func selectIDs(dl *spool.DeadLetters, args []string) []string {
+	if len(args) == 1 && args[0] == "--all" {
+		entries, err := dl.List()
+		if err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		ids := make([]string, 0, len(entries))
+		for _, e := range entries {
+			ids = append(ids, e.ID)
+		}
+		return ids
+	}
+
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	return args
+}
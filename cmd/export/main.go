@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/database"
+	"github.com/zeusnotfound04/nano-mail/pkg/mailfile"
+)
+
+const usage = `Usage: export [-o FILE] <command> [args]
+
+Commands:
+  eml <id>          write one message as an RFC 5322 .eml file
+  mbox [-since DATE] [-until DATE] <address>
+                    write a mailbox as mboxrd, oldest first; DATE is
+                    YYYY-MM-DD or RFC 3339, and -until includes a whole day
+
+Output goes to standard output unless -o is given.
+`
+
+func main() {
+	output := flag.String("o", "", "output file")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var run func(ctx context.Context, db *sql.DB, w io.Writer) (int, error)
+	switch args[0] {
+	case "eml":
+		if len(args) != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || id < 1 {
+			log.Fatalf("Invalid message id %q", args[1])
+		}
+		run = func(ctx context.Context, db *sql.DB, w io.Writer) (int, error) {
+			return 1, exportEML(ctx, db, w, id)
+		}
+	case "mbox":
+		fs := flag.NewFlagSet("mbox", flag.ExitOnError)
+		since := fs.String("since", "", "only mail received on or after DATE")
+		until := fs.String("until", "", "only mail received up to DATE")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		r, err := parseRange(*since, *until)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mailbox := fs.Arg(0)
+		run = func(ctx context.Context, db *sql.DB, w io.Writer) (int, error) {
+			return exportMbox(ctx, db, w, mailbox, r)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	db, err := database.ConnectDB()
+	if err != nil {
+		log.Fatal("Failed to connect to DB:", err)
+	}
+	defer db.Close()
+
+	var w io.Writer = os.Stdout
+	var file *os.File
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal("Failed to create output file:", err)
+		}
+		file, w = f, f
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	n, err := run(ctx, db, w)
+	if file != nil {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(file.Name())
+		}
+	}
+	if err != nil {
+		log.Fatal("Export failed: ", err)
+	}
+
+	log.Printf("Exported %d messages", n)
+}
+
+func exportEML(ctx context.Context, db *sql.DB, w io.Writer, id int64) error {
+	msg, err := database.GetStoredMessage(ctx, db, id)
+	if errors.Is(err, database.ErrMessageNotFound) {
+		return fmt.Errorf("message %d not found", id)
+	}
+	if err != nil {
+		return err
+	}
+	return mailfile.WriteEML(w, []byte(msg.Body))
+}
+
+func exportMbox(ctx context.Context, db *sql.DB, w io.Writer, mailbox string, r database.ExportRange) (int, error) {
+	mbox := mailfile.NewMboxWriter(w)
+	n := 0
+	err := database.ExportMailbox(ctx, db, mailbox, r, func(msg *database.StoredMessage) error {
+		n++
+		return mbox.WriteMessage(msg.Sender, msg.CreatedAt, []byte(msg.Body))
+	})
+	return n, err
+}
+
+// parseRange reads the -since and -until flags. A bare date for -until
+// covers that whole day.
+func parseRange(since, until string) (database.ExportRange, error) {
+	var r database.ExportRange
+	var err error
+	if since != "" {
+		if r.Since, _, err = parseDate(since); err != nil {
+			return r, fmt.Errorf("invalid -since: %w", err)
+		}
+	}
+	if until != "" {
+		var dateOnly bool
+		if r.Until, dateOnly, err = parseDate(until); err != nil {
+			return r, fmt.Errorf("invalid -until: %w", err)
+		}
+		if dateOnly {
+			r.Until = r.Until.AddDate(0, 0, 1)
+		}
+	}
+	if !r.Since.IsZero() && !r.Until.IsZero() && !r.Since.Before(r.Until) {
+		return r, fmt.Errorf("-since must be before -until")
+	}
+	return r, nil
+}
+
+func parseDate(s string) (t time.Time, dateOnly bool, err error) {
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, true, nil
+	}
+	t, err = time.Parse(time.RFC3339, s)
+	return t, false, err
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/database"
+	"github.com/zeusnotfound04/nano-mail/internal/config"
+	"github.com/zeusnotfound04/nano-mail/internal/ingest"
+	"github.com/zeusnotfound04/nano-mail/internal/outbound"
+	"github.com/zeusnotfound04/nano-mail/internal/quota"
+	"github.com/zeusnotfound04/nano-mail/internal/registry"
+	"github.com/zeusnotfound04/nano-mail/internal/srs"
+	"github.com/zeusnotfound04/nano-mail/internal/webhook"
+	"github.com/zeusnotfound04/nano-mail/pkg/mailfile"
+	"github.com/zeusnotfound04/nano-mail/pkg/message"
+)
+
+const usage = `Usage: import [flags] <path>
+
+Imports an mboxrd or mboxcl2 file, or a Maildir tree, into storage. Each
+message's envelope is rebuilt from its headers unless -rcpt is given.
+Mail goes through the same pipeline as mail received over SMTP: recipients
+are checked against the address registry and mailbox quotas, messages
+already stored with the same Message-ID and recipients are skipped, and
+stored mail is queued for webhooks and forwarding and announced to push
+clients. A dry run reads the archive without consulting storage, so it
+reports neither refused recipients nor duplicates.
+
+The address mode and SRS secret are read from ADDRESS_MODE and SRS_SECRET,
+as the server reads them.
+
+Flags:
+`
+
+// importOrigin tags the storage notifications of imported mail, which no
+// running server published itself.
+const importOrigin = "import"
+
+const batchSize = 50
+
+type stats struct {
+	imported   int
+	duplicates int
+	skipped    int
+	failed     int
+}
+
+func main() {
+	defaults := config.DefaultConfig()
+	format := flag.String("format", "auto", "archive format: mboxrd, mboxcl2, maildir or auto")
+	rcpts := flag.String("rcpt", "", "comma separated recipients for every message, instead of its headers")
+	sender := flag.String("from", "", "envelope sender for every message, instead of the archive's")
+	maxSize := flag.Int64("max-size", 20*1024*1024, "skip messages larger than this many bytes")
+	dryRun := flag.Bool("dry-run", false, "read and report without storing anything")
+	domain := flag.String("domain", "zeus.nanomail.in", "mail domain of the server, for rewriting the senders of forwarded mail")
+	webhooks := flag.Bool("webhooks", defaults.WebhooksEnabled, "queue webhook deliveries for imported mail")
+	forward := flag.Bool("forward", defaults.ForwardingEnabled, "queue forwarded copies of imported mail")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	path := flag.Arg(0)
+
+	reader, closeReader, err := openArchive(path, *format)
+	if err != nil {
+		log.Fatal("Failed to open archive: ", err)
+	}
+	defer closeReader()
+
+	var fixedRcpts []string
+	for _, r := range strings.Split(*rcpts, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			fixedRcpts = append(fixedRcpts, r)
+		}
+	}
+
+	var db *sql.DB
+	var pipeline *ingest.Pipeline
+	if !*dryRun {
+		db, err = database.ConnectDB()
+		if err != nil {
+			log.Fatal("Failed to connect to DB:", err)
+		}
+		defer db.Close()
+
+		migrateCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err = database.Migrate(migrateCtx, db)
+		cancel()
+		if err != nil {
+			log.Fatal("Failed to migrate DB schema:", err)
+		}
+
+		cfg := config.DefaultConfig()
+		cfg.Domain = *domain
+		cfg.WebhooksEnabled = *webhooks
+		cfg.ForwardingEnabled = *forward
+		// Read after connecting, which loads .env.
+		if mode := os.Getenv("ADDRESS_MODE"); mode != "" {
+			cfg.AddressMode = mode
+		}
+		cfg.SRSSecret = os.Getenv("SRS_SECRET")
+
+		pipeline, err = newPipeline(cfg, db)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	imp := &importer{
+		pipeline: pipeline,
+		sender:   *sender,
+		rcpts:    fixedRcpts,
+		maxSize:  *maxSize,
+		dryRun:   *dryRun,
+	}
+	err = imp.run(ctx, reader)
+
+	verb := "Imported"
+	if *dryRun {
+		verb = "Would import"
+	}
+	log.Printf("%s %d messages, %d duplicates, %d skipped, %d failed",
+		verb, imp.stats.imported, imp.stats.duplicates, imp.stats.skipped, imp.stats.failed)
+	if err != nil {
+		log.Fatal("Import stopped: ", err)
+	}
+	if imp.stats.failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// newPipeline builds the ingest pipeline the server would run under cfg.
+// Webhook deliveries and forwarded copies are only queued here; the running
+// server delivers them.
+func newPipeline(cfg *config.Config, db *sql.DB) (*ingest.Pipeline, error) {
+	reg := registry.New(db, registry.Options{
+		Mode:       registry.Mode(cfg.AddressMode),
+		Domain:     cfg.Domain,
+		DefaultTTL: cfg.AddressDefaultTTL,
+		MaxTTL:     cfg.AddressMaxTTL,
+	})
+	switch reg.Mode() {
+	case registry.ModeOpen, registry.ModeStrict, registry.ModeCatchAll:
+	default:
+		return nil, fmt.Errorf("unknown address mode %q", reg.Mode())
+	}
+
+	opts := ingest.Options{
+		DB:       db,
+		Origin:   importOrigin,
+		Registry: reg,
+		Quota:    quota.NewEnforcer(db, quota.PolicyFor(cfg)),
+	}
+	if cfg.WebhooksEnabled {
+		opts.Webhooks = webhook.NewDispatcher(webhook.Options{DB: db})
+	}
+	if cfg.ForwardingEnabled {
+		if cfg.SRSSecret == "" {
+			return nil, errors.New("forwarding requires SRS_SECRET; set it or pass -forward=false")
+		}
+		opts.Outbound = outbound.NewQueue(outbound.Options{
+			DB:     db,
+			MaxAge: cfg.OutboundMaxAge,
+			SRS:    srs.New(cfg.SRSSecret, cfg.Domain, cfg.SRSMaxAge),
+		})
+	}
+	return ingest.New(opts), nil
+}
+
+func openArchive(path, format string) (mailfile.Reader, func(), error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if format == "auto" {
+		format = "mboxrd"
+		if info.IsDir() {
+			format = "maildir"
+		}
+	}
+
+	switch format {
+	case "maildir":
+		r, err := mailfile.NewMaildirReader(path)
+		return r, func() {}, err
+	case "mboxrd", "mboxcl2":
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if format == "mboxcl2" {
+			return mailfile.NewMboxcl2Reader(f), func() { f.Close() }, nil
+		}
+		return mailfile.NewMboxrdReader(f), func() { f.Close() }, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+type importer struct {
+	pipeline *ingest.Pipeline
+	sender   string
+	rcpts    []string
+	maxSize  int64
+	dryRun   bool
+
+	batch   []*message.Message
+	sources []string
+	stats   stats
+}
+
+func (imp *importer) run(ctx context.Context, reader mailfile.Reader) error {
+	for ctx.Err() == nil {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// A broken mbox can't be resynchronised safely; a single
+			// unreadable Maildir file could, but is rare enough to stop on.
+			return err
+		}
+
+		if err := imp.add(ctx, entry); err != nil {
+			return err
+		}
+		if len(imp.batch) >= batchSize {
+			imp.flush(ctx)
+		}
+	}
+	imp.flush(ctx)
+	return ctx.Err()
+}
+
+// add admits entry's recipients and builds its message the way the SMTP
+// session does, queueing it for the next batch. Duplicates are dropped when
+// the batch is stored.
+func (imp *importer) add(ctx context.Context, entry *mailfile.Entry) error {
+	if int64(len(entry.Raw)) > imp.maxSize {
+		log.Printf("Skipping %s: %d bytes is over the size limit", entry.Source, len(entry.Raw))
+		imp.stats.skipped++
+		return nil
+	}
+
+	headerSender, headerRcpts := mailfile.HeaderEnvelope(entry.Raw)
+	sender := imp.sender
+	if sender == "" {
+		sender = entry.Sender
+	}
+	if sender == "" {
+		sender = headerSender
+	}
+	rcpts := imp.rcpts
+	if len(rcpts) == 0 {
+		rcpts = headerRcpts
+	}
+	if len(rcpts) == 0 {
+		log.Printf("Skipping %s: no recipients in its headers, use -rcpt", entry.Source)
+		imp.stats.skipped++
+		return nil
+	}
+
+	if !imp.dryRun {
+		admitted, err := imp.admit(ctx, entry.Source, rcpts)
+		if err != nil {
+			return err
+		}
+		if len(admitted) == 0 {
+			log.Printf("Skipping %s: every recipient was refused", entry.Source)
+			imp.stats.skipped++
+			return nil
+		}
+		rcpts = admitted
+	}
+
+	received := entry.Received
+	msg, err := message.New(sender, rcpts, entry.Raw, received)
+	if err != nil {
+		log.Printf("Warning: %s: failed to parse headers: %v", entry.Source, err)
+	}
+	if received.IsZero() {
+		msg.Date = time.Now()
+		if parsed, err := message.Parse(entry.Raw); err == nil && !parsed.Date.IsZero() {
+			msg.Date = parsed.Date
+		}
+	}
+
+	imp.batch = append(imp.batch, msg)
+	imp.sources = append(imp.sources, entry.Source)
+	return nil
+}
+
+// admit runs rcpts through the pipeline's admission checks and returns the
+// admitted ones in the form they are stored under. An error means the
+// address registry could not be consulted.
+func (imp *importer) admit(ctx context.Context, source string, rcpts []string) ([]string, error) {
+	admitted := make([]string, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		canonical, err := imp.pipeline.Admit(ctx, rcpt)
+		switch {
+		case err == nil:
+			admitted = append(admitted, canonical)
+		case errors.Is(err, ingest.ErrUnknownRecipient),
+			errors.Is(err, ingest.ErrExpiredRecipient),
+			errors.Is(err, ingest.ErrMailboxFull):
+			log.Printf("%s: dropping recipient %s: %v", source, rcpt, err)
+		default:
+			return nil, err
+		}
+	}
+	return admitted, nil
+}
+
+func (imp *importer) flush(ctx context.Context) {
+	if len(imp.batch) == 0 {
+		return
+	}
+	defer func() {
+		imp.batch = imp.batch[:0]
+		imp.sources = imp.sources[:0]
+	}()
+
+	if imp.dryRun {
+		for i, msg := range imp.batch {
+			fmt.Printf("%s: from <%s> to %s, %d bytes, %q\n",
+				imp.sources[i], msg.From, strings.Join(msg.To, ","), msg.Size, msg.Subject)
+		}
+		imp.stats.imported += len(imp.batch)
+		return
+	}
+
+	results := imp.pipeline.Store(ctx, imp.batch)
+	for i, result := range results {
+		switch {
+		case result.Err != nil:
+			if !errors.Is(result.Err, context.Canceled) {
+				log.Printf("Failed to store %s: %v", imp.sources[i], result.Err)
+			}
+			imp.stats.failed++
+		case result.Duplicate:
+			imp.stats.duplicates++
+		default:
+			imp.pipeline.Deliver(context.WithoutCancel(ctx), result, imp.batch[i])
+			imp.stats.imported++
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/database"
+	"github.com/zeusnotfound04/nano-mail/internal/auth"
+	"github.com/zeusnotfound04/nano-mail/pkg/message"
+)
+
+const usage = `Usage: inboxtoken <command> <address> [args]
+
+Commands:
+  issue <address>        create a token for the address, alongside any
+                         it already has
+  rotate <address>       create a token and revoke all the others
+  revoke <address> [id]  revoke one token, or every token of the address
+  list <address>         list the address's tokens
+
+Tokens are shown once, when created; only their hashes are stored.
+`
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 2 || (args[0] != "revoke" && len(args) != 2) || len(args) > 3 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	addr, err := message.ParseAddress(args[1])
+	if err != nil {
+		log.Fatalf("Invalid address %q: %v", args[1], err)
+	}
+	mailbox := addr.String()
+
+	db, err := database.ConnectDB()
+	if err != nil {
+		log.Fatal("Failed to connect to DB:", err)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := database.Migrate(ctx, db); err != nil {
+		log.Fatal("Failed to migrate DB schema:", err)
+	}
+
+	tokens := auth.NewStoredTokens(db)
+	switch args[0] {
+	case "issue":
+		token, err := tokens.Issue(ctx, mailbox)
+		if err != nil {
+			log.Fatal("Failed to issue token:", err)
+		}
+		fmt.Println(token)
+	case "rotate":
+		token, err := tokens.Rotate(ctx, mailbox)
+		if err != nil {
+			log.Fatal("Failed to rotate token:", err)
+		}
+		fmt.Println(token)
+	case "revoke":
+		if len(args) == 3 {
+			id, err := strconv.ParseInt(args[2], 10, 64)
+			if err != nil || id < 1 {
+				log.Fatalf("Invalid id %q", args[2])
+			}
+			err = database.RevokeInboxToken(ctx, db, mailbox, id)
+			if errors.Is(err, database.ErrTokenNotFound) {
+				log.Fatalf("No token %d in force for %s", id, mailbox)
+			}
+			if err != nil {
+				log.Fatal("Failed to revoke token:", err)
+			}
+			fmt.Println("✅ Token revoked")
+			return
+		}
+		n, err := database.RevokeInboxTokens(ctx, db, mailbox)
+		if err != nil {
+			log.Fatal("Failed to revoke tokens:", err)
+		}
+		fmt.Printf("✅ Revoked %d tokens\n", n)
+	case "list":
+		list, err := database.ListInboxTokens(ctx, db, mailbox)
+		if err != nil {
+			log.Fatal("Failed to list tokens:", err)
+		}
+		if len(list) == 0 {
+			fmt.Println("No tokens.")
+			return
+		}
+		fmt.Printf("%-8s %-20s %s\n", "ID", "CREATED", "REVOKED")
+		for _, t := range list {
+			revoked := "-"
+			if !t.RevokedAt.IsZero() {
+				revoked = t.RevokedAt.Format(time.DateTime)
+			}
+			fmt.Printf("%-8d %-20s %s\n", t.ID, t.CreatedAt.Format(time.DateTime), revoked)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
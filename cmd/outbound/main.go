@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/database"
+	"github.com/zeusnotfound04/nano-mail/internal/config"
+	"github.com/zeusnotfound04/nano-mail/internal/registry"
+)
+
+const usage = `Usage: outbound <command> [args]
+
+Commands:
+  forward <address> <target>
+                    forward mail for address to target
+  unforward <id>    delete a forwarding rule
+  rules [address]   list forwarding rules
+  queue [-status STATUS] [-limit N]
+                    show queued messages, newest first; STATUS is
+                    pending, delivered or failed
+  retry <id>        queue a failed message again
+`
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	db, err := database.ConnectDB()
+	if err != nil {
+		log.Fatal("Failed to connect to DB:", err)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := database.Migrate(ctx, db); err != nil {
+		log.Fatal("Failed to migrate DB schema:", err)
+	}
+
+	switch args[0] {
+	case "forward":
+		if len(args) != 3 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		address, err := registry.Canonical(args[1])
+		if err != nil {
+			log.Fatalf("Invalid address %q", args[1])
+		}
+		target, err := registry.Canonical(args[2])
+		if err != nil {
+			log.Fatalf("Invalid target %q", args[2])
+		}
+		// Rules set up by the operator need no confirmation.
+		rule, err := database.CreateForwardRule(ctx, db, address, target, nil)
+		if err != nil {
+			log.Fatal("Failed to add forwarding rule:", err)
+		}
+		fmt.Printf("✅ Added rule %d: %s -> %s\n", rule.ID, rule.Address, rule.Target)
+	case "unforward":
+		err := database.DeleteForwardRule(ctx, db, parseID(args), "")
+		if err != nil {
+			log.Fatal("Failed to delete forwarding rule:", err)
+		}
+		fmt.Println("✅ Rule deleted")
+	case "rules":
+		address := ""
+		if len(args) > 1 {
+			address = args[1]
+		}
+		rules, err := database.ListForwardRules(ctx, db, address)
+		if err != nil {
+			log.Fatal("Failed to list forwarding rules:", err)
+		}
+		if len(rules) == 0 {
+			fmt.Println("No forwarding rules.")
+			return
+		}
+		fmt.Printf("%-6s %-32s %-32s %s\n", "ID", "ADDRESS", "TARGET", "STATUS")
+		for _, r := range rules {
+			status := "active"
+			if r.ConfirmedAt.IsZero() {
+				status = "unconfirmed"
+			}
+			fmt.Printf("%-6d %-32s %-32s %s\n", r.ID, r.Address, r.Target, status)
+		}
+	case "queue":
+		fs := flag.NewFlagSet("queue", flag.ExitOnError)
+		status := fs.String("status", "", "only messages with this status")
+		limit := fs.Int("limit", 50, "number of messages to show")
+		fs.Parse(args[1:])
+		showQueue(ctx, db, *status, *limit)
+	case "retry":
+		maxAge := config.DefaultConfig().OutboundMaxAge
+		err := database.RetryOutbound(ctx, db, parseID(args), maxAge)
+		if errors.Is(err, database.ErrOutboundNotFound) {
+			log.Fatal("No failed message with that id")
+		}
+		if err != nil {
+			log.Fatal("Failed to requeue message:", err)
+		}
+		fmt.Println("✅ Message queued")
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func parseID(args []string) int64 {
+	if len(args) != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	id, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || id < 1 {
+		log.Fatalf("Invalid id %q", args[1])
+	}
+	return id
+}
+
+func showQueue(ctx context.Context, db *sql.DB, status string, limit int) {
+	msgs, err := database.ListOutbound(ctx, db, status, limit)
+	if err != nil {
+		log.Fatal("Failed to list queue:", err)
+	}
+	if len(msgs) == 0 {
+		fmt.Println("No messages.")
+		return
+	}
+
+	fmt.Printf("%-8s %-9s %-8s %-32s %-20s %s\n",
+		"ID", "STATUS", "ATTEMPTS", "RECIPIENT", "NEXT ATTEMPT", "LAST ERROR")
+	for _, m := range msgs {
+		next := "-"
+		if m.Status == database.OutboundPending {
+			next = m.NextAttemptAt.Format(time.DateTime)
+		}
+		fmt.Printf("%-8d %-9s %-8d %-32s %-20s %s\n",
+			m.ID, m.Status, m.Attempts, m.Recipient, next, m.LastError)
+	}
+}
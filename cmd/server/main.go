@@ -2,9 +2,7 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"fmt"
-	"log"
 	"log/slog"
 	"os"
 	"os/signal"
@@ -22,6 +20,15 @@ func main() {
 		Level: slog.LevelInfo,
 	}))
 
+	// run returns rather than exiting itself, so that its deferred cleanup
+	// runs before the process exits.
+	if err := run(logger); err != nil {
+		logger.Error("Server failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run(logger *slog.Logger) error {
 	cfg := config.DefaultConfig()
 	cfg.Host = "0.0.0.0"
 	cfg.Port = "25"
@@ -29,28 +36,50 @@ func main() {
 	cfg.MaxMessageSize = 20 * 1024 * 1024
 	cfg.ConnectionPerIP = 10
 	cfg.MaxRecipients = 50
+	cfg.SpoolDir = "spool"
 
 	cfg.ReadTimeout = 30 * time.Second
 	cfg.WriteTimeout = 30 * time.Second
 	cfg.Logger = logger
 
-	cfg.Logger = logger
+	connectCtx, connectCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	dbOpts := database.DefaultManagerOptions()
+	dbOpts.Logger = logger
+	dbm, err := database.ConnectManager(connectCtx, dbOpts)
+	connectCancel()
+	if err != nil {
+		return fmt.Errorf("failed to connect to DB: %w", err)
+	}
+	dbm.Start()
+	defer dbm.Close()
 
-	db, err := database.ConnectDB()
+	migrateCtx, migrateCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	err = database.Migrate(migrateCtx, dbm.DB())
+	migrateCancel()
 	if err != nil {
-		log.Fatal("Failed to connect to DB:", err)
+		return fmt.Errorf("failed to migrate DB schema: %w", err)
 	}
-	defer db.Close()
+
+	// Read after connecting, which loads .env.
+	cfg.POP3Port = envPort("POP3_PORT", "110")
+	cfg.IMAPPort = envPort("IMAP_PORT", "143")
+	cfg.APIPort = envPort("API_PORT", "8080")
+	if mode := os.Getenv("ADDRESS_MODE"); mode != "" {
+		cfg.AddressMode = mode
+	}
+	cfg.SRSSecret = os.Getenv("SRS_SECRET")
+	cfg.AddressAdminToken = os.Getenv("ADDRESS_ADMIN_TOKEN")
+	cfg.ForwardingEnabled = os.Getenv("FORWARDING_ENABLED") == "true"
+	cfg.APIPublicURL = os.Getenv("API_PUBLIC_URL")
 
 	logger.Info("Starting SMTP server....")
-	srv, err := server.StartServer(cfg, db)
+	srv, err := server.StartServer(cfg, dbm)
 	if err != nil {
-		logger.Error("Failed to start server", "error", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to start server: %w", err)
 	}
 
 	done := make(chan os.Signal, 1)
-	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGALRM)
+	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGALRM)
 
 	logger.Info("Server is running",
 		"host", cfg.Host,
@@ -63,41 +92,20 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	go func() {
-		<-ctx.Done()
-		if ctx.Err() == context.DeadlineExceeded {
-			logger.Error("Server shutdown timed out")
-			os.Exit(1)
-		}
-	}()
-
-	if err := srv.Stop(); err != nil {
-		logger.Error("Error during server shutdown", "error", err)
-		os.Exit(1)
+	report, err := srv.Stop(ctx)
+	if err != nil {
+		return fmt.Errorf("shutdown timed out with %d messages lost and %d spooled: %w", report.Lost, report.Spooled, err)
 	}
 
 	logger.Info("Server shutdown complete")
-
+	return nil
 }
 
-func initSchema(db *sql.DB) error {
-	query := `
-    CREATE TABLE IF NOT EXISTS emails (
-        id SERIAL PRIMARY KEY,
-        sender TEXT,
-        recipients TEXT[],
-        subject TEXT,
-        body TEXT,
-        size BIGINT,
-        created_at TIMESTAMPTZ DEFAULT NOW()
-    );
-    `
-	_, err := db.Exec(query)
-
-	if err != nil {
-		return fmt.Errorf("failed to initialize schema: %w", err)
+// envPort reads a listener port from the environment, falling back to def
+// when the variable is unset. Setting it empty disables the listener.
+func envPort(name, def string) string {
+	if port, ok := os.LookupEnv(name); ok {
+		return port
 	}
-
-	fmt.Println("Schema initialized successfully!!")
-	return nil
+	return def
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/database"
+)
+
+const usage = `Usage: webhook <command> [args]
+
+Commands:
+  add [-pattern GLOB] [-secret SECRET] <url>
+                    register an endpoint, for every message or only for
+                    recipients matching GLOB (e.g. '*@example.com'); a
+                    signing secret is generated unless one is given
+  list              list endpoints
+  remove <id>       delete an endpoint and its delivery log
+  enable <id>       re-enable an endpoint disabled after failures
+  log [-webhook ID] [-limit N]
+                    show recent deliveries, newest first
+  redeliver <delivery-id>
+                    send a delivery again
+`
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	db, err := database.ConnectDB()
+	if err != nil {
+		log.Fatal("Failed to connect to DB:", err)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := database.Migrate(ctx, db); err != nil {
+		log.Fatal("Failed to migrate DB schema:", err)
+	}
+
+	switch args[0] {
+	case "add":
+		fs := flag.NewFlagSet("add", flag.ExitOnError)
+		pattern := fs.String("pattern", "", "recipient glob; empty matches every message")
+		secret := fs.String("secret", "", "signing secret; generated when empty")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		add(ctx, db, fs.Arg(0), *pattern, *secret)
+	case "list":
+		list(ctx, db)
+	case "remove":
+		err := database.DeleteWebhook(ctx, db, parseID(args))
+		if err != nil {
+			log.Fatal("Failed to remove webhook:", err)
+		}
+		fmt.Println("✅ Webhook removed")
+	case "enable":
+		err := database.EnableWebhook(ctx, db, parseID(args))
+		if err != nil {
+			log.Fatal("Failed to enable webhook:", err)
+		}
+		fmt.Println("✅ Webhook enabled")
+	case "log":
+		fs := flag.NewFlagSet("log", flag.ExitOnError)
+		webhookID := fs.Int64("webhook", 0, "only this webhook's deliveries")
+		limit := fs.Int("limit", 50, "number of deliveries to show")
+		fs.Parse(args[1:])
+		showLog(ctx, db, *webhookID, *limit)
+	case "redeliver":
+		if err := database.RedeliverWebhook(ctx, db, parseID(args)); err != nil {
+			log.Fatal("Failed to redeliver:", err)
+		}
+		fmt.Println("✅ Delivery queued")
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func parseID(args []string) int64 {
+	if len(args) != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	id, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || id < 1 {
+		log.Fatalf("Invalid id %q", args[1])
+	}
+	return id
+}
+
+func add(ctx context.Context, db *sql.DB, rawURL, pattern, secret string) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		log.Fatalf("Invalid webhook URL %q: must be an absolute http or https URL", rawURL)
+	}
+	if _, err := path.Match(pattern, ""); errors.Is(err, path.ErrBadPattern) {
+		log.Fatalf("Invalid recipient pattern %q", pattern)
+	}
+
+	if secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			log.Fatal("Failed to generate secret:", err)
+		}
+		secret = hex.EncodeToString(b)
+	}
+
+	hook, err := database.CreateWebhook(ctx, db, u.String(), pattern, secret)
+	if err != nil {
+		log.Fatal("Failed to add webhook:", err)
+	}
+
+	fmt.Printf("✅ Added webhook %d\n", hook.ID)
+	fmt.Printf("Signing secret: %s\n", hook.Secret)
+}
+
+func list(ctx context.Context, db *sql.DB) {
+	hooks, err := database.ListWebhooks(ctx, db, false)
+	if err != nil {
+		log.Fatal("Failed to list webhooks:", err)
+	}
+	if len(hooks) == 0 {
+		fmt.Println("No webhooks.")
+		return
+	}
+
+	fmt.Printf("%-6s %-9s %-8s %-24s %s\n", "ID", "STATE", "FAILURES", "PATTERN", "URL")
+	for _, h := range hooks {
+		state := "enabled"
+		if h.Disabled() {
+			state = "disabled"
+		}
+		pattern := h.Pattern
+		if pattern == "" {
+			pattern = "(all mail)"
+		}
+		fmt.Printf("%-6d %-9s %-8d %-24s %s\n", h.ID, state, h.Failures, pattern, h.URL)
+	}
+}
+
+func showLog(ctx context.Context, db *sql.DB, webhookID int64, limit int) {
+	deliveries, err := database.ListWebhookDeliveries(ctx, db, webhookID, limit)
+	if err != nil {
+		log.Fatal("Failed to read delivery log:", err)
+	}
+	if len(deliveries) == 0 {
+		fmt.Println("No deliveries.")
+		return
+	}
+
+	fmt.Printf("%-8s %-7s %-8s %-9s %-8s %-6s %-20s %s\n",
+		"ID", "WEBHOOK", "EMAIL", "STATUS", "ATTEMPTS", "HTTP", "CREATED", "LAST ERROR")
+	for _, d := range deliveries {
+		httpStatus := "-"
+		if d.LastStatus != 0 {
+			httpStatus = strconv.Itoa(d.LastStatus)
+		}
+		fmt.Printf("%-8d %-7d %-8d %-9s %-8d %-6s %-20s %s\n",
+			d.ID, d.WebhookID, d.EmailID, d.Status, d.Attempts, httpStatus,
+			d.CreatedAt.Format(time.DateTime), d.LastError)
+	}
+}
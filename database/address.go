@@ -0,0 +1,198 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrAddressNotFound = errors.New("address not found")
+	ErrAddressTaken    = errors.New("address already registered")
+)
+
+// Address is a registered mailbox. A zero ExpiresAt never expires.
+type Address struct {
+	Address   string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+func (a Address) Expired(now time.Time) bool {
+	return !a.ExpiresAt.IsZero() && !now.Before(a.ExpiresAt)
+}
+
+func nullTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// CreateAddress registers address, which must already be in canonical form,
+// with a lower-case domain. An address that is registered, even if expired
+// and awaiting purge, is taken.
+func CreateAddress(ctx context.Context, db *sql.DB, address string, expiresAt time.Time) (*Address, error) {
+	a := Address{Address: address, ExpiresAt: expiresAt}
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO addresses (address, expires_at)
+		VALUES ($1, $2)
+		ON CONFLICT (address) DO NOTHING
+		RETURNING created_at
+	`, address, nullTime(expiresAt)).Scan(&a.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAddressTaken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to register address: %w", err)
+	}
+	return &a, nil
+}
+
+func GetAddress(ctx context.Context, db *sql.DB, address string) (*Address, error) {
+	a := Address{Address: address}
+	var expiresAt sql.NullTime
+	err := db.QueryRowContext(ctx, `
+		SELECT created_at, expires_at FROM addresses WHERE address = $1
+	`, address).Scan(&a.CreatedAt, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAddressNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up address: %w", err)
+	}
+	a.ExpiresAt = expiresAt.Time
+	return &a, nil
+}
+
+// SetAddressExpiry moves an unexpired address's expiry. Expired addresses
+// are left alone, as their mail is already due to be purged.
+func SetAddressExpiry(ctx context.Context, db *sql.DB, address string, expiresAt time.Time) (*Address, error) {
+	a := Address{Address: address, ExpiresAt: expiresAt}
+	err := db.QueryRowContext(ctx, `
+		UPDATE addresses SET expires_at = $2
+		WHERE address = $1 AND (expires_at IS NULL OR expires_at > NOW())
+		RETURNING created_at
+	`, address, nullTime(expiresAt)).Scan(&a.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAddressNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update address: %w", err)
+	}
+	return &a, nil
+}
+
+// PurgeExpiredAddresses removes up to batchSize addresses that expired
+// before now, together with their mail, access tokens and forward rules:
+// each address is taken off the messages sent to it, and messages left with
+// no recipient are deleted. It returns the number of addresses and of
+// messages removed.
+func PurgeExpiredAddresses(ctx context.Context, db *sql.DB, now time.Time, batchSize int) (addresses, messages int64, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		DELETE FROM addresses
+		WHERE address IN (
+			SELECT address FROM addresses
+			WHERE expires_at <= $1
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING address
+	`, now, batchSize)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to purge expired addresses: %w", err)
+	}
+	var expired []string
+	for rows.Next() {
+		var address string
+		if err := rows.Scan(&address); err != nil {
+			rows.Close()
+			return 0, 0, fmt.Errorf("failed to scan expired address: %w", err)
+		}
+		expired = append(expired, address)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, fmt.Errorf("failed to purge expired addresses: %w", err)
+	}
+	if len(expired) == 0 {
+		return 0, 0, tx.Commit()
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+		UPDATE emails
+		SET recipients = (
+			SELECT coalesce(array_agg(r), '{}')
+			FROM unnest(recipients) AS r
+			WHERE r <> ALL($1::text[])
+		)
+		WHERE recipients && $1::text[]
+		RETURNING id, cardinality(recipients)
+	`, pq.Array(expired))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to remove expired recipients: %w", err)
+	}
+	var orphaned []int64
+	for rows.Next() {
+		var id int64
+		var remaining int
+		if err := rows.Scan(&id, &remaining); err != nil {
+			rows.Close()
+			return 0, 0, fmt.Errorf("failed to scan purged email: %w", err)
+		}
+		if remaining == 0 {
+			orphaned = append(orphaned, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, fmt.Errorf("failed to remove expired recipients: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM email_states WHERE mailbox = ANY($1)`, pq.Array(expired)); err != nil {
+		return 0, 0, fmt.Errorf("failed to delete expired mailbox state: %w", err)
+	}
+	// The tokens go too, so that whoever registers the address next does
+	// not share it with the previous holder.
+	if _, err := tx.ExecContext(ctx, `DELETE FROM inbox_tokens WHERE mailbox = ANY($1)`, pq.Array(expired)); err != nil {
+		return 0, 0, fmt.Errorf("failed to delete expired mailbox tokens: %w", err)
+	}
+	// So do the forward rules, or the next holder's mail would go on to the
+	// previous holder's targets.
+	if _, err := tx.ExecContext(ctx, `DELETE FROM forward_rules WHERE address = ANY($1)`, pq.Array(expired)); err != nil {
+		return 0, 0, fmt.Errorf("failed to delete expired forward rules: %w", err)
+	}
+	if len(orphaned) > 0 {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM emails WHERE id = ANY($1)`, pq.Array(orphaned)); err != nil {
+			return 0, 0, fmt.Errorf("failed to delete orphaned emails: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return int64(len(expired)), int64(len(orphaned)), nil
+}
+
+// MailboxHasMail reports whether any stored message is addressed to
+// mailbox, deleted or not.
+func MailboxHasMail(ctx context.Context, db *sql.DB, mailbox string) (bool, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM emails WHERE recipients @> ARRAY[$1]::text[])
+	`, mailbox).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check mailbox: %w", err)
+	}
+	return exists, nil
+}
@@ -0,0 +1,244 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/zeusnotfound04/nano-mail/pkg/message"
+)
+
+const emailInsertColumns = 9
+
+// BatchOptions describes who is storing a batch. Origin is announced with
+// each stored message on MailChannel, so the instance that stored it can
+// skip its own notifications. Logger receives failures to announce, which
+// do not fail the batch; it defaults to slog.Default().
+type BatchOptions struct {
+	Origin string
+	Logger *slog.Logger
+}
+
+type StoreResult struct {
+	ID int64
+	// Seq is the message's commit sequence number; see assignCommitSeq.
+	Seq int64
+	Err error
+}
+
+// StoreMailBatch writes msgs in a single transaction and returns one result
+// per message, in order. The whole batch is first tried as one multi-row
+// INSERT; if that fails, each message is retried under its own savepoint so
+// one bad row only fails itself. A failure to begin or commit the
+// transaction fails every message. Stored messages are announced on
+// MailChannel as sent from opts.Origin.
+func StoreMailBatch(ctx context.Context, db *sql.DB, opts BatchOptions, msgs []*message.Message) []StoreResult {
+	results := make([]StoreResult, len(msgs))
+	if len(msgs) == 0 {
+		return results
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+
+	failAll := func(err error) []StoreResult {
+		for i := range results {
+			results[i] = StoreResult{Err: err}
+		}
+		return results
+	}
+
+	ids, err := reserveEmailIDs(ctx, db, len(msgs))
+	if err != nil {
+		return failAll(err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return failAll(fmt.Errorf("failed to begin transaction: %w", err))
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT batch"); err != nil {
+		return failAll(fmt.Errorf("failed to create savepoint: %w", err))
+	}
+
+	query, args := buildBatchInsert(ids, msgs)
+	if _, err := tx.ExecContext(ctx, query, args...); err == nil {
+		for i, id := range ids {
+			results[i] = StoreResult{ID: id}
+		}
+	} else {
+		if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT batch"); err != nil {
+			return failAll(fmt.Errorf("failed to roll back batch insert: %w", err))
+		}
+		for i, msg := range msgs {
+			var err error
+			results[i], err = insertWithSavepoint(ctx, tx, ids[i], msg)
+			if err != nil {
+				// The transaction is aborted, so nothing in the batch can
+				// be committed.
+				return failAll(err)
+			}
+			if results[i].Err != nil && ctx.Err() != nil {
+				return failAll(ctx.Err())
+			}
+		}
+	}
+
+	var storedIDs []int64
+	var storedMsgs []*message.Message
+	for i, r := range results {
+		if r.Err == nil {
+			storedIDs = append(storedIDs, r.ID)
+			storedMsgs = append(storedMsgs, msgs[i])
+		}
+	}
+
+	seqs, err := assignCommitSeq(ctx, tx, storedIDs)
+	if err != nil {
+		return failAll(err)
+	}
+	for i := range results {
+		results[i].Seq = seqs[results[i].ID]
+	}
+	notifyStored(ctx, tx, opts, storedIDs, storedMsgs)
+
+	if err := tx.Commit(); err != nil {
+		return failAll(fmt.Errorf("failed to commit transaction: %w", err))
+	}
+
+	return results
+}
+
+// assignCommitSeq numbers the messages ids from emails_commit_seq while
+// holding a transaction-scoped advisory lock, which is released only once tx
+// has committed or rolled back. Transactions therefore take their numbers
+// in the order they become visible, so a reader that has seen a number has
+// also seen every smaller one. Ids give no such guarantee: they are drawn
+// before the transaction starts, and concurrent batches commit in any
+// order. It must be the last statement before the notifications and the
+// commit, since every other store waits on the lock.
+func assignCommitSeq(ctx context.Context, tx *sql.Tx, ids []int64) (map[int64]int64, error) {
+	seqs := make(map[int64]int64, len(ids))
+	if len(ids) == 0 {
+		return seqs, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", CommitSeqLockKey); err != nil {
+		return nil, fmt.Errorf("failed to lock commit sequence: %w", err)
+	}
+	rows, err := tx.QueryContext(ctx, `
+		UPDATE emails e SET commit_seq = n.seq
+		FROM (
+			SELECT id, nextval('emails_commit_seq') AS seq
+			FROM unnest($1::bigint[]) AS id
+		) n
+		WHERE e.id = n.id
+		RETURNING e.id, e.commit_seq
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("failed to assign commit sequence: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, seq int64
+		if err := rows.Scan(&id, &seq); err != nil {
+			return nil, fmt.Errorf("failed to scan commit sequence: %w", err)
+		}
+		seqs[id] = seq
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to assign commit sequence: %w", err)
+	}
+	return seqs, nil
+}
+
+// reserveEmailIDs draws ids from the emails sequence up front, so results can
+// be matched to messages without relying on RETURNING order.
+func reserveEmailIDs(ctx context.Context, db *sql.DB, n int) ([]int64, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT nextval(pg_get_serial_sequence('emails', 'id')) FROM generate_series(1, $1)`, n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve email ids: %w", err)
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0, n)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan reserved email id: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to reserve email ids: %w", err)
+	}
+	if len(ids) != n {
+		return nil, fmt.Errorf("reserved %d email ids, wanted %d", len(ids), n)
+	}
+
+	return ids, nil
+}
+
+func buildBatchInsert(ids []int64, msgs []*message.Message) (string, []any) {
+	var b strings.Builder
+	b.WriteString(`INSERT INTO emails (id, sender, recipients, subject, body, text_body, size, created_at, message_id) VALUES `)
+
+	args := make([]any, 0, len(msgs)*emailInsertColumns)
+	for i, msg := range msgs {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		n := i * emailInsertColumns
+		fmt.Fprintf(&b, "($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, nullif($%d, ''))",
+			n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8, n+9)
+		args = append(args, emailInsertArgs(ids[i], msg)...)
+	}
+
+	return b.String(), args
+}
+
+// insertWithSavepoint stores one message under its own savepoint. The
+// returned error is set when the transaction itself is no longer usable,
+// which fails the rest of the batch too.
+func insertWithSavepoint(ctx context.Context, tx *sql.Tx, id int64, msg *message.Message) (StoreResult, error) {
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT msg"); err != nil {
+		return StoreResult{}, fmt.Errorf("failed to create savepoint: %w", err)
+	}
+
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO emails (id, sender, recipients, subject, body, text_body, size, created_at, message_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, nullif($9, ''))`,
+		emailInsertArgs(id, msg)...)
+	if err != nil {
+		if _, rbErr := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT msg"); rbErr != nil {
+			return StoreResult{}, fmt.Errorf("failed to roll back message insert: %w", rbErr)
+		}
+		return StoreResult{Err: fmt.Errorf("failed to store the email: %w", err)}, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT msg"); err != nil {
+		return StoreResult{}, fmt.Errorf("failed to release savepoint: %w", err)
+	}
+	return StoreResult{ID: id}, nil
+}
+
+func emailInsertArgs(id int64, msg *message.Message) []any {
+	return []any{
+		id,
+		stripNUL(msg.From),
+		pq.Array(msg.To),
+		stripNUL(msg.Subject),
+		stripNUL(msg.Body),
+		stripNUL(msg.TextBody),
+		msg.Size,
+		msg.Date,
+		stripNUL(msg.MessageID),
+	}
+}
@@ -0,0 +1,187 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/pkg/message"
+)
+
+// testDB connects to DATABASE_URL, skipping the test or benchmark when it
+// is not set. It writes to the emails table of that database.
+func testDB(tb testing.TB) *sql.DB {
+	tb.Helper()
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		tb.Skip("DATABASE_URL not set")
+	}
+	db, err := openPool(dsn)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { db.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := Migrate(ctx, db); err != nil {
+		tb.Fatal(err)
+	}
+	return db
+}
+
+func benchMessages(n int) []*message.Message {
+	raw := []byte("From: bench@example.com\r\nSubject: benchmark\r\n\r\n" +
+		"A short message body, about the size of a typical notification.\r\n")
+	msgs := make([]*message.Message, n)
+	for i := range msgs {
+		msg, _ := message.New("bench@example.com", []string{"bench@nanomail.test"}, raw, time.Now())
+		msg.MessageID = fmt.Sprintf("<bench-%d-%d@example.com>", time.Now().UnixNano(), i)
+		msgs[i] = msg
+	}
+	return msgs
+}
+
+func BenchmarkStoreMailBatch(b *testing.B) {
+	db := testDB(b)
+	ctx := context.Background()
+
+	b.Run("StoreMail", func(b *testing.B) {
+		msgs := benchMessages(b.N)
+		b.ResetTimer()
+		for _, msg := range msgs {
+			if err := StoreMail(ctx, db, msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	for _, size := range []int{10, 50, 200} {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			msgs := benchMessages(b.N)
+			b.ResetTimer()
+			for start := 0; start < len(msgs); start += size {
+				end := min(start+size, len(msgs))
+				for _, r := range StoreMailBatch(ctx, db, BatchOptions{Origin: "bench"}, msgs[start:end]) {
+					if r.Err != nil {
+						b.Fatal(r.Err)
+					}
+				}
+			}
+		})
+	}
+
+	b.Cleanup(func() {
+		db.Exec(`DELETE FROM emails WHERE sender = 'bench@example.com' AND 'bench@nanomail.test' = ANY(recipients)`)
+	})
+}
+
+// batchMessages builds one message for each of rcpts, removing whatever of
+// them gets stored once the test ends.
+func batchMessages(t *testing.T, db *sql.DB, rcpts ...string) []*message.Message {
+	t.Helper()
+	raw := []byte("From: batch@example.com\r\nSubject: batch test\r\n\r\nHello.\r\n")
+	prefix := fmt.Sprintf("<batch-%d-", time.Now().UnixNano())
+	msgs := make([]*message.Message, len(rcpts))
+	for i, rcpt := range rcpts {
+		msg, err := message.New("batch@example.com", []string{rcpt}, raw, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.MessageID = fmt.Sprintf("%s%d@example.com>", prefix, i)
+		msgs[i] = msg
+	}
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM emails WHERE message_id LIKE $1`, prefix+"%")
+	})
+	return msgs
+}
+
+// lockEmails blocks inserts into emails until the test ends.
+func lockEmails(t *testing.T, db *sql.DB) {
+	t.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tx.Rollback() })
+	if _, err := tx.Exec(`LOCK TABLE emails IN EXCLUSIVE MODE`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreMailBatchFallback(t *testing.T) {
+	db := testDB(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// A NUL byte is not allowed in text, so the second message fails the
+	// multi-row insert and is then the only one to fail on its own.
+	msgs := batchMessages(t, db, "one@nanomail.test", "bad\x00@nanomail.test", "three@nanomail.test")
+	results := StoreMailBatch(ctx, db, BatchOptions{Origin: "test"}, msgs)
+
+	if results[1].Err == nil {
+		t.Error("message with a NUL recipient was stored")
+	}
+	for _, i := range []int{0, 2} {
+		r := results[i]
+		if r.Err != nil {
+			t.Errorf("message %d: %v", i, r.Err)
+			continue
+		}
+		if r.ID == 0 || r.Seq == 0 {
+			t.Errorf("message %d: ID = %d, Seq = %d; want both set", i, r.ID, r.Seq)
+		}
+		var messageID string
+		if err := db.QueryRowContext(ctx, `SELECT message_id FROM emails WHERE id = $1`, r.ID).Scan(&messageID); err != nil {
+			t.Errorf("message %d not found: %v", i, err)
+		} else if messageID != msgs[i].MessageID {
+			t.Errorf("message %d stored as %q, want %q", i, messageID, msgs[i].MessageID)
+		}
+	}
+	if results[0].Seq >= results[2].Seq {
+		t.Errorf("Seq = %d, %d; want increasing", results[0].Seq, results[2].Seq)
+	}
+}
+
+// TestStoreMailBatchFailedRollback cancels a batch while its insert waits on
+// a lock, so that rolling back to the savepoint fails too. Nothing in the
+// batch may then be reported as stored.
+func TestStoreMailBatchFailedRollback(t *testing.T) {
+	db := testDB(t)
+	msgs := batchMessages(t, db, "one@nanomail.test", "two@nanomail.test")
+	lockEmails(t, db)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	for i, r := range StoreMailBatch(ctx, db, BatchOptions{Origin: "test"}, msgs) {
+		if r.Err == nil {
+			t.Errorf("message %d stored with ID %d after a failed rollback", i, r.ID)
+		}
+	}
+}
+
+func TestInsertWithSavepointFailedRollback(t *testing.T) {
+	db := testDB(t)
+	msgs := batchMessages(t, db, "one@nanomail.test")
+	ids, err := reserveEmailIDs(context.Background(), db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockEmails(t, db)
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := insertWithSavepoint(ctx, tx, ids[0], msgs[0]); err == nil {
+		t.Error("insertWithSavepoint kept the transaction after its rollback failed")
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"os"
+	"regexp"
 	"strings"
 	"time"
 
@@ -18,47 +20,42 @@ import (
 const (
 	DATABASE_ERROR     = "Error connecting to database"
 	DATABASE_CONNECTED = "Connected to database successfully"
+
+	retentionBatchSize = 1000
 )
 
-func ConnectDB() (*sql.DB, error) {
+// LoadDSN returns DATABASE_URL, loading .env first if one is present.
+func LoadDSN() (string, error) {
 	err := godotenv.Load(".env")
 	if err != nil {
 		log.Println("Error loading .env file")
 	}
 
-	fmt.Println("DB URL")
-
 	dcs := os.Getenv("DATABASE_URL")
 	if dcs == "" {
-		return nil, fmt.Errorf("DATABASE_URL environment variable is empty")
+		return "", fmt.Errorf("DATABASE_URL environment variable is empty")
 	}
+	return dcs, nil
+}
 
-	hostStart := strings.Index(dcs, "@")
-	hostEnd := strings.LastIndex(dcs, ":")
-	if hostStart > 0 && hostEnd > hostStart {
-		hostname := dcs[hostStart+1 : hostEnd]
-
-		_, err := net.LookupHost(hostname)
-		if err != nil {
-			log.Printf("Warning: Could not resolve database hostname %s: %v", hostname, err)
-		}
+// ConnectDB opens and verifies a one-off pool. Long-running processes should
+// use a Manager instead, which owns the pool and watches its health.
+func ConnectDB() (*sql.DB, error) {
+	dcs, err := LoadDSN()
+	if err != nil {
+		return nil, err
 	}
 
-	db, err := sql.Open("postgres", dcs)
-	fmt.Println("DB URL", dcs)
+	db, err := openPool(dcs)
 	if err != nil {
-		log.Println(DATABASE_ERROR)
 		return nil, err
 	}
 
-	db.SetMaxOpenConns(25)
-	db.SetMaxIdleConns(5)
-	db.SetConnMaxLifetime(5 * time.Minute)
-
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := db.PingContext(ctx); err != nil {
+		db.Close()
 		log.Printf("Failed to verify database connection: %v", err)
 		return nil, fmt.Errorf("database connection validation failed: %w", err)
 	}
@@ -67,66 +64,52 @@ func ConnectDB() (*sql.DB, error) {
 	return db, nil
 }
 
-func StoreMail(ctx context.Context, db *sql.DB, msg *message.Message) error {
-	fmt.Println(" Incoming message to store in DB:")
-	fmt.Printf("From: %s\nTo: %v\nSubject: %s\nSize: %d\nDate: %v\n",
-		msg.From, msg.To, msg.Subject, msg.Size, msg.Date)
-
-	fmt.Println("Checking DB connection...")
-
-	var err error
-	for retries := 0; retries < 3; retries++ {
-		fmt.Printf("DB connection check attempt %d/3\n", retries+1)
-		err = db.PingContext(ctx)
-		if err == nil {
-			fmt.Println("DB connection check successful")
-			break
+func openPool(dcs string) (*sql.DB, error) {
+	if u, err := url.Parse(dcs); err == nil && u.Hostname() != "" {
+		if _, err := net.LookupHost(u.Hostname()); err != nil {
+			log.Printf("Warning: Could not resolve database hostname %s: %v", u.Hostname(), err)
 		}
-		log.Printf("DB connection check failed (attempt %d/3): %v", retries+1, err)
-		time.Sleep(time.Duration(retries+1) * 500 * time.Millisecond)
 	}
 
+	db, err := sql.Open("postgres", dcs)
 	if err != nil {
-		fmt.Println("All DB connection check attempts failed, trying to reconnect")
-		log.Println("Attempting to reestablish database connection...")
-		newDB, reconnectErr := ConnectDB()
-		if reconnectErr != nil {
-			fmt.Printf("Failed to reconnect to database: %v\n", reconnectErr)
-			log.Printf("Failed to reconnect to database: %v", reconnectErr)
-			return fmt.Errorf("database connection unavailable: %w", err)
-		}
+		log.Println(DATABASE_ERROR, RedactDSN(dcs))
+		return nil, err
+	}
 
-		db = newDB
-		fmt.Println("Reconnected to database, checking connection...")
+	db.SetMaxOpenConns(25)
+	db.SetMaxIdleConns(5)
+	db.SetConnMaxLifetime(5 * time.Minute)
 
-		if pingErr := db.PingContext(ctx); pingErr != nil {
-			fmt.Printf("Reconnected database still not responding: %v\n", pingErr)
-			return fmt.Errorf("reconnected database still unavailable: %w", pingErr)
-		}
-		fmt.Println("Reconnection successful")
-	}
+	return db, nil
+}
+
+var dsnPasswordPattern = regexp.MustCompile(`(?i)(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
 
-	fmt.Println("DB connection is alive, proceeding with storing message")
+// RedactDSN masks the password in a URL or key=value connection string so it
+// can be logged.
+func RedactDSN(dcs string) string {
+	if u, err := url.Parse(dcs); err == nil && u.Scheme != "" {
+		return u.Redacted()
+	}
+	return dsnPasswordPattern.ReplaceAllString(dcs, "${1}xxxxx")
+}
 
-	fmt.Println("Beginning database transaction...")
+func StoreMail(ctx context.Context, db *sql.DB, msg *message.Message) error {
 	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		fmt.Printf("Failed to begin transaction: %v\n", err)
 		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
 	query := `
 		INSERT INTO emails (
-			sender, recipients, subject, body, size, created_at
+			sender, recipients, subject, body, text_body, size, created_at
 		) VALUES (
-			$1, $2, $3, $4, $5, $6
+			$1, $2, $3, $4, $5, $6, $7
 		)
 		RETURNING id;
 	`
-	fmt.Println("Executing insert query...")
-	fmt.Printf("Parameters: sender=%s, recipients=%v, subject=%s, bodySize=%d, size=%d, date=%v\n",
-		msg.From, msg.To, msg.Subject, len(msg.Body), msg.Size, msg.Date)
 
 	var id int
 	err = tx.QueryRowContext(
@@ -136,45 +119,52 @@ func StoreMail(ctx context.Context, db *sql.DB, msg *message.Message) error {
 		pq.Array(msg.To),
 		msg.Subject,
 		msg.Body,
+		stripNUL(msg.TextBody),
 		msg.Size,
 		msg.Date,
 	).Scan(&id)
 
 	if err != nil {
-		fmt.Printf("Database insert failed: %v\n", err)
 		log.Printf("Failed to store email in database: %v", err)
 		return fmt.Errorf("failed to store the email: %w", err)
 	}
 
-	fmt.Println("Insert successful, committing transaction...")
+	if _, err := assignCommitSeq(ctx, tx, []int64{int64(id)}); err != nil {
+		return err
+	}
+
 	if err = tx.Commit(); err != nil {
-		fmt.Printf("Failed to commit transaction: %v\n", err)
 		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	fmt.Printf("Email stored in the DATABASE with ID: %d\n", id)
 	log.Printf("Email stored in the DATABASE with ID: %d", id)
 	return nil
 }
 
-func DeleteOldMails(ctx context.Context, db *sql.DB, olderThan time.Duration) (int64, error) {
-	cutOffTime := time.Now().Add(-olderThan)
-
-	query := `
-	DELETE FROM emails 
-	WHERE created_at < $1
-	`
+// stripNUL removes NUL bytes, which Postgres rejects in TEXT columns but which
+// decoded bodies occasionally contain.
+func stripNUL(s string) string {
+	return strings.ReplaceAll(s, "\x00", "")
+}
 
-	result, err := db.ExecContext(ctx, query, cutOffTime)
-	if err != nil {
-		return 0, fmt.Errorf("failed to delete old emails : %w", err)
-	}
+// DeleteOldMails removes every message older than olderThan, in batches of
+// retentionBatchSize so a large purge never holds locks on the whole table.
+func DeleteOldMails(ctx context.Context, db *sql.DB, olderThan time.Duration) (int64, error) {
+	policy := RetentionPolicy{DefaultTTL: olderThan}
+	now := time.Now()
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return 0, fmt.Errorf("failed to get affected rows : %w", err)
+	var total int64
+	for {
+		deleted, err := DeleteExpiredMailBatch(ctx, db, policy, now, retentionBatchSize)
+		total += deleted
+		if err != nil {
+			return total, fmt.Errorf("failed to delete old emails : %w", err)
+		}
+		if deleted < retentionBatchSize {
+			break
+		}
 	}
 
-	log.Printf("Deleted %d emails older than %s", rowsAffected, olderThan.String())
-	return rowsAffected, nil
+	log.Printf("Deleted %d emails older than %s", total, olderThan.String())
+	return total, nil
 }
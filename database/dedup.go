@@ -0,0 +1,32 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// MessageStored reports whether a message with this Message-ID was already
+// stored for exactly these recipients, in any order. A message without a
+// Message-ID can't be matched and is never reported as stored.
+func MessageStored(ctx context.Context, db *sql.DB, messageID string, recipients []string) (bool, error) {
+	if messageID == "" {
+		return false, nil
+	}
+
+	var exists bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM emails
+			WHERE message_id = $1
+				AND recipients @> $2::text[]
+				AND recipients <@ $2::text[]
+		)
+	`, stripNUL(messageID), pq.Array(recipients)).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check for a stored duplicate: %w", err)
+	}
+	return exists, nil
+}
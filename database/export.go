@@ -0,0 +1,102 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// exportBatchSize is how many message bodies an export holds in memory at
+// once.
+const exportBatchSize = 50
+
+// ExportRange limits an export to mail received in [Since, Until). A zero
+// bound is open.
+type ExportRange struct {
+	Since time.Time
+	Until time.Time
+}
+
+// ExportMailbox calls fn with each message in mailbox, oldest first, that
+// the mailbox has not deleted. Bodies are read in small keyset batches, so
+// memory use does not grow with the mailbox and no long transaction is held.
+// An error from fn stops the export and is returned as is.
+func ExportMailbox(ctx context.Context, db *sql.DB, mailbox string, r ExportRange, fn func(*StoredMessage) error) error {
+	var since, until any
+	if !r.Since.IsZero() {
+		since = r.Since
+	}
+	if !r.Until.IsZero() {
+		until = r.Until
+	}
+
+	var cursor int64
+	for {
+		rows, err := db.QueryContext(ctx, `
+			SELECT e.id, e.sender, e.recipients, e.subject, e.size, e.created_at,
+				coalesce(s.is_read, false), coalesce(s.starred, false), e.body
+			FROM emails e
+			LEFT JOIN email_states s ON s.email_id = e.id AND s.mailbox = $1
+			WHERE e.recipients @> ARRAY[$1]::text[]
+				AND s.deleted_at IS NULL
+				AND e.id > $2
+				AND ($3::timestamptz IS NULL OR e.created_at >= $3)
+				AND ($4::timestamptz IS NULL OR e.created_at < $4)
+			ORDER BY e.id
+			LIMIT $5
+		`, mailbox, cursor, since, until, exportBatchSize)
+		if err != nil {
+			return fmt.Errorf("failed to export mailbox: %w", err)
+		}
+
+		batch := make([]*StoredMessage, 0, exportBatchSize)
+		for rows.Next() {
+			var msg StoredMessage
+			var body sql.NullString
+			if err := scanMailboxMessage(rows, &msg.MailboxMessage, &body); err != nil {
+				rows.Close()
+				return err
+			}
+			msg.Body = body.String
+			batch = append(batch, &msg)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return fmt.Errorf("failed to export mailbox: %w", err)
+		}
+
+		for _, msg := range batch {
+			if err := fn(msg); err != nil {
+				return err
+			}
+		}
+		if len(batch) < exportBatchSize {
+			return nil
+		}
+		cursor = batch[len(batch)-1].ID
+	}
+}
+
+// GetStoredMessage loads a message with its raw body by id, whoever it was
+// addressed to.
+func GetStoredMessage(ctx context.Context, db *sql.DB, id int64) (*StoredMessage, error) {
+	row := db.QueryRowContext(ctx, `
+		SELECT id, sender, recipients, subject, size, created_at, false, false, body
+		FROM emails
+		WHERE id = $1
+	`, id)
+
+	var msg StoredMessage
+	var body sql.NullString
+	if err := scanMailboxMessage(row, &msg.MailboxMessage, &body); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	msg.Body = body.String
+	return &msg, nil
+}
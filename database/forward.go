@@ -0,0 +1,138 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrForwardRuleNotFound = errors.New("forward rule not found")
+	ErrForwardRuleExists   = errors.New("forward rule already exists")
+)
+
+// ForwardRule sends a copy of mail for Address on to Target, once Target
+// has confirmed it wants the mail. ConfirmedAt is zero until then.
+type ForwardRule struct {
+	ID          int64
+	Address     string
+	Target      string
+	CreatedAt   time.Time
+	ConfirmedAt time.Time
+}
+
+// CreateForwardRule adds a rule that stays inactive until ConfirmForwardRule
+// is called with confirmHash. A nil confirmHash creates it confirmed, for
+// rules an operator sets up.
+func CreateForwardRule(ctx context.Context, db *sql.DB, address, target string, confirmHash []byte) (*ForwardRule, error) {
+	r := ForwardRule{Address: address, Target: target}
+	var confirmedAt sql.NullTime
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO forward_rules (address, target, confirm_hash, confirmed_at)
+		VALUES ($1, $2, $3, CASE WHEN $3::bytea IS NULL THEN NOW() END)
+		ON CONFLICT (address, target) DO NOTHING
+		RETURNING id, created_at, confirmed_at
+	`, address, target, confirmHash).Scan(&r.ID, &r.CreatedAt, &confirmedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrForwardRuleExists
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create forward rule: %w", err)
+	}
+	r.ConfirmedAt = confirmedAt.Time
+	return &r, nil
+}
+
+// ConfirmForwardRule activates the unconfirmed rule created with
+// confirmHash, unless it was created more than maxAge ago.
+func ConfirmForwardRule(ctx context.Context, db *sql.DB, confirmHash []byte, maxAge time.Duration) (*ForwardRule, error) {
+	var r ForwardRule
+	err := db.QueryRowContext(ctx, `
+		UPDATE forward_rules SET confirmed_at = NOW(), confirm_hash = NULL
+		WHERE confirm_hash = $1
+			AND confirmed_at IS NULL
+			AND created_at > NOW() - $2::float8 * interval '1 second'
+		RETURNING id, address, target, created_at, confirmed_at
+	`, confirmHash, maxAge.Seconds()).Scan(&r.ID, &r.Address, &r.Target, &r.CreatedAt, &r.ConfirmedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrForwardRuleNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to confirm forward rule: %w", err)
+	}
+	return &r, nil
+}
+
+// ListForwardRules returns the rules for address, or every rule when
+// address is empty.
+func ListForwardRules(ctx context.Context, db *sql.DB, address string) ([]ForwardRule, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, address, target, created_at, confirmed_at FROM forward_rules
+		WHERE $1 = '' OR address = $1
+		ORDER BY address, id
+	`, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list forward rules: %w", err)
+	}
+	defer rows.Close()
+
+	var rules []ForwardRule
+	for rows.Next() {
+		var r ForwardRule
+		var confirmedAt sql.NullTime
+		if err := rows.Scan(&r.ID, &r.Address, &r.Target, &r.CreatedAt, &confirmedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan forward rule: %w", err)
+		}
+		r.ConfirmedAt = confirmedAt.Time
+		rules = append(rules, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list forward rules: %w", err)
+	}
+	return rules, nil
+}
+
+// DeleteForwardRule removes a rule by id. A non-empty address must also
+// match, so that a mailbox can only remove its own rules.
+func DeleteForwardRule(ctx context.Context, db *sql.DB, id int64, address string) error {
+	result, err := db.ExecContext(ctx, `
+		DELETE FROM forward_rules WHERE id = $1 AND ($2 = '' OR address = $2)
+	`, id, address)
+	if err != nil {
+		return fmt.Errorf("failed to delete forward rule: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrForwardRuleNotFound
+	}
+	return nil
+}
+
+// ForwardRulesFor returns the confirmed rules for any of addresses.
+func ForwardRulesFor(ctx context.Context, db *sql.DB, addresses []string) ([]ForwardRule, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, address, target, created_at, confirmed_at FROM forward_rules
+		WHERE address = ANY($1) AND confirmed_at IS NOT NULL
+		ORDER BY id
+	`, pq.Array(addresses))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up forward rules: %w", err)
+	}
+	defer rows.Close()
+
+	var rules []ForwardRule
+	for rows.Next() {
+		var r ForwardRule
+		if err := rows.Scan(&r.ID, &r.Address, &r.Target, &r.CreatedAt, &r.ConfirmedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan forward rule: %w", err)
+		}
+		rules = append(rules, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to look up forward rules: %w", err)
+	}
+	return rules, nil
+}
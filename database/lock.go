@@ -0,0 +1,48 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+)
+
+// Advisory lock keys for cluster-wide singleton jobs. They only need to be
+// unique among the locks this application takes.
+const (
+	RetentionLockKey int64 = 0x6e616e6f0001
+	// CommitSeqLockKey serializes the commits that number stored mail; see
+	// assignCommitSeq.
+	CommitSeqLockKey int64 = 0x6e616e6f0002
+)
+
+// WithAdvisoryLock runs fn while holding the session-level Postgres advisory
+// lock identified by key. The lock lives on a dedicated connection, so it is
+// released even if the process dies mid-run. If another session already holds
+// the lock, fn is not called and acquired is false.
+func WithAdvisoryLock(ctx context.Context, db *sql.DB, key int64, fn func(ctx context.Context) error) (acquired bool, err error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to reserve connection for advisory lock: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&acquired); err != nil {
+		return false, fmt.Errorf("failed to acquire advisory lock: %w", err)
+	}
+	if !acquired {
+		return false, nil
+	}
+
+	defer func() {
+		// Unlock with a fresh context: ctx may already be cancelled, and a
+		// lock left on a pooled connection would block every other instance.
+		if _, unlockErr := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key); unlockErr != nil {
+			log.Printf("Failed to release advisory lock %d: %v", key, unlockErr)
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+	}()
+
+	return true, fn(ctx)
+}
@@ -0,0 +1,221 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var ErrMessageNotFound = errors.New("message not found")
+
+// MailboxMessage is a stored message as seen from one recipient's mailbox,
+// without its body.
+type MailboxMessage struct {
+	ID int64
+	// Seq is the commit sequence number, which orders messages by when
+	// they became visible. Only ListMailbox and GetMessageSummary set it.
+	Seq        int64
+	Sender     string
+	Recipients []string
+	Subject    string
+	Size       int64
+	CreatedAt  time.Time
+	Read       bool
+	Starred    bool
+}
+
+type StoredMessage struct {
+	MailboxMessage
+	Body string
+}
+
+type ListOptions struct {
+	// Limit caps the number of messages returned; zero returns them all.
+	Limit int
+	// Cursor is an id boundary for keyset paging: messages after it in the
+	// chosen order are returned. Zero starts from the beginning.
+	Cursor int64
+	// OldestFirst lists in ascending id order instead of newest first.
+	OldestFirst bool
+	// CommitOrder orders and pages by commit sequence number instead of
+	// id, so Cursor is a Seq. Paging forward this way never skips a
+	// message that commits later.
+	CommitOrder bool
+}
+
+// ListMailbox returns the messages addressed to mailbox that it has not
+// soft-deleted.
+func ListMailbox(ctx context.Context, db *sql.DB, mailbox string, opts ListOptions) ([]MailboxMessage, error) {
+	order, cmp := "DESC", "<"
+	if opts.OldestFirst {
+		order, cmp = "ASC", ">"
+	}
+
+	key, numbered := "e.id", ""
+	if opts.CommitOrder {
+		// Rows get their number just before they commit, so only rows
+		// written by older versions can lack one.
+		key, numbered = "e.commit_seq", "AND e.commit_seq IS NOT NULL"
+	}
+
+	var limit any
+	if opts.Limit > 0 {
+		limit = opts.Limit
+	}
+
+	query := fmt.Sprintf(`
+		SELECT e.id, e.sender, e.recipients, e.subject, e.size, e.created_at,
+			coalesce(s.is_read, false), coalesce(s.starred, false), e.commit_seq
+		FROM emails e
+		LEFT JOIN email_states s ON s.email_id = e.id AND s.mailbox = $1
+		WHERE e.recipients @> ARRAY[$1]::text[]
+			AND s.deleted_at IS NULL
+			AND ($2::bigint = 0 OR %[1]s %[2]s $2::bigint)
+			%[4]s
+		ORDER BY %[1]s %[3]s
+		LIMIT $3
+	`, key, cmp, order, numbered)
+
+	rows, err := db.QueryContext(ctx, query, mailbox, opts.Cursor, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list mailbox: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []MailboxMessage
+	for rows.Next() {
+		var m MailboxMessage
+		var seq sql.NullInt64
+		if err := scanMailboxMessage(rows, &m, &seq); err != nil {
+			return nil, err
+		}
+		m.Seq = seq.Int64
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read mailbox: %w", err)
+	}
+
+	return messages, nil
+}
+
+// CommitSeqGeneration identifies the commit sequence that numbers stored
+// mail. It changes only if the sequence is dropped and created again, which
+// restarts the numbering, so numbers from different generations must not
+// be compared.
+func CommitSeqGeneration(ctx context.Context, db *sql.DB) (int64, error) {
+	var oid int64
+	if err := db.QueryRowContext(ctx, `SELECT 'emails_commit_seq'::regclass::oid::bigint`).Scan(&oid); err != nil {
+		return 0, fmt.Errorf("failed to read commit sequence: %w", err)
+	}
+	return oid, nil
+}
+
+// LatestCommitSeq returns the highest commit sequence number visible, or
+// zero when nothing has been stored.
+func LatestCommitSeq(ctx context.Context, db *sql.DB) (int64, error) {
+	var seq int64
+	if err := db.QueryRowContext(ctx, `SELECT coalesce(max(commit_seq), 0) FROM emails`).Scan(&seq); err != nil {
+		return 0, fmt.Errorf("failed to read commit sequence: %w", err)
+	}
+	return seq, nil
+}
+
+// GetMailboxMessage loads one message, including its raw body, if it is
+// addressed to mailbox and not soft-deleted there.
+func GetMailboxMessage(ctx context.Context, db *sql.DB, mailbox string, id int64) (*StoredMessage, error) {
+	row := db.QueryRowContext(ctx, `
+		SELECT e.id, e.sender, e.recipients, e.subject, e.size, e.created_at,
+			coalesce(s.is_read, false), coalesce(s.starred, false), e.body
+		FROM emails e
+		LEFT JOIN email_states s ON s.email_id = e.id AND s.mailbox = $1
+		WHERE e.id = $2
+			AND e.recipients @> ARRAY[$1]::text[]
+			AND s.deleted_at IS NULL
+	`, mailbox, id)
+
+	var msg StoredMessage
+	var body sql.NullString
+	if err := scanMailboxMessage(row, &msg.MailboxMessage, &body); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	msg.Body = body.String
+
+	return &msg, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanMailboxMessage(row rowScanner, m *MailboxMessage, extra ...any) error {
+	var sender, subject sql.NullString
+	var size sql.NullInt64
+	var createdAt sql.NullTime
+
+	dest := append([]any{
+		&m.ID,
+		&sender,
+		pq.Array(&m.Recipients),
+		&subject,
+		&size,
+		&createdAt,
+		&m.Read,
+		&m.Starred,
+	}, extra...)
+
+	if err := row.Scan(dest...); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		return fmt.Errorf("failed to scan message: %w", err)
+	}
+
+	m.Sender = sender.String
+	m.Subject = subject.String
+	m.Size = size.Int64
+	m.CreatedAt = createdAt.Time
+	return nil
+}
+
+type MailboxStats struct {
+	Messages int64
+	Unread   int64
+	Starred  int64
+	Bytes    int64
+	// Oldest and Newest are zero when the mailbox is empty.
+	Oldest time.Time
+	Newest time.Time
+}
+
+func GetMailboxStats(ctx context.Context, db *sql.DB, mailbox string) (MailboxStats, error) {
+	var stats MailboxStats
+	var oldest, newest sql.NullTime
+
+	err := db.QueryRowContext(ctx, `
+		SELECT count(*),
+			count(*) FILTER (WHERE NOT coalesce(s.is_read, false)),
+			count(*) FILTER (WHERE coalesce(s.starred, false)),
+			coalesce(sum(e.size), 0),
+			min(e.created_at),
+			max(e.created_at)
+		FROM emails e
+		LEFT JOIN email_states s ON s.email_id = e.id AND s.mailbox = $1
+		WHERE e.recipients @> ARRAY[$1]::text[]
+			AND s.deleted_at IS NULL
+	`, mailbox).Scan(&stats.Messages, &stats.Unread, &stats.Starred, &stats.Bytes, &oldest, &newest)
+	if err != nil {
+		return stats, fmt.Errorf("failed to get mailbox stats: %w", err)
+	}
+
+	stats.Oldest = oldest.Time
+	stats.Newest = newest.Time
+	return stats, nil
+}
@@ -0,0 +1,279 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type ManagerOptions struct {
+	HealthInterval time.Duration
+	PingTimeout    time.Duration
+	MinBackoff     time.Duration
+	MaxBackoff     time.Duration
+	// Logger receives state changes and failed health checks. It defaults
+	// to slog.Default().
+	Logger *slog.Logger
+}
+
+func DefaultManagerOptions() ManagerOptions {
+	return ManagerOptions{
+		HealthInterval: 10 * time.Second,
+		PingTimeout:    3 * time.Second,
+		MinBackoff:     500 * time.Millisecond,
+		MaxBackoff:     30 * time.Second,
+	}
+}
+
+// Manager owns the process's single connection pool. database/sql already
+// replaces broken connections inside a pool, so the manager never opens a
+// second one; it only tracks whether the database is reachable, re-checking
+// with exponential backoff while it is not, so callers can shed load instead
+// of piling up on a dead pool.
+type Manager struct {
+	db   *sql.DB
+	dsn  string
+	opts ManagerOptions
+
+	ready   atomic.Bool
+	mu      sync.Mutex
+	lastErr error
+	since   time.Time
+
+	done chan struct{}
+	wake chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewManager opens the pool for dcs without waiting for the database. Call
+// Connect to block until it answers and Start to begin health checks.
+func NewManager(dcs string, opts ManagerOptions) (*Manager, error) {
+	defaults := DefaultManagerOptions()
+	if opts.HealthInterval <= 0 {
+		opts.HealthInterval = defaults.HealthInterval
+	}
+	if opts.PingTimeout <= 0 {
+		opts.PingTimeout = defaults.PingTimeout
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaults.MinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = defaults.MaxBackoff
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+
+	db, err := openPool(dcs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database pool: %w", err)
+	}
+
+	return &Manager{
+		db:    db,
+		dsn:   dcs,
+		opts:  opts,
+		since: time.Now(),
+		done:  make(chan struct{}),
+		wake:  make(chan struct{}, 1),
+	}, nil
+}
+
+// ConnectManager builds a Manager from DATABASE_URL and verifies the
+// database answers before returning.
+func ConnectManager(ctx context.Context, opts ManagerOptions) (*Manager, error) {
+	dcs, err := LoadDSN()
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := NewManager(dcs, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.Connect(ctx); err != nil {
+		m.db.Close()
+		return nil, err
+	}
+
+	m.opts.Logger.Info(DATABASE_CONNECTED)
+	return m, nil
+}
+
+// Connect pings until the database answers or ctx is done, backing off
+// between attempts.
+func (m *Manager) Connect(ctx context.Context) error {
+	backoff := m.opts.MinBackoff
+	for {
+		if err := m.check(ctx); err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("database connection validation failed: %w", m.Err())
+		case <-time.After(backoff):
+		}
+		backoff = m.nextBackoff(backoff)
+	}
+}
+
+func (m *Manager) Start() {
+	m.wg.Add(1)
+	go m.monitor()
+}
+
+// Close stops health checks and closes the pool.
+func (m *Manager) Close() error {
+	select {
+	case <-m.done:
+	default:
+		close(m.done)
+	}
+	m.wg.Wait()
+	return m.db.Close()
+}
+
+// DB returns the managed pool. It is the same pool for the manager's whole
+// lifetime, so callers may keep the pointer.
+func (m *Manager) DB() *sql.DB {
+	return m.db
+}
+
+// DSN returns the connection string the pool was opened with, for the few
+// callers that need a dedicated connection, such as LISTEN.
+func (m *Manager) DSN() string {
+	return m.dsn
+}
+
+func (m *Manager) Ready() bool {
+	return m.ready.Load()
+}
+
+// Err returns the error from the latest failed health check, or nil while
+// the database is ready.
+func (m *Manager) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastErr
+}
+
+// Since reports when the current ready/not-ready state began.
+func (m *Manager) Since() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.since
+}
+
+// ReportFailure lets callers that hit a connection error flag the database as
+// unhealthy immediately rather than waiting for the next health check, which
+// is brought forward to confirm it. Errors that say nothing about the
+// connection, such as constraint violations, are ignored.
+func (m *Manager) ReportFailure(err error) {
+	if !IsConnectionError(err) {
+		return
+	}
+	m.setState(false, err)
+
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// IsConnectionError reports whether err means the database could not be
+// reached or dropped the connection, as opposed to refusing a statement.
+func IsConnectionError(err error) bool {
+	// context.DeadlineExceeded satisfies net.Error, but a slow statement is
+	// not a lost connection.
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// Class 08 is connection exception; 57P01-57P03 are admin or
+		// crash shutdown and "cannot connect now".
+		class := pqErr.Code.Class()
+		return class == "08" || pqErr.Code == "57P01" || pqErr.Code == "57P02" || pqErr.Code == "57P03"
+	}
+	return false
+}
+
+func (m *Manager) monitor() {
+	defer m.wg.Done()
+
+	delay := m.opts.HealthInterval
+	backoff := m.opts.MinBackoff
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-time.After(delay):
+		case <-m.wake:
+		}
+
+		if err := m.check(context.Background()); err != nil {
+			delay = backoff
+			backoff = m.nextBackoff(backoff)
+			m.opts.Logger.Warn("Database health check failed", "retry_in", delay, "error", err)
+			continue
+		}
+
+		delay = m.opts.HealthInterval
+		backoff = m.opts.MinBackoff
+	}
+}
+
+func (m *Manager) check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, m.opts.PingTimeout)
+	defer cancel()
+
+	err := m.db.PingContext(ctx)
+	m.setState(err == nil, err)
+	return err
+}
+
+func (m *Manager) setState(ready bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastErr = err
+	if m.ready.Swap(ready) == ready {
+		return
+	}
+	m.since = time.Now()
+
+	if ready {
+		m.opts.Logger.Info("Database connection is healthy")
+	} else {
+		m.opts.Logger.Error("Database connection is unhealthy", "error", err)
+	}
+}
+
+func (m *Manager) nextBackoff(current time.Duration) time.Duration {
+	next := current * 2
+	if next > m.opts.MaxBackoff {
+		next = m.opts.MaxBackoff
+	}
+	return next
+}
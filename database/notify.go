@@ -0,0 +1,87 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/lib/pq"
+	"github.com/zeusnotfound04/nano-mail/pkg/message"
+)
+
+// MailChannel is the NOTIFY channel on which every stored message is
+// announced, so instances sharing the database can tell their own clients.
+const MailChannel = "nanomail_mail"
+
+// maxNotifyPayload stays under Postgres's 8000 byte NOTIFY payload limit.
+const maxNotifyPayload = 7900
+
+// MailNotification is the payload sent on MailChannel. Origin identifies the
+// instance that stored the message, which has already announced it locally.
+// Recipients is omitted when the list is too long for a payload; listeners
+// then read it from the stored row.
+type MailNotification struct {
+	ID         int64    `json:"id"`
+	Recipients []string `json:"to,omitempty"`
+	Origin     string   `json:"origin,omitempty"`
+}
+
+// notifyStored queues a notification for each stored message. NOTIFY is
+// transactional, so listeners hear of the messages only once tx commits.
+// The notifications run under their own savepoint: failing to announce mail
+// must not fail storing it.
+func notifyStored(ctx context.Context, tx *sql.Tx, opts BatchOptions, ids []int64, msgs []*message.Message) {
+	payloads := make([]string, 0, len(ids))
+	for i, id := range ids {
+		n := MailNotification{ID: id, Recipients: msgs[i].To, Origin: opts.Origin}
+		data, err := json.Marshal(n)
+		if err == nil && len(data) > maxNotifyPayload {
+			n.Recipients = nil
+			data, err = json.Marshal(n)
+		}
+		if err != nil {
+			continue
+		}
+		payloads = append(payloads, string(data))
+	}
+	if len(payloads) == 0 {
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT notify"); err != nil {
+		opts.Logger.Warn("Failed to announce stored mail", "error", err)
+		return
+	}
+	_, err := tx.ExecContext(ctx,
+		`SELECT pg_notify($1, payload) FROM unnest($2::text[]) AS payload`,
+		MailChannel, pq.Array(payloads))
+	if err != nil {
+		opts.Logger.Warn("Failed to announce stored mail", "error", err)
+		tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT notify")
+		return
+	}
+	tx.ExecContext(ctx, "RELEASE SAVEPOINT notify")
+}
+
+// GetMessageSummary returns a stored message's envelope, size and commit
+// sequence number without its body. Read and Starred are left false; they
+// depend on the mailbox.
+func GetMessageSummary(ctx context.Context, db *sql.DB, id int64) (*MailboxMessage, error) {
+	row := db.QueryRowContext(ctx, `
+		SELECT id, sender, recipients, subject, size, created_at, false, false, commit_seq
+		FROM emails
+		WHERE id = $1
+	`, id)
+
+	var m MailboxMessage
+	var seq sql.NullInt64
+	if err := scanMailboxMessage(row, &m, &seq); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	m.Seq = seq.Int64
+	return &m, nil
+}
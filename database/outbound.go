@@ -0,0 +1,240 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	OutboundPending   = "pending"
+	OutboundDelivered = "delivered"
+	OutboundFailed    = "failed"
+)
+
+var ErrOutboundNotFound = errors.New("outbound message not found")
+
+// OutboundMessage is one message queued for delivery to one remote
+// recipient. An empty Sender is the null reverse-path.
+type OutboundMessage struct {
+	ID        int64
+	EmailID   int64
+	Sender    string
+	Recipient string
+	Domain    string
+	Body      []byte
+	// ReturnPath is where a report of the delivery's failure is sent;
+	// empty sends none. DSNRet, DSNEnvID and DSNORCPT are the sender's DSN
+	// parameters for the report.
+	ReturnPath    string
+	DSNRet        string
+	DSNEnvID      string
+	DSNORCPT      string
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	ExpiresAt     time.Time
+	LastError     string
+	CreatedAt     time.Time
+	FinishedAt    time.Time
+}
+
+func nullID(id int64) any {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// EnqueueOutbound queues msgs in one transaction. Only EmailID, Sender,
+// Recipient, Domain, Body, ExpiresAt and the failure report fields are
+// used.
+func EnqueueOutbound(ctx context.Context, db *sql.DB, msgs []OutboundMessage) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO outbound_messages (email_id, sender, recipient, domain, body, expires_at,
+			return_path, dsn_ret, dsn_envid, dsn_orcpt)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare outbound insert: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, m := range msgs {
+		if _, err := stmt.ExecContext(ctx, nullID(m.EmailID), m.Sender, m.Recipient, m.Domain, m.Body, m.ExpiresAt,
+			m.ReturnPath, m.DSNRet, m.DSNEnvID, m.DSNORCPT); err != nil {
+			return fmt.Errorf("failed to queue outbound message: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// ClaimOutbound takes up to limit due messages for delivery by pushing their
+// next attempt out by lease, so no other instance picks them up while they
+// are being sent.
+func ClaimOutbound(ctx context.Context, db *sql.DB, limit int, lease time.Duration) ([]OutboundMessage, error) {
+	rows, err := db.QueryContext(ctx, `
+		UPDATE outbound_messages
+		SET next_attempt_at = NOW() + $2::float8 * interval '1 second'
+		WHERE id IN (
+			SELECT id FROM outbound_messages
+			WHERE status = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, coalesce(email_id, 0), sender, recipient, domain, body,
+			attempts, expires_at, created_at, return_path, dsn_ret, dsn_envid, dsn_orcpt
+	`, limit, lease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim outbound messages: %w", err)
+	}
+	defer rows.Close()
+
+	var claimed []OutboundMessage
+	for rows.Next() {
+		m := OutboundMessage{Status: OutboundPending}
+		if err := rows.Scan(&m.ID, &m.EmailID, &m.Sender, &m.Recipient, &m.Domain, &m.Body,
+			&m.Attempts, &m.ExpiresAt, &m.CreatedAt, &m.ReturnPath, &m.DSNRet, &m.DSNEnvID, &m.DSNORCPT); err != nil {
+			return nil, fmt.Errorf("failed to scan outbound message: %w", err)
+		}
+		claimed = append(claimed, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to claim outbound messages: %w", err)
+	}
+	return claimed, nil
+}
+
+// DeferOutbound hands a claimed message back without counting an attempt,
+// to be tried again at at.
+func DeferOutbound(ctx context.Context, db *sql.DB, id int64, at time.Time) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE outbound_messages SET next_attempt_at = $2
+		WHERE id = $1 AND status = 'pending'
+	`, id, at)
+	if err != nil {
+		return fmt.Errorf("failed to defer outbound message: %w", err)
+	}
+	return nil
+}
+
+// OutboundAttempt is the outcome of one delivery attempt. A failed attempt
+// with a zero RetryAt is final.
+type OutboundAttempt struct {
+	Delivered bool
+	Error     string
+	RetryAt   time.Time
+}
+
+func RecordOutboundAttempt(ctx context.Context, db *sql.DB, id int64, attempt OutboundAttempt) error {
+	status := OutboundDelivered
+	var nextAttempt any
+	switch {
+	case attempt.Delivered:
+	case attempt.RetryAt.IsZero():
+		status = OutboundFailed
+	default:
+		status = OutboundPending
+		nextAttempt = attempt.RetryAt
+	}
+
+	_, err := db.ExecContext(ctx, `
+		UPDATE outbound_messages SET
+			status = $2,
+			attempts = attempts + 1,
+			next_attempt_at = coalesce($3, next_attempt_at),
+			last_error = nullif($4, ''),
+			finished_at = CASE WHEN $2 = 'pending' THEN NULL ELSE NOW() END
+		WHERE id = $1
+	`, id, status, nextAttempt, attempt.Error)
+	if err != nil {
+		return fmt.Errorf("failed to record outbound attempt: %w", err)
+	}
+	return nil
+}
+
+// ListOutbound returns queued messages without their bodies, newest first,
+// optionally only those with status.
+func ListOutbound(ctx context.Context, db *sql.DB, status string, limit int) ([]OutboundMessage, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, coalesce(email_id, 0), sender, recipient, domain, status, attempts,
+			next_attempt_at, expires_at, coalesce(last_error, ''), created_at, finished_at
+		FROM outbound_messages
+		WHERE $1 = '' OR status = $1
+		ORDER BY id DESC
+		LIMIT $2
+	`, status, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list outbound messages: %w", err)
+	}
+	defer rows.Close()
+
+	var msgs []OutboundMessage
+	for rows.Next() {
+		var m OutboundMessage
+		var finishedAt sql.NullTime
+		if err := rows.Scan(&m.ID, &m.EmailID, &m.Sender, &m.Recipient, &m.Domain, &m.Status, &m.Attempts,
+			&m.NextAttemptAt, &m.ExpiresAt, &m.LastError, &m.CreatedAt, &finishedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan outbound message: %w", err)
+		}
+		m.FinishedAt = finishedAt.Time
+		msgs = append(msgs, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list outbound messages: %w", err)
+	}
+	return msgs, nil
+}
+
+// RetryOutbound puts a failed message back in the queue, due now and with
+// its expiry pushed out by maxAge.
+func RetryOutbound(ctx context.Context, db *sql.DB, id int64, maxAge time.Duration) error {
+	result, err := db.ExecContext(ctx, `
+		UPDATE outbound_messages SET
+			status = 'pending',
+			next_attempt_at = NOW(),
+			expires_at = NOW() + $2::float8 * interval '1 second',
+			finished_at = NULL
+		WHERE id = $1 AND status = 'failed'
+	`, id, maxAge.Seconds())
+	if err != nil {
+		return fmt.Errorf("failed to requeue outbound message: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrOutboundNotFound
+	}
+	return nil
+}
+
+// PurgeOutbound deletes up to limit messages that finished before cutoff.
+func PurgeOutbound(ctx context.Context, db *sql.DB, cutoff time.Time, limit int) (int64, error) {
+	result, err := db.ExecContext(ctx, `
+		DELETE FROM outbound_messages
+		WHERE id IN (
+			SELECT id FROM outbound_messages
+			WHERE finished_at < $1
+			LIMIT $2
+		)
+	`, cutoff, limit)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge outbound messages: %w", err)
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// MailboxUsage counts only messages the mailbox has not soft-deleted; those
+// are already on their way out and should not hold the quota.
+type MailboxUsage struct {
+	Messages int64
+	Bytes    int64
+}
+
+func GetMailboxUsage(ctx context.Context, db *sql.DB, mailbox string) (MailboxUsage, error) {
+	var usage MailboxUsage
+	err := db.QueryRowContext(ctx, `
+		SELECT count(*), coalesce(sum(size), 0)
+		FROM emails e
+		WHERE e.recipients @> ARRAY[$1]::text[]
+			AND NOT `+softDeletedFor("e", "$1")+`
+	`, mailbox).Scan(&usage.Messages, &usage.Bytes)
+	if err != nil {
+		return usage, fmt.Errorf("failed to get mailbox usage: %w", err)
+	}
+	return usage, nil
+}
+
+// EvictOldestMail trims mailbox, oldest first, until at most keepMessages
+// messages totalling at most keepBytes remain besides the message keepID,
+// which is never evicted. Messages shared with other recipients only lose
+// this recipient; a row is deleted once nobody is left on it. It returns
+// the number of messages removed from the mailbox.
+func EvictOldestMail(ctx context.Context, db *sql.DB, mailbox string, keepID, keepMessages, keepBytes int64) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		WITH ranked AS (
+			SELECT id,
+				row_number() OVER newest AS n,
+				sum(coalesce(size, 0)) OVER newest AS running
+			FROM emails e
+			WHERE e.recipients @> ARRAY[$1]::text[]
+				AND e.id <> $4
+				AND NOT `+softDeletedFor("e", "$1")+`
+			WINDOW newest AS (ORDER BY created_at DESC, id DESC)
+		)
+		UPDATE emails
+		SET recipients = array_remove(recipients, $1)
+		WHERE id IN (SELECT id FROM ranked WHERE n > $2 OR running > $3)
+		RETURNING id, cardinality(recipients)
+	`, mailbox, keepMessages, keepBytes, keepID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to evict mailbox messages: %w", err)
+	}
+
+	var evicted int64
+	var orphaned []int64
+	for rows.Next() {
+		var id int64
+		var remaining int
+		if err := rows.Scan(&id, &remaining); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan evicted message: %w", err)
+		}
+		evicted++
+		if remaining == 0 {
+			orphaned = append(orphaned, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to evict mailbox messages: %w", err)
+	}
+
+	if len(orphaned) > 0 {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM emails WHERE id = ANY($1)`, pq.Array(orphaned)); err != nil {
+			return 0, fmt.Errorf("failed to delete orphaned emails: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return evicted, nil
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// RetentionPolicy decides how long a message is kept. A message addressed to
+// several domains lives as long as the most generous TTL among them, so a
+// short override on one domain never destroys mail another domain keeps.
+type RetentionPolicy struct {
+	DefaultTTL time.Duration
+	DomainTTL  map[string]time.Duration
+}
+
+func (p RetentionPolicy) minTTL() time.Duration {
+	min := p.DefaultTTL
+	for _, ttl := range p.DomainTTL {
+		if ttl < min {
+			min = ttl
+		}
+	}
+	return min
+}
+
+// DeleteExpiredMailBatch removes at most batchSize messages that have outlived
+// the policy as of now. Callers loop until it returns fewer rows than
+// batchSize; keeping each statement small avoids long row locks and WAL
+// spikes when a large backlog expires at once.
+func DeleteExpiredMailBatch(ctx context.Context, db *sql.DB, policy RetentionPolicy, now time.Time, batchSize int) (int64, error) {
+	if policy.DefaultTTL <= 0 {
+		return 0, fmt.Errorf("retention default TTL must be positive")
+	}
+	if batchSize <= 0 {
+		return 0, fmt.Errorf("retention batch size must be positive")
+	}
+
+	domains := make([]string, 0, len(policy.DomainTTL))
+	ttls := make([]float64, 0, len(policy.DomainTTL))
+	for domain, ttl := range policy.DomainTTL {
+		domains = append(domains, strings.ToLower(domain))
+		ttls = append(ttls, ttl.Seconds())
+	}
+
+	// The created_at prefilter on the shortest TTL lets the planner skip
+	// fresh rows before evaluating the per-recipient TTL subquery.
+	query := `
+	DELETE FROM emails
+	WHERE id IN (
+		SELECT e.id FROM emails e
+		WHERE e.created_at < $1::timestamptz - $2::float8 * interval '1 second'
+			AND e.created_at < $1::timestamptz - (
+				SELECT coalesce(max(coalesce(o.ttl, $3::float8)), $3::float8)
+				FROM unnest(e.recipients) AS r(addr)
+				LEFT JOIN unnest($4::text[], $5::float8[]) AS o(domain, ttl)
+					ON lower(regexp_replace(r.addr, '^.*@', '')) = o.domain
+			) * interval '1 second'
+		ORDER BY e.id
+		LIMIT $6
+		FOR UPDATE SKIP LOCKED
+	)
+	`
+
+	result, err := db.ExecContext(ctx, query,
+		now,
+		policy.minTTL().Seconds(),
+		policy.DefaultTTL.Seconds(),
+		pq.Array(domains),
+		pq.Array(ttls),
+		batchSize,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired emails : %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get affected rows : %w", err)
+	}
+
+	return rowsAffected, nil
+}
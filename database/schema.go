@@ -0,0 +1,169 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// searchConfig is the text search configuration used both for the generated
+// search_vector column and for parsing queries; the two must agree or ranked
+// lookups silently miss stemmed terms.
+const searchConfig = "english"
+
+// schemaStatements are applied in order on every start. Each one must be
+// idempotent so that instances sharing a database can migrate concurrently.
+var schemaStatements = []string{
+	`CREATE TABLE IF NOT EXISTS emails (
+		id SERIAL PRIMARY KEY,
+		sender TEXT,
+		recipients TEXT[],
+		subject TEXT,
+		body TEXT,
+		size BIGINT,
+		created_at TIMESTAMPTZ DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS emails_recipients_idx ON emails USING GIN (recipients)`,
+	`ALTER TABLE emails ADD COLUMN IF NOT EXISTS text_body TEXT`,
+	fmt.Sprintf(`ALTER TABLE emails ADD COLUMN IF NOT EXISTS search_vector tsvector
+		GENERATED ALWAYS AS (
+			setweight(to_tsvector('%[1]s', coalesce(subject, '')), 'A') ||
+			setweight(to_tsvector('%[1]s', coalesce(sender, '')), 'B') ||
+			setweight(to_tsvector('%[1]s', coalesce(text_body, '')), 'C')
+		) STORED`, searchConfig),
+	`CREATE INDEX IF NOT EXISTS emails_search_idx ON emails USING GIN (search_vector)`,
+	`CREATE TABLE IF NOT EXISTS email_states (
+		email_id INTEGER NOT NULL REFERENCES emails(id) ON DELETE CASCADE,
+		mailbox TEXT NOT NULL,
+		is_read BOOLEAN NOT NULL DEFAULT FALSE,
+		starred BOOLEAN NOT NULL DEFAULT FALSE,
+		deleted_at TIMESTAMPTZ,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (email_id, mailbox)
+	)`,
+	`CREATE INDEX IF NOT EXISTS email_states_mailbox_idx ON email_states (mailbox, email_id)`,
+	`CREATE INDEX IF NOT EXISTS email_states_deleted_idx ON email_states (deleted_at) WHERE deleted_at IS NOT NULL`,
+	`ALTER TABLE emails ADD COLUMN IF NOT EXISTS message_id TEXT`,
+	`CREATE INDEX IF NOT EXISTS emails_message_id_idx ON emails (message_id) WHERE message_id IS NOT NULL`,
+	`CREATE TABLE IF NOT EXISTS webhooks (
+		id SERIAL PRIMARY KEY,
+		url TEXT NOT NULL,
+		pattern TEXT,
+		secret TEXT NOT NULL,
+		failures INTEGER NOT NULL DEFAULT 0,
+		disabled_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id BIGSERIAL PRIMARY KEY,
+		webhook_id INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+		email_id INTEGER NOT NULL,
+		payload BYTEA NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		last_status INTEGER,
+		last_error TEXT,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		delivered_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending'`,
+	`CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_idx ON webhook_deliveries (webhook_id, id)`,
+	`CREATE TABLE IF NOT EXISTS addresses (
+		address TEXT PRIMARY KEY,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		expires_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS addresses_expires_idx ON addresses (expires_at) WHERE expires_at IS NOT NULL`,
+	`CREATE TABLE IF NOT EXISTS inbox_tokens (
+		id BIGSERIAL PRIMARY KEY,
+		mailbox TEXT NOT NULL,
+		token_hash BYTEA NOT NULL UNIQUE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		revoked_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS inbox_tokens_mailbox_idx ON inbox_tokens (mailbox, id)`,
+	`CREATE TABLE IF NOT EXISTS forward_rules (
+		id SERIAL PRIMARY KEY,
+		address TEXT NOT NULL,
+		target TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		UNIQUE (address, target)
+	)`,
+	`CREATE TABLE IF NOT EXISTS outbound_messages (
+		id BIGSERIAL PRIMARY KEY,
+		email_id INTEGER REFERENCES emails(id) ON DELETE SET NULL,
+		sender TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		domain TEXT NOT NULL,
+		body BYTEA NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		expires_at TIMESTAMPTZ NOT NULL,
+		last_error TEXT,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		finished_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS outbound_messages_due_idx ON outbound_messages (next_attempt_at) WHERE status = 'pending'`,
+	`CREATE INDEX IF NOT EXISTS outbound_messages_finished_idx ON outbound_messages (finished_at) WHERE finished_at IS NOT NULL`,
+	`ALTER TABLE outbound_messages ADD COLUMN IF NOT EXISTS return_path TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE outbound_messages ADD COLUMN IF NOT EXISTS dsn_ret TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE outbound_messages ADD COLUMN IF NOT EXISTS dsn_envid TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE outbound_messages ADD COLUMN IF NOT EXISTS dsn_orcpt TEXT NOT NULL DEFAULT ''`,
+	// commit_seq numbers messages in the order they became visible, which
+	// ids do not; see assignCommitSeq. The sequence is deliberately not
+	// owned by the table, so truncating emails never restarts it.
+	`CREATE SEQUENCE IF NOT EXISTS emails_commit_seq`,
+	// Rules forward nothing until their target confirms them: confirm_hash
+	// holds the hash of the token mailed to the target, and confirmed_at is
+	// NULL until the token comes back.
+	`ALTER TABLE forward_rules ADD COLUMN IF NOT EXISTS confirm_hash BYTEA UNIQUE`,
+	`ALTER TABLE forward_rules ADD COLUMN IF NOT EXISTS confirmed_at TIMESTAMPTZ`,
+	`ALTER TABLE emails ADD COLUMN IF NOT EXISTS commit_seq BIGINT`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS emails_commit_seq_idx ON emails (commit_seq)`,
+}
+
+// backfillCommitSeq numbers the mail stored before commit_seq existed, in
+// id order. Once that is done no row is left without a number, so later
+// starts find nothing to update and skip it.
+func backfillCommitSeq(ctx context.Context, db *sql.DB) error {
+	var pending bool
+	err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM emails WHERE commit_seq IS NULL)`).Scan(&pending)
+	if err != nil {
+		return fmt.Errorf("failed to check for unnumbered emails: %w", err)
+	}
+	if !pending {
+		return nil
+	}
+
+	result, err := db.ExecContext(ctx, `
+		UPDATE emails e SET commit_seq = n.seq
+		FROM (
+			SELECT id, nextval('emails_commit_seq') AS seq
+			FROM (SELECT id FROM emails WHERE commit_seq IS NULL ORDER BY id) pending
+		) n
+		WHERE e.id = n.id
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to backfill commit sequence: %w", err)
+	}
+	n, _ := result.RowsAffected()
+	log.Printf("Assigned commit sequence numbers to %d existing emails", n)
+	return nil
+}
+
+func Migrate(ctx context.Context, db *sql.DB) error {
+	for i, stmt := range schemaStatements {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to apply schema statement %d: %w", i+1, err)
+		}
+	}
+	if err := backfillCommitSeq(ctx, db); err != nil {
+		return err
+	}
+
+	log.Println("Schema initialized successfully")
+	return nil
+}
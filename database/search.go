@@ -0,0 +1,165 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+type SearchQuery struct {
+	// Text is parsed with websearch_to_tsquery, so quoted phrases, "or" and
+	// a leading "-" behave the way users expect from a search box.
+	Text string
+	// Recipient scopes the search to a single mailbox. It is required:
+	// searching across every inbox would leak mail between users.
+	Recipient string
+	Limit     int
+	// Cursor is the NextCursor of the previous page, empty for the first.
+	Cursor string
+}
+
+type SearchHit struct {
+	ID         int64
+	Sender     string
+	Recipients []string
+	Subject    string
+	Size       int64
+	CreatedAt  time.Time
+	Rank       float32
+}
+
+type SearchResult struct {
+	Hits       []SearchHit
+	NextCursor string
+}
+
+// SearchMails returns messages matching q ordered by relevance, newest first
+// among equal ranks. Pagination is keyset based on (rank, id) so that deep
+// pages cost the same as the first one and concurrent inserts never shift
+// results between pages.
+func SearchMails(ctx context.Context, db *sql.DB, q SearchQuery) (*SearchResult, error) {
+	text := strings.TrimSpace(q.Text)
+	if text == "" {
+		return nil, fmt.Errorf("search text is empty")
+	}
+	if q.Recipient == "" {
+		return nil, fmt.Errorf("search recipient is empty")
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+
+	var afterRank sql.NullFloat64
+	var afterID sql.NullInt64
+	if q.Cursor != "" {
+		rank, id, err := decodeSearchCursor(q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		afterRank = sql.NullFloat64{Float64: float64(rank), Valid: true}
+		afterID = sql.NullInt64{Int64: id, Valid: true}
+	}
+
+	query := fmt.Sprintf(`
+		SELECT id, sender, recipients, subject, size, created_at, rank
+		FROM (
+			SELECT id, sender, recipients, subject, size, created_at,
+				ts_rank_cd(search_vector, q) AS rank
+			FROM emails e, websearch_to_tsquery('%s', $1) q
+			WHERE e.search_vector @@ q
+				AND e.recipients @> ARRAY[$2]::text[]
+				AND NOT %s
+		) ranked
+		WHERE $3::real IS NULL OR (rank, id) < ($3::real, $4::int)
+		ORDER BY rank DESC, id DESC
+		LIMIT $5
+	`, searchConfig, softDeletedFor("e", "$2"))
+
+	rows, err := db.QueryContext(ctx, query, text, q.Recipient, afterRank, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search emails: %w", err)
+	}
+	defer rows.Close()
+
+	result := &SearchResult{}
+	for rows.Next() {
+		var hit SearchHit
+		var sender, subject sql.NullString
+		var size sql.NullInt64
+		var createdAt sql.NullTime
+
+		if err := rows.Scan(
+			&hit.ID,
+			&sender,
+			pq.Array(&hit.Recipients),
+			&subject,
+			&size,
+			&createdAt,
+			&hit.Rank,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan search result: %w", err)
+		}
+
+		hit.Sender = sender.String
+		hit.Subject = subject.String
+		hit.Size = size.Int64
+		hit.CreatedAt = createdAt.Time
+		result.Hits = append(result.Hits, hit)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read search results: %w", err)
+	}
+
+	if len(result.Hits) == limit {
+		last := result.Hits[len(result.Hits)-1]
+		result.NextCursor = encodeSearchCursor(last.Rank, last.ID)
+	}
+
+	return result, nil
+}
+
+// The cursor carries the rank in its shortest float32 form, which round-trips
+// exactly, so the keyset comparison never skips or repeats a row.
+func encodeSearchCursor(rank float32, id int64) string {
+	raw := strconv.FormatFloat(float64(rank), 'g', -1, 32) + ":" + strconv.FormatInt(id, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeSearchCursor(cursor string) (float32, int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid search cursor: %w", err)
+	}
+
+	rankPart, idPart, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid search cursor")
+	}
+
+	rank, err := strconv.ParseFloat(rankPart, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid search cursor rank: %w", err)
+	}
+	id, err := strconv.ParseInt(idPart, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid search cursor id: %w", err)
+	}
+
+	return float32(rank), id, nil
+}
@@ -0,0 +1,219 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// MessageState is one recipient's view of a message. Messages without a
+// state row are unread, unstarred and not deleted.
+type MessageState struct {
+	EmailID   int64
+	Mailbox   string
+	Read      bool
+	Starred   bool
+	DeletedAt *time.Time
+}
+
+// FlagUpdate changes only the flags that are non-nil.
+type FlagUpdate struct {
+	Read    *bool
+	Starred *bool
+	Deleted *bool
+}
+
+// UpdateMessageFlags applies update to the given messages as seen by
+// mailbox, or to every message in the mailbox when ids is nil. Messages not
+// addressed to mailbox are ignored. It returns how many messages changed.
+func UpdateMessageFlags(ctx context.Context, db *sql.DB, mailbox string, ids []int64, update FlagUpdate) (int64, error) {
+	if update.Read == nil && update.Starred == nil && update.Deleted == nil {
+		return 0, nil
+	}
+
+	result, err := db.ExecContext(ctx, `
+		INSERT INTO email_states (email_id, mailbox, is_read, starred, deleted_at)
+		SELECT e.id, $1, coalesce($3::boolean, false), coalesce($4::boolean, false),
+			CASE WHEN $5::boolean THEN now() END
+		FROM emails e
+		WHERE e.recipients @> ARRAY[$1]::text[]
+			AND ($2::int[] IS NULL OR e.id = ANY($2::int[]))
+		ON CONFLICT (email_id, mailbox) DO UPDATE SET
+			is_read = coalesce($3::boolean, email_states.is_read),
+			starred = coalesce($4::boolean, email_states.starred),
+			deleted_at = CASE
+				WHEN $5::boolean IS NULL THEN email_states.deleted_at
+				WHEN $5::boolean THEN coalesce(email_states.deleted_at, now())
+				ELSE NULL
+			END,
+			updated_at = now()
+	`, mailbox, idArray(ids), update.Read, update.Starred, update.Deleted)
+	if err != nil {
+		return 0, fmt.Errorf("failed to update message flags: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get affected rows : %w", err)
+	}
+	return rowsAffected, nil
+}
+
+// DeleteMessage soft-deletes one message for mailbox. It reports false when
+// the message is not addressed to mailbox or is already deleted there.
+func DeleteMessage(ctx context.Context, db *sql.DB, mailbox string, id int64) (bool, error) {
+	result, err := db.ExecContext(ctx, `
+		INSERT INTO email_states (email_id, mailbox, deleted_at)
+		SELECT e.id, $1, now()
+		FROM emails e
+		WHERE e.id = $2 AND e.recipients @> ARRAY[$1]::text[]
+		ON CONFLICT (email_id, mailbox) DO UPDATE SET
+			deleted_at = now(),
+			updated_at = now()
+		WHERE email_states.deleted_at IS NULL
+	`, mailbox, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete message: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get affected rows : %w", err)
+	}
+	return rowsAffected > 0, nil
+}
+
+func MarkAllRead(ctx context.Context, db *sql.DB, mailbox string) (int64, error) {
+	read := true
+	return UpdateMessageFlags(ctx, db, mailbox, nil, FlagUpdate{Read: &read})
+}
+
+// DeleteAllMail soft-deletes every message in mailbox. The rows are removed
+// for good by PurgeDeletedMail.
+func DeleteAllMail(ctx context.Context, db *sql.DB, mailbox string) (int64, error) {
+	deleted := true
+	return UpdateMessageFlags(ctx, db, mailbox, nil, FlagUpdate{Deleted: &deleted})
+}
+
+// GetMessageStates returns the state of each requested message for mailbox,
+// defaulting messages that have no state row.
+func GetMessageStates(ctx context.Context, db *sql.DB, mailbox string, ids []int64) (map[int64]MessageState, error) {
+	states := make(map[int64]MessageState, len(ids))
+	for _, id := range ids {
+		states[id] = MessageState{EmailID: id, Mailbox: mailbox}
+	}
+	if len(ids) == 0 {
+		return states, nil
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT email_id, is_read, starred, deleted_at
+		FROM email_states
+		WHERE mailbox = $1 AND email_id = ANY($2::int[])
+	`, mailbox, pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get message states: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		state := MessageState{Mailbox: mailbox}
+		var deletedAt sql.NullTime
+		if err := rows.Scan(&state.EmailID, &state.Read, &state.Starred, &deletedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan message state: %w", err)
+		}
+		if deletedAt.Valid {
+			state.DeletedAt = &deletedAt.Time
+		}
+		states[state.EmailID] = state
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read message states: %w", err)
+	}
+
+	return states, nil
+}
+
+// PurgeDeletedMail permanently removes messages that were soft-deleted
+// before cutoff. The recipient is taken off the message, and the message
+// itself is deleted once no recipient remains on it.
+func PurgeDeletedMail(ctx context.Context, db *sql.DB, cutoff time.Time, batchSize int) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		WITH purged AS (
+			DELETE FROM email_states
+			WHERE (email_id, mailbox) IN (
+				SELECT email_id, mailbox FROM email_states
+				WHERE deleted_at < $1
+				LIMIT $2
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING email_id, mailbox
+		)
+		UPDATE emails e
+		SET recipients = (
+			SELECT coalesce(array_agg(r), '{}')
+			FROM unnest(e.recipients) AS r
+			WHERE r NOT IN (SELECT mailbox FROM purged p WHERE p.email_id = e.id)
+		)
+		WHERE e.id IN (SELECT email_id FROM purged)
+		RETURNING e.id, cardinality(e.recipients)
+	`, cutoff, batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge deleted emails: %w", err)
+	}
+
+	var purged int64
+	var orphaned []int64
+	for rows.Next() {
+		var id int64
+		var remaining int
+		if err := rows.Scan(&id, &remaining); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan purged email: %w", err)
+		}
+		purged++
+		if remaining == 0 {
+			orphaned = append(orphaned, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to purge deleted emails: %w", err)
+	}
+
+	if len(orphaned) > 0 {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM emails WHERE id = ANY($1)`, pq.Array(orphaned)); err != nil {
+			return 0, fmt.Errorf("failed to delete orphaned emails: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return purged, nil
+}
+
+// softDeletedFor returns an SQL predicate that is true when the email aliased
+// as emailAlias has been soft-deleted by the mailbox in mailboxExpr.
+func softDeletedFor(emailAlias, mailboxExpr string) string {
+	return fmt.Sprintf(`EXISTS (
+		SELECT 1 FROM email_states s
+		WHERE s.email_id = %[1]s.id AND s.mailbox = %[2]s AND s.deleted_at IS NOT NULL
+	)`, emailAlias, mailboxExpr)
+}
+
+func idArray(ids []int64) any {
+	if ids == nil {
+		return nil
+	}
+	return pq.Array(ids)
+}
@@ -0,0 +1,137 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrTokenNotFound = errors.New("token not found")
+
+// InboxToken describes an access token without the token itself, which is
+// only ever stored as a hash. A zero RevokedAt is still in force.
+type InboxToken struct {
+	ID        int64
+	Mailbox   string
+	CreatedAt time.Time
+	RevokedAt time.Time
+}
+
+func CreateInboxToken(ctx context.Context, db *sql.DB, mailbox string, hash []byte) (*InboxToken, error) {
+	t := InboxToken{Mailbox: mailbox}
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO inbox_tokens (mailbox, token_hash) VALUES ($1, $2)
+		RETURNING id, created_at
+	`, mailbox, hash).Scan(&t.ID, &t.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store token: %w", err)
+	}
+	return &t, nil
+}
+
+// InboxTokenValid reports whether hash belongs to an unrevoked token for
+// exactly mailbox.
+func InboxTokenValid(ctx context.Context, db *sql.DB, mailbox string, hash []byte) (bool, error) {
+	var valid bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM inbox_tokens
+			WHERE token_hash = $1 AND mailbox = $2 AND revoked_at IS NULL
+		)
+	`, hash, mailbox).Scan(&valid)
+	if err != nil {
+		return false, fmt.Errorf("failed to check token: %w", err)
+	}
+	return valid, nil
+}
+
+// ListInboxTokens returns mailbox's tokens, revoked ones included, oldest
+// first.
+func ListInboxTokens(ctx context.Context, db *sql.DB, mailbox string) ([]InboxToken, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, created_at, revoked_at FROM inbox_tokens
+		WHERE mailbox = $1
+		ORDER BY id
+	`, mailbox)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []InboxToken
+	for rows.Next() {
+		t := InboxToken{Mailbox: mailbox}
+		var revokedAt sql.NullTime
+		if err := rows.Scan(&t.ID, &t.CreatedAt, &revokedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan token: %w", err)
+		}
+		t.RevokedAt = revokedAt.Time
+		tokens = append(tokens, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list tokens: %w", err)
+	}
+	return tokens, nil
+}
+
+// RevokeInboxToken revokes one of mailbox's tokens by id.
+func RevokeInboxToken(ctx context.Context, db *sql.DB, mailbox string, id int64) error {
+	result, err := db.ExecContext(ctx, `
+		UPDATE inbox_tokens SET revoked_at = NOW()
+		WHERE id = $1 AND mailbox = $2 AND revoked_at IS NULL
+	`, id, mailbox)
+	if err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// RevokeInboxTokens revokes every token of mailbox, returning how many were
+// in force.
+func RevokeInboxTokens(ctx context.Context, db *sql.DB, mailbox string) (int64, error) {
+	result, err := db.ExecContext(ctx, `
+		UPDATE inbox_tokens SET revoked_at = NOW()
+		WHERE mailbox = $1 AND revoked_at IS NULL
+	`, mailbox)
+	if err != nil {
+		return 0, fmt.Errorf("failed to revoke tokens: %w", err)
+	}
+	n, _ := result.RowsAffected()
+	return n, nil
+}
+
+// RotateInboxToken stores a new token for mailbox and revokes the others in
+// the same transaction, so there is no moment with both or neither.
+func RotateInboxToken(ctx context.Context, db *sql.DB, mailbox string, hash []byte) (*InboxToken, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE inbox_tokens SET revoked_at = NOW()
+		WHERE mailbox = $1 AND revoked_at IS NULL
+	`, mailbox); err != nil {
+		return nil, fmt.Errorf("failed to revoke tokens: %w", err)
+	}
+
+	t := InboxToken{Mailbox: mailbox}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO inbox_tokens (mailbox, token_hash) VALUES ($1, $2)
+		RETURNING id, created_at
+	`, mailbox, hash).Scan(&t.ID, &t.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store token: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &t, nil
+}
@@ -0,0 +1,330 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook is an HTTP endpoint told about stored mail. An empty Pattern
+// matches every message; otherwise it is a path.Match glob tested against
+// each lower-cased recipient, such as "*@example.com".
+type Webhook struct {
+	ID      int64
+	URL     string
+	Pattern string
+	Secret  string
+	// Failures counts consecutive failed attempts; any success resets it.
+	Failures   int
+	DisabledAt time.Time
+	CreatedAt  time.Time
+}
+
+func (w Webhook) Disabled() bool {
+	return !w.DisabledAt.IsZero()
+}
+
+// WebhookDelivery is one message's delivery to one webhook, which doubles as
+// its log entry once finished.
+type WebhookDelivery struct {
+	ID            int64
+	WebhookID     int64
+	EmailID       int64
+	Payload       []byte
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	LastStatus    int
+	LastError     string
+	CreatedAt     time.Time
+	DeliveredAt   time.Time
+}
+
+func CreateWebhook(ctx context.Context, db *sql.DB, url, pattern, secret string) (*Webhook, error) {
+	w := Webhook{URL: url, Pattern: pattern, Secret: secret}
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO webhooks (url, pattern, secret)
+		VALUES ($1, nullif($2, ''), $3)
+		RETURNING id, created_at
+	`, url, pattern, secret).Scan(&w.ID, &w.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webhook: %w", err)
+	}
+	return &w, nil
+}
+
+const webhookColumns = `id, url, coalesce(pattern, ''), secret, failures, disabled_at, created_at`
+
+func scanWebhook(row rowScanner) (*Webhook, error) {
+	var w Webhook
+	var disabledAt sql.NullTime
+	if err := row.Scan(&w.ID, &w.URL, &w.Pattern, &w.Secret, &w.Failures, &disabledAt, &w.CreatedAt); err != nil {
+		return nil, err
+	}
+	w.DisabledAt = disabledAt.Time
+	return &w, nil
+}
+
+// ListWebhooks returns every webhook, or only enabled ones when activeOnly
+// is set.
+func ListWebhooks(ctx context.Context, db *sql.DB, activeOnly bool) ([]Webhook, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+webhookColumns+`
+		FROM webhooks
+		WHERE NOT $1 OR disabled_at IS NULL
+		ORDER BY id
+	`, activeOnly)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	var hooks []Webhook
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook: %w", err)
+		}
+		hooks = append(hooks, *w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list webhooks: %w", err)
+	}
+	return hooks, nil
+}
+
+func DeleteWebhook(ctx context.Context, db *sql.DB, id int64) error {
+	res, err := db.ExecContext(ctx, `DELETE FROM webhooks WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// EnableWebhook clears a webhook's disabled state and failure count.
+// Deliveries that were waiting on it resume.
+func EnableWebhook(ctx context.Context, db *sql.DB, id int64) error {
+	res, err := db.ExecContext(ctx, `
+		UPDATE webhooks SET disabled_at = NULL, failures = 0 WHERE id = $1
+	`, id)
+	if err != nil {
+		return fmt.Errorf("failed to enable webhook: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// EnqueueWebhookDelivery records a pending delivery, due at once.
+func EnqueueWebhookDelivery(ctx context.Context, db *sql.DB, webhookID, emailID int64, payload []byte) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO webhook_deliveries (webhook_id, email_id, payload)
+		VALUES ($1, $2, $3)
+	`, webhookID, emailID, payload)
+	if err != nil {
+		return fmt.Errorf("failed to enqueue webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// ClaimedDelivery is a delivery taken for an attempt, with the endpoint it
+// goes to.
+type ClaimedDelivery struct {
+	WebhookDelivery
+	URL    string
+	Secret string
+}
+
+// ClaimWebhookDeliveries takes up to limit due deliveries to enabled
+// webhooks, pushing their next attempt out by lease so that no other
+// instance claims them while they are in flight. A delivery whose claimer
+// dies is retried once the lease runs out.
+func ClaimWebhookDeliveries(ctx context.Context, db *sql.DB, limit int, lease time.Duration) ([]ClaimedDelivery, error) {
+	rows, err := db.QueryContext(ctx, `
+		UPDATE webhook_deliveries d
+		SET next_attempt_at = NOW() + $2::float8 * interval '1 second'
+		FROM webhooks w
+		WHERE w.id = d.webhook_id AND d.id IN (
+			SELECT d2.id FROM webhook_deliveries d2
+			JOIN webhooks w2 ON w2.id = d2.webhook_id
+			WHERE d2.status = 'pending'
+				AND d2.next_attempt_at <= NOW()
+				AND w2.disabled_at IS NULL
+			ORDER BY d2.next_attempt_at
+			LIMIT $1
+			FOR UPDATE OF d2 SKIP LOCKED
+		)
+		RETURNING d.id, d.webhook_id, d.email_id, d.payload, d.attempts, w.url, w.secret
+	`, limit, lease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var claimed []ClaimedDelivery
+	for rows.Next() {
+		var d ClaimedDelivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.EmailID, &d.Payload, &d.Attempts, &d.URL, &d.Secret); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery: %w", err)
+		}
+		d.Status = DeliveryPending
+		claimed = append(claimed, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to claim webhook deliveries: %w", err)
+	}
+	return claimed, nil
+}
+
+// WebhookAttempt is the outcome of one delivery attempt.
+type WebhookAttempt struct {
+	Delivered bool
+	// Status is the HTTP status received, or zero if none was.
+	Status int
+	Error  string
+	// RetryAt schedules the next attempt of a failed delivery; zero gives
+	// up on it.
+	RetryAt time.Time
+}
+
+// RecordWebhookAttempt logs an attempt on the delivery and updates the
+// webhook's consecutive failure count, disabling it when a failure brings
+// the count to disableAfter. It reports whether that happened.
+func RecordWebhookAttempt(ctx context.Context, db *sql.DB, d ClaimedDelivery, attempt WebhookAttempt, disableAfter int) (disabled bool, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	status := DeliveryDelivered
+	var nextAttempt any
+	switch {
+	case attempt.Delivered:
+	case attempt.RetryAt.IsZero():
+		status = DeliveryFailed
+	default:
+		status = DeliveryPending
+		nextAttempt = attempt.RetryAt
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE webhook_deliveries SET
+			status = $2,
+			attempts = attempts + 1,
+			next_attempt_at = coalesce($3, next_attempt_at),
+			last_status = nullif($4, 0),
+			last_error = nullif($5, ''),
+			delivered_at = CASE WHEN $2 = 'delivered' THEN NOW() END
+		WHERE id = $1
+	`, d.ID, status, nextAttempt, attempt.Status, attempt.Error)
+	if err != nil {
+		return false, fmt.Errorf("failed to record webhook delivery: %w", err)
+	}
+
+	if attempt.Delivered {
+		_, err = tx.ExecContext(ctx, `UPDATE webhooks SET failures = 0 WHERE id = $1`, d.WebhookID)
+	} else {
+		err = tx.QueryRowContext(ctx, `
+			UPDATE webhooks SET
+				failures = failures + 1,
+				disabled_at = CASE
+					WHEN $2 > 0 AND failures + 1 >= $2 THEN coalesce(disabled_at, NOW())
+					ELSE disabled_at
+				END
+			WHERE id = $1
+			RETURNING $2 > 0 AND failures = $2
+		`, d.WebhookID, disableAfter).Scan(&disabled)
+		if errors.Is(err, sql.ErrNoRows) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to update webhook: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return disabled, nil
+}
+
+// ListWebhookDeliveries returns the newest deliveries first, for one webhook
+// or, with webhookID zero, for all of them. Payloads are not loaded.
+func ListWebhookDeliveries(ctx context.Context, db *sql.DB, webhookID int64, limit int) ([]WebhookDelivery, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, webhook_id, email_id, status, attempts, next_attempt_at,
+			coalesce(last_status, 0), coalesce(last_error, ''), created_at, delivered_at
+		FROM webhook_deliveries
+		WHERE $1 = 0 OR webhook_id = $1
+		ORDER BY id DESC
+		LIMIT $2
+	`, webhookID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		var deliveredAt sql.NullTime
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.EmailID, &d.Status, &d.Attempts, &d.NextAttemptAt,
+			&d.LastStatus, &d.LastError, &d.CreatedAt, &deliveredAt); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery: %w", err)
+		}
+		d.DeliveredAt = deliveredAt.Time
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list webhook deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+// RedeliverWebhook makes a finished or waiting delivery due again.
+func RedeliverWebhook(ctx context.Context, db *sql.DB, deliveryID int64) error {
+	res, err := db.ExecContext(ctx, `
+		UPDATE webhook_deliveries
+		SET status = 'pending', next_attempt_at = NOW(), delivered_at = NULL
+		WHERE id = $1
+	`, deliveryID)
+	if err != nil {
+		return fmt.Errorf("failed to redeliver webhook: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("webhook delivery %d not found", deliveryID)
+	}
+	return nil
+}
+
+// PurgeWebhookDeliveries drops finished deliveries created before cutoff,
+// at most batchSize of them, and drops their payloads with them.
+func PurgeWebhookDeliveries(ctx context.Context, db *sql.DB, cutoff time.Time, batchSize int) (int64, error) {
+	res, err := db.ExecContext(ctx, `
+		DELETE FROM webhook_deliveries
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status <> 'pending' AND created_at < $1
+			LIMIT $2
+		)
+	`, cutoff, batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge webhook deliveries: %w", err)
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/database"
+	"github.com/zeusnotfound04/nano-mail/internal/auth"
+	"github.com/zeusnotfound04/nano-mail/internal/registry"
+)
+
+type addressRequest struct {
+	Address    string `json:"address"`
+	TTLSeconds int64  `json:"ttl_seconds"`
+}
+
+type addressInfo struct {
+	Address   string     `json:"address"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Token     string     `json:"token,omitempty"`
+}
+
+func newAddressInfo(a *database.Address) addressInfo {
+	info := addressInfo{Address: a.Address, CreatedAt: a.CreatedAt}
+	if !a.ExpiresAt.IsZero() {
+		info.ExpiresAt = &a.ExpiresAt
+	}
+	return info
+}
+
+// readAddressRequest decodes an optional JSON body; an empty one asks for
+// the defaults.
+func readAddressRequest(w http.ResponseWriter, r *http.Request) (addressRequest, bool) {
+	var req addressRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return req, false
+	}
+	if req.TTLSeconds < 0 {
+		writeError(w, http.StatusBadRequest, "ttl_seconds must not be negative")
+		return req, false
+	}
+	return req, true
+}
+
+// handleCreateAddress provisions an address, random unless an admin asks
+// for one, and returns it with its mailbox token. Anyone may generate an
+// address, so other clients are rate limited.
+func (s *Server) handleCreateAddress(w http.ResponseWriter, r *http.Request) {
+	req, ok := readAddressRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.isAdmin(r) {
+		if req.Address != "" {
+			writeError(w, http.StatusForbidden, "choosing an address requires the admin token")
+			return
+		}
+		if !allow(w, s.generated, clientIP(r), "too many addresses generated, try again later") {
+			return
+		}
+	}
+
+	ttl := time.Duration(req.TTLSeconds) * time.Second
+
+	var a *database.Address
+	var err error
+	if req.Address == "" {
+		a, err = s.opts.Registry.Generate(r.Context(), ttl)
+	} else {
+		a, err = s.opts.Registry.Create(r.Context(), req.Address, ttl)
+	}
+	if err != nil {
+		s.addressError(w, "Failed to register address", err)
+		return
+	}
+
+	info := newAddressInfo(a)
+	if issuer, ok := s.opts.Auth.(auth.Issuer); ok {
+		info.Token, err = issuer.Issue(r.Context(), a.Address)
+		if err != nil {
+			s.opts.Logger.Error("Failed to issue mailbox token", "error", err, "mailbox", a.Address)
+			writeError(w, http.StatusServiceUnavailable, "authentication unavailable")
+			return
+		}
+	}
+
+	s.opts.Logger.Info("Address registered", "address", a.Address, "expires_at", a.ExpiresAt)
+	writeJSON(w, http.StatusCreated, info)
+}
+
+func (s *Server) handleGetAddress(w http.ResponseWriter, r *http.Request, mailbox string) {
+	a, err := s.opts.Registry.Lookup(r.Context(), mailbox)
+	if err == nil && a.Expired(time.Now()) {
+		err = database.ErrAddressNotFound
+	}
+	if err != nil {
+		s.addressError(w, "Failed to look up address", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAddressInfo(a))
+}
+
+func (s *Server) handleExtendAddress(w http.ResponseWriter, r *http.Request, mailbox string) {
+	req, ok := readAddressRequest(w, r)
+	if !ok {
+		return
+	}
+
+	a, err := s.opts.Registry.Extend(r.Context(), mailbox, time.Duration(req.TTLSeconds)*time.Second)
+	if err != nil {
+		s.addressError(w, "Failed to extend address", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAddressInfo(a))
+}
+
+func (s *Server) handleReleaseAddress(w http.ResponseWriter, r *http.Request, mailbox string) {
+	if err := s.opts.Registry.Release(r.Context(), mailbox); err != nil {
+		s.addressError(w, "Failed to release address", err)
+		return
+	}
+	s.opts.Logger.Info("Address released", "address", mailbox)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) addressError(w http.ResponseWriter, msg string, err error) {
+	switch {
+	case errors.Is(err, database.ErrAddressNotFound):
+		writeError(w, http.StatusNotFound, "address not found")
+	case errors.Is(err, database.ErrAddressTaken):
+		writeError(w, http.StatusConflict, "address already registered")
+	case errors.Is(err, registry.ErrInvalidAddress):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, registry.ErrTTLTooLong):
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		s.storageError(w, msg, err)
+	}
+}
@@ -0,0 +1,252 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/database"
+	"github.com/zeusnotfound04/nano-mail/internal/auth"
+	"github.com/zeusnotfound04/nano-mail/internal/registry"
+)
+
+// maxForwardRules caps the targets one mailbox may forward to, so that an
+// address cannot be turned into a mailing list.
+const maxForwardRules = 5
+
+// Creating a rule mails its target, so both the mailbox and the target are
+// limited in how many they see an hour.
+const (
+	forwardsPerMailbox = 10
+	forwardsPerTarget  = 3
+)
+
+// forwardConfirmTTL is how long a target has to confirm a rule.
+const forwardConfirmTTL = 48 * time.Hour
+
+type forwardRequest struct {
+	Target string `json:"target"`
+}
+
+type forwardRule struct {
+	ID        int64     `json:"id"`
+	Target    string    `json:"target"`
+	Confirmed bool      `json:"confirmed"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newForwardRule(rule *database.ForwardRule) forwardRule {
+	return forwardRule{
+		ID:        rule.ID,
+		Target:    rule.Target,
+		Confirmed: !rule.ConfirmedAt.IsZero(),
+		CreatedAt: rule.CreatedAt,
+	}
+}
+
+type forwardList struct {
+	Forwards []forwardRule `json:"forwards"`
+}
+
+func (s *Server) handleListForwards(w http.ResponseWriter, r *http.Request, mailbox string) {
+	rules, err := database.ListForwardRules(r.Context(), s.opts.DB, mailbox)
+	if err != nil {
+		s.storageError(w, "Failed to list forward rules", err)
+		return
+	}
+
+	resp := forwardList{Forwards: make([]forwardRule, 0, len(rules))}
+	for i := range rules {
+		resp.Forwards = append(resp.Forwards, newForwardRule(&rules[i]))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleCreateForward adds an unconfirmed rule and mails its target a
+// token to confirm it with. Nothing is forwarded until the target does.
+func (s *Server) handleCreateForward(w http.ResponseWriter, r *http.Request, mailbox string) {
+	var req forwardRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	target, err := registry.Canonical(req.Target)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid target address")
+		return
+	}
+	if target == mailbox {
+		writeError(w, http.StatusBadRequest, "a mailbox cannot forward to itself")
+		return
+	}
+
+	existing, err := database.ListForwardRules(r.Context(), s.opts.DB, mailbox)
+	if err != nil {
+		s.storageError(w, "Failed to list forward rules", err)
+		return
+	}
+	if len(existing) >= maxForwardRules {
+		writeError(w, http.StatusConflict, "too many forwarding targets")
+		return
+	}
+
+	const limited = "too many forwarding requests, try again later"
+	if !allow(w, s.forwardsByMailbox, mailbox, limited) || !allow(w, s.forwardsByTarget, target, limited) {
+		return
+	}
+
+	token, err := newConfirmToken()
+	if err != nil {
+		s.opts.Logger.Error("Failed to create forward confirmation token", "error", err)
+		writeError(w, http.StatusServiceUnavailable, "forwarding unavailable")
+		return
+	}
+
+	rule, err := database.CreateForwardRule(r.Context(), s.opts.DB, mailbox, target, auth.HashToken(token))
+	if errors.Is(err, database.ErrForwardRuleExists) {
+		writeError(w, http.StatusConflict, "already forwarding to that address")
+		return
+	}
+	if err != nil {
+		s.storageError(w, "Failed to create forward rule", err)
+		return
+	}
+
+	if err := s.requestConfirmation(r, rule, token); err != nil {
+		// Without the mail the rule could never be confirmed.
+		database.DeleteForwardRule(r.Context(), s.opts.DB, rule.ID, mailbox)
+		s.storageError(w, "Failed to queue forward confirmation", err)
+		return
+	}
+
+	s.opts.Logger.Info("Forward rule created, awaiting confirmation", "mailbox", mailbox, "target", target)
+	writeJSON(w, http.StatusCreated, newForwardRule(rule))
+}
+
+func newConfirmToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// requestConfirmation queues the mail asking rule's target to confirm it.
+// It is sent from the null reverse-path, like a bounce, so that it cannot
+// bounce back to anyone.
+func (s *Server) requestConfirmation(r *http.Request, rule *database.ForwardRule, token string) error {
+	id := make([]byte, 12)
+	rand.Read(id)
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: NanoMail <postmaster@%s>\r\n", s.opts.Domain)
+	fmt.Fprintf(&body, "To: <%s>\r\n", rule.Target)
+	body.WriteString("Subject: Confirm mail forwarding\r\n")
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&body, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), s.opts.Domain)
+	body.WriteString("Auto-Submitted: auto-generated\r\n")
+	body.WriteString("MIME-Version: 1.0\r\n")
+	body.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&body, "Someone asked for mail to %s to be forwarded to this address.\r\n\r\n", rule.Address)
+	if s.opts.PublicURL != "" {
+		link := s.opts.PublicURL + "/api/v1/forwards/confirm?token=" + url.QueryEscape(token)
+		fmt.Fprintf(&body, "To accept it, open this link within %d hours:\r\n\r\n%s\r\n\r\n", int(forwardConfirmTTL.Hours()), link)
+	} else {
+		fmt.Fprintf(&body, "To accept it, POST this token to /api/v1/forwards/confirm within %d hours:\r\n\r\n%s\r\n\r\n", int(forwardConfirmTTL.Hours()), token)
+	}
+	body.WriteString("If you did not expect this, ignore it and nothing will be forwarded.\r\n")
+
+	return s.opts.Outbound.Enqueue(r.Context(), []database.OutboundMessage{{
+		Recipient: rule.Target,
+		Body:      body.Bytes(),
+	}})
+}
+
+var confirmPage = template.Must(template.New("confirm").Parse(`<!DOCTYPE html>
+<title>Confirm mail forwarding</title>
+<form method="post" action="/api/v1/forwards/confirm">
+<input type="hidden" name="token" value="{{.}}">
+<p>Accept mail forwarded to this address?</p>
+<button type="submit">Accept forwarding</button>
+</form>
+`))
+
+// handleConfirmForwardPage shows the form the confirmation link leads to.
+// Opening the link changes nothing, since mail scanners follow links too.
+func (s *Server) handleConfirmForwardPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	confirmPage.Execute(w, r.URL.Query().Get("token"))
+}
+
+// handleConfirmForward activates the rule a mailed token belongs to. It
+// takes the token as a form field, from the confirmation page, or as JSON.
+func (s *Server) handleConfirmForward(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+
+	form := false
+	var token string
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "application/x-www-form-urlencoded" {
+		form = true
+		token = r.PostFormValue("token")
+	} else {
+		var req struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		token = req.Token
+	}
+	if token == "" {
+		writeError(w, http.StatusBadRequest, "token required")
+		return
+	}
+
+	rule, err := database.ConfirmForwardRule(r.Context(), s.opts.DB, auth.HashToken(token), forwardConfirmTTL)
+	if errors.Is(err, database.ErrForwardRuleNotFound) {
+		writeError(w, http.StatusNotFound, "unknown or expired confirmation token")
+		return
+	}
+	if err != nil {
+		s.storageError(w, "Failed to confirm forward rule", err)
+		return
+	}
+
+	s.opts.Logger.Info("Forward rule confirmed", "mailbox", rule.Address, "target", rule.Target)
+	if form {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "Mail to %s is now forwarded to %s.\n", rule.Address, rule.Target)
+		return
+	}
+	writeJSON(w, http.StatusOK, newForwardRule(rule))
+}
+
+func (s *Server) handleDeleteForward(w http.ResponseWriter, r *http.Request, mailbox string) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id < 1 {
+		writeError(w, http.StatusBadRequest, "invalid forward id")
+		return
+	}
+
+	err = database.DeleteForwardRule(r.Context(), s.opts.DB, id, mailbox)
+	if errors.Is(err, database.ErrForwardRuleNotFound) {
+		writeError(w, http.StatusNotFound, "forward rule not found")
+		return
+	}
+	if err != nil {
+		s.storageError(w, "Failed to delete forward rule", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,308 @@
+package api
+
+import (
+	"errors"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/database"
+	"github.com/zeusnotfound04/nano-mail/pkg/message"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+type messageSummary struct {
+	ID         int64     `json:"id"`
+	From       string    `json:"from"`
+	To         []string  `json:"to"`
+	Subject    string    `json:"subject"`
+	Size       int64     `json:"size"`
+	ReceivedAt time.Time `json:"received_at"`
+	Read       bool      `json:"read"`
+	Starred    bool      `json:"starred"`
+}
+
+type messageList struct {
+	Messages   []messageSummary `json:"messages"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+type attachmentInfo struct {
+	Index       int    `json:"index"`
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type"`
+	ContentID   string `json:"content_id,omitempty"`
+	Inline      bool   `json:"inline"`
+	Size        int    `json:"size"`
+}
+
+type messageDetail struct {
+	messageSummary
+	Headers     map[string][]string `json:"headers"`
+	HeaderFrom  string              `json:"header_from,omitempty"`
+	HeaderTo    []string            `json:"header_to,omitempty"`
+	Cc          []string            `json:"cc,omitempty"`
+	Date        *time.Time          `json:"date,omitempty"`
+	MessageID   string              `json:"message_id,omitempty"`
+	Text        string              `json:"text"`
+	HTML        string              `json:"html"`
+	Attachments []attachmentInfo    `json:"attachments"`
+}
+
+type mailboxStats struct {
+	Address  string     `json:"address"`
+	Messages int64      `json:"messages"`
+	Unread   int64      `json:"unread"`
+	Starred  int64      `json:"starred"`
+	Bytes    int64      `json:"bytes"`
+	Oldest   *time.Time `json:"oldest,omitempty"`
+	Newest   *time.Time `json:"newest,omitempty"`
+	Quota    *quotaInfo `json:"quota,omitempty"`
+}
+
+type quotaInfo struct {
+	MaxMessages int64 `json:"max_messages"`
+	MaxBytes    int64 `json:"max_bytes"`
+}
+
+func summarize(m database.MailboxMessage) messageSummary {
+	return messageSummary{
+		ID:         m.ID,
+		From:       m.Sender,
+		To:         m.Recipients,
+		Subject:    m.Subject,
+		Size:       m.Size,
+		ReceivedAt: m.CreatedAt,
+		Read:       m.Read,
+		Starred:    m.Starred,
+	}
+}
+
+func (s *Server) handleListMessages(w http.ResponseWriter, r *http.Request, mailbox string) {
+	query := r.URL.Query()
+
+	limit := defaultPageSize
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = min(n, maxPageSize)
+	}
+
+	var cursor int64
+	if v := query.Get("cursor"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		cursor = n
+	}
+
+	messages, err := database.ListMailbox(r.Context(), s.opts.DB, mailbox, database.ListOptions{
+		Limit:  limit,
+		Cursor: cursor,
+	})
+	if err != nil {
+		s.storageError(w, "Failed to list mailbox", err)
+		return
+	}
+
+	list := messageList{Messages: make([]messageSummary, 0, len(messages))}
+	for _, m := range messages {
+		list.Messages = append(list.Messages, summarize(m))
+	}
+	if len(messages) == limit {
+		list.NextCursor = strconv.FormatInt(messages[len(messages)-1].ID, 10)
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) handleGetMessage(w http.ResponseWriter, r *http.Request, mailbox string) {
+	msg, ok := s.loadMessage(w, r, mailbox)
+	if !ok {
+		return
+	}
+
+	detail := messageDetail{
+		messageSummary: summarize(msg.MailboxMessage),
+		Attachments:    []attachmentInfo{},
+	}
+
+	parsed, err := message.Parse([]byte(msg.Body))
+	if err != nil {
+		// Unparseable mail is still served, as a plain text body.
+		detail.Text = msg.Body
+		writeJSON(w, http.StatusOK, detail)
+		return
+	}
+
+	detail.Headers = parsed.Header
+	detail.HeaderFrom = parsed.From
+	detail.HeaderTo = parsed.To
+	detail.Cc = parsed.Cc
+	detail.MessageID = parsed.MessageID
+	detail.Text = parsed.Text
+	detail.HTML = parsed.HTML
+	if !parsed.Date.IsZero() {
+		detail.Date = &parsed.Date
+	}
+	for i, a := range parsed.Attachments {
+		detail.Attachments = append(detail.Attachments, attachmentInfo{
+			Index:       i,
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			ContentID:   a.ContentID,
+			Inline:      a.Inline,
+			Size:        a.Size,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, detail)
+}
+
+func (s *Server) handleGetRawMessage(w http.ResponseWriter, r *http.Request, mailbox string) {
+	msg, ok := s.loadMessage(w, r, mailbox)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": strconv.FormatInt(msg.ID, 10) + ".eml",
+	}))
+	w.Write([]byte(msg.Body))
+}
+
+func (s *Server) handleGetAttachment(w http.ResponseWriter, r *http.Request, mailbox string) {
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil || index < 0 {
+		writeError(w, http.StatusBadRequest, "invalid attachment index")
+		return
+	}
+
+	msg, ok := s.loadMessage(w, r, mailbox)
+	if !ok {
+		return
+	}
+
+	parsed, err := message.Parse([]byte(msg.Body))
+	if err != nil || index >= len(parsed.Attachments) {
+		writeError(w, http.StatusNotFound, "attachment not found")
+		return
+	}
+	a := parsed.Attachments[index]
+
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	disposition := "attachment"
+	if a.Inline {
+		disposition = "inline"
+	}
+	params := map[string]string{}
+	if a.Filename != "" {
+		params["filename"] = a.Filename
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, params))
+	// Attachments are untrusted sender content; never let a browser sniff
+	// them into something executable on this origin.
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Write(a.Content)
+}
+
+func (s *Server) handleDeleteMessage(w http.ResponseWriter, r *http.Request, mailbox string) {
+	id, ok := messageID(w, r)
+	if !ok {
+		return
+	}
+
+	deleted, err := database.DeleteMessage(r.Context(), s.opts.DB, mailbox, id)
+	if err != nil {
+		s.storageError(w, "Failed to delete message", err)
+		return
+	}
+	if !deleted {
+		writeError(w, http.StatusNotFound, "message not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request, mailbox string) {
+	stats, err := database.GetMailboxStats(r.Context(), s.opts.DB, mailbox)
+	if err != nil {
+		s.storageError(w, "Failed to get mailbox stats", err)
+		return
+	}
+
+	resp := mailboxStats{
+		Address:  mailbox,
+		Messages: stats.Messages,
+		Unread:   stats.Unread,
+		Starred:  stats.Starred,
+		Bytes:    stats.Bytes,
+	}
+	if !stats.Oldest.IsZero() {
+		resp.Oldest, resp.Newest = &stats.Oldest, &stats.Newest
+	}
+	if s.opts.Quota != nil {
+		limits := s.opts.Quota.LimitsFor(mailbox)
+		resp.Quota = &quotaInfo{MaxMessages: limits.MaxMessages, MaxBytes: limits.MaxBytes}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// messageID parses the id in the path. Ids are stored as INTEGER, so a
+// larger one cannot name a message; it is answered 404 here rather than
+// failing in the query.
+func messageID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id < 1 {
+		writeError(w, http.StatusBadRequest, "invalid message id")
+		return 0, false
+	}
+	if id > math.MaxInt32 {
+		writeError(w, http.StatusNotFound, "message not found")
+		return 0, false
+	}
+	return id, true
+}
+
+func (s *Server) loadMessage(w http.ResponseWriter, r *http.Request, mailbox string) (*database.StoredMessage, bool) {
+	id, ok := messageID(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	msg, err := database.GetMailboxMessage(r.Context(), s.opts.DB, mailbox, id)
+	if errors.Is(err, database.ErrMessageNotFound) {
+		writeError(w, http.StatusNotFound, "message not found")
+		return nil, false
+	}
+	if err != nil {
+		s.storageError(w, "Failed to load message", err)
+		return nil, false
+	}
+	return msg, true
+}
+
+func (s *Server) storageError(w http.ResponseWriter, msg string, err error) {
+	s.opts.Logger.Error(msg, "error", err)
+	writeError(w, http.StatusServiceUnavailable, "storage unavailable")
+}
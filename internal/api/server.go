@@ -0,0 +1,295 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/internal/auth"
+	"github.com/zeusnotfound04/nano-mail/internal/events"
+	"github.com/zeusnotfound04/nano-mail/internal/limiter"
+	"github.com/zeusnotfound04/nano-mail/internal/outbound"
+	"github.com/zeusnotfound04/nano-mail/internal/quota"
+	"github.com/zeusnotfound04/nano-mail/internal/registry"
+	"github.com/zeusnotfound04/nano-mail/pkg/message"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+type Options struct {
+	Host   string
+	Port   string
+	Logger *slog.Logger
+	DB     *sql.DB
+	// Auth, when set, requires a mailbox token on every request that reads
+	// or changes a mailbox.
+	Auth auth.Authenticator
+	// Tokens enables the endpoints for rotating and revoking a mailbox's
+	// tokens.
+	Tokens *auth.StoredTokens
+	// Quota, when set, is reported alongside mailbox stats.
+	Quota *quota.Policy
+	// Events enables the SSE and WebSocket push endpoints.
+	Events *events.Bus
+	// Heartbeat is the keepalive interval on push connections.
+	Heartbeat time.Duration
+	// Registry enables the address provisioning endpoints.
+	Registry *registry.Registry
+	// AdminToken, when set, lets requests bearing it register an address
+	// of their choosing. Everyone else can only generate random ones, at
+	// most GenerateLimit an hour per client.
+	AdminToken    string
+	GenerateLimit int
+	// Outbound enables the endpoints for managing a mailbox's forwarding
+	// rules, and sends the mail asking targets to confirm them. Domain
+	// names the server in that mail, and PublicURL, when set, is the
+	// API's address as the targets reach it, for the confirmation link.
+	Outbound  *outbound.Queue
+	Domain    string
+	PublicURL string
+}
+
+// Server is the HTTP JSON API over stored mail. It is described by the
+// OpenAPI document served at /api/openapi.json.
+type Server struct {
+	opts       Options
+	listener   net.Listener
+	httpServer *http.Server
+	done       chan struct{}
+
+	// closing ends push streams when shutdown starts; streams tracks the
+	// WebSocket connections, which http.Server stops tracking once they
+	// are hijacked.
+	closing chan struct{}
+	streams sync.WaitGroup
+
+	generated         *limiter.RequestLimiter
+	forwardsByMailbox *limiter.RequestLimiter
+	forwardsByTarget  *limiter.RequestLimiter
+}
+
+func NewServer(opts Options) *Server {
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if opts.Heartbeat <= 0 {
+		opts.Heartbeat = 15 * time.Second
+	}
+	if opts.GenerateLimit <= 0 {
+		opts.GenerateLimit = 10
+	}
+
+	opts.PublicURL = strings.TrimSuffix(opts.PublicURL, "/")
+
+	s := &Server{
+		opts:              opts,
+		closing:           make(chan struct{}),
+		generated:         limiter.NewRequestLimiter(opts.GenerateLimit, time.Hour),
+		forwardsByMailbox: limiter.NewRequestLimiter(forwardsPerMailbox, time.Hour),
+		forwardsByTarget:  limiter.NewRequestLimiter(forwardsPerTarget, time.Hour),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/openapi.json", s.handleOpenAPI)
+	mux.HandleFunc("GET /api/v1/mailboxes/{address}/messages", s.mailbox(s.handleListMessages))
+	mux.HandleFunc("GET /api/v1/mailboxes/{address}/messages/{id}", s.mailbox(s.handleGetMessage))
+	mux.HandleFunc("GET /api/v1/mailboxes/{address}/messages/{id}/raw", s.mailbox(s.handleGetRawMessage))
+	mux.HandleFunc("GET /api/v1/mailboxes/{address}/messages/{id}/attachments/{index}", s.mailbox(s.handleGetAttachment))
+	mux.HandleFunc("DELETE /api/v1/mailboxes/{address}/messages/{id}", s.mailbox(s.handleDeleteMessage))
+	mux.HandleFunc("GET /api/v1/mailboxes/{address}/stats", s.mailbox(s.handleStats))
+	mux.HandleFunc("GET /api/v1/mailboxes/{address}/events", s.mailbox(s.handleEventStream))
+	mux.HandleFunc("GET /api/v1/mailboxes/{address}/ws", s.mailbox(s.handleWebSocket))
+	if opts.Tokens != nil {
+		mux.HandleFunc("GET /api/v1/mailboxes/{address}/tokens", s.mailbox(s.handleListTokens))
+		mux.HandleFunc("POST /api/v1/mailboxes/{address}/tokens/rotate", s.mailbox(s.handleRotateToken))
+		mux.HandleFunc("DELETE /api/v1/mailboxes/{address}/tokens", s.mailbox(s.handleRevokeTokens))
+		mux.HandleFunc("DELETE /api/v1/mailboxes/{address}/tokens/{id}", s.mailbox(s.handleRevokeToken))
+	}
+	if opts.Outbound != nil {
+		mux.HandleFunc("GET /api/v1/mailboxes/{address}/forwards", s.mailbox(s.handleListForwards))
+		mux.HandleFunc("POST /api/v1/mailboxes/{address}/forwards", s.mailbox(s.handleCreateForward))
+		mux.HandleFunc("DELETE /api/v1/mailboxes/{address}/forwards/{id}", s.mailbox(s.handleDeleteForward))
+		mux.HandleFunc("GET /api/v1/forwards/confirm", s.handleConfirmForwardPage)
+		mux.HandleFunc("POST /api/v1/forwards/confirm", s.handleConfirmForward)
+	}
+	if opts.Registry != nil {
+		mux.HandleFunc("POST /api/v1/addresses", s.handleCreateAddress)
+		mux.HandleFunc("GET /api/v1/addresses/{address}", s.mailbox(s.handleGetAddress))
+		mux.HandleFunc("POST /api/v1/addresses/{address}/extend", s.mailbox(s.handleExtendAddress))
+		mux.HandleFunc("DELETE /api/v1/addresses/{address}", s.mailbox(s.handleReleaseAddress))
+	}
+
+	s.httpServer = &http.Server{
+		Handler:           s.logRequests(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		ErrorLog:          slog.NewLogLogger(opts.Logger.Handler(), slog.LevelWarn),
+	}
+	s.httpServer.RegisterOnShutdown(func() { close(s.closing) })
+	return s
+}
+
+func (s *Server) Start() error {
+	addr := fmt.Sprintf("%s:%s", s.opts.Host, s.opts.Port)
+
+	var err error
+	s.listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start API server: %w", err)
+	}
+
+	s.opts.Logger.Info("API server started", "host", s.opts.Host, "port", s.opts.Port)
+
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		if err := s.httpServer.Serve(s.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.opts.Logger.Error("API server failed", "error", err)
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops accepting requests, ends push streams and waits for requests
+// in flight, closing whatever is still open when ctx ends.
+func (s *Server) Stop(ctx context.Context) error {
+	err := s.httpServer.Shutdown(ctx)
+	if err != nil {
+		s.httpServer.Close()
+	}
+	if s.done != nil {
+		<-s.done
+	}
+	// Push loops exit as soon as closing is closed, so this wait is short.
+	s.streams.Wait()
+	return err
+}
+
+type mailboxHandler func(w http.ResponseWriter, r *http.Request, mailbox string)
+
+// mailbox resolves the address path segment to the form mail is stored
+// under and checks the request's token for it before calling next.
+func (s *Server) mailbox(next mailboxHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addr, err := message.ParseAddress(r.PathValue("address"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid mailbox address")
+			return
+		}
+		mailbox := addr.String()
+
+		if s.opts.Auth != nil {
+			ok, err := s.opts.Auth.Verify(r.Context(), mailbox, requestToken(r))
+			if err != nil {
+				s.opts.Logger.Error("API authentication check failed", "error", err, "mailbox", mailbox)
+				writeError(w, http.StatusServiceUnavailable, "authentication unavailable")
+				return
+			}
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="nanomail"`)
+				writeError(w, http.StatusUnauthorized, "invalid or missing mailbox token")
+				return
+			}
+		}
+
+		next(w, r, mailbox)
+	}
+}
+
+// isAdmin reports whether the request bears the admin token.
+func (s *Server) isAdmin(r *http.Request) bool {
+	token := requestToken(r)
+	return s.opts.AdminToken != "" && token != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.AdminToken)) == 1
+}
+
+// clientIP is the address the request came from, without its port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// allow counts a request against lim for key, replying 429 with msg when
+// it is over the limit.
+func allow(w http.ResponseWriter, lim *limiter.RequestLimiter, key, msg string) bool {
+	ok, wait := lim.Allow(key)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, msg)
+	}
+	return ok
+}
+
+// requestToken takes the token from a bearer Authorization header, or from
+// the token query parameter so that attachment links work in a browser.
+func requestToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return r.URL.Query().Get("token")
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		s.opts.Logger.Info("API request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration", time.Since(start),
+			"client", r.RemoteAddr)
+	})
+}
+
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, errorResponse{Error: message})
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/database"
+	"github.com/zeusnotfound04/nano-mail/internal/events"
+)
+
+// stream is a live subscription for one mailbox. Events on the bus only
+// say that new mail may be there; the stream reads it back from storage past
+// the commit sequence number it last sent. Those numbers follow commit
+// order, so once one is visible every smaller one is too, and nothing is
+// skipped however the events themselves are ordered.
+type stream struct {
+	sub     *events.Subscription
+	db      *sql.DB
+	mailbox string
+	// cursor is the commit sequence number of the last message sent.
+	cursor int64
+	// backlog is the stored mail the client missed before it connected.
+	backlog []events.MailStored
+}
+
+// openStream resumes after lastEventID, or starts from the mail stored now
+// when it is zero. The starting point is read before subscribing, so mail
+// stored in between is picked up on the next event rather than lost.
+func (s *Server) openStream(ctx context.Context, mailbox string, lastEventID int64) (*stream, error) {
+	st := &stream{db: s.opts.DB, mailbox: mailbox, cursor: lastEventID}
+	if lastEventID <= 0 {
+		latest, err := database.LatestCommitSeq(ctx, s.opts.DB)
+		if err != nil {
+			return nil, err
+		}
+		st.cursor = latest
+	}
+
+	st.sub = s.opts.Events.Subscribe(mailbox)
+	if lastEventID <= 0 {
+		return st, nil
+	}
+
+	backlog, err := st.catchUp(ctx)
+	if err != nil {
+		st.sub.Close()
+		return nil, err
+	}
+	st.backlog = backlog
+	return st, nil
+}
+
+// catchUp returns the mailbox's mail committed after the cursor and moves
+// the cursor past it. Events already queued are dropped first, as this one
+// read covers them.
+func (st *stream) catchUp(ctx context.Context) ([]events.MailStored, error) {
+	for drained := false; !drained; {
+		select {
+		case <-st.sub.Events():
+		default:
+			drained = true
+		}
+	}
+
+	messages, err := database.ListMailbox(ctx, st.db, st.mailbox, database.ListOptions{
+		Cursor:      st.cursor,
+		OldestFirst: true,
+		CommitOrder: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mail := make([]events.MailStored, 0, len(messages))
+	for _, m := range messages {
+		mail = append(mail, events.MailStored{
+			ID:         m.ID,
+			Seq:        m.Seq,
+			Sender:     m.Sender,
+			Recipients: m.Recipients,
+			Subject:    m.Subject,
+			Size:       m.Size,
+			ReceivedAt: m.CreatedAt,
+		})
+		st.cursor = m.Seq
+	}
+	return mail, nil
+}
+
+// lastEventID reads the resume point from the Last-Event-ID header that
+// EventSource sends on reconnect, or from the last_event_id parameter.
+func lastEventID(r *http.Request) (int64, error) {
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = r.URL.Query().Get("last_event_id")
+	}
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+func (s *Server) handleEventStream(w http.ResponseWriter, r *http.Request, mailbox string) {
+	if s.opts.Events == nil {
+		writeError(w, http.StatusNotFound, "push notifications are not enabled")
+		return
+	}
+	lastID, err := lastEventID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid last event id")
+		return
+	}
+
+	st, err := s.openStream(r.Context(), mailbox, lastID)
+	if err != nil {
+		s.storageError(w, "Failed to replay missed mail", err)
+		return
+	}
+	defer st.sub.Close()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", streamRetry.Milliseconds())
+	for _, e := range st.backlog {
+		if writeSSE(w, e) != nil {
+			return
+		}
+	}
+	if rc.Flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(s.opts.Heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.closing:
+			return
+		case <-st.sub.Lagged():
+			// Ending the stream makes the client reconnect with its
+			// Last-Event-ID and pick up what was dropped from storage.
+			return
+		case <-st.sub.Events():
+			mail, err := st.catchUp(r.Context())
+			if err != nil {
+				// The client reconnects and resumes from its last event.
+				s.opts.Logger.Error("Failed to read new mail for stream", "error", err)
+				return
+			}
+			for _, e := range mail {
+				if writeSSE(w, e) != nil {
+					return
+				}
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+// streamRetry is the reconnect delay suggested to EventSource clients.
+const streamRetry = 3 * time.Second
+
+func writeSSE(w http.ResponseWriter, e events.MailStored) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: mail\ndata: %s\n\n", e.Seq, data)
+	return err
+}
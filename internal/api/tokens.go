@@ -0,0 +1,86 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/database"
+)
+
+type tokenInfo struct {
+	ID        int64      `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+type tokenList struct {
+	Tokens []tokenInfo `json:"tokens"`
+}
+
+type issuedToken struct {
+	Token string `json:"token"`
+}
+
+func (s *Server) handleListTokens(w http.ResponseWriter, r *http.Request, mailbox string) {
+	tokens, err := database.ListInboxTokens(r.Context(), s.opts.DB, mailbox)
+	if err != nil {
+		s.storageError(w, "Failed to list tokens", err)
+		return
+	}
+
+	resp := tokenList{Tokens: make([]tokenInfo, 0, len(tokens))}
+	for _, t := range tokens {
+		info := tokenInfo{ID: t.ID, CreatedAt: t.CreatedAt}
+		if !t.RevokedAt.IsZero() {
+			info.RevokedAt = &t.RevokedAt
+		}
+		resp.Tokens = append(resp.Tokens, info)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleRotateToken replaces every token of the mailbox, including the one
+// the request was made with, by a new one.
+func (s *Server) handleRotateToken(w http.ResponseWriter, r *http.Request, mailbox string) {
+	token, err := s.opts.Tokens.Rotate(r.Context(), mailbox)
+	if err != nil {
+		s.storageError(w, "Failed to rotate token", err)
+		return
+	}
+	s.opts.Logger.Info("Mailbox token rotated", "mailbox", mailbox)
+	writeJSON(w, http.StatusOK, issuedToken{Token: token})
+}
+
+// handleRevokeTokens revokes every token of the mailbox, locking it until
+// one is issued by hand.
+func (s *Server) handleRevokeTokens(w http.ResponseWriter, r *http.Request, mailbox string) {
+	n, err := database.RevokeInboxTokens(r.Context(), s.opts.DB, mailbox)
+	if err != nil {
+		s.storageError(w, "Failed to revoke tokens", err)
+		return
+	}
+	s.opts.Logger.Info("Mailbox tokens revoked", "mailbox", mailbox, "revoked", n)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleRevokeToken(w http.ResponseWriter, r *http.Request, mailbox string) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id < 1 {
+		writeError(w, http.StatusBadRequest, "invalid token id")
+		return
+	}
+
+	err = database.RevokeInboxToken(r.Context(), s.opts.DB, mailbox, id)
+	if errors.Is(err, database.ErrTokenNotFound) {
+		writeError(w, http.StatusNotFound, "token not found")
+		return
+	}
+	if err != nil {
+		s.storageError(w, "Failed to revoke token", err)
+		return
+	}
+	s.opts.Logger.Info("Mailbox token revoked", "mailbox", mailbox, "token_id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,311 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/internal/events"
+)
+
+// websocketGUID is the fixed key suffix from RFC 6455 section 1.3.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxFramePayload bounds client frames. Clients have nothing to send but
+// control frames, so anything large is a misbehaving peer.
+const maxFramePayload = 64 * 1024
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+const (
+	closeNormal    = 1000
+	closeGoingAway = 1001
+	closeProtocol  = 1002
+	closeTooBig    = 1009
+	closeTryAgain  = 1013
+)
+
+var errFrameTooBig = errors.New("websocket frame too large")
+
+// wsMessage is the JSON sent for each event. It carries the same id, event
+// name and data as the SSE stream.
+type wsMessage struct {
+	ID    int64             `json:"id"`
+	Event string            `json:"event"`
+	Data  events.MailStored `json:"data"`
+}
+
+// wsConn is a server-side WebSocket connection. Writes come from both the
+// event loop and the reader answering pings, so they are serialized.
+type wsConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	mu     sync.Mutex
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	header := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *wsConn) writeClose(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return c.writeFrame(opClose, append(payload, reason...))
+}
+
+// readFrame reads one client frame and unmasks it.
+func (c *wsConn) readFrame() (op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+		return 0, nil, err
+	}
+	fin := head[0]&0x80 != 0
+	op = head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if !masked {
+		return 0, nil, fmt.Errorf("unmasked client frame")
+	}
+	if length > maxFramePayload || (op >= opClose && (length > 125 || !fin)) {
+		return 0, nil, errFrameTooBig
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return op, payload, nil
+}
+
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request, mailbox string) {
+	if s.opts.Events == nil {
+		writeError(w, http.StatusNotFound, "push notifications are not enabled")
+		return
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerContainsToken(r.Header, "Connection", "upgrade") ||
+		!headerContainsToken(r.Header, "Upgrade", "websocket") || key == "" {
+		writeError(w, http.StatusBadRequest, "websocket upgrade required")
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeError(w, http.StatusUpgradeRequired, "unsupported websocket version")
+		return
+	}
+
+	lastID, err := lastEventID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid last event id")
+		return
+	}
+
+	st, err := s.openStream(r.Context(), mailbox, lastID)
+	if err != nil {
+		s.storageError(w, "Failed to replay missed mail", err)
+		return
+	}
+	defer st.sub.Close()
+
+	// Registering before the hijack, while http.Server still counts this
+	// request as active, orders it before Stop's wait on streams.
+	s.streams.Add(1)
+	defer s.streams.Done()
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		s.opts.Logger.Error("Failed to take over websocket connection", "error", err)
+		writeError(w, http.StatusInternalServerError, "websocket unavailable")
+		return
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Time{})
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", websocketAccept(key))
+	if err := brw.Flush(); err != nil {
+		return
+	}
+
+	ws := &wsConn{conn: conn, reader: brw.Reader}
+	s.serveWebSocket(ws, st)
+}
+
+// serveWebSocket pushes events until the client goes away, falls behind or
+// the server shuts down. Pings go out every heartbeat; a client that sends
+// nothing, not even a pong, for three heartbeats is dropped.
+func (s *Server) serveWebSocket(ws *wsConn, st *stream) {
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		s.readWebSocket(ws)
+	}()
+
+	send := func(e events.MailStored) error {
+		data, err := json.Marshal(wsMessage{ID: e.Seq, Event: "mail", Data: e})
+		if err != nil {
+			return err
+		}
+		return ws.writeFrame(opText, data)
+	}
+
+	for _, e := range st.backlog {
+		if send(e) != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(s.opts.Heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-readerDone:
+			return
+		case <-s.closing:
+			ws.writeClose(closeGoingAway, "server shutting down")
+			return
+		case <-st.sub.Lagged():
+			ws.writeClose(closeTryAgain, "fell behind, reconnect with last_event_id")
+			return
+		case <-st.sub.Events():
+			// Bounded, as nothing else limits a storage read here.
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			mail, err := st.catchUp(ctx)
+			cancel()
+			if err != nil {
+				s.opts.Logger.Error("Failed to read new mail for stream", "error", err)
+				ws.writeClose(closeTryAgain, "storage unavailable, reconnect with last_event_id")
+				return
+			}
+			for _, e := range mail {
+				if send(e) != nil {
+					return
+				}
+			}
+		case <-heartbeat.C:
+			if ws.writeFrame(opPing, nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) readWebSocket(ws *wsConn) {
+	for {
+		ws.conn.SetReadDeadline(time.Now().Add(3 * s.opts.Heartbeat))
+
+		op, payload, err := ws.readFrame()
+		if err != nil {
+			switch {
+			case errors.Is(err, errFrameTooBig):
+				ws.writeClose(closeTooBig, "frame too large")
+			case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed):
+			default:
+				var netErr net.Error
+				if !errors.As(err, &netErr) {
+					ws.writeClose(closeProtocol, "protocol error")
+				}
+			}
+			return
+		}
+
+		switch op {
+		case opPing:
+			if ws.writeFrame(opPong, payload) != nil {
+				return
+			}
+		case opClose:
+			code := closeNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			ws.writeClose(code, "")
+			return
+		case opPong, opText, opBinary, opContinuation:
+			// Nothing is expected from the client; data frames are
+			// read and dropped.
+		default:
+			ws.writeClose(closeProtocol, "unknown opcode")
+			return
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+
+	"github.com/zeusnotfound04/nano-mail/database"
+)
+
+// Authenticator checks the credentials presented for reading a mailbox.
+type Authenticator interface {
+	// Verify reports whether token grants access to mailbox.
+	Verify(ctx context.Context, mailbox, token string) (bool, error)
+}
+
+// Issuer is implemented by authenticators that can hand out a mailbox's
+// token, so that provisioning an address can return it.
+type Issuer interface {
+	Issue(ctx context.Context, mailbox string) (string, error)
+}
+
+// tokenBytes is the entropy of an issued token, enough that tokens cannot
+// be guessed and a fast hash is safe to store them under.
+const tokenBytes = 32
+
+// StoredTokens issues random per-mailbox tokens and keeps only their
+// SHA-256 hashes, so a database dump does not grant access. A token is bound
+// to the exact mailbox string it was issued for, and a mailbox may hold
+// several until they are revoked.
+type StoredTokens struct {
+	db *sql.DB
+}
+
+func NewStoredTokens(db *sql.DB) *StoredTokens {
+	return &StoredTokens{db: db}
+}
+
+// HashToken is the form a token is stored and looked up under.
+func HashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+func newToken() (string, error) {
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (t *StoredTokens) Verify(ctx context.Context, mailbox, token string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+	return database.InboxTokenValid(ctx, t.db, mailbox, HashToken(token))
+}
+
+// Issue adds a token for mailbox alongside any it already has.
+func (t *StoredTokens) Issue(ctx context.Context, mailbox string) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	if _, err := database.CreateInboxToken(ctx, t.db, mailbox, HashToken(token)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Rotate replaces all of mailbox's tokens with a new one.
+func (t *StoredTokens) Rotate(ctx context.Context, mailbox string) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	if _, err := database.RotateInboxToken(ctx, t.db, mailbox, HashToken(token)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
@@ -7,6 +7,12 @@ import (
 	"github.com/zeusnotfound04/nano-mail/internal/limiter"
 )
 
+// MailboxLimits caps a single mailbox. A zero field is unlimited.
+type MailboxLimits struct {
+	MaxMessages int64
+	MaxBytes    int64
+}
+
 type Config struct {
 	Host              string
 	Port              string
@@ -22,6 +28,98 @@ type Config struct {
 	Logger            *slog.Logger
 	ConnectionPerIP   int
 	ConnectionLimiter map[string]limiter.ConnectionLimiter
+
+	QueueBatchSize int
+	QueueBatchWait time.Duration
+
+	SpoolDir            string
+	SpoolReplayInterval time.Duration
+
+	// DeadLetterDir defaults to a "deadletter" directory inside SpoolDir.
+	DeadLetterDir           string
+	DeadLetterRetryInterval time.Duration
+	DeadLetterMaxAttempts   int
+	DeadLetterMinBackoff    time.Duration
+	DeadLetterMaxBackoff    time.Duration
+
+	// Admission thresholds: past either one, RCPT and end-of-data get
+	// temporary 451/452 failures instead of accepting more mail.
+	AdmissionQueueHighWater  float64
+	AdmissionMaxStoreLatency time.Duration
+
+	// MailboxQuotaDomains overrides MailboxQuota for mailboxes under a
+	// domain, keyed by lower-case domain. With MailboxQuotaEvictOldest, a
+	// full mailbox drops its oldest mail when a new message is stored
+	// instead of refusing the recipient.
+	MailboxQuota            MailboxLimits
+	MailboxQuotaDomains     map[string]MailboxLimits
+	MailboxQuotaEvictOldest bool
+
+	RetentionEnabled   bool
+	RetentionTTL       time.Duration
+	RetentionDomainTTL map[string]time.Duration
+	// RetentionDeletedGrace is how long soft-deleted mail is kept before
+	// the janitor removes it.
+	RetentionDeletedGrace time.Duration
+	RetentionInterval     time.Duration
+	RetentionBatchSize    int
+
+	// POP3Port, IMAPPort and APIPort enable those listeners when set.
+	// Each requires a mailbox's stored access token, issued when the
+	// address is provisioned or with the inboxtoken command.
+	POP3Port string
+	IMAPPort string
+	APIPort  string
+	// APIPublicURL is the API's base URL as mail recipients reach it, used
+	// in the links that confirm forwarding rules.
+	APIPublicURL string
+	// PushHeartbeat is the keepalive interval on SSE and WebSocket streams.
+	PushHeartbeat time.Duration
+
+	WebhooksEnabled    bool
+	WebhookTimeout     time.Duration
+	WebhookMaxAttempts int
+	// WebhookDisableAfter disables an endpoint after this many consecutive
+	// failed attempts; it stays off until re-enabled by hand.
+	WebhookDisableAfter int
+
+	// AddressMode decides whether RCPT TO consults the address registry:
+	// "open", "strict" or "catchall". Expired addresses and their mail are
+	// purged by the retention janitor in every mode.
+	AddressMode string
+	// AddressDefaultTTL is the lifetime of addresses provisioned without
+	// one, and of those registered by catch-all delivery; zero never
+	// expires. AddressMaxTTL caps requested lifetimes and extensions.
+	AddressDefaultTTL time.Duration
+	AddressMaxTTL     time.Duration
+	// AddressAdminToken lets API callers bearing it register an address of
+	// their choosing; without it the API only generates random addresses.
+	// AddressGenerateLimit caps how many each other client may generate an
+	// hour.
+	AddressAdminToken    string
+	AddressGenerateLimit int
+
+	// ForwardingEnabled runs the outbound queue, which delivers copies of
+	// mail to the addresses' forwarding targets once they have confirmed
+	// they want it. It is off by default, as it sends mail to other hosts.
+	ForwardingEnabled   bool
+	OutboundConcurrency int
+	OutboundPerDomain   int
+	OutboundTimeout     time.Duration
+	// OutboundMaxAge is how long undelivered mail is retried.
+	OutboundMaxAge time.Duration
+	// OutboundRelayHost, as host or host:port, receives all forwarded mail
+	// instead of the recipients' MX hosts. OutboundPort is the remote port
+	// for servers given without one.
+	OutboundRelayHost string
+	OutboundPort      string
+
+	// SRSSecret keys the Sender Rewriting Scheme applied to forwarded mail,
+	// and must be the same on every instance receiving mail for Domain.
+	// Forwarding refuses to start without it. SRSMaxAge is how long bounces
+	// to rewritten senders are routed back.
+	SRSSecret string
+	SRSMaxAge time.Duration
 }
 
 func DefaultConfig() *Config {
@@ -37,5 +135,51 @@ func DefaultConfig() *Config {
 		EnableCompression: true,
 		Logger:            slog.Default(),
 		ConnectionPerIP:   10,
+
+		QueueBatchSize: 50,
+		QueueBatchWait: 50 * time.Millisecond,
+
+		SpoolReplayInterval: 30 * time.Second,
+
+		DeadLetterRetryInterval: time.Minute,
+		DeadLetterMaxAttempts:   10,
+		DeadLetterMinBackoff:    time.Minute,
+		DeadLetterMaxBackoff:    6 * time.Hour,
+
+		AdmissionQueueHighWater:  0.8,
+		AdmissionMaxStoreLatency: 5 * time.Second,
+
+		MailboxQuota: MailboxLimits{
+			MaxMessages: 1000,
+			MaxBytes:    100 * 1024 * 1024,
+		},
+
+		RetentionEnabled:      true,
+		RetentionTTL:          7 * 24 * time.Hour,
+		RetentionDeletedGrace: 24 * time.Hour,
+		RetentionInterval:     time.Hour,
+		RetentionBatchSize:    1000,
+
+		PushHeartbeat: 15 * time.Second,
+
+		WebhooksEnabled:     true,
+		WebhookTimeout:      10 * time.Second,
+		WebhookMaxAttempts:  10,
+		WebhookDisableAfter: 20,
+
+		AddressMode:       "open",
+		AddressDefaultTTL: 24 * time.Hour,
+		AddressMaxTTL:     30 * 24 * time.Hour,
+
+		AddressGenerateLimit: 10,
+
+		ForwardingEnabled:   false,
+		OutboundConcurrency: 8,
+		OutboundPerDomain:   2,
+		OutboundTimeout:     5 * time.Minute,
+		OutboundMaxAge:      5 * 24 * time.Hour,
+		OutboundPort:        "25",
+
+		SRSMaxAge: 21 * 24 * time.Hour,
 	}
 }
@@ -0,0 +1,153 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// subscriptionBuffer is how many events a subscriber may fall behind before
+// it is cut off as lagging.
+const subscriptionBuffer = 64
+
+// MailStored announces a message that has been committed to storage. Seq is
+// its commit sequence number, which is the event id clients resume from:
+// unlike the storage id, it increases in the order messages are committed.
+type MailStored struct {
+	ID         int64     `json:"id"`
+	Seq        int64     `json:"seq"`
+	Sender     string    `json:"from"`
+	Recipients []string  `json:"to"`
+	Subject    string    `json:"subject"`
+	Size       int64     `json:"size"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// Bus fans stored-mail events out to subscribers by recipient mailbox.
+// Publishing never blocks: a subscriber that stops reading is marked lagged
+// and should resubscribe, catching up from storage.
+type Bus struct {
+	mu   sync.RWMutex
+	subs map[string]map[*Subscription]struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[string]map[*Subscription]struct{})}
+}
+
+type Subscription struct {
+	bus     *Bus
+	mailbox string
+
+	events    chan MailStored
+	lagged    chan struct{}
+	lagOnce   sync.Once
+	unsubOnce sync.Once
+}
+
+// Subscribe starts delivering events for mail addressed to mailbox. The
+// caller must Close the subscription when done with it.
+func (b *Bus) Subscribe(mailbox string) *Subscription {
+	sub := &Subscription{
+		bus:     b,
+		mailbox: mailbox,
+		events:  make(chan MailStored, subscriptionBuffer),
+		lagged:  make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	if b.subs[mailbox] == nil {
+		b.subs[mailbox] = make(map[*Subscription]struct{})
+	}
+	b.subs[mailbox][sub] = struct{}{}
+	b.mu.Unlock()
+
+	return sub
+}
+
+// Publish delivers e to the subscribers of each of its recipients.
+func (b *Bus) Publish(e MailStored) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	seen := make(map[string]bool, len(e.Recipients))
+	for _, rcpt := range e.Recipients {
+		if seen[rcpt] {
+			continue
+		}
+		seen[rcpt] = true
+
+		for sub := range b.subs[rcpt] {
+			select {
+			case sub.events <- e:
+			default:
+				sub.lagOnce.Do(func() { close(sub.lagged) })
+			}
+		}
+	}
+}
+
+// HasSubscribers reports whether any of mailboxes is currently subscribed
+// to, so callers can skip work for events nobody would receive.
+func (b *Bus) HasSubscribers(mailboxes []string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, mailbox := range mailboxes {
+		if len(b.subs[mailbox]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Lag marks the subscriptions of mailboxes lagged, for when their events
+// may have been missed.
+func (b *Bus) Lag(mailboxes []string) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, mailbox := range mailboxes {
+		for sub := range b.subs[mailbox] {
+			sub.lagOnce.Do(func() { close(sub.lagged) })
+		}
+	}
+}
+
+// LagAll marks every subscription lagged. It is for when events may have
+// been missed without knowing whose, so every subscriber resumes from
+// storage.
+func (b *Bus) LagAll() {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, subs := range b.subs {
+		for sub := range subs {
+			sub.lagOnce.Do(func() { close(sub.lagged) })
+		}
+	}
+}
+
+// Events delivers events in publish order.
+func (s *Subscription) Events() <-chan MailStored {
+	return s.events
+}
+
+// Lagged is closed once an event had to be dropped because the subscriber
+// was not keeping up. The subscriber has missed mail at that point and
+// should close and resume from storage.
+func (s *Subscription) Lagged() <-chan struct{} {
+	return s.lagged
+}
+
+func (s *Subscription) Close() {
+	s.unsubOnce.Do(func() {
+		s.bus.mu.Lock()
+		defer s.bus.mu.Unlock()
+
+		subs := s.bus.subs[s.mailbox]
+		delete(subs, s)
+		if len(subs) == 0 {
+			delete(s.bus.subs, s.mailbox)
+		}
+	})
+}
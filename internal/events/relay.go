@@ -0,0 +1,171 @@
+package events
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/zeusnotfound04/nano-mail/database"
+)
+
+type RelayOptions struct {
+	// DSN opens the relay's dedicated LISTEN connection; DB is the shared
+	// pool used to look up announced messages.
+	DSN string
+	DB  *sql.DB
+	// Origin is this instance's id, as passed to StoreMailBatch. Its own
+	// notifications are skipped since it publishes those directly.
+	Origin string
+	Logger *slog.Logger
+
+	MinReconnect time.Duration
+	MaxReconnect time.Duration
+	// PingInterval is how often an idle connection is checked, so a
+	// silently dropped one is noticed and replaced.
+	PingInterval time.Duration
+}
+
+// Relay republishes mail stored by other instances sharing the database,
+// which they announce with NOTIFY, onto the local bus.
+type Relay struct {
+	bus      *Bus
+	opts     RelayOptions
+	listener *pq.Listener
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewRelay(bus *Bus, opts RelayOptions) *Relay {
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if opts.MinReconnect <= 0 {
+		opts.MinReconnect = time.Second
+	}
+	if opts.MaxReconnect < opts.MinReconnect {
+		opts.MaxReconnect = time.Minute
+	}
+	if opts.PingInterval <= 0 {
+		opts.PingInterval = 90 * time.Second
+	}
+
+	return &Relay{
+		bus:  bus,
+		opts: opts,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// Start begins listening in the background. The connection is made, and
+// remade after it drops, with backoff, so Start does not wait for the
+// database.
+func (r *Relay) Start() {
+	r.listener = pq.NewListener(r.opts.DSN, r.opts.MinReconnect, r.opts.MaxReconnect, r.logEvent)
+	go r.run()
+}
+
+func (r *Relay) Stop() {
+	close(r.stop)
+	r.listener.Close()
+	<-r.done
+}
+
+func (r *Relay) logEvent(event pq.ListenerEventType, err error) {
+	switch event {
+	case pq.ListenerEventConnected:
+		r.opts.Logger.Info("Listening for mail stored by other instances", "channel", database.MailChannel)
+	case pq.ListenerEventDisconnected:
+		r.opts.Logger.Warn("Lost mail notification connection", "error", err)
+	case pq.ListenerEventReconnected:
+		r.opts.Logger.Info("Mail notification connection restored")
+	case pq.ListenerEventConnectionAttemptFailed:
+		r.opts.Logger.Debug("Mail notification connection attempt failed", "error", err)
+	}
+}
+
+func (r *Relay) run() {
+	defer close(r.done)
+
+	// Listen blocks until the first connection is made, or Stop closes the
+	// listener.
+	if err := r.listener.Listen(database.MailChannel); err != nil {
+		select {
+		case <-r.stop:
+		default:
+			r.opts.Logger.Error("Failed to listen for mail notifications", "error", err)
+		}
+		return
+	}
+
+	ping := time.NewTicker(r.opts.PingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case n, ok := <-r.listener.Notify:
+			if !ok {
+				return
+			}
+			if n == nil {
+				// The connection was remade; anything sent while it was
+				// down is gone, so every subscriber resumes from storage.
+				r.bus.LagAll()
+				continue
+			}
+			r.relay(n.Extra)
+		case <-ping.C:
+			// A failed ping makes the listener reconnect.
+			r.listener.Ping()
+		}
+	}
+}
+
+func (r *Relay) relay(payload string) {
+	var n database.MailNotification
+	if err := json.Unmarshal([]byte(payload), &n); err != nil {
+		r.opts.Logger.Warn("Ignoring malformed mail notification", "error", err)
+		return
+	}
+	if n.Origin != "" && n.Origin == r.opts.Origin {
+		return
+	}
+	if len(n.Recipients) > 0 && !r.bus.HasSubscribers(n.Recipients) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	m, err := database.GetMessageSummary(ctx, r.opts.DB, n.ID)
+	if errors.Is(err, database.ErrMessageNotFound) {
+		return
+	}
+	if err != nil {
+		// Subscribers of this message can no longer trust their stream.
+		r.opts.Logger.Error("Failed to load announced mail", "error", err, "id", n.ID)
+		if len(n.Recipients) > 0 {
+			r.bus.Lag(n.Recipients)
+		} else {
+			r.bus.LagAll()
+		}
+		return
+	}
+
+	r.bus.Publish(MailStored{
+		ID:         m.ID,
+		Seq:        m.Seq,
+		Sender:     m.Sender,
+		Recipients: m.Recipients,
+		Subject:    m.Subject,
+		Size:       m.Size,
+		ReceivedAt: m.CreatedAt,
+	})
+}
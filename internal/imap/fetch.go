@@ -0,0 +1,476 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/zeusnotfound04/nano-mail/database"
+	"github.com/zeusnotfound04/nano-mail/pkg/message"
+)
+
+const internalDateLayout = "02-Jan-2006 15:04:05 -0700"
+
+// fetchItem is one data item of a FETCH request.
+type fetchItem struct {
+	name    string
+	section *section
+	// partial is the <origin.count> suffix of a body section, with count
+	// -1 when absent.
+	origin, count int64
+}
+
+type section struct {
+	path      []int
+	specifier string
+	fields    []string
+}
+
+func (sec *section) String() string {
+	var parts []string
+	for _, n := range sec.path {
+		parts = append(parts, strconv.Itoa(n))
+	}
+	if sec.specifier != "" {
+		parts = append(parts, sec.specifier)
+	}
+	s := strings.Join(parts, ".")
+	if sec.fields != nil {
+		s += " (" + strings.Join(sec.fields, " ") + ")"
+	}
+	return s
+}
+
+// loaded is a message body fetched from storage for FETCH or SEARCH.
+type loaded struct {
+	raw  []byte
+	root *message.Part
+}
+
+// selected returns the indexes of the messages a sequence set names,
+// interpreting it as UIDs when uid is set.
+func (s *session) selected(set seqSet, uid bool) []int {
+	var indexes []int
+	if uid {
+		var max int64
+		if len(s.messages) > 0 {
+			max = s.messages[len(s.messages)-1].Seq
+		}
+		for i, m := range s.messages {
+			if set.contains(m.Seq, max) {
+				indexes = append(indexes, i)
+			}
+		}
+		return indexes
+	}
+
+	max := int64(len(s.messages))
+	for i := range s.messages {
+		if set.contains(int64(i+1), max) {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// load fetches the body of the message at index i. A nil result with no
+// error means the message has been removed since it was listed.
+func (s *session) load(i int) (*loaded, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, storageTimeout)
+	defer cancel()
+
+	msg, err := database.GetMailboxMessage(ctx, s.server.opts.DB, s.mailbox, s.messages[i].ID)
+	if errors.Is(err, database.ErrMessageNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	raw := normalizeCRLF(msg.Body)
+	return &loaded{raw: raw, root: message.ParseStructure(raw)}, nil
+}
+
+// normalizeCRLF turns bare LF line endings into CRLF, which IMAP requires
+// in everything it serves.
+func normalizeCRLF(body string) []byte {
+	out := make([]byte, 0, len(body)+len(body)/32)
+	for i := 0; i < len(body); i++ {
+		if body[i] == '\n' && (i == 0 || body[i-1] != '\r') {
+			out = append(out, '\r')
+		}
+		out = append(out, body[i])
+	}
+	return out
+}
+
+func (s *session) handleFetch(tag string, uid bool, p *parser) error {
+	if p.space() != nil {
+		return errSyntax
+	}
+	setArg, err := p.atom()
+	if err != nil {
+		return errSyntax
+	}
+	set, err := parseSeqSet(setArg)
+	if err != nil {
+		return err
+	}
+	if p.space() != nil {
+		return errSyntax
+	}
+	items, err := parseFetchItems(p)
+	if err != nil {
+		return err
+	}
+	if uid {
+		items = append([]fetchItem{{name: "UID"}}, items...)
+	}
+
+	// The mailbox is read-only, so serving a body never sets \Seen.
+	needBody := false
+	for _, item := range items {
+		switch item.name {
+		case "FLAGS", "UID", "INTERNALDATE", "RFC822.SIZE":
+		default:
+			needBody = true
+		}
+	}
+
+	for _, i := range s.selected(set, uid) {
+		var msg *loaded
+		if needBody {
+			msg, err = s.load(i)
+			if err != nil {
+				s.logger().Error("Failed to load IMAP message", "error", err, "id", s.messages[i].ID)
+				s.no(tag, "[UNAVAILABLE] Unable to read message")
+				return nil
+			}
+			if msg == nil {
+				continue
+			}
+		}
+
+		var out bytes.Buffer
+		fmt.Fprintf(&out, "* %d FETCH (", i+1)
+		for n, item := range items {
+			if n > 0 {
+				out.WriteByte(' ')
+			}
+			s.writeFetchItem(&out, i, msg, item)
+		}
+		out.WriteString(")\r\n")
+
+		if _, err := s.writer.Write(out.Bytes()); err != nil {
+			return nil
+		}
+	}
+	s.writer.Flush()
+
+	s.ok(tag, "FETCH completed")
+	return nil
+}
+
+func (s *session) flags(i int) string {
+	var flags []string
+	if s.messages[i].Read {
+		flags = append(flags, `\Seen`)
+	}
+	if s.messages[i].Starred {
+		flags = append(flags, `\Flagged`)
+	}
+	return "(" + strings.Join(flags, " ") + ")"
+}
+
+func (s *session) writeFetchItem(out *bytes.Buffer, i int, msg *loaded, item fetchItem) {
+	m := s.messages[i]
+
+	switch item.name {
+	case "UID":
+		fmt.Fprintf(out, "UID %d", m.Seq)
+	case "FLAGS":
+		out.WriteString("FLAGS " + s.flags(i))
+	case "INTERNALDATE":
+		out.WriteString("INTERNALDATE " + quote(m.CreatedAt.Format(internalDateLayout)))
+	case "RFC822.SIZE":
+		fmt.Fprintf(out, "RFC822.SIZE %d", m.Size)
+	case "ENVELOPE":
+		out.WriteString("ENVELOPE " + envelope(msg.root))
+	case "BODYSTRUCTURE":
+		out.WriteString("BODYSTRUCTURE " + bodyStructure(msg.root, true))
+	case "RFC822":
+		out.WriteString("RFC822 " + literal(msg.raw))
+	case "RFC822.HEADER":
+		out.WriteString("RFC822.HEADER " + literal(msg.root.RawHeader))
+	case "RFC822.TEXT":
+		out.WriteString("RFC822.TEXT " + literal(msg.root.Body))
+	case "BODY", "BODY.PEEK":
+		if item.section == nil {
+			out.WriteString("BODY " + bodyStructure(msg.root, false))
+			return
+		}
+
+		out.WriteString("BODY[" + item.section.String() + "]")
+		content, ok := sectionContent(msg, item.section)
+		if item.count >= 0 {
+			fmt.Fprintf(out, "<%d>", item.origin)
+			content = partial(content, item.origin, item.count)
+		}
+		out.WriteByte(' ')
+		if !ok {
+			out.WriteString("NIL")
+			return
+		}
+		out.WriteString(literal(content))
+	}
+}
+
+func partial(content []byte, origin, count int64) []byte {
+	if origin >= int64(len(content)) {
+		return nil
+	}
+	content = content[origin:]
+	if count < int64(len(content)) {
+		content = content[:count]
+	}
+	return content
+}
+
+// sectionContent resolves a body section, reporting false when it names a
+// part the message does not have.
+func sectionContent(msg *loaded, sec *section) ([]byte, bool) {
+	if len(sec.path) == 0 {
+		switch sec.specifier {
+		case "":
+			return msg.raw, true
+		case "TEXT":
+			return msg.root.Body, true
+		default:
+			return headerSection(msg.root.RawHeader, sec), true
+		}
+	}
+
+	part := findPart(msg.root, sec.path)
+	if part == nil {
+		return nil, false
+	}
+
+	switch sec.specifier {
+	case "":
+		return part.Body, true
+	case "MIME":
+		return part.RawHeader, true
+	}
+
+	// HEADER and TEXT of a numbered part address the message it carries.
+	if part.Message == nil {
+		return nil, false
+	}
+	if sec.specifier == "TEXT" {
+		return part.Message.Body, true
+	}
+	return headerSection(part.Message.RawHeader, sec), true
+}
+
+func headerSection(raw []byte, sec *section) []byte {
+	switch sec.specifier {
+	case "HEADER.FIELDS":
+		return filterHeader(raw, sec.fields, false)
+	case "HEADER.FIELDS.NOT":
+		return filterHeader(raw, sec.fields, true)
+	default:
+		return raw
+	}
+}
+
+// findPart follows an IMAP part number. The body of a non-multipart
+// message is its part 1, and numbering continues inside embedded messages.
+func findPart(root *message.Part, path []int) *message.Part {
+	cur := root
+	for depth, n := range path {
+		if depth > 0 && cur.Message != nil {
+			cur = cur.Message
+		}
+		if len(cur.Parts) > 0 {
+			if n < 1 || n > len(cur.Parts) {
+				return nil
+			}
+			cur = cur.Parts[n-1]
+			continue
+		}
+		if n != 1 {
+			return nil
+		}
+	}
+	return cur
+}
+
+// filterHeader keeps, or with exclude drops, the named header fields along
+// with their continuation lines.
+func filterHeader(raw []byte, fields []string, exclude bool) []byte {
+	want := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		want[strings.ToLower(f)] = true
+	}
+
+	var out bytes.Buffer
+	keep := false
+	for _, line := range bytes.SplitAfter(raw, []byte("\n")) {
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if len(trimmed) == 0 {
+			continue
+		}
+		if trimmed[0] != ' ' && trimmed[0] != '\t' {
+			name, _, _ := bytes.Cut(trimmed, []byte(":"))
+			keep = want[strings.ToLower(strings.TrimSpace(string(name)))] != exclude
+		}
+		if keep {
+			out.Write(trimmed)
+			out.WriteString("\r\n")
+		}
+	}
+	out.WriteString("\r\n")
+	return out.Bytes()
+}
+
+// parseFetchItems reads a single data item, a macro, or a parenthesized
+// list of items.
+func parseFetchItems(p *parser) ([]fetchItem, error) {
+	if p.peek() != '(' {
+		name := strings.ToUpper(peekWord(p))
+		switch name {
+		case "ALL", "FAST", "FULL":
+			p.pos += len(name)
+			items := []fetchItem{{name: "FLAGS"}, {name: "INTERNALDATE"}, {name: "RFC822.SIZE"}}
+			if name != "FAST" {
+				items = append(items, fetchItem{name: "ENVELOPE"})
+			}
+			if name == "FULL" {
+				items = append(items, fetchItem{name: "BODY"})
+			}
+			return items, nil
+		}
+	}
+
+	var items []fetchItem
+	err := p.list(true, func() error {
+		item, err := parseFetchItem(p)
+		items = append(items, item)
+		return err
+	})
+	return items, err
+}
+
+func peekWord(p *parser) string {
+	end := p.pos
+	for end < len(p.buf) && p.buf[end] != ' ' && p.buf[end] != ')' && p.buf[end] != '[' {
+		end++
+	}
+	return string(p.buf[p.pos:end])
+}
+
+func parseFetchItem(p *parser) (fetchItem, error) {
+	word := peekWord(p)
+	p.pos += len(word)
+	item := fetchItem{name: strings.ToUpper(word), count: -1}
+
+	switch item.name {
+	case "UID", "FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODYSTRUCTURE",
+		"RFC822", "RFC822.HEADER", "RFC822.TEXT":
+		return item, nil
+	case "BODY", "BODY.PEEK":
+	default:
+		return item, fmt.Errorf("unknown fetch item %q", word)
+	}
+
+	if p.peek() != '[' {
+		if item.name == "BODY.PEEK" {
+			return item, errSyntax
+		}
+		return item, nil
+	}
+
+	end := bytes.IndexByte(p.buf[p.pos:], ']')
+	if end < 0 {
+		return item, errSyntax
+	}
+	sec, err := parseSection(string(p.buf[p.pos+1 : p.pos+end]))
+	if err != nil {
+		return item, err
+	}
+	item.section = sec
+	p.pos += end + 1
+
+	if p.peek() == '<' {
+		end := bytes.IndexByte(p.buf[p.pos:], '>')
+		if end < 0 {
+			return item, errSyntax
+		}
+		originPart, countPart, ok := strings.Cut(string(p.buf[p.pos+1:p.pos+end]), ".")
+		origin, err1 := strconv.ParseInt(originPart, 10, 64)
+		count, err2 := strconv.ParseInt(countPart, 10, 64)
+		if !ok || err1 != nil || err2 != nil || origin < 0 || count < 0 {
+			return item, fmt.Errorf("invalid partial range")
+		}
+		item.origin, item.count = origin, count
+		p.pos += end + 1
+	}
+
+	return item, nil
+}
+
+func parseSection(s string) (*section, error) {
+	spec, fieldList, hasFields := strings.Cut(s, " ")
+	sec := &section{}
+
+	parts := strings.Split(spec, ".")
+	for len(parts) > 0 && parts[0] != "" {
+		n, err := strconv.Atoi(parts[0])
+		if err != nil {
+			break
+		}
+		if n < 1 {
+			return nil, fmt.Errorf("invalid part number %d", n)
+		}
+		sec.path = append(sec.path, n)
+		parts = parts[1:]
+	}
+	sec.specifier = strings.ToUpper(strings.Join(parts, "."))
+
+	switch sec.specifier {
+	case "", "HEADER", "TEXT":
+	case "MIME":
+		if len(sec.path) == 0 {
+			return nil, fmt.Errorf("MIME requires a part number")
+		}
+	case "HEADER.FIELDS", "HEADER.FIELDS.NOT":
+		if !hasFields {
+			return nil, fmt.Errorf("%s requires a field list", sec.specifier)
+		}
+		fieldList = strings.TrimSpace(fieldList)
+		if !strings.HasPrefix(fieldList, "(") || !strings.HasSuffix(fieldList, ")") {
+			return nil, errSyntax
+		}
+		sec.fields = []string{}
+		for _, f := range strings.Fields(fieldList[1 : len(fieldList)-1]) {
+			sec.fields = append(sec.fields, strings.ToUpper(strings.Trim(f, `"`)))
+		}
+		return sec, nil
+	default:
+		return nil, fmt.Errorf("unknown section %q", sec.specifier)
+	}
+
+	if hasFields {
+		return nil, errSyntax
+	}
+	return sec, nil
+}
+
+// handleStore refuses every STORE: the mailbox is always opened read-only.
+// The arguments are not parsed, as nothing would be done with them.
+func (s *session) handleStore(tag string) {
+	s.no(tag, "[READ-ONLY] Mailbox is read-only")
+}
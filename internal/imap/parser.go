@@ -0,0 +1,201 @@
+package imap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var errSyntax = errors.New("syntax error")
+
+// parser walks one command as assembled by readCommand, with any literals
+// still inline as "{n}\r\n" followed by their n bytes.
+type parser struct {
+	buf []byte
+	pos int
+}
+
+func newParser(buf []byte) *parser {
+	return &parser{buf: buf}
+}
+
+func (p *parser) atEnd() bool {
+	return p.pos >= len(p.buf)
+}
+
+func (p *parser) peek() byte {
+	if p.atEnd() {
+		return 0
+	}
+	return p.buf[p.pos]
+}
+
+func (p *parser) space() error {
+	if p.peek() != ' ' {
+		return errSyntax
+	}
+	p.pos++
+	return nil
+}
+
+// atom reads up to the next space, parenthesis or quote. It is lenient
+// about atom-specials so that sequence sets, flags and list wildcards can
+// all be read with it.
+func (p *parser) atom() (string, error) {
+	start := p.pos
+	for !p.atEnd() {
+		switch p.buf[p.pos] {
+		case ' ', '(', ')', '"', '\r', '\n':
+			if p.pos == start {
+				return "", errSyntax
+			}
+			return string(p.buf[start:p.pos]), nil
+		}
+		p.pos++
+	}
+	if p.pos == start {
+		return "", errSyntax
+	}
+	return string(p.buf[start:]), nil
+}
+
+func (p *parser) astring() (string, error) {
+	switch p.peek() {
+	case '"':
+		return p.quoted()
+	case '{':
+		return p.literal()
+	default:
+		return p.atom()
+	}
+}
+
+func (p *parser) quoted() (string, error) {
+	p.pos++
+	var b strings.Builder
+	for !p.atEnd() {
+		c := p.buf[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if p.atEnd() {
+				return "", errSyntax
+			}
+			b.WriteByte(p.buf[p.pos])
+			p.pos++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", errSyntax
+}
+
+func (p *parser) literal() (string, error) {
+	end := bytes.IndexByte(p.buf[p.pos:], '}')
+	if end < 0 {
+		return "", errSyntax
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(string(p.buf[p.pos+1:p.pos+end]), "+"))
+	if err != nil || n < 0 {
+		return "", errSyntax
+	}
+	p.pos += end + 1
+
+	if !bytes.HasPrefix(p.buf[p.pos:], []byte("\r\n")) || len(p.buf)-p.pos-2 < n {
+		return "", errSyntax
+	}
+	p.pos += 2
+	s := string(p.buf[p.pos : p.pos+n])
+	p.pos += n
+	return s, nil
+}
+
+// list reads a parenthesized, space separated list, calling item for each
+// element. A bare element without parentheses is accepted when single is
+// set, as several commands allow.
+func (p *parser) list(single bool, item func() error) error {
+	if p.peek() != '(' {
+		if single {
+			return item()
+		}
+		return errSyntax
+	}
+	p.pos++
+
+	for first := true; ; first = false {
+		if p.peek() == ')' {
+			p.pos++
+			return nil
+		}
+		if !first {
+			if err := p.space(); err != nil {
+				return err
+			}
+		}
+		if err := item(); err != nil {
+			return err
+		}
+	}
+}
+
+// seqRange is an inclusive range of message numbers or UIDs, where zero
+// stands for "*", the largest one in use.
+type seqRange struct {
+	lo, hi int64
+}
+
+type seqSet []seqRange
+
+func parseSeqSet(s string) (seqSet, error) {
+	var set seqSet
+	for _, part := range strings.Split(s, ",") {
+		loPart, hiPart, isRange := strings.Cut(part, ":")
+		lo, err := parseSeqNumber(loPart)
+		if err != nil {
+			return nil, err
+		}
+		hi := lo
+		if isRange {
+			if hi, err = parseSeqNumber(hiPart); err != nil {
+				return nil, err
+			}
+		}
+		set = append(set, seqRange{lo: lo, hi: hi})
+	}
+	return set, nil
+}
+
+func parseSeqNumber(s string) (int64, error) {
+	if s == "*" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid sequence number %q", s)
+	}
+	return n, nil
+}
+
+// contains reports whether n falls in the set, with "*" resolved to max.
+func (set seqSet) contains(n, max int64) bool {
+	for _, r := range set {
+		lo, hi := r.lo, r.hi
+		if lo == 0 {
+			lo = max
+		}
+		if hi == 0 {
+			hi = max
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		if n >= lo && n <= hi {
+			return true
+		}
+	}
+	return false
+}
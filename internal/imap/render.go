@@ -0,0 +1,195 @@
+package imap
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"github.com/zeusnotfound04/nano-mail/pkg/message"
+)
+
+// quote renders s as an IMAP string, falling back to a literal for content
+// a quoted string cannot carry.
+func quote(s string) string {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '\r' || c == '\n' || c == 0 || c >= 0x80 {
+			return literal([]byte(s))
+		}
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func nstring(s string) string {
+	if s == "" {
+		return "NIL"
+	}
+	return quote(s)
+}
+
+func literal(b []byte) string {
+	return fmt.Sprintf("{%d}\r\n%s", len(b), b)
+}
+
+// envelope renders the ENVELOPE structure from raw header values, leaving
+// encoded words for the client to decode as RFC 3501 intends.
+func envelope(p *message.Part) string {
+	h := p.Header
+	from := addressList(h, "From")
+	sender := addressList(h, "Sender")
+	if sender == "NIL" {
+		sender = from
+	}
+	replyTo := addressList(h, "Reply-To")
+	if replyTo == "NIL" {
+		replyTo = from
+	}
+
+	return "(" + strings.Join([]string{
+		nstring(h.Get("Date")),
+		nstring(h.Get("Subject")),
+		from,
+		sender,
+		replyTo,
+		addressList(h, "To"),
+		addressList(h, "Cc"),
+		addressList(h, "Bcc"),
+		nstring(h.Get("In-Reply-To")),
+		nstring(h.Get("Message-Id")),
+	}, " ") + ")"
+}
+
+func addressList(h textproto.MIMEHeader, key string) string {
+	value := h.Get(key)
+	if value == "" {
+		return "NIL"
+	}
+	list, err := mail.ParseAddressList(value)
+	if err != nil || len(list) == 0 {
+		return "NIL"
+	}
+
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, a := range list {
+		// net/mail decodes display names; encode them again so the
+		// envelope stays in the header's own form.
+		name := a.Name
+		if name != "" && !isASCII(name) {
+			name = mime.QEncoding.Encode("utf-8", name)
+		}
+		local, domain := a.Address, ""
+		if i := strings.LastIndexByte(a.Address, '@'); i >= 0 {
+			local, domain = a.Address[:i], a.Address[i+1:]
+		}
+		fmt.Fprintf(&b, "(%s NIL %s %s)", nstring(name), nstring(local), nstring(domain))
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// bodyStructure renders BODYSTRUCTURE, or the non-extensible BODY form when
+// extended is false.
+func bodyStructure(p *message.Part, extended bool) string {
+	mediaType, subtype, _ := strings.Cut(strings.ToUpper(p.MediaType), "/")
+
+	if mediaType == "MULTIPART" && len(p.Parts) > 0 {
+		var b strings.Builder
+		b.WriteByte('(')
+		for _, child := range p.Parts {
+			b.WriteString(bodyStructure(child, extended))
+		}
+		b.WriteString(" " + quote(subtype))
+		if extended {
+			b.WriteString(" " + paramList(p.Params))
+			b.WriteString(" " + disposition(p.Header))
+			b.WriteString(" " + nstring(p.Header.Get("Content-Language")))
+			b.WriteString(" " + nstring(p.Header.Get("Content-Location")))
+		}
+		b.WriteByte(')')
+		return b.String()
+	}
+
+	encoding := strings.ToUpper(strings.TrimSpace(p.Header.Get("Content-Transfer-Encoding")))
+	if encoding == "" {
+		encoding = "7BIT"
+	}
+
+	fields := []string{
+		quote(mediaType),
+		quote(subtype),
+		paramList(p.Params),
+		nstring(p.Header.Get("Content-Id")),
+		nstring(p.Header.Get("Content-Description")),
+		quote(encoding),
+		fmt.Sprint(len(p.Body)),
+	}
+	switch {
+	case mediaType == "TEXT":
+		fields = append(fields, fmt.Sprint(countLines(p.Body)))
+	case p.Message != nil:
+		fields = append(fields,
+			envelope(p.Message),
+			bodyStructure(p.Message, extended),
+			fmt.Sprint(countLines(p.Body)))
+	}
+	if extended {
+		fields = append(fields,
+			nstring(p.Header.Get("Content-Md5")),
+			disposition(p.Header),
+			nstring(p.Header.Get("Content-Language")),
+			nstring(p.Header.Get("Content-Location")))
+	}
+
+	return "(" + strings.Join(fields, " ") + ")"
+}
+
+func paramList(params map[string]string) string {
+	if len(params) == 0 {
+		return "NIL"
+	}
+
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var fields []string
+	for _, k := range keys {
+		fields = append(fields, quote(strings.ToUpper(k)), quote(params[k]))
+	}
+	return "(" + strings.Join(fields, " ") + ")"
+}
+
+func disposition(h textproto.MIMEHeader) string {
+	value := h.Get("Content-Disposition")
+	if value == "" {
+		return "NIL"
+	}
+	kind, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		return "NIL"
+	}
+	return "(" + quote(strings.ToUpper(kind)) + " " + paramList(params) + ")"
+}
+
+func countLines(b []byte) int {
+	n := bytes.Count(b, []byte("\n"))
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,345 @@
+package imap
+
+import (
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/pkg/message"
+)
+
+const searchDateLayout = "2-Jan-2006"
+
+// candidate is one message under evaluation by SEARCH. Its body is loaded
+// on first use, so searches on flags, dates and sizes never touch it.
+type candidate struct {
+	s   *session
+	i   int
+	msg *loaded
+	// text caches the decoded text and HTML bodies for BODY and TEXT.
+	text   *string
+	err    error
+	loaded bool
+}
+
+func (c *candidate) body() *loaded {
+	if !c.loaded {
+		c.msg, c.err = c.s.load(c.i)
+		c.loaded = true
+	}
+	return c.msg
+}
+
+func (c *candidate) header(key string) string {
+	msg := c.body()
+	if msg == nil {
+		return ""
+	}
+	return message.DecodeHeader(strings.Join(msg.root.Header.Values(key), ", "))
+}
+
+func (c *candidate) bodyText() string {
+	if c.text != nil {
+		return *c.text
+	}
+	text := ""
+	if msg := c.body(); msg != nil {
+		if parsed, err := message.Parse(msg.raw); err == nil {
+			text = parsed.Text + "\n" + parsed.HTML
+		}
+	}
+	c.text = &text
+	return text
+}
+
+func (c *candidate) sentDate() (time.Time, bool) {
+	msg := c.body()
+	if msg == nil {
+		return time.Time{}, false
+	}
+	date, err := mail.ParseDate(msg.root.Header.Get("Date"))
+	return date, err == nil
+}
+
+type matcher func(c *candidate) bool
+
+func (s *session) handleSearch(tag string, uid bool, p *parser) error {
+	if p.space() != nil {
+		return errSyntax
+	}
+
+	if word := strings.ToUpper(peekWord(p)); word == "CHARSET" {
+		p.pos += len(word)
+		if p.space() != nil {
+			return errSyntax
+		}
+		charset, err := p.astring()
+		if err != nil || p.space() != nil {
+			return errSyntax
+		}
+		if !strings.EqualFold(charset, "UTF-8") && !strings.EqualFold(charset, "US-ASCII") {
+			s.no(tag, "[BADCHARSET (UTF-8 US-ASCII)] Unsupported charset")
+			return nil
+		}
+	}
+
+	var keys []matcher
+	for {
+		key, err := s.parseSearchKey(p)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		if p.atEnd() {
+			break
+		}
+		if p.space() != nil {
+			return errSyntax
+		}
+	}
+
+	var results []string
+	for i := range s.messages {
+		c := &candidate{s: s, i: i}
+		matched := true
+		for _, key := range keys {
+			if !key(c) {
+				matched = false
+				break
+			}
+		}
+		if c.err != nil {
+			s.logger().Error("Failed to load IMAP message for search", "error", c.err, "id", s.messages[i].ID)
+			s.no(tag, "[UNAVAILABLE] Unable to read messages")
+			return nil
+		}
+		if !matched {
+			continue
+		}
+		if uid {
+			results = append(results, strconv.FormatInt(s.messages[i].Seq, 10))
+		} else {
+			results = append(results, strconv.Itoa(i+1))
+		}
+	}
+
+	line := "* SEARCH"
+	if len(results) > 0 {
+		line += " " + strings.Join(results, " ")
+	}
+	s.writeLine(line)
+	s.ok(tag, "SEARCH completed")
+	return nil
+}
+
+func (s *session) parseSearchKey(p *parser) (matcher, error) {
+	if p.peek() == '(' {
+		var keys []matcher
+		err := p.list(false, func() error {
+			key, err := s.parseSearchKey(p)
+			keys = append(keys, key)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return func(c *candidate) bool {
+			for _, key := range keys {
+				if !key(c) {
+					return false
+				}
+			}
+			return true
+		}, nil
+	}
+
+	word, err := p.atom()
+	if err != nil {
+		return nil, err
+	}
+	name := strings.ToUpper(word)
+
+	never := func(*candidate) bool { return false }
+	always := func(*candidate) bool { return true }
+
+	switch name {
+	case "ALL", "OLD", "UNANSWERED", "UNDRAFT":
+		return always, nil
+	case "ANSWERED", "DRAFT", "NEW", "RECENT":
+		return never, nil
+	case "SEEN":
+		return func(c *candidate) bool { return s.messages[c.i].Read }, nil
+	case "UNSEEN":
+		return func(c *candidate) bool { return !s.messages[c.i].Read }, nil
+	case "FLAGGED":
+		return func(c *candidate) bool { return s.messages[c.i].Starred }, nil
+	case "UNFLAGGED":
+		return func(c *candidate) bool { return !s.messages[c.i].Starred }, nil
+	case "DELETED":
+		return never, nil
+	case "UNDELETED":
+		return always, nil
+
+	case "KEYWORD", "UNKEYWORD":
+		if _, err := s.searchArg(p); err != nil {
+			return nil, err
+		}
+		if name == "KEYWORD" {
+			return never, nil
+		}
+		return always, nil
+
+	case "FROM", "TO", "CC", "BCC", "SUBJECT":
+		value, err := s.searchArg(p)
+		if err != nil {
+			return nil, err
+		}
+		key := strings.ToLower(name)
+		return func(c *candidate) bool { return containsFold(c.header(key), value) }, nil
+	case "HEADER":
+		field, err := s.searchArg(p)
+		if err != nil {
+			return nil, err
+		}
+		value, err := s.searchArg(p)
+		if err != nil {
+			return nil, err
+		}
+		return func(c *candidate) bool {
+			if value == "" {
+				msg := c.body()
+				return msg != nil && len(msg.root.Header.Values(field)) > 0
+			}
+			return containsFold(c.header(field), value)
+		}, nil
+	case "BODY":
+		value, err := s.searchArg(p)
+		if err != nil {
+			return nil, err
+		}
+		return func(c *candidate) bool { return containsFold(c.bodyText(), value) }, nil
+	case "TEXT":
+		value, err := s.searchArg(p)
+		if err != nil {
+			return nil, err
+		}
+		return func(c *candidate) bool {
+			msg := c.body()
+			if msg == nil {
+				return false
+			}
+			return containsFold(message.DecodeHeader(string(msg.root.RawHeader)), value) ||
+				containsFold(c.bodyText(), value)
+		}, nil
+
+	case "BEFORE", "ON", "SINCE", "SENTBEFORE", "SENTON", "SENTSINCE":
+		arg, err := s.searchArg(p)
+		if err != nil {
+			return nil, err
+		}
+		day, err := time.Parse(searchDateLayout, arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date %q", arg)
+		}
+		sent := strings.HasPrefix(name, "SENT")
+		cmp := strings.TrimPrefix(name, "SENT")
+		return func(c *candidate) bool {
+			date := s.messages[c.i].CreatedAt
+			if sent {
+				var ok bool
+				if date, ok = c.sentDate(); !ok {
+					return false
+				}
+			}
+			return compareDay(date, day, cmp)
+		}, nil
+
+	case "LARGER", "SMALLER":
+		arg, err := s.searchArg(p)
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size %q", arg)
+		}
+		if name == "LARGER" {
+			return func(c *candidate) bool { return s.messages[c.i].Size > n }, nil
+		}
+		return func(c *candidate) bool { return s.messages[c.i].Size < n }, nil
+
+	case "UID":
+		arg, err := s.searchArg(p)
+		if err != nil {
+			return nil, err
+		}
+		set, err := parseSeqSet(arg)
+		if err != nil {
+			return nil, err
+		}
+		return func(c *candidate) bool {
+			return set.contains(s.messages[c.i].Seq, s.messages[len(s.messages)-1].Seq)
+		}, nil
+
+	case "NOT":
+		if p.space() != nil {
+			return nil, errSyntax
+		}
+		key, err := s.parseSearchKey(p)
+		if err != nil {
+			return nil, err
+		}
+		return func(c *candidate) bool { return !key(c) }, nil
+	case "OR":
+		if p.space() != nil {
+			return nil, errSyntax
+		}
+		left, err := s.parseSearchKey(p)
+		if err != nil {
+			return nil, err
+		}
+		if p.space() != nil {
+			return nil, errSyntax
+		}
+		right, err := s.parseSearchKey(p)
+		if err != nil {
+			return nil, err
+		}
+		return func(c *candidate) bool { return left(c) || right(c) }, nil
+	}
+
+	set, err := parseSeqSet(word)
+	if err != nil {
+		return nil, fmt.Errorf("unknown search key %q", word)
+	}
+	max := int64(len(s.messages))
+	return func(c *candidate) bool { return set.contains(int64(c.i+1), max) }, nil
+}
+
+func (s *session) searchArg(p *parser) (string, error) {
+	if p.space() != nil {
+		return "", errSyntax
+	}
+	return p.astring()
+}
+
+// compareDay compares calendar dates only, as SEARCH ignores time and
+// timezone.
+func compareDay(t, day time.Time, cmp string) bool {
+	y, m, d := t.Date()
+	date := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	switch cmp {
+	case "BEFORE":
+		return date.Before(day)
+	case "ON":
+		return date.Equal(day)
+	default:
+		return !date.Before(day)
+	}
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
@@ -0,0 +1,178 @@
+package imap
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/internal/auth"
+	"github.com/zeusnotfound04/nano-mail/internal/limiter"
+)
+
+type Options struct {
+	Host   string
+	Port   string
+	Domain string
+	// IdleTimeout is the autologout timer. RFC 3501 requires at least 30
+	// minutes, which also bounds a single IDLE.
+	IdleTimeout time.Duration
+	// PollInterval is how often an idling session checks for new mail.
+	PollInterval time.Duration
+	Logger       *slog.Logger
+	RateLimiter  limiter.ConnectionLimiter
+	Auth         auth.Authenticator
+	DB           *sql.DB
+}
+
+// Server serves stored mail over IMAP4rev1. Each login sees a single,
+// read-only INBOX holding the messages addressed to that mailbox; flags
+// show the per-recipient read and starred state.
+type Server struct {
+	opts Options
+
+	listener  net.Listener
+	closing   atomic.Bool
+	wg        sync.WaitGroup
+	sessionWG sync.WaitGroup
+
+	mu       sync.Mutex
+	sessions map[*session]struct{}
+}
+
+func NewServer(opts Options) *Server {
+	if opts.IdleTimeout < 30*time.Minute {
+		opts.IdleTimeout = 30 * time.Minute
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = 10 * time.Second
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+
+	return &Server{
+		opts:     opts,
+		sessions: make(map[*session]struct{}),
+	}
+}
+
+func (s *Server) Start() error {
+	addr := fmt.Sprintf("%s:%s", s.opts.Host, s.opts.Port)
+
+	var err error
+	s.listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start IMAP server: %w", err)
+	}
+
+	s.opts.Logger.Info("IMAP server started", "host", s.opts.Host, "port", s.opts.Port)
+
+	s.wg.Add(1)
+	go s.acceptConnections()
+
+	return nil
+}
+
+func (s *Server) acceptConnections() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !s.closing.Load() {
+				s.opts.Logger.Error("Error accepting IMAP connection", "error", err)
+			}
+			return
+		}
+
+		remoteIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if s.opts.RateLimiter != nil && !s.opts.RateLimiter.Allow(remoteIP) {
+			s.opts.Logger.Warn("IMAP connection rate limit exceeded", "ip", remoteIP)
+			conn.Write([]byte("* BYE [UNAVAILABLE] Too many connections from your IP\r\n"))
+			conn.Close()
+			continue
+		}
+
+		s.sessionWG.Add(1)
+		go func(c net.Conn, ip string) {
+			defer s.sessionWG.Done()
+			if s.opts.RateLimiter != nil {
+				defer s.opts.RateLimiter.Release(ip)
+			}
+			s.handleConnection(c)
+		}(conn, remoteIP)
+	}
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	sess := &session{
+		server:     s,
+		conn:       conn,
+		reader:     bufio.NewReader(conn),
+		writer:     bufio.NewWriter(conn),
+		state:      stateNotAuthenticated,
+		remoteAddr: conn.RemoteAddr().String(),
+		ctx:        context.Background(),
+	}
+
+	s.mu.Lock()
+	s.sessions[sess] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, sess)
+		s.mu.Unlock()
+	}()
+
+	greeting := fmt.Sprintf("* OK [CAPABILITY %s] %s NanoMail IMAP4rev1 server ready", capabilities, s.opts.Domain)
+	if err := sess.writeLine(greeting); err != nil {
+		return
+	}
+
+	sess.process()
+}
+
+// Stop closes the listener and ends every session with an untagged BYE.
+// Flag changes already stored stay stored; \Deleted marks that were never
+// expunged are dropped. Sessions still open when ctx ends are closed hard.
+func (s *Server) Stop(ctx context.Context) error {
+	s.closing.Store(true)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.wg.Wait()
+
+	s.mu.Lock()
+	for sess := range s.sessions {
+		sess.mu.Lock()
+		sess.conn.SetReadDeadline(time.Now())
+		sess.mu.Unlock()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.sessionWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for sess := range s.sessions {
+			sess.conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,616 @@
+package imap
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/database"
+	"github.com/zeusnotfound04/nano-mail/pkg/message"
+)
+
+const capabilities = "IMAP4rev1 LITERAL+ IDLE UNSELECT"
+
+const (
+	stateNotAuthenticated = iota
+	stateAuthenticated
+	stateSelected
+	stateLogout
+)
+
+const (
+	maxAuthFailures  = 3
+	authFailureDelay = time.Second
+	storageTimeout   = 10 * time.Second
+	// maxLiteral bounds literals in commands. Nothing but credentials and
+	// search strings is ever sent as one, since APPEND is not supported.
+	maxLiteral = 64 * 1024
+)
+
+const flagsList = `(\Seen \Flagged)`
+
+var errLiteralTooLarge = errors.New("literal too large")
+
+// literalPattern matches the "{n}" or "{n+}" that ends a line continued by a
+// literal.
+var literalPattern = regexp.MustCompile(`\{(\d+)(\+?)\}$`)
+
+type session struct {
+	server     *Server
+	conn       net.Conn
+	reader     *bufio.Reader
+	writer     *bufio.Writer
+	state      int
+	remoteAddr string
+	ctx        context.Context
+
+	mailbox      string
+	authFailures int
+
+	// messages is the selected INBOX in sequence number order. UIDs are
+	// commit sequence numbers, which increase in the order messages become
+	// visible, as RFC 3501 section 2.3.1.1 requires; storage ids do not.
+	// uidValidity is the generation of that sequence.
+	messages    []database.MailboxMessage
+	uidValidity int64
+
+	// mu orders the deadline set before each read against Stop's nudge.
+	mu sync.Mutex
+}
+
+func (s *session) writeLine(line string) error {
+	if _, err := s.writer.WriteString(line + "\r\n"); err != nil {
+		return err
+	}
+	return s.writer.Flush()
+}
+
+func (s *session) ok(tag, text string) {
+	s.writeLine(tag + " OK " + text)
+}
+
+func (s *session) no(tag, text string) {
+	s.writeLine(tag + " NO " + text)
+}
+
+func (s *session) bad(tag, text string) {
+	s.writeLine(tag + " BAD " + text)
+}
+
+func (s *session) logger() *slog.Logger {
+	return s.server.opts.Logger.With("client", s.remoteAddr, "mailbox", s.mailbox)
+}
+
+func (s *session) process() {
+	for s.state != stateLogout {
+		if !s.armDeadline(s.server.opts.IdleTimeout) {
+			s.writeLine("* BYE Server shutting down")
+			return
+		}
+
+		cmd, err := s.readCommand()
+		if err != nil {
+			s.readFailed(err)
+			return
+		}
+
+		s.execute(cmd)
+	}
+}
+
+// armDeadline sets the read deadline unless the server is closing, in which
+// case it returns false.
+func (s *session) armDeadline(d time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.server.closing.Load() {
+		return false
+	}
+	s.conn.SetDeadline(time.Now().Add(d))
+	return true
+}
+
+func (s *session) readFailed(err error) {
+	var netErr net.Error
+	switch {
+	case s.server.closing.Load():
+		s.writeLine("* BYE Server shutting down")
+	case errors.Is(err, errLiteralTooLarge):
+		s.writeLine("* BYE [TOOBIG] Literal too large")
+	case errors.As(err, &netErr) && netErr.Timeout():
+		s.writeLine("* BYE Autologout; idle for too long")
+	case err != io.EOF:
+		s.logger().Error("Failed to read IMAP command", "error", err)
+	}
+}
+
+// readCommand reads one command line together with any literals it
+// continues into, sending the continuation request for synchronizing
+// literals.
+func (s *session) readCommand() ([]byte, error) {
+	var buf []byte
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		buf = append(buf, line...)
+
+		m := literalPattern.FindStringSubmatch(line)
+		if m == nil {
+			return buf, nil
+		}
+
+		n, err := strconv.Atoi(m[1])
+		if err != nil || n > maxLiteral {
+			return nil, errLiteralTooLarge
+		}
+		if m[2] == "" {
+			if err := s.writeLine("+ Ready for literal data"); err != nil {
+				return nil, err
+			}
+		}
+
+		literal := make([]byte, n)
+		if _, err := io.ReadFull(s.reader, literal); err != nil {
+			return nil, err
+		}
+		buf = append(buf, "\r\n"...)
+		buf = append(buf, literal...)
+	}
+}
+
+func (s *session) execute(cmd []byte) {
+	p := newParser(cmd)
+
+	tag, err := p.atom()
+	if err != nil || p.space() != nil {
+		s.writeLine("* BAD Missing command tag")
+		return
+	}
+
+	name, err := p.atom()
+	if err != nil {
+		s.bad(tag, "Missing command")
+		return
+	}
+	name = strings.ToUpper(name)
+
+	if name == "LOGIN" {
+		s.logger().Debug("Received IMAP command", "tag", tag, "command", name)
+	} else {
+		s.logger().Debug("Received IMAP command", "tag", tag, "command", string(cmd))
+	}
+
+	uid := false
+	if name == "UID" {
+		if p.space() != nil {
+			s.bad(tag, "Missing UID command")
+			return
+		}
+		if name, err = p.atom(); err != nil {
+			s.bad(tag, "Missing UID command")
+			return
+		}
+		name = strings.ToUpper(name)
+		uid = true
+		if name != "FETCH" && name != "SEARCH" && name != "STORE" {
+			s.bad(tag, "Unsupported UID command")
+			return
+		}
+	}
+
+	if err := s.dispatch(tag, name, uid, p); err != nil {
+		s.bad(tag, fmt.Sprintf("%s: %v", name, err))
+	}
+}
+
+// dispatch runs one command. A returned error is a protocol error and is
+// answered with BAD; handlers send their own OK or NO.
+func (s *session) dispatch(tag, name string, uid bool, p *parser) error {
+	switch name {
+	case "CAPABILITY":
+		s.writeLine("* CAPABILITY " + capabilities)
+		s.ok(tag, "CAPABILITY completed")
+		return nil
+	case "NOOP", "CHECK":
+		if s.state == stateSelected {
+			s.refresh()
+		}
+		s.ok(tag, name+" completed")
+		return nil
+	case "LOGOUT":
+		s.writeLine("* BYE NanoMail IMAP4rev1 server logging out")
+		s.ok(tag, "LOGOUT completed")
+		s.state = stateLogout
+		return nil
+	}
+
+	if s.state == stateNotAuthenticated {
+		switch name {
+		case "LOGIN":
+			return s.handleLogin(tag, p)
+		case "AUTHENTICATE":
+			s.no(tag, "Unsupported authentication mechanism, use LOGIN")
+			return nil
+		case "SELECT", "EXAMINE", "LIST", "LSUB", "STATUS", "IDLE", "FETCH", "STORE", "SEARCH":
+			s.bad(tag, "Not authenticated")
+			return nil
+		}
+		return fmt.Errorf("unknown command")
+	}
+
+	switch name {
+	case "LOGIN", "AUTHENTICATE":
+		s.bad(tag, "Already authenticated")
+		return nil
+	case "SELECT", "EXAMINE":
+		return s.handleSelect(tag, name, p)
+	case "LIST", "LSUB":
+		return s.handleList(tag, name, p)
+	case "STATUS":
+		return s.handleStatus(tag, p)
+	case "SUBSCRIBE", "UNSUBSCRIBE":
+		s.ok(tag, name+" completed")
+		return nil
+	case "CREATE", "DELETE", "RENAME", "APPEND", "COPY":
+		s.no(tag, "[CANNOT] Only INBOX is available and it cannot be modified this way")
+		return nil
+	case "IDLE":
+		return s.handleIdle(tag)
+	}
+
+	if s.state != stateSelected {
+		switch name {
+		case "CLOSE", "UNSELECT", "EXPUNGE", "FETCH", "STORE", "SEARCH":
+			s.bad(tag, "No mailbox selected")
+			return nil
+		}
+		return fmt.Errorf("unknown command")
+	}
+
+	switch name {
+	case "CLOSE", "UNSELECT":
+		s.unselect()
+		s.ok(tag, name+" completed")
+		return nil
+	case "EXPUNGE":
+		s.no(tag, "[READ-ONLY] Mailbox is read-only")
+		return nil
+	case "FETCH":
+		return s.handleFetch(tag, uid, p)
+	case "STORE":
+		s.handleStore(tag)
+		return nil
+	case "SEARCH":
+		return s.handleSearch(tag, uid, p)
+	}
+
+	return fmt.Errorf("unknown command")
+}
+
+func (s *session) handleLogin(tag string, p *parser) error {
+	if p.space() != nil {
+		return errSyntax
+	}
+	user, err := p.astring()
+	if err != nil || p.space() != nil {
+		return errSyntax
+	}
+	pass, err := p.astring()
+	if err != nil {
+		return errSyntax
+	}
+
+	addr, err := message.ParseAddress(user)
+	if err != nil {
+		s.no(tag, "[AUTHENTICATIONFAILED] Invalid mailbox address")
+		return nil
+	}
+	user = addr.String()
+
+	logger := s.server.opts.Logger.With("client", s.remoteAddr, "mailbox", user)
+
+	ok, err := s.server.opts.Auth.Verify(s.ctx, user, pass)
+	if err != nil {
+		logger.Error("IMAP authentication check failed", "error", err)
+		s.no(tag, "[UNAVAILABLE] Authentication unavailable, try again later")
+		return nil
+	}
+
+	if !ok {
+		s.authFailures++
+		logger.Warn("IMAP authentication failed", "failures", s.authFailures)
+		time.Sleep(authFailureDelay)
+		s.no(tag, "[AUTHENTICATIONFAILED] Invalid credentials")
+		if s.authFailures >= maxAuthFailures {
+			s.writeLine("* BYE Too many authentication failures")
+			s.state = stateLogout
+		}
+		return nil
+	}
+
+	s.mailbox = user
+	s.state = stateAuthenticated
+	logger.Info("IMAP login")
+	s.ok(tag, "[CAPABILITY "+capabilities+"] LOGIN completed")
+	return nil
+}
+
+func isInbox(name string) bool {
+	return strings.EqualFold(name, "INBOX")
+}
+
+// handleSelect opens INBOX for SELECT and EXAMINE alike. It is always
+// read-only: clients may read and search stored mail, but flags and
+// deletions are changed only through the API.
+func (s *session) handleSelect(tag, name string, p *parser) error {
+	if p.space() != nil {
+		return errSyntax
+	}
+	mailboxName, err := p.astring()
+	if err != nil {
+		return errSyntax
+	}
+
+	s.unselect()
+	if !isInbox(mailboxName) {
+		s.no(tag, "[NONEXISTENT] No such mailbox")
+		return nil
+	}
+
+	messages, uidValidity, err := s.loadMailbox()
+	if err != nil {
+		s.logger().Error("Failed to load IMAP mailbox", "error", err)
+		s.no(tag, "[UNAVAILABLE] Unable to open mailbox")
+		return nil
+	}
+
+	s.messages = messages
+	s.uidValidity = uidValidity
+	s.state = stateSelected
+
+	s.writeLine("* FLAGS " + flagsList)
+	s.writeLine("* OK [PERMANENTFLAGS ()] No permanent flags permitted")
+	s.writeLine(fmt.Sprintf("* %d EXISTS", len(messages)))
+	s.writeLine("* 0 RECENT")
+	for i, m := range messages {
+		if !m.Read {
+			s.writeLine(fmt.Sprintf("* OK [UNSEEN %d] First unseen", i+1))
+			break
+		}
+	}
+	s.writeLine(fmt.Sprintf("* OK [UIDVALIDITY %d] UIDs valid", uidValidity))
+	s.writeLine(fmt.Sprintf("* OK [UIDNEXT %d] Predicted next UID", uidNext(messages)))
+
+	s.ok(tag, "[READ-ONLY] "+name+" completed")
+	return nil
+}
+
+// loadMailbox lists INBOX in UID order along with the UIDVALIDITY its UIDs
+// belong to.
+func (s *session) loadMailbox() ([]database.MailboxMessage, int64, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, storageTimeout)
+	defer cancel()
+
+	uidValidity, err := database.CommitSeqGeneration(ctx, s.server.opts.DB)
+	if err != nil {
+		return nil, 0, err
+	}
+	messages, err := database.ListMailbox(ctx, s.server.opts.DB, s.mailbox, database.ListOptions{
+		OldestFirst: true,
+		CommitOrder: true,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return messages, uidValidity, nil
+}
+
+func (s *session) unselect() {
+	if s.state == stateSelected {
+		s.state = stateAuthenticated
+	}
+	s.messages = nil
+	s.uidValidity = 0
+}
+
+// uidNext is a lower bound only: commit sequence numbers are shared by
+// every mailbox, so the next message here may get a much larger one.
+func uidNext(messages []database.MailboxMessage) int64 {
+	if len(messages) == 0 {
+		return 1
+	}
+	return messages[len(messages)-1].Seq + 1
+}
+
+func (s *session) handleList(tag, name string, p *parser) error {
+	if p.space() != nil {
+		return errSyntax
+	}
+	if _, err := p.astring(); err != nil || p.space() != nil {
+		return errSyntax
+	}
+	pattern, err := p.astring()
+	if err != nil {
+		return errSyntax
+	}
+
+	switch {
+	case pattern == "":
+		s.writeLine(fmt.Sprintf(`* %s (\Noselect) "/" ""`, name))
+	case matchListPattern(pattern, "INBOX"):
+		s.writeLine(fmt.Sprintf(`* %s (\HasNoChildren) "/" "INBOX"`, name))
+	}
+	s.ok(tag, name+" completed")
+	return nil
+}
+
+// matchListPattern matches a LIST pattern, where "*" and "%" are both
+// wildcards since there is no hierarchy. INBOX is case-insensitive.
+func matchListPattern(pattern, name string) bool {
+	pattern = strings.ToUpper(strings.ReplaceAll(pattern, "%", "*"))
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == name
+	}
+
+	if !strings.HasPrefix(name, parts[0]) {
+		return false
+	}
+	rest := name[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(rest, part)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(part):]
+	}
+	return strings.HasSuffix(rest, parts[len(parts)-1])
+}
+
+func (s *session) handleStatus(tag string, p *parser) error {
+	if p.space() != nil {
+		return errSyntax
+	}
+	name, err := p.astring()
+	if err != nil || p.space() != nil {
+		return errSyntax
+	}
+
+	var items []string
+	if err := p.list(false, func() error {
+		item, err := p.atom()
+		items = append(items, strings.ToUpper(item))
+		return err
+	}); err != nil {
+		return err
+	}
+
+	if !isInbox(name) {
+		s.no(tag, "[NONEXISTENT] No such mailbox")
+		return nil
+	}
+
+	messages, uidValidity, err := s.loadMailbox()
+	if err != nil {
+		s.logger().Error("Failed to load IMAP mailbox status", "error", err)
+		s.no(tag, "[UNAVAILABLE] Unable to read mailbox")
+		return nil
+	}
+
+	unseen := 0
+	for _, m := range messages {
+		if !m.Read {
+			unseen++
+		}
+	}
+
+	var fields []string
+	for _, item := range items {
+		switch item {
+		case "MESSAGES":
+			fields = append(fields, fmt.Sprintf("MESSAGES %d", len(messages)))
+		case "RECENT":
+			fields = append(fields, "RECENT 0")
+		case "UIDNEXT":
+			fields = append(fields, fmt.Sprintf("UIDNEXT %d", uidNext(messages)))
+		case "UIDVALIDITY":
+			fields = append(fields, fmt.Sprintf("UIDVALIDITY %d", uidValidity))
+		case "UNSEEN":
+			fields = append(fields, fmt.Sprintf("UNSEEN %d", unseen))
+		default:
+			return fmt.Errorf("unknown status item %s", item)
+		}
+	}
+
+	s.writeLine(fmt.Sprintf(`* STATUS "INBOX" (%s)`, strings.Join(fields, " ")))
+	s.ok(tag, "STATUS completed")
+	return nil
+}
+
+// refresh announces mail that arrived since the mailbox was selected.
+// Removals by other clients are not tracked; fetching such a message just
+// returns nothing for it.
+func (s *session) refresh() {
+	var after int64
+	if len(s.messages) > 0 {
+		after = s.messages[len(s.messages)-1].Seq
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, storageTimeout)
+	added, err := database.ListMailbox(ctx, s.server.opts.DB, s.mailbox, database.ListOptions{
+		Cursor:      after,
+		OldestFirst: true,
+		CommitOrder: true,
+	})
+	cancel()
+	if err != nil {
+		s.logger().Warn("Failed to check IMAP mailbox for new mail", "error", err)
+		return
+	}
+	if len(added) == 0 {
+		return
+	}
+
+	s.messages = append(s.messages, added...)
+	s.writeLine(fmt.Sprintf("* %d EXISTS", len(s.messages)))
+}
+
+// handleIdle reports new mail until the client sends DONE, polling storage
+// every PollInterval.
+func (s *session) handleIdle(tag string) error {
+	if err := s.writeLine("+ idling"); err != nil {
+		s.state = stateLogout
+		return nil
+	}
+
+	deadline := time.Now().Add(s.server.opts.IdleTimeout)
+	var partial string
+	for {
+		wait := min(s.server.opts.PollInterval, time.Until(deadline))
+		if wait <= 0 {
+			s.writeLine("* BYE Autologout; idle for too long")
+			s.state = stateLogout
+			return nil
+		}
+		if !s.armDeadline(wait) {
+			s.writeLine("* BYE Server shutting down")
+			s.state = stateLogout
+			return nil
+		}
+
+		line, err := s.reader.ReadString('\n')
+		partial += line
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && !s.server.closing.Load() {
+				if s.state == stateSelected {
+					s.refresh()
+				}
+				continue
+			}
+			s.readFailed(err)
+			s.state = stateLogout
+			return nil
+		}
+
+		if !strings.EqualFold(strings.TrimRight(partial, "\r\n"), "DONE") {
+			s.bad(tag, "Expected DONE")
+			return nil
+		}
+		s.ok(tag, "IDLE terminated")
+		return nil
+	}
+}
@@ -0,0 +1,231 @@
+// Package ingest is the path received mail takes into storage, shared by the
+// SMTP server and the import command so both admit, deduplicate, store and
+// follow up on mail the same way.
+package ingest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/database"
+	"github.com/zeusnotfound04/nano-mail/internal/events"
+	"github.com/zeusnotfound04/nano-mail/internal/outbound"
+	"github.com/zeusnotfound04/nano-mail/internal/quota"
+	"github.com/zeusnotfound04/nano-mail/internal/registry"
+	"github.com/zeusnotfound04/nano-mail/internal/webhook"
+	"github.com/zeusnotfound04/nano-mail/pkg/message"
+)
+
+// Recipients refused by Admit.
+var (
+	ErrUnknownRecipient = errors.New("address not registered")
+	ErrExpiredRecipient = errors.New("address expired")
+	ErrMailboxFull      = errors.New("mailbox over quota")
+)
+
+type Options struct {
+	DB     *sql.DB
+	Logger *slog.Logger
+	// Origin tags the storage notifications of mail stored here, so the
+	// instance that stored it can ignore its own.
+	Origin   string
+	Registry *registry.Registry
+	Quota    *quota.Enforcer
+	// Webhooks and Outbound are optional; mail is not handed to them when
+	// they are nil. Neither has to be started, as both only queue work in
+	// storage for whichever instance runs their workers.
+	Webhooks *webhook.Dispatcher
+	Outbound *outbound.Queue
+	// Events is optional; without it other instances still learn of stored
+	// mail through its storage notifications.
+	Events *events.Bus
+}
+
+type Pipeline struct {
+	opts Options
+}
+
+func New(opts Options) *Pipeline {
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	return &Pipeline{opts: opts}
+}
+
+// Admit checks a recipient against the address registry and its mailbox
+// quota. Accepted recipients come back in the form they are stored under;
+// refused ones return one of the Err*Recipient or ErrMailboxFull errors, and
+// any other error means the registry could not be consulted. A failed quota
+// lookup admits the recipient, as a quota is not worth refusing mail over.
+func (p *Pipeline) Admit(ctx context.Context, rcpt string) (string, error) {
+	canonical, verdict, err := p.opts.Registry.Admit(ctx, rcpt)
+	if err != nil {
+		return "", err
+	}
+	switch verdict {
+	case registry.Unknown:
+		return "", ErrUnknownRecipient
+	case registry.Expired:
+		return "", ErrExpiredRecipient
+	}
+
+	logger := p.opts.Logger.With("recipient", canonical)
+	decision, err := p.opts.Quota.Admit(ctx, canonical)
+	if err != nil {
+		logger.Warn("Mailbox quota check failed, accepting recipient", "error", err)
+		return canonical, nil
+	}
+	if decision.Evict {
+		logger.Info("Mailbox full, oldest mail will be evicted when the message is stored")
+	}
+	if !decision.Allowed {
+		logger.Warn("Mailbox over quota",
+			"messages", decision.Usage.Messages,
+			"bytes", decision.Usage.Bytes,
+			"max_messages", decision.Limits.MaxMessages,
+			"max_bytes", decision.Limits.MaxBytes)
+		return "", ErrMailboxFull
+	}
+	return canonical, nil
+}
+
+// Result is the outcome of storing one message. Duplicate is set, with no
+// ID, when the message was dropped as already stored.
+type Result struct {
+	ID        int64
+	Seq       int64
+	Duplicate bool
+	Err       error
+}
+
+// Store stores msgs in one batch, dropping any with the same Message-ID and
+// recipients as mail already stored or earlier in the batch. The results
+// line up with msgs. Stored messages still need Deliver.
+func (p *Pipeline) Store(ctx context.Context, msgs []*message.Message) []Result {
+	results := make([]Result, len(msgs))
+	batch := make([]*message.Message, 0, len(msgs))
+	index := make([]int, 0, len(msgs))
+	keys := make(map[string]bool)
+
+	for i, msg := range msgs {
+		if key := dedupKey(msg); key != "" {
+			if keys[key] {
+				results[i].Duplicate = true
+				continue
+			}
+			keys[key] = true
+
+			stored, err := database.MessageStored(ctx, p.opts.DB, msg.MessageID, msg.To)
+			if err != nil {
+				results[i].Err = err
+				continue
+			}
+			if stored {
+				results[i].Duplicate = true
+				continue
+			}
+		}
+		batch = append(batch, msg)
+		index = append(index, i)
+	}
+
+	if len(batch) == 0 {
+		return results
+	}
+	stored := database.StoreMailBatch(ctx, p.opts.DB, database.BatchOptions{
+		Origin: p.opts.Origin,
+		Logger: p.opts.Logger,
+	}, batch)
+	for j, result := range stored {
+		results[index[j]] = Result{ID: result.ID, Seq: result.Seq, Err: result.Err}
+	}
+	return results
+}
+
+// dedupKey identifies a message by its Message-ID and recipients in any
+// order. Messages without a Message-ID have no key and are never dropped.
+func dedupKey(msg *message.Message) string {
+	if msg.MessageID == "" {
+		return ""
+	}
+	rcpts := slices.Clone(msg.To)
+	slices.Sort(rcpts)
+	return msg.MessageID + "\x00" + strings.Join(rcpts, "\x00")
+}
+
+// Deliver carries out what follows storing msg under result: evicting mail
+// from mailboxes over quota, queueing webhook deliveries and forwarded
+// copies, and announcing it to push subscribers. Failures are logged, as
+// the message is stored either way.
+func (p *Pipeline) Deliver(ctx context.Context, result Result, msg *message.Message) {
+	p.trimMailboxes(ctx, result.ID, msg)
+	p.enqueueWebhooks(ctx, result.ID, msg)
+	p.forward(ctx, result.ID, msg)
+
+	if p.opts.Events != nil {
+		p.opts.Events.Publish(events.MailStored{
+			ID:         result.ID,
+			Seq:        result.Seq,
+			Sender:     msg.From,
+			Recipients: msg.To,
+			Subject:    msg.Subject,
+			Size:       msg.Size,
+			ReceivedAt: msg.Date,
+		})
+	}
+}
+
+// trimMailboxes evicts old mail from the message's mailboxes that are over
+// quota now that it is stored, when the quota policy evicts rather than
+// refuses.
+func (p *Pipeline) trimMailboxes(ctx context.Context, id int64, msg *message.Message) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	for _, mailbox := range msg.To {
+		evicted, err := p.opts.Quota.Trim(ctx, mailbox, id, msg.Size)
+		if err != nil {
+			p.opts.Logger.Warn("Failed to evict mail over quota", "mailbox", mailbox, "error", err)
+			continue
+		}
+		if evicted > 0 {
+			p.opts.Logger.Info("Evicted oldest messages to stay within quota", "mailbox", mailbox, "evicted", evicted)
+		}
+	}
+}
+
+func (p *Pipeline) enqueueWebhooks(ctx context.Context, id int64, msg *message.Message) {
+	if p.opts.Webhooks == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if err := p.opts.Webhooks.Enqueue(ctx, id, msg); err != nil {
+		p.opts.Logger.Error("Failed to queue webhook deliveries", "error", err, "id", id)
+	}
+}
+
+func (p *Pipeline) forward(ctx context.Context, id int64, msg *message.Message) {
+	if p.opts.Outbound == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	n, err := p.opts.Outbound.Forward(ctx, id, msg)
+	if err != nil {
+		p.opts.Logger.Error("Failed to queue forwarded mail", "error", err, "id", id)
+		return
+	}
+	if n > 0 {
+		p.opts.Logger.Info("Mail queued for forwarding", "id", id, "copies", n)
+	}
+}
@@ -0,0 +1,59 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+type requestWindow struct {
+	start time.Time
+	count int
+}
+
+// RequestLimiter allows each key a fixed number of requests per window,
+// counting from the key's first request in the window.
+type RequestLimiter struct {
+	limit     int
+	window    time.Duration
+	mu        sync.Mutex
+	keys      map[string]*requestWindow
+	lastSweep time.Time
+}
+
+func NewRequestLimiter(limit int, window time.Duration) *RequestLimiter {
+	return &RequestLimiter{
+		limit:     limit,
+		window:    window,
+		keys:      make(map[string]*requestWindow),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow counts a request for key and reports whether it is within the
+// limit. When it is not, it also returns how long until the key's window
+// ends.
+func (r *RequestLimiter) Allow(key string) (bool, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.lastSweep) >= r.window {
+		for k, w := range r.keys {
+			if now.Sub(w.start) >= r.window {
+				delete(r.keys, k)
+			}
+		}
+		r.lastSweep = now
+	}
+
+	w, ok := r.keys[key]
+	if !ok || now.Sub(w.start) >= r.window {
+		r.keys[key] = &requestWindow{start: now, count: 1}
+		return true, 0
+	}
+	if w.count >= r.limit {
+		return false, w.start.Add(r.window).Sub(now)
+	}
+	w.count++
+	return true, 0
+}
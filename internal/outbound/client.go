@@ -0,0 +1,194 @@
+package outbound
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// DeliveryError describes a failed delivery. Permanent errors are worth no
+// retry: the remote server refused with a 5xx reply, or the domain accepts
+// no mail at all.
+type DeliveryError struct {
+	Host      string
+	Code      int
+	Permanent bool
+	Err       error
+}
+
+func (e *DeliveryError) Error() string {
+	if e.Host == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %v", e.Host, e.Err)
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// Client delivers messages straight to the recipient domain's mail servers.
+type Client struct {
+	Resolver Resolver
+	// HeloName is the name given in EHLO; it should resolve back to this
+	// host, or many servers will refuse the mail.
+	HeloName string
+	// Port is the remote SMTP port for hosts that do not name one.
+	Port string
+	// DialTimeout bounds connecting to each host.
+	DialTimeout time.Duration
+	// TLSConfig, when set, is used for STARTTLS instead of the default
+	// unverified opportunistic configuration.
+	TLSConfig *tls.Config
+}
+
+func NewClient(resolver Resolver, heloName string) *Client {
+	if resolver == nil {
+		resolver = DNSResolver{}
+	}
+	return &Client{
+		Resolver:    resolver,
+		HeloName:    heloName,
+		Port:        "25",
+		DialTimeout: 30 * time.Second,
+	}
+}
+
+// Send delivers body from sender to one recipient, trying the domain's mail
+// servers in order until one accepts it or refuses it outright. An empty
+// sender is sent as the null reverse-path. Errors are *DeliveryError.
+func (c *Client) Send(ctx context.Context, sender, recipient string, body []byte) error {
+	at := strings.LastIndexByte(recipient, '@')
+	if at < 0 {
+		return &DeliveryError{Permanent: true, Err: fmt.Errorf("invalid recipient %q", recipient)}
+	}
+	domain := recipient[at+1:]
+
+	hosts, err := c.Resolver.LookupMX(ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		permanent := errors.Is(err, ErrNullMX) || (errors.As(err, &dnsErr) && dnsErr.IsNotFound)
+		return &DeliveryError{Permanent: permanent, Err: fmt.Errorf("no mail servers for %s: %w", domain, err)}
+	}
+	if len(hosts) == 0 {
+		return &DeliveryError{Err: fmt.Errorf("no mail servers for %s", domain)}
+	}
+
+	var lastErr error
+	for _, host := range hosts {
+		err := c.sendHost(ctx, host, sender, recipient, body, true)
+		if err == nil {
+			return nil
+		}
+		var delivery *DeliveryError
+		if errors.As(err, &delivery) && delivery.Permanent {
+			return err
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return lastErr
+}
+
+// sendHost makes one SMTP transaction with host. When the server offers
+// STARTTLS but the handshake fails, the transaction is retried once in the
+// clear, as opportunistic TLS must not stop delivery.
+func (c *Client) sendHost(ctx context.Context, host, sender, recipient string, body []byte, useTLS bool) error {
+	addr := host
+	name, _, err := net.SplitHostPort(host)
+	if err != nil {
+		name = host
+		addr = net.JoinHostPort(host, c.Port)
+	}
+	fail := func(err error) error {
+		d := &DeliveryError{Host: host, Err: err}
+		var reply *textproto.Error
+		if errors.As(err, &reply) {
+			d.Code = reply.Code
+			d.Permanent = reply.Code >= 500
+		}
+		return d
+	}
+
+	dialer := net.Dialer{Timeout: c.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fail(err)
+	}
+	// net/smtp knows nothing of contexts, so cancellation closes the
+	// connection under it.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, name)
+	if err != nil {
+		conn.Close()
+		return fail(err)
+	}
+	defer client.Close()
+
+	if err := client.Hello(c.HeloName); err != nil {
+		return fail(err)
+	}
+
+	if ok, _ := client.Extension("STARTTLS"); ok && useTLS {
+		if err := client.StartTLS(c.tlsConfig(name)); err != nil {
+			client.Close()
+			var reply *textproto.Error
+			if errors.As(err, &reply) {
+				return fail(err)
+			}
+			return c.sendHost(ctx, host, sender, recipient, body, false)
+		}
+	}
+
+	if err := client.Mail(sender); err != nil {
+		return fail(err)
+	}
+	if err := client.Rcpt(recipient); err != nil {
+		return fail(err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := w.Write(body); err != nil {
+		return fail(err)
+	}
+	if err := w.Close(); err != nil {
+		return fail(err)
+	}
+
+	// The message is accepted once DATA is; a failed QUIT changes nothing.
+	client.Quit()
+	return nil
+}
+
+func (c *Client) tlsConfig(serverName string) *tls.Config {
+	if c.TLSConfig != nil {
+		cfg := c.TLSConfig.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName = serverName
+		}
+		return cfg
+	}
+	// Opportunistic TLS between MTAs is unauthenticated (RFC 7435): it
+	// stops passive eavesdropping, and refusing self-signed or mismatched
+	// certificates would only push delivery back into the clear.
+	return &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	}
+}
@@ -0,0 +1,218 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/database"
+)
+
+type received struct {
+	from, to string
+	body     string
+}
+
+// fakeMX is a minimal SMTP server that answers RCPT with rcptReply and
+// reports each message it accepts on got.
+type fakeMX struct {
+	ln        net.Listener
+	rcptReply string
+	got       chan received
+}
+
+func newFakeMX(t *testing.T, rcptReply string) *fakeMX {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &fakeMX{ln: ln, rcptReply: rcptReply, got: make(chan received, 10)}
+	t.Cleanup(func() { ln.Close() })
+	go m.serve()
+	return m
+}
+
+func (m *fakeMX) addr() string {
+	return m.ln.Addr().String()
+}
+
+func (m *fakeMX) serve() {
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			return
+		}
+		go m.handle(conn)
+	}
+}
+
+func (m *fakeMX) handle(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 fake ESMTP")
+
+	var msg received
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(verb, "EHLO"), strings.HasPrefix(verb, "HELO"):
+			tp.PrintfLine("250 fake")
+		case strings.HasPrefix(verb, "MAIL FROM:"):
+			msg.from = strings.Trim(line[len("MAIL FROM:"):], "<> ")
+			tp.PrintfLine("250 OK")
+		case strings.HasPrefix(verb, "RCPT TO:"):
+			msg.to = strings.Trim(line[len("RCPT TO:"):], "<> ")
+			tp.PrintfLine("%s", m.rcptReply)
+		case verb == "DATA":
+			tp.PrintfLine("354 Go ahead")
+			body, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.body = string(body)
+			tp.PrintfLine("250 Queued")
+			m.got <- msg
+			msg = received{}
+		case verb == "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("250 OK")
+		}
+	}
+}
+
+func testClient(resolver Resolver) *Client {
+	c := NewClient(resolver, "test.local")
+	c.DialTimeout = 5 * time.Second
+	return c
+}
+
+func TestClientSendDelivers(t *testing.T) {
+	mx := newFakeMX(t, "250 OK")
+	c := testClient(StaticResolver{"example.com": {mx.addr()}})
+
+	body := "Subject: hello\r\n\r\nHi there.\r\n"
+	if err := c.Send(context.Background(), "sender@test.local", "user@example.com", []byte(body)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	select {
+	case got := <-mx.got:
+		if got.from != "sender@test.local" || got.to != "user@example.com" {
+			t.Errorf("envelope = %q -> %q, want sender@test.local -> user@example.com", got.from, got.to)
+		}
+		if strings.ReplaceAll(got.body, "\r\n", "\n") != strings.ReplaceAll(body, "\r\n", "\n") {
+			t.Errorf("body = %q, want %q", got.body, body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fake MX received nothing")
+	}
+}
+
+func TestClientSendPermanentFailure(t *testing.T) {
+	refusing := newFakeMX(t, "550 5.1.1 No such user")
+	accepting := newFakeMX(t, "250 OK")
+	c := testClient(StaticResolver{"example.com": {refusing.addr(), accepting.addr()}})
+
+	err := c.Send(context.Background(), "sender@test.local", "nobody@example.com", []byte("\r\n"))
+	var delivery *DeliveryError
+	if !errors.As(err, &delivery) {
+		t.Fatalf("Send error = %v, want a *DeliveryError", err)
+	}
+	if !delivery.Permanent || delivery.Code != 550 {
+		t.Errorf("Permanent = %v, Code = %d; want true, 550", delivery.Permanent, delivery.Code)
+	}
+	select {
+	case <-accepting.got:
+		t.Error("a permanent refusal was retried on the next host")
+	default:
+	}
+}
+
+func TestClientSendTriesNextHost(t *testing.T) {
+	deferring := newFakeMX(t, "451 4.3.0 Try later")
+	accepting := newFakeMX(t, "250 OK")
+	c := testClient(StaticResolver{"*": {deferring.addr(), accepting.addr()}})
+
+	if err := c.Send(context.Background(), "", "user@example.org", []byte("\r\n")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	select {
+	case got := <-accepting.got:
+		if got.from != "" {
+			t.Errorf("sender = %q, want the null reverse-path", got.from)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second host received nothing")
+	}
+}
+
+func TestClientSendNoRoute(t *testing.T) {
+	c := testClient(StaticResolver{"example.com": {"127.0.0.1:1"}})
+
+	err := c.Send(context.Background(), "sender@test.local", "user@elsewhere.test", []byte("\r\n"))
+	var delivery *DeliveryError
+	if !errors.As(err, &delivery) || !delivery.Permanent {
+		t.Fatalf("Send error = %v, want a permanent *DeliveryError", err)
+	}
+}
+
+// TestQueueDelivers runs a queued message through the queue's workers to
+// the fake MX. It needs a database, named by DATABASE_URL.
+func TestQueueDelivers(t *testing.T) {
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set")
+	}
+	db, err := database.ConnectDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := database.Migrate(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	mx := newFakeMX(t, "250 OK")
+	q := NewQueue(Options{
+		DB:           db,
+		Client:       testClient(StaticResolver{"queue.test": {mx.addr()}}),
+		PollInterval: 100 * time.Millisecond,
+	})
+	q.Start()
+	defer q.Stop()
+
+	rcpt := "user-" + time.Now().Format("150405.000000000") + "@queue.test"
+	err = q.Enqueue(ctx, []database.OutboundMessage{{
+		Sender:    "sender@test.local",
+		Recipient: rcpt,
+		Body:      []byte("Subject: queued\r\n\r\nQueued.\r\n"),
+	}})
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	for {
+		select {
+		case got := <-mx.got:
+			if got.to == rcpt {
+				return
+			}
+		case <-ctx.Done():
+			t.Fatal("queued message was not delivered")
+		}
+	}
+}
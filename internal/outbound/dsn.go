@@ -0,0 +1,193 @@
+package outbound
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/database"
+	"github.com/zeusnotfound04/nano-mail/pkg/message"
+)
+
+// maxReturnedSize is the largest message returned whole in a failure report
+// when the sender did not ask for RET=FULL; larger ones are returned as
+// headers only.
+const maxReturnedSize = 64 << 10
+
+// Report is a delivery status notification (RFC 3464) telling a sender that
+// their message could not be delivered to some recipients.
+type Report struct {
+	// To is the envelope sender of the failed message.
+	To          string
+	EnvelopeID  string
+	ArrivalDate time.Time
+	Recipients  []ReportRecipient
+	// Message is the failed message. Ret is the sender's RET parameter:
+	// RET=HDRS returns only its header, RET=FULL all of it, and no RET all
+	// of it when it is small.
+	Message []byte
+	Ret     string
+}
+
+// ReportRecipient is the outcome for one recipient. Status is an enhanced
+// status code (RFC 3463); RemoteMTA and Diagnostic name the server that
+// refused the message and its reply, when there was one.
+type ReportRecipient struct {
+	Original   string
+	Final      string
+	Status     string
+	RemoteMTA  string
+	Diagnostic string
+}
+
+var enhancedCode = regexp.MustCompile(`^([245])\.\d{1,3}\.\d{1,3}\b`)
+
+// failureRecipient describes the final failure of a delivery to recipient.
+func failureRecipient(recipient string, err error) ReportRecipient {
+	rcpt := ReportRecipient{Final: recipient, Status: "4.4.7"}
+
+	var delivery *DeliveryError
+	if errors.As(err, &delivery) && delivery.Host != "" {
+		host := delivery.Host
+		if name, _, splitErr := net.SplitHostPort(host); splitErr == nil {
+			host = name
+		}
+		rcpt.RemoteMTA = host
+	}
+
+	var reply *textproto.Error
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &reply):
+		rcpt.Diagnostic = fmt.Sprintf("%d %s", reply.Code, strings.ReplaceAll(reply.Msg, "\n", " "))
+		if m := enhancedCode.FindStringSubmatch(reply.Msg); m != nil && m[1][0] == byte('0'+reply.Code/100) {
+			rcpt.Status = m[0]
+		} else if reply.Code >= 500 {
+			rcpt.Status = "5.0.0"
+		}
+	case errors.Is(err, ErrNullMX):
+		rcpt.Status = "5.1.10"
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		rcpt.Status = "5.1.2"
+	case delivery != nil && delivery.Permanent:
+		rcpt.Status = "5.0.0"
+	}
+	return rcpt
+}
+
+// Bounce queues report for delivery to the failed message's sender, from
+// the null reverse-path so that it can never bounce in turn. Reports to
+// the null sender are dropped.
+func (q *Queue) Bounce(ctx context.Context, report Report) error {
+	if report.To == "" {
+		return nil
+	}
+	body, err := report.build(q.opts.Domain, time.Now())
+	if err != nil {
+		return err
+	}
+	return q.Enqueue(ctx, []database.OutboundMessage{{
+		Recipient: report.To,
+		Body:      body,
+	}})
+}
+
+func (r *Report) build(domain string, now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	id := make([]byte, 12)
+	rand.Read(id)
+
+	fmt.Fprintf(&buf, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", domain)
+	fmt.Fprintf(&buf, "To: <%s>\r\n", r.To)
+	buf.WriteString("Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	buf.WriteString("Auto-Submitted: auto-replied\r\n")
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/report; report-type=delivery-status;\r\n\tboundary=\"%s\"\r\n\r\n", mw.Boundary())
+
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(part, "This is the mail system at %s.\r\n\r\n", domain)
+	part.Write([]byte("Your message could not be delivered to the following recipients:\r\n\r\n"))
+	for _, rcpt := range r.Recipients {
+		fmt.Fprintf(part, "<%s>", rcpt.Final)
+		if rcpt.Diagnostic != "" {
+			fmt.Fprintf(part, ": %s said: %s", rcpt.RemoteMTA, rcpt.Diagnostic)
+		}
+		part.Write([]byte("\r\n"))
+	}
+
+	part, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"message/delivery-status"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(part, "Reporting-MTA: dns; %s\r\n", domain)
+	if r.EnvelopeID != "" {
+		fmt.Fprintf(part, "Original-Envelope-Id: %s\r\n", r.EnvelopeID)
+	}
+	if !r.ArrivalDate.IsZero() {
+		fmt.Fprintf(part, "Arrival-Date: %s\r\n", r.ArrivalDate.Format(time.RFC1123Z))
+	}
+	for _, rcpt := range r.Recipients {
+		part.Write([]byte("\r\n"))
+		if rcpt.Original != "" {
+			fmt.Fprintf(part, "Original-Recipient: %s\r\n", rcpt.Original)
+		}
+		fmt.Fprintf(part, "Final-Recipient: rfc822; %s\r\n", rcpt.Final)
+		part.Write([]byte("Action: failed\r\n"))
+		fmt.Fprintf(part, "Status: %s\r\n", rcpt.Status)
+		if rcpt.RemoteMTA != "" {
+			fmt.Fprintf(part, "Remote-MTA: dns; %s\r\n", rcpt.RemoteMTA)
+		}
+		if rcpt.Diagnostic != "" {
+			fmt.Fprintf(part, "Diagnostic-Code: smtp; %s\r\n", rcpt.Diagnostic)
+		}
+	}
+
+	returned, contentType := r.Message, "message/rfc822"
+	if r.Ret == message.RetHeaders || (r.Ret == "" && len(r.Message) > maxReturnedSize) {
+		returned, contentType = messageHeader(r.Message), "text/rfc822-headers"
+	}
+	part, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {contentType},
+	})
+	if err != nil {
+		return nil, err
+	}
+	part.Write(returned)
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// messageHeader returns raw's header section, including the blank line
+// that ends it.
+func messageHeader(raw []byte) []byte {
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+		return raw[:i+4]
+	}
+	if i := bytes.Index(raw, []byte("\n\n")); i >= 0 {
+		return raw[:i+2]
+	}
+	return raw
+}
@@ -0,0 +1,401 @@
+package outbound
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/database"
+	"github.com/zeusnotfound04/nano-mail/internal/srs"
+	"github.com/zeusnotfound04/nano-mail/pkg/message"
+)
+
+type Options struct {
+	DB     *sql.DB
+	Logger *slog.Logger
+	Client *Client
+	// Timeout bounds one delivery attempt, across all of the domain's
+	// mail servers.
+	Timeout time.Duration
+	// PollInterval is how often due retries are looked for. New messages
+	// are sent straight away.
+	PollInterval time.Duration
+	// Concurrency caps deliveries in flight from this instance, and
+	// PerDomain those to any one recipient domain.
+	Concurrency int
+	PerDomain   int
+
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxAge is how long a message is retried before it is given up.
+	MaxAge time.Duration
+	// LogRetention is how long finished messages stay in the queue table.
+	LogRetention time.Duration
+	// SRS rewrites the envelope sender of forwarded mail; nil forwards
+	// with the original sender.
+	SRS *srs.Rewriter
+	// Domain names this host in failure reports; it defaults to the
+	// client's HELO name.
+	Domain string
+}
+
+// Queue delivers mail to remote servers. Messages are queued in the
+// database, so they survive restarts, and any instance may send any of them.
+type Queue struct {
+	opts Options
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	wake      chan struct{}
+	lastPurge time.Time
+}
+
+func NewQueue(opts Options) *Queue {
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if opts.Client == nil {
+		opts.Client = NewClient(nil, "localhost")
+	}
+	if opts.Domain == "" {
+		opts.Domain = opts.Client.HeloName
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Minute
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = 15 * time.Second
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 8
+	}
+	if opts.PerDomain <= 0 {
+		opts.PerDomain = 2
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = time.Minute
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = 2 * time.Hour
+	}
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = 5 * 24 * time.Hour
+	}
+	if opts.LogRetention <= 0 {
+		opts.LogRetention = 7 * 24 * time.Hour
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Queue{
+		opts:   opts,
+		ctx:    ctx,
+		cancel: cancel,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+func (q *Queue) Start() {
+	q.wg.Add(1)
+	go q.run()
+}
+
+// Stop abandons deliveries in flight and waits for them to return. Their
+// messages are picked up again once their claim lapses.
+func (q *Queue) Stop() {
+	q.cancel()
+	q.wg.Wait()
+}
+
+// Enqueue queues msgs for delivery, filling in their domain and expiry.
+func (q *Queue) Enqueue(ctx context.Context, msgs []database.OutboundMessage) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	expiresAt := time.Now().Add(q.opts.MaxAge)
+	for i := range msgs {
+		if msgs[i].Domain == "" {
+			msgs[i].Domain = recipientDomain(msgs[i].Recipient)
+		}
+		if msgs[i].ExpiresAt.IsZero() {
+			msgs[i].ExpiresAt = expiresAt
+		}
+	}
+	if err := database.EnqueueOutbound(ctx, q.opts.DB, msgs); err != nil {
+		return err
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func recipientDomain(rcpt string) string {
+	return strings.ToLower(rcpt[strings.LastIndexByte(rcpt, '@')+1:])
+}
+
+// Forward queues a copy of the stored message for each forwarding rule of
+// its recipients, and returns how many were queued. Each copy gets a
+// Delivered-To header naming the address it was forwarded from; a message
+// that already carries that header has been through this address before
+// and is not forwarded again, which breaks forwarding loops.
+func (q *Queue) Forward(ctx context.Context, id int64, msg *message.Message) (int, error) {
+	rules, err := database.ForwardRulesFor(ctx, q.opts.DB, msg.To)
+	if err != nil || len(rules) == 0 {
+		return 0, err
+	}
+
+	raw := []byte(msg.Body)
+	delivered := deliveredTo(raw)
+
+	sender := msg.From
+	if q.opts.SRS != nil {
+		rewritten, err := q.opts.SRS.Forward(sender)
+		if err != nil {
+			q.opts.Logger.Warn("Not rewriting forwarded sender", "email_id", id, "sender", sender, "error", err)
+		} else {
+			sender = rewritten
+		}
+	}
+
+	var ret, envID string
+	if msg.DSN != nil {
+		ret, envID = msg.DSN.Ret, msg.DSN.EnvID
+	}
+
+	var msgs []database.OutboundMessage
+	targets := make(map[string]bool)
+	for _, rule := range rules {
+		if delivered[strings.ToLower(rule.Address)] {
+			q.opts.Logger.Warn("Not forwarding, message has been through this address before",
+				"email_id", id, "address", rule.Address, "target", rule.Target)
+			continue
+		}
+		target := strings.ToLower(rule.Target)
+		if targets[target] {
+			continue
+		}
+		targets[target] = true
+
+		body := make([]byte, 0, len(raw)+len(rule.Address)+16)
+		body = append(body, "Delivered-To: "+rule.Address+"\r\n"...)
+		body = append(body, raw...)
+		// Failures are reported to the original sender, not the rewritten
+		// one, as they would only come straight back here.
+		rcptDSN := msg.DSN.Recipient(rule.Address)
+		returnPath := ""
+		if rcptDSN.NotifyFailure() {
+			returnPath = msg.From
+		}
+		msgs = append(msgs, database.OutboundMessage{
+			EmailID:    id,
+			Sender:     sender,
+			Recipient:  rule.Target,
+			Body:       body,
+			ReturnPath: returnPath,
+			DSNRet:     ret,
+			DSNEnvID:   envID,
+			DSNORCPT:   rcptDSN.ORCPT,
+		})
+	}
+
+	if err := q.Enqueue(ctx, msgs); err != nil {
+		return 0, err
+	}
+	return len(msgs), nil
+}
+
+// deliveredTo returns the addresses in raw's Delivered-To headers,
+// lower-cased.
+func deliveredTo(raw []byte) map[string]bool {
+	addresses := make(map[string]bool)
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return addresses
+	}
+	for _, v := range parsed.Header["Delivered-To"] {
+		addresses[strings.ToLower(strings.Trim(strings.TrimSpace(v), "<>"))] = true
+	}
+	return addresses
+}
+
+func (q *Queue) run() {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(q.opts.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		q.deliverDue()
+		q.purgeFinished()
+
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverDue sends due messages until none are left, one claimed round of
+// concurrent deliveries at a time. Messages beyond the per-domain limit in
+// a round are handed back for the next one.
+func (q *Queue) deliverDue() {
+	// The claim outlasts the attempt, with room to record its outcome.
+	lease := q.opts.Timeout + 30*time.Second
+
+	for q.ctx.Err() == nil {
+		claimed, err := database.ClaimOutbound(q.ctx, q.opts.DB, q.opts.Concurrency, lease)
+		if err != nil {
+			if q.ctx.Err() == nil {
+				q.opts.Logger.Error("Failed to claim outbound messages", "error", err)
+			}
+			return
+		}
+
+		perDomain := make(map[string]int)
+		var wg sync.WaitGroup
+		for _, m := range claimed {
+			if perDomain[m.Domain] >= q.opts.PerDomain {
+				if err := database.DeferOutbound(q.ctx, q.opts.DB, m.ID, time.Now()); err != nil && q.ctx.Err() == nil {
+					q.opts.Logger.Error("Failed to defer outbound message", "error", err, "outbound_id", m.ID)
+				}
+				continue
+			}
+			perDomain[m.Domain]++
+
+			wg.Add(1)
+			go func(m database.OutboundMessage) {
+				defer wg.Done()
+				q.deliver(m)
+			}(m)
+		}
+		wg.Wait()
+
+		if len(claimed) < q.opts.Concurrency {
+			return
+		}
+	}
+}
+
+func (q *Queue) deliver(m database.OutboundMessage) {
+	ctx, cancel := context.WithTimeout(q.ctx, q.opts.Timeout)
+	err := q.opts.Client.Send(ctx, m.Sender, m.Recipient, m.Body)
+	cancel()
+	if q.ctx.Err() != nil {
+		// Cut off by shutdown; the claim lapses and the message is tried
+		// again later.
+		return
+	}
+
+	attempt := database.OutboundAttempt{Delivered: err == nil}
+	if err != nil {
+		attempt.Error = err.Error()
+		var delivery *DeliveryError
+		if !errors.As(err, &delivery) || !delivery.Permanent {
+			attempt.RetryAt = q.retryAt(m.Attempts+1, m.ExpiresAt)
+		}
+	}
+
+	recordCtx, recordCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer recordCancel()
+	if err := database.RecordOutboundAttempt(recordCtx, q.opts.DB, m.ID, attempt); err != nil {
+		q.opts.Logger.Error("Failed to record outbound attempt", "error", err, "outbound_id", m.ID)
+		return
+	}
+
+	logger := q.opts.Logger.With(
+		"outbound_id", m.ID,
+		"email_id", m.EmailID,
+		"recipient", m.Recipient,
+		"attempt", m.Attempts+1)
+	switch {
+	case attempt.Delivered:
+		logger.Info("Outbound message delivered")
+	case attempt.RetryAt.IsZero():
+		logger.Warn("Outbound delivery failed, giving up", "error", attempt.Error)
+		q.bounceFailed(m, err)
+	default:
+		logger.Info("Outbound delivery failed, will retry", "error", attempt.Error, "retry_at", attempt.RetryAt)
+	}
+}
+
+// bounceFailed reports a message given up on to its return path.
+func (q *Queue) bounceFailed(m database.OutboundMessage, cause error) {
+	if m.ReturnPath == "" {
+		return
+	}
+
+	rcpt := failureRecipient(m.Recipient, cause)
+	rcpt.Original = m.DSNORCPT
+	report := Report{
+		To:          m.ReturnPath,
+		EnvelopeID:  m.DSNEnvID,
+		ArrivalDate: m.CreatedAt,
+		Recipients:  []ReportRecipient{rcpt},
+		Message:     m.Body,
+		Ret:         m.DSNRet,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := q.Bounce(ctx, report); err != nil {
+		q.opts.Logger.Error("Failed to queue failure report", "error", err, "outbound_id", m.ID)
+		return
+	}
+	q.opts.Logger.Info("Failure report queued", "outbound_id", m.ID, "to", m.ReturnPath)
+}
+
+// retryAt returns when to try again after attempts failures, or the zero
+// time once the message has expired. The last retry falls on the expiry.
+func (q *Queue) retryAt(attempts int, expiresAt time.Time) time.Time {
+	now := time.Now()
+	if !now.Before(expiresAt) {
+		return time.Time{}
+	}
+
+	backoff := q.opts.MinBackoff
+	for i := 1; i < attempts && backoff < q.opts.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > q.opts.MaxBackoff {
+		backoff = q.opts.MaxBackoff
+	}
+	if next := now.Add(backoff); next.Before(expiresAt) {
+		return next
+	}
+	return expiresAt
+}
+
+// purgeFinished trims finished messages past the retention, at most
+// hourly.
+func (q *Queue) purgeFinished() {
+	if time.Since(q.lastPurge) < time.Hour {
+		return
+	}
+	q.lastPurge = time.Now()
+
+	cutoff := time.Now().Add(-q.opts.LogRetention)
+	for q.ctx.Err() == nil {
+		n, err := database.PurgeOutbound(q.ctx, q.opts.DB, cutoff, 1000)
+		if err != nil {
+			if q.ctx.Err() == nil {
+				q.opts.Logger.Error("Failed to purge outbound messages", "error", err)
+			}
+			return
+		}
+		if n < 1000 {
+			return
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrNullMX is returned for domains that publish a null MX record, declaring
+// that they accept no mail (RFC 7505).
+var ErrNullMX = errors.New("domain accepts no mail")
+
+// Resolver finds the hosts that accept mail for a domain, most preferred
+// first. A host may carry a port, which overrides the client's.
+type Resolver interface {
+	LookupMX(ctx context.Context, domain string) ([]string, error)
+}
+
+// DNSResolver resolves MX records through DNS, falling back to the domain
+// itself when it has none (RFC 5321 section 5.1).
+type DNSResolver struct {
+	// Resolver defaults to net.DefaultResolver.
+	Resolver *net.Resolver
+}
+
+func (r DNSResolver) LookupMX(ctx context.Context, domain string) ([]string, error) {
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	records, err := resolver.LookupMX(ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, err
+		}
+		if _, err := resolver.LookupHost(ctx, domain); err != nil {
+			return nil, err
+		}
+		return []string{domain}, nil
+	}
+
+	if len(records) == 1 && (records[0].Host == "." || records[0].Host == "") {
+		return nil, ErrNullMX
+	}
+	// LookupMX has already sorted by preference.
+	hosts := make([]string, 0, len(records))
+	for _, mx := range records {
+		hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+	}
+	return hosts, nil
+}
+
+// StaticResolver maps domains to fixed hosts, for tests against a local
+// fake MX and for routing mail through a smarthost. The "*" entry matches
+// any domain without its own.
+type StaticResolver map[string][]string
+
+func (r StaticResolver) LookupMX(_ context.Context, domain string) ([]string, error) {
+	if hosts, ok := r[strings.ToLower(domain)]; ok {
+		return hosts, nil
+	}
+	if hosts, ok := r["*"]; ok {
+		return hosts, nil
+	}
+	return nil, &net.DNSError{Err: fmt.Sprintf("no route for %s", domain), Name: domain, IsNotFound: true}
+}
@@ -0,0 +1,192 @@
+package pop3
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/internal/auth"
+	"github.com/zeusnotfound04/nano-mail/internal/limiter"
+)
+
+type Options struct {
+	Host string
+	Port string
+	// IdleTimeout closes sessions that send nothing for this long. RFC 1939
+	// requires at least ten minutes.
+	IdleTimeout time.Duration
+	Logger      *slog.Logger
+	RateLimiter limiter.ConnectionLimiter
+	Auth        auth.Authenticator
+	DB          *sql.DB
+}
+
+// Server serves stored mail over POP3. It is read-only apart from DELE,
+// which soft-deletes messages for the authenticated mailbox only.
+type Server struct {
+	opts Options
+
+	listener  net.Listener
+	closing   atomic.Bool
+	wg        sync.WaitGroup
+	sessionWG sync.WaitGroup
+
+	mu       sync.Mutex
+	sessions map[*session]struct{}
+	locked   map[string]struct{}
+}
+
+func NewServer(opts Options) *Server {
+	if opts.IdleTimeout < 10*time.Minute {
+		opts.IdleTimeout = 10 * time.Minute
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+
+	return &Server{
+		opts:     opts,
+		sessions: make(map[*session]struct{}),
+		locked:   make(map[string]struct{}),
+	}
+}
+
+func (s *Server) Start() error {
+	addr := fmt.Sprintf("%s:%s", s.opts.Host, s.opts.Port)
+
+	var err error
+	s.listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start POP3 server: %w", err)
+	}
+
+	s.opts.Logger.Info("POP3 server started", "host", s.opts.Host, "port", s.opts.Port)
+
+	s.wg.Add(1)
+	go s.acceptConnections()
+
+	return nil
+}
+
+func (s *Server) acceptConnections() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !s.closing.Load() {
+				s.opts.Logger.Error("Error accepting POP3 connection", "error", err)
+			}
+			return
+		}
+
+		remoteIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if s.opts.RateLimiter != nil && !s.opts.RateLimiter.Allow(remoteIP) {
+			s.opts.Logger.Warn("POP3 connection rate limit exceeded", "ip", remoteIP)
+			conn.Write([]byte("-ERR [SYS/TEMP] Too many connections from your IP\r\n"))
+			conn.Close()
+			continue
+		}
+
+		s.sessionWG.Add(1)
+		go func(c net.Conn, ip string) {
+			defer s.sessionWG.Done()
+			if s.opts.RateLimiter != nil {
+				defer s.opts.RateLimiter.Release(ip)
+			}
+			s.handleConnection(c)
+		}(conn, remoteIP)
+	}
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	sess := &session{
+		server:     s,
+		conn:       conn,
+		reader:     bufio.NewReader(conn),
+		writer:     bufio.NewWriter(conn),
+		state:      stateAuthorization,
+		remoteAddr: conn.RemoteAddr().String(),
+		ctx:        context.Background(),
+	}
+
+	s.mu.Lock()
+	s.sessions[sess] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, sess)
+		s.mu.Unlock()
+	}()
+
+	if err := sess.writeLine("+OK NanoMail POP3 server ready"); err != nil {
+		return
+	}
+
+	sess.process()
+}
+
+// lock takes the exclusive maildrop lock RFC 1939 requires for the
+// transaction state. It is per process; POP3 clients of one inbox are
+// expected to reach the same instance.
+func (s *Server) lock(mailbox string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, held := s.locked[mailbox]; held {
+		return false
+	}
+	s.locked[mailbox] = struct{}{}
+	return true
+}
+
+func (s *Server) unlock(mailbox string) {
+	s.mu.Lock()
+	delete(s.locked, mailbox)
+	s.mu.Unlock()
+}
+
+// Stop closes the listener and ends every session without entering the
+// UPDATE state, so DELE marks from interrupted sessions are discarded as
+// RFC 1939 requires. Sessions still open when ctx ends are closed hard.
+func (s *Server) Stop(ctx context.Context) error {
+	s.closing.Store(true)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.wg.Wait()
+
+	s.mu.Lock()
+	for sess := range s.sessions {
+		sess.mu.Lock()
+		sess.conn.SetReadDeadline(time.Now())
+		sess.mu.Unlock()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.sessionWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for sess := range s.sessions {
+			sess.conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,408 @@
+package pop3
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/database"
+	"github.com/zeusnotfound04/nano-mail/pkg/message"
+)
+
+const (
+	stateAuthorization = iota
+	stateTransaction
+)
+
+const (
+	maxAuthFailures  = 3
+	authFailureDelay = time.Second
+	storageTimeout   = 10 * time.Second
+)
+
+type session struct {
+	server     *Server
+	conn       net.Conn
+	reader     *bufio.Reader
+	writer     *bufio.Writer
+	state      int
+	remoteAddr string
+	ctx        context.Context
+
+	user         string
+	mailbox      string
+	authFailures int
+
+	// messages is the maildrop snapshot taken at login; message numbers are
+	// indexes into it plus one, and stay stable for the whole session.
+	messages []database.MailboxMessage
+	deleted  []bool
+
+	// mu orders the deadline set before each read against Stop's nudge.
+	mu sync.Mutex
+}
+
+func (s *session) writeLine(line string) error {
+	if _, err := s.writer.WriteString(line + "\r\n"); err != nil {
+		return err
+	}
+	return s.writer.Flush()
+}
+
+func (s *session) process() {
+	logger := s.server.opts.Logger.With("client", s.remoteAddr)
+	defer func() {
+		if s.state == stateTransaction {
+			s.server.unlock(s.mailbox)
+		}
+	}()
+
+	for {
+		if !s.armDeadline() {
+			s.writeLine("-ERR [SYS/TEMP] Server shutting down")
+			return
+		}
+
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			if s.server.closing.Load() {
+				s.writeLine("-ERR [SYS/TEMP] Server shutting down")
+			} else if err != io.EOF {
+				logger.Error("Failed to read POP3 command", "error", err)
+			}
+			return
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		cmd, args, _ := strings.Cut(line, " ")
+		cmd = strings.ToUpper(cmd)
+
+		if cmd == "PASS" {
+			logger.Debug("Received POP3 command", "command", cmd)
+		} else {
+			logger.Debug("Received POP3 command", "command", line)
+		}
+
+		if cmd == "QUIT" {
+			s.handleQuit()
+			return
+		}
+
+		if s.state == stateAuthorization {
+			if !s.handleAuthorization(cmd, args) {
+				return
+			}
+			continue
+		}
+		s.handleTransaction(cmd, args)
+	}
+}
+
+func (s *session) armDeadline() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.server.closing.Load() {
+		return false
+	}
+	s.conn.SetDeadline(time.Now().Add(s.server.opts.IdleTimeout))
+	return true
+}
+
+// handleAuthorization returns false when the session must be closed.
+func (s *session) handleAuthorization(cmd, args string) bool {
+	switch cmd {
+	case "CAPA":
+		s.writeCapabilities()
+	case "USER":
+		if args == "" {
+			s.writeLine("-ERR Mailbox name required")
+			return true
+		}
+		addr, err := message.ParseAddress(strings.TrimSpace(args))
+		if err != nil {
+			s.writeLine("-ERR Invalid mailbox address")
+			return true
+		}
+		s.user = addr.String()
+		s.writeLine("+OK Send PASS")
+	case "PASS":
+		if s.user == "" {
+			s.writeLine("-ERR Send USER first")
+			return true
+		}
+		ok, err := s.server.opts.Auth.Verify(s.ctx, s.user, args)
+		return s.finishLogin(s.user, ok, err)
+	case "NOOP":
+		s.writeLine("+OK")
+	default:
+		s.writeLine("-ERR Command not valid before authentication")
+	}
+	return true
+}
+
+func (s *session) finishLogin(mailbox string, ok bool, err error) bool {
+	logger := s.server.opts.Logger.With("client", s.remoteAddr, "mailbox", mailbox)
+	s.user = ""
+
+	if err != nil {
+		logger.Error("POP3 authentication check failed", "error", err)
+		s.writeLine("-ERR [SYS/TEMP] Authentication unavailable, try again later")
+		return true
+	}
+
+	if !ok {
+		s.authFailures++
+		logger.Warn("POP3 authentication failed", "failures", s.authFailures)
+		time.Sleep(authFailureDelay)
+		s.writeLine("-ERR [AUTH] Invalid credentials")
+		return s.authFailures < maxAuthFailures
+	}
+
+	if !s.server.lock(mailbox) {
+		s.writeLine("-ERR [IN-USE] Maildrop already locked")
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, storageTimeout)
+	messages, err := database.ListMailbox(ctx, s.server.opts.DB, mailbox, database.ListOptions{OldestFirst: true})
+	cancel()
+	if err != nil {
+		s.server.unlock(mailbox)
+		logger.Error("Failed to load POP3 maildrop", "error", err)
+		s.writeLine("-ERR [SYS/TEMP] Unable to open maildrop")
+		return true
+	}
+
+	s.mailbox = mailbox
+	s.messages = messages
+	s.deleted = make([]bool, len(messages))
+	s.state = stateTransaction
+
+	count, size := s.stat()
+	logger.Info("POP3 login", "messages", count)
+	s.writeLine(fmt.Sprintf("+OK Maildrop has %d messages (%d octets)", count, size))
+	return true
+}
+
+func (s *session) handleTransaction(cmd, args string) {
+	switch cmd {
+	case "CAPA":
+		s.writeCapabilities()
+	case "STAT":
+		count, size := s.stat()
+		s.writeLine(fmt.Sprintf("+OK %d %d", count, size))
+	case "LIST":
+		s.handleList(args)
+	case "UIDL":
+		s.handleUIDL(args)
+	case "RETR":
+		n, ok := s.messageNumber(args)
+		if ok {
+			s.sendMessage(n, -1)
+		}
+	case "TOP":
+		fields := strings.Fields(args)
+		if len(fields) != 2 {
+			s.writeLine("-ERR Syntax: TOP msg n")
+			return
+		}
+		lines, err := strconv.Atoi(fields[1])
+		if err != nil || lines < 0 {
+			s.writeLine("-ERR Invalid line count")
+			return
+		}
+		n, ok := s.messageNumber(fields[0])
+		if ok {
+			s.sendMessage(n, lines)
+		}
+	case "DELE":
+		n, ok := s.messageNumber(args)
+		if ok {
+			s.deleted[n] = true
+			s.writeLine(fmt.Sprintf("+OK Message %d deleted", n+1))
+		}
+	case "RSET":
+		for i := range s.deleted {
+			s.deleted[i] = false
+		}
+		count, size := s.stat()
+		s.writeLine(fmt.Sprintf("+OK Maildrop has %d messages (%d octets)", count, size))
+	case "NOOP":
+		s.writeLine("+OK")
+	default:
+		s.writeLine("-ERR Unknown command")
+	}
+}
+
+func (s *session) writeCapabilities() {
+	s.writeLine("+OK Capability list follows")
+	for _, capability := range []string{"USER", "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "IMPLEMENTATION NanoMail"} {
+		s.writeLine(capability)
+	}
+	s.writeLine(".")
+}
+
+func (s *session) stat() (count int, size int64) {
+	for i, m := range s.messages {
+		if !s.deleted[i] {
+			count++
+			size += m.Size
+		}
+	}
+	return count, size
+}
+
+// messageNumber parses a 1-based message number, replying with an error and
+// returning false when it does not name a live message.
+func (s *session) messageNumber(arg string) (int, bool) {
+	n, err := strconv.Atoi(strings.TrimSpace(arg))
+	if err != nil || n < 1 || n > len(s.messages) {
+		s.writeLine("-ERR No such message")
+		return 0, false
+	}
+	if s.deleted[n-1] {
+		s.writeLine("-ERR Message already deleted")
+		return 0, false
+	}
+	return n - 1, true
+}
+
+func (s *session) handleList(args string) {
+	if strings.TrimSpace(args) != "" {
+		n, ok := s.messageNumber(args)
+		if ok {
+			s.writeLine(fmt.Sprintf("+OK %d %d", n+1, s.messages[n].Size))
+		}
+		return
+	}
+
+	count, size := s.stat()
+	s.writeLine(fmt.Sprintf("+OK %d messages (%d octets)", count, size))
+	for i, m := range s.messages {
+		if !s.deleted[i] {
+			s.writeLine(fmt.Sprintf("%d %d", i+1, m.Size))
+		}
+	}
+	s.writeLine(".")
+}
+
+// handleUIDL uses the storage id, which never changes and is never reused.
+func (s *session) handleUIDL(args string) {
+	if strings.TrimSpace(args) != "" {
+		n, ok := s.messageNumber(args)
+		if ok {
+			s.writeLine(fmt.Sprintf("+OK %d %d", n+1, s.messages[n].ID))
+		}
+		return
+	}
+
+	s.writeLine("+OK")
+	for i, m := range s.messages {
+		if !s.deleted[i] {
+			s.writeLine(fmt.Sprintf("%d %d", i+1, m.ID))
+		}
+	}
+	s.writeLine(".")
+}
+
+// sendMessage writes message n as a multi-line response. bodyLines limits
+// the body to that many lines after the headers, as TOP does; -1 sends the
+// whole message and marks it read.
+func (s *session) sendMessage(n, bodyLines int) {
+	logger := s.server.opts.Logger.With("client", s.remoteAddr, "mailbox", s.mailbox)
+
+	ctx, cancel := context.WithTimeout(s.ctx, storageTimeout)
+	defer cancel()
+
+	msg, err := database.GetMailboxMessage(ctx, s.server.opts.DB, s.mailbox, s.messages[n].ID)
+	if err != nil {
+		if errors.Is(err, database.ErrMessageNotFound) {
+			s.writeLine("-ERR Message no longer available")
+			return
+		}
+		logger.Error("Failed to load POP3 message", "error", err, "id", s.messages[n].ID)
+		s.writeLine("-ERR [SYS/TEMP] Unable to read message")
+		return
+	}
+
+	s.writer.WriteString(fmt.Sprintf("+OK %d octets\r\n", s.messages[n].Size))
+	writeDotStuffed(s.writer, msg.Body, bodyLines)
+	s.writeLine(".")
+
+	if bodyLines < 0 {
+		read := true
+		if _, err := database.UpdateMessageFlags(ctx, s.server.opts.DB, s.mailbox, []int64{msg.ID}, database.FlagUpdate{Read: &read}); err != nil {
+			logger.Warn("Failed to mark POP3 message read", "error", err, "id", msg.ID)
+		}
+	}
+}
+
+// writeDotStuffed writes body with CRLF line endings and dot-stuffing. When
+// bodyLines is not negative, output stops that many lines after the blank
+// line ending the headers.
+func writeDotStuffed(w *bufio.Writer, body string, bodyLines int) {
+	inHeaders := true
+	sent := 0
+
+	for _, line := range strings.SplitAfter(body, "\n") {
+		if line == "" {
+			continue
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if !inHeaders && bodyLines >= 0 {
+			if sent >= bodyLines {
+				return
+			}
+			sent++
+		}
+		if inHeaders && line == "" {
+			inHeaders = false
+		}
+
+		if strings.HasPrefix(line, ".") {
+			w.WriteString(".")
+		}
+		w.WriteString(line)
+		w.WriteString("\r\n")
+	}
+}
+
+// handleQuit enters the UPDATE state when authenticated, soft-deleting the
+// messages marked with DELE.
+func (s *session) handleQuit() {
+	if s.state != stateTransaction {
+		s.writeLine("+OK NanoMail POP3 server signing off")
+		return
+	}
+
+	var ids []int64
+	for i, m := range s.messages {
+		if s.deleted[i] {
+			ids = append(ids, m.ID)
+		}
+	}
+
+	if len(ids) > 0 {
+		ctx, cancel := context.WithTimeout(s.ctx, storageTimeout)
+		deleted := true
+		_, err := database.UpdateMessageFlags(ctx, s.server.opts.DB, s.mailbox, ids, database.FlagUpdate{Deleted: &deleted})
+		cancel()
+		if err != nil {
+			s.server.opts.Logger.Error("Failed to delete POP3 messages", "error", err, "client", s.remoteAddr, "mailbox", s.mailbox)
+			s.writeLine("-ERR [SYS/TEMP] Some deleted messages not removed")
+			return
+		}
+	}
+
+	count, _ := s.stat()
+	s.writeLine(fmt.Sprintf("+OK NanoMail POP3 server signing off (%d messages left)", count))
+}
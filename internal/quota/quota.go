@@ -0,0 +1,130 @@
+package quota
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/zeusnotfound04/nano-mail/database"
+	"github.com/zeusnotfound04/nano-mail/internal/config"
+)
+
+// Limits caps a single mailbox. A zero field is unlimited.
+type Limits struct {
+	MaxMessages int64
+	MaxBytes    int64
+}
+
+func (l Limits) unlimited() bool {
+	return l.MaxMessages <= 0 && l.MaxBytes <= 0
+}
+
+func (l Limits) exceededBy(u database.MailboxUsage) bool {
+	return (l.MaxMessages > 0 && u.Messages >= l.MaxMessages) ||
+		(l.MaxBytes > 0 && u.Bytes >= l.MaxBytes)
+}
+
+type Policy struct {
+	Default Limits
+	// Domains overrides Default for mailboxes under a domain, keyed by
+	// lower-case domain.
+	Domains map[string]Limits
+	// EvictOldest admits mail to a full mailbox and makes room by dropping
+	// its oldest messages once the new one is stored, instead of refusing
+	// it.
+	EvictOldest bool
+}
+
+// PolicyFor builds the policy configured in cfg.
+func PolicyFor(cfg *config.Config) Policy {
+	policy := Policy{
+		Default:     Limits(cfg.MailboxQuota),
+		EvictOldest: cfg.MailboxQuotaEvictOldest,
+	}
+	if len(cfg.MailboxQuotaDomains) > 0 {
+		policy.Domains = make(map[string]Limits, len(cfg.MailboxQuotaDomains))
+		for domain, limits := range cfg.MailboxQuotaDomains {
+			policy.Domains[domain] = Limits(limits)
+		}
+	}
+	return policy
+}
+
+func (p Policy) LimitsFor(mailbox string) Limits {
+	if at := strings.LastIndexByte(mailbox, '@'); at >= 0 {
+		if limits, ok := p.Domains[strings.ToLower(mailbox[at+1:])]; ok {
+			return limits
+		}
+	}
+	return p.Default
+}
+
+type Decision struct {
+	Allowed bool
+	Usage   database.MailboxUsage
+	Limits  Limits
+	// Evict is set when the mailbox is full but the policy makes room
+	// instead; Trim must be called once the message is stored.
+	Evict bool
+}
+
+type Enforcer struct {
+	db     *sql.DB
+	policy Policy
+}
+
+func NewEnforcer(db *sql.DB, policy Policy) *Enforcer {
+	return &Enforcer{db: db, policy: policy}
+}
+
+// Admit decides whether mailbox can take one more message. Nothing is
+// evicted here, as the transaction may still be abandoned; see Trim.
+func (e *Enforcer) Admit(ctx context.Context, mailbox string) (Decision, error) {
+	limits := e.policy.LimitsFor(mailbox)
+	decision := Decision{Allowed: true, Limits: limits}
+	if limits.unlimited() {
+		return decision, nil
+	}
+
+	usage, err := database.GetMailboxUsage(ctx, e.db, mailbox)
+	if err != nil {
+		return decision, err
+	}
+	decision.Usage = usage
+
+	if !limits.exceededBy(usage) {
+		return decision, nil
+	}
+
+	if !e.policy.EvictOldest {
+		decision.Allowed = false
+		return decision, nil
+	}
+	decision.Evict = true
+	return decision, nil
+}
+
+// Trim evicts mailbox's oldest mail until it is back within its limits,
+// counting the newly stored message id of size bytes, which is kept. It
+// does nothing unless the policy evicts.
+func (e *Enforcer) Trim(ctx context.Context, mailbox string, id, size int64) (int64, error) {
+	limits := e.policy.LimitsFor(mailbox)
+	if !e.policy.EvictOldest || limits.unlimited() {
+		return 0, nil
+	}
+	keepMessages, keepBytes := keepFor(limits, size)
+	return database.EvictOldestMail(ctx, e.db, mailbox, id, keepMessages, keepBytes)
+}
+
+// keepFor is what the rest of a mailbox may hold alongside a new message of
+// size bytes.
+func keepFor(limits Limits, size int64) (messages, bytes int64) {
+	messages, bytes = 1<<62, 1<<62
+	if limits.MaxMessages > 0 {
+		messages = limits.MaxMessages - 1
+	}
+	if limits.MaxBytes > 0 {
+		bytes = max(limits.MaxBytes-size, 0)
+	}
+	return messages, bytes
+}
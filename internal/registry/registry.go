@@ -0,0 +1,260 @@
+package registry
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/database"
+	"github.com/zeusnotfound04/nano-mail/pkg/message"
+)
+
+// Mode decides what the SMTP server does with recipients the registry does
+// not know.
+type Mode string
+
+const (
+	// ModeOpen accepts any address without consulting the registry.
+	ModeOpen Mode = "open"
+	// ModeStrict accepts only registered, unexpired addresses.
+	ModeStrict Mode = "strict"
+	// ModeCatchAll registers unknown addresses on first delivery, with the
+	// default TTL. Nobody holds a token for them until one is issued by
+	// hand.
+	ModeCatchAll Mode = "catchall"
+)
+
+var (
+	ErrInvalidAddress = errors.New("invalid address")
+	ErrTTLTooLong     = errors.New("ttl exceeds the maximum")
+)
+
+// localAlphabet avoids look-alike characters, since generated addresses
+// get read off screens and typed in.
+const localAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+type Options struct {
+	Mode Mode
+	// Domain is the domain generated addresses are under and requested
+	// ones must be under. Empty allows requests under any domain.
+	Domain string
+	// DefaultTTL applies when no TTL is asked for; zero never expires.
+	DefaultTTL time.Duration
+	// MaxTTL caps how far ahead an expiry may be set; zero is no cap.
+	MaxTTL time.Duration
+	// LocalPartLength is the length of generated local parts.
+	LocalPartLength int
+}
+
+// Registry tracks which addresses exist and until when.
+type Registry struct {
+	db   *sql.DB
+	opts Options
+}
+
+func New(db *sql.DB, opts Options) *Registry {
+	if opts.Mode == "" {
+		opts.Mode = ModeOpen
+	}
+	if opts.LocalPartLength <= 0 {
+		opts.LocalPartLength = 10
+	}
+	opts.Domain = strings.ToLower(opts.Domain)
+	return &Registry{db: db, opts: opts}
+}
+
+func (r *Registry) Mode() Mode {
+	return r.opts.Mode
+}
+
+// expiry turns a requested TTL into an expiry time, applying the default
+// and the cap.
+func (r *Registry) expiry(now time.Time, ttl time.Duration) (time.Time, error) {
+	if ttl <= 0 {
+		ttl = r.opts.DefaultTTL
+	}
+	if r.opts.MaxTTL > 0 && ttl > r.opts.MaxTTL {
+		return time.Time{}, ErrTTLTooLong
+	}
+	if ttl <= 0 {
+		return time.Time{}, nil
+	}
+	return now.Add(ttl), nil
+}
+
+// Canonical validates address and returns the form it is registered and
+// stored under: the local part as given, and the domain in lower-case ASCII.
+func Canonical(address string) (string, error) {
+	parsed, err := message.ParseAddress(strings.TrimSpace(address))
+	if err != nil {
+		return "", ErrInvalidAddress
+	}
+	return parsed.String(), nil
+}
+
+// Generate registers a random address under the registry's domain.
+func (r *Registry) Generate(ctx context.Context, ttl time.Duration) (*database.Address, error) {
+	if r.opts.Domain == "" {
+		return nil, fmt.Errorf("no domain to generate addresses under")
+	}
+	expiresAt, err := r.expiry(time.Now(), ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	// Collisions are unlikely at any realistic number of addresses, but
+	// cheap to retry.
+	for range 5 {
+		local, err := randomLocalPart(r.opts.LocalPartLength)
+		if err != nil {
+			return nil, err
+		}
+		a, err := database.CreateAddress(ctx, r.db, local+"@"+r.opts.Domain, expiresAt)
+		if !errors.Is(err, database.ErrAddressTaken) {
+			return a, err
+		}
+	}
+	return nil, fmt.Errorf("failed to find a free address")
+}
+
+func randomLocalPart(n int) (string, error) {
+	// Bytes at or past the largest multiple of the alphabet size are
+	// dropped, so every character is equally likely.
+	limit := 256 - 256%len(localAlphabet)
+	out := make([]byte, 0, n)
+	buf := make([]byte, n)
+	for len(out) < n {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			if int(b) < limit && len(out) < n {
+				out = append(out, localAlphabet[int(b)%len(localAlphabet)])
+			}
+		}
+	}
+	return string(out), nil
+}
+
+// Create registers a requested address.
+func (r *Registry) Create(ctx context.Context, address string, ttl time.Duration) (*database.Address, error) {
+	address, err := Canonical(address)
+	if err != nil {
+		return nil, err
+	}
+	if r.opts.Domain != "" && !strings.HasSuffix(address, "@"+r.opts.Domain) {
+		return nil, fmt.Errorf("%w: not under %s", ErrInvalidAddress, r.opts.Domain)
+	}
+	expiresAt, err := r.expiry(time.Now(), ttl)
+	if err != nil {
+		return nil, err
+	}
+	// Mail already delivered to an unregistered address must not become
+	// readable by whoever registers it first.
+	hasMail, err := database.MailboxHasMail(ctx, r.db, address)
+	if err != nil {
+		return nil, err
+	}
+	if hasMail {
+		return nil, database.ErrAddressTaken
+	}
+	// Nor may it inherit rules forwarding its mail elsewhere.
+	rules, err := database.ListForwardRules(ctx, r.db, address)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) > 0 {
+		return nil, database.ErrAddressTaken
+	}
+	return database.CreateAddress(ctx, r.db, address, expiresAt)
+}
+
+func (r *Registry) Lookup(ctx context.Context, address string) (*database.Address, error) {
+	address, err := Canonical(address)
+	if err != nil {
+		return nil, database.ErrAddressNotFound
+	}
+	return database.GetAddress(ctx, r.db, address)
+}
+
+// Extend pushes an address's expiry out by ttl, from its current expiry or
+// from now if that is later. Addresses that never expire are unchanged.
+func (r *Registry) Extend(ctx context.Context, address string, ttl time.Duration) (*database.Address, error) {
+	a, err := r.Lookup(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if a.Expired(now) {
+		return nil, database.ErrAddressNotFound
+	}
+	if a.ExpiresAt.IsZero() {
+		return a, nil
+	}
+
+	if ttl <= 0 {
+		ttl = r.opts.DefaultTTL
+	}
+	expiresAt := a.ExpiresAt.Add(ttl)
+	if r.opts.MaxTTL > 0 && expiresAt.After(now.Add(r.opts.MaxTTL)) {
+		return nil, ErrTTLTooLong
+	}
+	return database.SetAddressExpiry(ctx, r.db, a.Address, expiresAt)
+}
+
+// Release expires an address at once. It and its mail go with the next
+// purge.
+func (r *Registry) Release(ctx context.Context, address string) error {
+	a, err := r.Lookup(ctx, address)
+	if err != nil {
+		return err
+	}
+	_, err = database.SetAddressExpiry(ctx, r.db, a.Address, time.Now())
+	return err
+}
+
+// Verdict is the registry's answer for a recipient.
+type Verdict int
+
+const (
+	Accept Verdict = iota
+	Unknown
+	Expired
+)
+
+// Admit decides whether mail for address is accepted under the registry's
+// mode, registering it first in catch-all mode. Accepted recipients should
+// be stored under the returned canonical address.
+func (r *Registry) Admit(ctx context.Context, address string) (string, Verdict, error) {
+	canonical, err := Canonical(address)
+	if err != nil {
+		return address, Unknown, nil
+	}
+	if r.opts.Mode == ModeOpen {
+		return canonical, Accept, nil
+	}
+
+	a, err := database.GetAddress(ctx, r.db, canonical)
+	switch {
+	case err == nil:
+		if a.Expired(time.Now()) {
+			return canonical, Expired, nil
+		}
+		return canonical, Accept, nil
+	case !errors.Is(err, database.ErrAddressNotFound):
+		return canonical, Unknown, err
+	case r.opts.Mode != ModeCatchAll:
+		return canonical, Unknown, nil
+	}
+
+	expiresAt, _ := r.expiry(time.Now(), 0)
+	if _, err := database.CreateAddress(ctx, r.db, canonical, expiresAt); err != nil && !errors.Is(err, database.ErrAddressTaken) {
+		return canonical, Unknown, err
+	}
+	// Losing a race to register it means another session just did.
+	return canonical, Accept, nil
+}
@@ -0,0 +1,204 @@
+package retention
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/database"
+)
+
+// batchPause is the gap between delete batches, leaving room for ingest
+// writes while a large backlog is purged.
+const batchPause = 100 * time.Millisecond
+
+type Options struct {
+	Policy database.RetentionPolicy
+	// DeletedGrace is how long soft-deleted messages are kept before they
+	// are purged for good, leaving a window to undo a delete.
+	DeletedGrace time.Duration
+	Interval     time.Duration
+	BatchSize    int
+	Logger       *slog.Logger
+}
+
+type Report struct {
+	StartedAt time.Time
+	Duration  time.Duration
+	Deleted   int64
+	// Purged counts messages removed because their recipients had
+	// soft-deleted them.
+	Purged int64
+	// Addresses counts expired registry addresses removed, and
+	// AddressMail the messages removed with them because none of their
+	// recipients was left.
+	Addresses   int64
+	AddressMail int64
+	Batches     int
+	// Skipped is set when another instance held the retention lock.
+	Skipped bool
+}
+
+// Janitor periodically deletes mail that has outlived the retention policy,
+// and registry addresses that have expired along with their mail.
+// Any number of server instances may run one; the advisory lock ensures only
+// one of them purges at a time.
+type Janitor struct {
+	db   *sql.DB
+	opts Options
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu           sync.Mutex
+	last         Report
+	totalDeleted int64
+}
+
+func NewJanitor(db *sql.DB, opts Options) *Janitor {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Hour
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Janitor{
+		db:     db,
+		opts:   opts,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (j *Janitor) Start() {
+	j.wg.Add(1)
+	go j.run()
+}
+
+// Stop cancels any purge in progress and waits for the loop to exit. Rows
+// deleted by already committed batches stay deleted.
+func (j *Janitor) Stop() {
+	j.cancel()
+	j.wg.Wait()
+}
+
+func (j *Janitor) run() {
+	defer j.wg.Done()
+
+	ticker := time.NewTicker(j.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := j.RunOnce(j.ctx); err != nil && j.ctx.Err() == nil {
+			j.opts.Logger.Error("Retention run failed", "error", err)
+		}
+
+		select {
+		case <-j.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce purges expired mail now, batch by batch, until nothing expired is
+// left or ctx is done.
+func (j *Janitor) RunOnce(ctx context.Context) (Report, error) {
+	report := Report{StartedAt: time.Now()}
+
+	acquired, err := database.WithAdvisoryLock(ctx, j.db, database.RetentionLockKey, func(ctx context.Context) error {
+		err := j.inBatches(ctx, &report, func(ctx context.Context) (int64, error) {
+			deleted, err := database.DeleteExpiredMailBatch(ctx, j.db, j.opts.Policy, report.StartedAt, j.opts.BatchSize)
+			report.Deleted += deleted
+			return deleted, err
+		})
+		if err != nil {
+			return err
+		}
+
+		cutoff := report.StartedAt.Add(-j.opts.DeletedGrace)
+		err = j.inBatches(ctx, &report, func(ctx context.Context) (int64, error) {
+			purged, err := database.PurgeDeletedMail(ctx, j.db, cutoff, j.opts.BatchSize)
+			report.Purged += purged
+			return purged, err
+		})
+		if err != nil {
+			return err
+		}
+
+		return j.inBatches(ctx, &report, func(ctx context.Context) (int64, error) {
+			addresses, messages, err := database.PurgeExpiredAddresses(ctx, j.db, report.StartedAt, j.opts.BatchSize)
+			report.Addresses += addresses
+			report.AddressMail += messages
+			return addresses, err
+		})
+	})
+	report.Skipped = !acquired
+	report.Duration = time.Since(report.StartedAt)
+
+	j.mu.Lock()
+	j.last = report
+	j.totalDeleted += report.Deleted + report.Purged + report.AddressMail
+	j.mu.Unlock()
+
+	if err != nil {
+		return report, fmt.Errorf("retention purge failed after %d rows: %w",
+			report.Deleted+report.Purged+report.AddressMail, err)
+	}
+
+	if report.Skipped {
+		j.opts.Logger.Debug("Retention run skipped, lock held by another instance")
+	} else {
+		j.opts.Logger.Info("Retention run complete",
+			"deleted", report.Deleted,
+			"purged", report.Purged,
+			"expired_addresses", report.Addresses,
+			"expired_address_mail", report.AddressMail,
+			"batches", report.Batches,
+			"duration", report.Duration)
+	}
+
+	return report, nil
+}
+
+// inBatches calls batch until it handles fewer rows than a full batch,
+// pausing in between.
+func (j *Janitor) inBatches(ctx context.Context, report *Report, batch func(ctx context.Context) (int64, error)) error {
+	for {
+		n, err := batch(ctx)
+		report.Batches++
+		if err != nil {
+			return err
+		}
+		if n < int64(j.opts.BatchSize) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(batchPause):
+		}
+	}
+}
+
+func (j *Janitor) LastReport() Report {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.last
+}
+
+func (j *Janitor) TotalDeleted() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.totalDeleted
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// latencySampleTTL is how long a storage latency measurement counts. Without
+// it a slow spell would keep the server degraded forever: rejecting mail
+// means no new writes, so no fresh sample would ever clear the old one.
+const latencySampleTTL = 30 * time.Second
+
+// smtpReply is an error that carries the exact reply to send to the client,
+// used where a failure must be reported as temporary rather than 554.
+type smtpReply struct {
+	code     int
+	enhanced string
+	text     string
+}
+
+func (r *smtpReply) Error() string {
+	return fmt.Sprintf("%d %s %s", r.code, r.enhanced, r.text)
+}
+
+func (r *smtpReply) String() string {
+	return r.Error() + "\r\n"
+}
+
+var (
+	errQueueBusy = &smtpReply{452, "4.3.1", "Insufficient system storage, try again later"}
+	errStorage   = &smtpReply{451, "4.3.0", "Storage temporarily unavailable, try again later"}
+)
+
+// admission decides whether new mail can be accepted, based on how full the
+// mail queue is and how healthy storage looks. Rejections are always
+// temporary so senders queue and retry instead of bouncing.
+type admission struct {
+	server *Server
+
+	mu         sync.Mutex
+	latency    time.Duration
+	lastSample time.Time
+}
+
+// observeStore feeds a storage write duration into an exponentially
+// weighted moving average.
+func (a *admission) observeStore(d time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.latency == 0 || time.Since(a.lastSample) > latencySampleTTL {
+		a.latency = d
+	} else {
+		a.latency = (a.latency*4 + d) / 5
+	}
+	a.lastSample = time.Now()
+}
+
+func (a *admission) storeLatency() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if time.Since(a.lastSample) > latencySampleTTL {
+		return 0
+	}
+	return a.latency
+}
+
+// check returns nil when mail can be admitted, otherwise the temporary
+// failure reply explaining why not.
+func (a *admission) check() *smtpReply {
+	cfg := a.server.config
+
+	if !a.server.Ready() {
+		return errStorage
+	}
+
+	if cfg.AdmissionMaxStoreLatency > 0 && a.storeLatency() > cfg.AdmissionMaxStoreLatency {
+		return errStorage
+	}
+
+	queue := a.server.mailQueue
+	if cfg.AdmissionQueueHighWater > 0 && cap(queue) > 0 {
+		if float64(len(queue)) >= cfg.AdmissionQueueHighWater*float64(cap(queue)) {
+			return errQueueBusy
+		}
+	}
+
+	return nil
+}
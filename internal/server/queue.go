@@ -0,0 +1,307 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/internal/outbound"
+	"github.com/zeusnotfound04/nano-mail/internal/spool"
+	"github.com/zeusnotfound04/nano-mail/pkg/message"
+)
+
+// queuedMail is a message waiting for a storage worker. spoolID is set when
+// the message has a durable spool entry that must be removed once stored,
+// and deadLetter when the message is a retry from the dead letter area.
+type queuedMail struct {
+	msg        *message.Message
+	spoolID    string
+	deadLetter *spool.DeadLetter
+}
+
+// processMailQueue stores queued mail until the queue is closed and empty,
+// or until storage is aborted because the shutdown deadline passed.
+func (s *Server) processMailQueue() {
+	defer s.workerWG.Done()
+
+	batchSize := s.config.QueueBatchSize
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	batch := make([]*queuedMail, 0, batchSize)
+
+	for {
+		select {
+		case <-s.stopCtx.Done():
+			return
+		case item, ok := <-s.mailQueue:
+			if !ok {
+				return
+			}
+			batch = append(batch[:0], item)
+		}
+
+		batch = s.fillBatch(batch, batchSize)
+		s.storeBatch(batch)
+	}
+}
+
+// fillBatch keeps taking queued messages until the batch is full or
+// QueueBatchWait has passed since the first one arrived, so a lone message
+// is never held back longer than that.
+func (s *Server) fillBatch(batch []*queuedMail, batchSize int) []*queuedMail {
+	if len(batch) >= batchSize {
+		return batch
+	}
+
+	timer := time.NewTimer(s.config.QueueBatchWait)
+	defer timer.Stop()
+
+	for len(batch) < batchSize {
+		select {
+		case item, ok := <-s.mailQueue:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, item)
+		case <-timer.C:
+			return batch
+		case <-s.stopCtx.Done():
+			return batch
+		}
+	}
+	return batch
+}
+
+func (s *Server) storeBatch(batch []*queuedMail) {
+	msgs := make([]*message.Message, len(batch))
+	for i, item := range batch {
+		msgs[i] = item.msg
+	}
+
+	ctx, cancel := context.WithTimeout(s.stopCtx, 10*time.Second)
+	start := time.Now()
+	results := s.ingest.Store(ctx, msgs)
+	elapsed := time.Since(start)
+	cancel()
+	s.admission.observeStore(elapsed)
+
+	stored := 0
+	for i, result := range results {
+		item := batch[i]
+		if result.Err != nil {
+			s.dbm.ReportFailure(result.Err)
+			s.config.Logger.Error("Failed to store mail from queue", "error", result.Err, "from", item.msg.From)
+			s.countDrained(false, s.storeFailed(item, result.Err))
+			continue
+		}
+
+		stored++
+		s.countDrained(true, true)
+		s.storeSucceeded(item)
+		if result.Duplicate {
+			s.config.Logger.Info("Duplicate mail dropped", "message_id", item.msg.MessageID, "from", item.msg.From)
+			continue
+		}
+		s.config.Logger.Debug("Mail stored from queue", "id", result.ID, "from", item.msg.From, "size", item.msg.Size)
+		s.ingest.Deliver(s.stopCtx, result, item.msg)
+	}
+
+	s.config.Logger.Debug("Mail batch stored",
+		"batch", len(batch),
+		"stored", stored,
+		"failed", len(batch)-stored,
+		"duration", elapsed,
+		"msgs_per_sec", float64(len(batch))/elapsed.Seconds())
+}
+
+func (s *Server) storeSucceeded(item *queuedMail) {
+	if item.spoolID != "" {
+		if err := s.spool.Remove(item.spoolID); err != nil {
+			s.config.Logger.Error("Failed to remove spool entry", "error", err, "spool_id", item.spoolID)
+		}
+	}
+	if item.deadLetter != nil {
+		if err := s.deadLetters.Remove(item.deadLetter.ID); err != nil {
+			s.config.Logger.Error("Failed to remove dead letter", "error", err, "dead_letter_id", item.deadLetter.ID)
+		}
+	}
+}
+
+// storeFailed moves a message that could not be stored into the dead letter
+// area, or records another failed attempt if it came from there. It reports
+// whether the message is still held durably somewhere.
+func (s *Server) storeFailed(item *queuedMail, cause error) bool {
+	// Failures caused by the shutdown deadline are not the message's fault;
+	// leave it where it came from to be picked up on the next start.
+	if s.stopCtx.Err() != nil {
+		if item.spoolID != "" {
+			s.spool.Release(item.spoolID)
+		}
+		if item.deadLetter != nil {
+			s.deadLetters.Release(item.deadLetter.ID)
+		}
+		return item.spoolID != "" || item.deadLetter != nil
+	}
+
+	if item.deadLetter != nil {
+		wasParked := item.deadLetter.Parked()
+		if err := s.deadLetters.Fail(item.deadLetter, cause); err != nil {
+			s.config.Logger.Error("Failed to update dead letter", "error", err, "dead_letter_id", item.deadLetter.ID)
+		}
+		if item.deadLetter.Parked() && !wasParked {
+			s.config.Logger.Warn("Dead letter parked after final retry",
+				"dead_letter_id", item.deadLetter.ID,
+				"attempts", item.deadLetter.Attempts)
+			s.bounceUnstored(item.deadLetter)
+		}
+		return true
+	}
+
+	if s.deadLetters == nil {
+		if item.spoolID != "" {
+			s.spool.Release(item.spoolID)
+		}
+		return item.spoolID != ""
+	}
+
+	entry, err := s.deadLetters.Add(item.msg, cause)
+	if err != nil {
+		s.config.Logger.Error("Failed to dead-letter message", "error", err, "from", item.msg.From)
+		if item.spoolID != "" {
+			s.spool.Release(item.spoolID)
+		}
+		return item.spoolID != ""
+	}
+
+	s.config.Logger.Warn("Message moved to dead letters",
+		"dead_letter_id", entry.ID,
+		"next_retry_at", entry.NextRetryAt)
+
+	if item.spoolID != "" {
+		if err := s.spool.Remove(item.spoolID); err != nil {
+			s.config.Logger.Error("Failed to remove spool entry", "error", err, "spool_id", item.spoolID)
+		}
+	}
+	return true
+}
+
+// bounceUnstored tells the sender of a dead letter that has used up its
+// retries that it was not delivered. An operator may still retry it later.
+func (s *Server) bounceUnstored(entry *spool.DeadLetter) {
+	msg := entry.Message
+	if s.outbound == nil || msg.From == "" {
+		return
+	}
+
+	report := outbound.Report{
+		To:          msg.From,
+		ArrivalDate: msg.Date,
+		Message:     []byte(msg.Body),
+	}
+	if msg.DSN != nil {
+		report.EnvelopeID, report.Ret = msg.DSN.EnvID, msg.DSN.Ret
+	}
+	for _, rcpt := range msg.To {
+		rcptDSN := msg.DSN.Recipient(rcpt)
+		if !rcptDSN.NotifyFailure() {
+			continue
+		}
+		report.Recipients = append(report.Recipients, outbound.ReportRecipient{
+			Original: rcptDSN.ORCPT,
+			Final:    rcpt,
+			Status:   "5.3.0",
+		})
+	}
+	if len(report.Recipients) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(s.stopCtx, 5*time.Second)
+	defer cancel()
+	if err := s.outbound.Bounce(ctx, report); err != nil {
+		s.config.Logger.Error("Failed to queue failure report", "error", err, "dead_letter_id", entry.ID)
+		return
+	}
+	s.config.Logger.Info("Failure report queued", "dead_letter_id", entry.ID, "to", msg.From)
+}
+
+// retryDeadLetters periodically queues dead letters whose backoff has
+// expired.
+func (s *Server) retryDeadLetters() {
+	defer s.wg.Done()
+
+	interval := s.config.DeadLetterRetryInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case <-ticker.C:
+		}
+
+		entries, err := s.deadLetters.ClaimDue(time.Now())
+		if err != nil {
+			s.config.Logger.Error("Failed to read some dead letters", "error", err)
+		}
+		if len(entries) > 0 {
+			s.config.Logger.Info("Retrying dead letters", "count", len(entries))
+		}
+
+		for i, entry := range entries {
+			select {
+			case s.mailQueue <- &queuedMail{msg: entry.Message, deadLetter: entry}:
+			case <-s.shutdown:
+				for _, rest := range entries[i:] {
+					s.deadLetters.Release(rest.ID)
+				}
+				return
+			}
+		}
+	}
+}
+
+// replaySpool feeds unclaimed spool entries back into the queue: everything
+// left over from a previous run at startup, then periodically anything that
+// overflowed the queue, or failed to store while dead letters are disabled.
+func (s *Server) replaySpool() {
+	defer s.wg.Done()
+
+	interval := s.config.SpoolReplayInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		entries, err := s.spool.ClaimPending()
+		if err != nil {
+			s.config.Logger.Error("Failed to read some spool entries", "error", err)
+		}
+		if len(entries) > 0 {
+			s.config.Logger.Info("Replaying spooled messages", "count", len(entries))
+		}
+
+		for i, entry := range entries {
+			select {
+			case s.mailQueue <- &queuedMail{msg: entry.Message, spoolID: entry.ID}:
+			case <-s.shutdown:
+				for _, rest := range entries[i:] {
+					s.spool.Release(rest.ID)
+				}
+				return
+			}
+		}
+
+		select {
+		case <-s.shutdown:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+
+	"github.com/zeusnotfound04/nano-mail/internal/api"
+	"github.com/zeusnotfound04/nano-mail/internal/auth"
+	"github.com/zeusnotfound04/nano-mail/internal/events"
+	"github.com/zeusnotfound04/nano-mail/internal/imap"
+	"github.com/zeusnotfound04/nano-mail/internal/pop3"
+)
+
+// startReaders starts the configured listeners that serve stored mail back
+// out: POP3, IMAP and the HTTP API.
+func (s *Server) startReaders() error {
+	tokens := auth.NewStoredTokens(s.db)
+
+	if s.config.POP3Port != "" {
+		s.pop3 = pop3.NewServer(pop3.Options{
+			Host:        s.config.Host,
+			Port:        s.config.POP3Port,
+			Logger:      s.config.Logger,
+			RateLimiter: s.rateLimiter,
+			Auth:        tokens,
+			DB:          s.db,
+		})
+		if err := s.pop3.Start(); err != nil {
+			s.pop3 = nil
+			return err
+		}
+	}
+
+	if s.config.IMAPPort != "" {
+		s.imap = imap.NewServer(imap.Options{
+			Host:        s.config.Host,
+			Port:        s.config.IMAPPort,
+			Domain:      s.config.Domain,
+			Logger:      s.config.Logger,
+			RateLimiter: s.rateLimiter,
+			Auth:        tokens,
+			DB:          s.db,
+		})
+		if err := s.imap.Start(); err != nil {
+			s.imap = nil
+			s.stopReaders(context.Background())
+			return err
+		}
+	}
+
+	if s.config.APIPort != "" {
+		s.api = api.NewServer(api.Options{
+			Host:          s.config.Host,
+			Port:          s.config.APIPort,
+			Logger:        s.config.Logger,
+			DB:            s.db,
+			Auth:          tokens,
+			Tokens:        tokens,
+			Quota:         &s.quotaPolicy,
+			Events:        s.events,
+			Heartbeat:     s.config.PushHeartbeat,
+			Registry:      s.registry,
+			AdminToken:    s.config.AddressAdminToken,
+			GenerateLimit: s.config.AddressGenerateLimit,
+			Outbound:      s.outbound,
+			Domain:        s.config.Domain,
+			PublicURL:     s.config.APIPublicURL,
+		})
+		if err := s.api.Start(); err != nil {
+			s.api = nil
+			s.stopReaders(context.Background())
+			return err
+		}
+
+		// Push clients may be connected to any instance, so mail stored
+		// through the others has to reach this one's bus too.
+		s.relay = events.NewRelay(s.events, events.RelayOptions{
+			DSN:    s.dbm.DSN(),
+			DB:     s.db,
+			Origin: s.instanceID,
+			Logger: s.config.Logger,
+		})
+		s.relay.Start()
+	}
+
+	return nil
+}
+
+func (s *Server) stopReaders(ctx context.Context) {
+	logger := s.config.Logger
+
+	if s.pop3 != nil {
+		if err := s.pop3.Stop(ctx); err != nil {
+			logger.Warn("POP3 sessions closed before finishing", "error", err)
+		}
+	}
+	if s.imap != nil {
+		if err := s.imap.Stop(ctx); err != nil {
+			logger.Warn("IMAP sessions closed before finishing", "error", err)
+		}
+	}
+	if s.api != nil {
+		if err := s.api.Stop(ctx); err != nil {
+			logger.Warn("API requests cut off by shutdown", "error", err)
+		}
+	}
+	if s.relay != nil {
+		s.relay.Stop()
+	}
+}
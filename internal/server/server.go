@@ -3,18 +3,30 @@ package server
 import (
 	"bufio"
 	"context"
-	"database/sql"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
-	"time"
+	"path/filepath"
 
 	"github.com/zeusnotfound04/nano-mail/database"
 	"github.com/zeusnotfound04/nano-mail/internal/config"
+	"github.com/zeusnotfound04/nano-mail/internal/events"
+	"github.com/zeusnotfound04/nano-mail/internal/ingest"
 	"github.com/zeusnotfound04/nano-mail/internal/limiter"
-	"github.com/zeusnotfound04/nano-mail/pkg/message"
+	"github.com/zeusnotfound04/nano-mail/internal/outbound"
+	"github.com/zeusnotfound04/nano-mail/internal/quota"
+	"github.com/zeusnotfound04/nano-mail/internal/registry"
+	"github.com/zeusnotfound04/nano-mail/internal/retention"
+	"github.com/zeusnotfound04/nano-mail/internal/spool"
+	"github.com/zeusnotfound04/nano-mail/internal/srs"
+	"github.com/zeusnotfound04/nano-mail/internal/webhook"
 )
 
-func NewServer(cfg *config.Config, db *sql.DB) *Server {
+// NewServer builds a server on dbm, which must not be nil: every part of the
+// server stores or reads through it.
+func NewServer(cfg *config.Config, dbm *database.Manager) *Server {
 	if cfg == nil {
 		cfg = config.DefaultConfig()
 	}
@@ -32,40 +44,99 @@ func NewServer(cfg *config.Config, db *sql.DB) *Server {
 		config:      cfg,
 		shutdown:    make(chan struct{}),
 		rateLimiter: connectionLimiter,
-		db:          db,
-		mailQueue:   make(chan *message.Message, 1000),
+		dbm:         dbm,
+		db:          dbm.DB(),
+		mailQueue:   make(chan *queuedMail, 1000),
 		workers:     4,
+		sessions:    make(map[*smtpSession]struct{}),
+		events:      events.NewBus(),
+		instanceID:  newInstanceID(),
+	}
+	server.stopCtx, server.abortStorage = context.WithCancel(context.Background())
+	server.admission = &admission{server: server}
+	server.quotaPolicy = quota.PolicyFor(cfg)
+	server.quota = quota.NewEnforcer(server.db, server.quotaPolicy)
+	server.registry = registry.New(server.db, registry.Options{
+		Mode:       registry.Mode(cfg.AddressMode),
+		Domain:     cfg.Domain,
+		DefaultTTL: cfg.AddressDefaultTTL,
+		MaxTTL:     cfg.AddressMaxTTL,
+	})
+	if cfg.SRSSecret != "" {
+		server.srs = srs.New(cfg.SRSSecret, cfg.Domain, cfg.SRSMaxAge)
 	}
 
 	for i := 0; i < server.workers; i++ {
-		server.wg.Add(1)
+		server.workerWG.Add(1)
 		go server.processMailQueue()
 	}
 
 	return server
 }
 
-func (s *Server) processMailQueue() {
-	defer s.wg.Done()
-	for {
-		select {
-		case <-s.shutdown:
-			return
-		case msg := <-s.mailQueue:
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			err := database.StoreMail(ctx, s.db, msg)
-			cancel()
+func newInstanceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
 
-			if err != nil {
-				s.config.Logger.Error("Failed to store mail from queue", "error", err)
-			} else {
-				s.config.Logger.Debug("Mail stored from queue", "from", msg.From, "size", msg.Size)
-			}
+func (s *Server) Start() error {
+	switch s.registry.Mode() {
+	case registry.ModeOpen, registry.ModeStrict, registry.ModeCatchAll:
+	default:
+		return fmt.Errorf("unknown address mode %q", s.registry.Mode())
+	}
+	// Forwarded mail keeps its sender's domain without SRS, so it fails
+	// SPF wherever it arrives, and bounces could not be routed back.
+	if s.config.ForwardingEnabled && s.srs == nil {
+		return errors.New("forwarding requires an SRS secret")
+	}
+
+	// The ingest pipeline has to be complete before anything can feed the
+	// mail queue; the workers behind the webhooks and forwarding start once
+	// the listener is up.
+	if s.config.WebhooksEnabled {
+		s.webhooks = webhook.NewDispatcher(webhook.Options{
+			DB:           s.db,
+			Logger:       s.config.Logger,
+			Timeout:      s.config.WebhookTimeout,
+			MaxAttempts:  s.config.WebhookMaxAttempts,
+			DisableAfter: s.config.WebhookDisableAfter,
+		})
+	}
+
+	if s.config.ForwardingEnabled {
+		var resolver outbound.Resolver
+		if s.config.OutboundRelayHost != "" {
+			resolver = outbound.StaticResolver{"*": {s.config.OutboundRelayHost}}
+		}
+		client := outbound.NewClient(resolver, s.config.Domain)
+		if s.config.OutboundPort != "" {
+			client.Port = s.config.OutboundPort
 		}
+		s.outbound = outbound.NewQueue(outbound.Options{
+			DB:          s.db,
+			Logger:      s.config.Logger,
+			Client:      client,
+			Timeout:     s.config.OutboundTimeout,
+			Concurrency: s.config.OutboundConcurrency,
+			PerDomain:   s.config.OutboundPerDomain,
+			MaxAge:      s.config.OutboundMaxAge,
+			SRS:         s.srs,
+		})
 	}
-}
 
-func (s *Server) Start() error {
+	s.ingest = ingest.New(ingest.Options{
+		DB:       s.db,
+		Logger:   s.config.Logger,
+		Origin:   s.instanceID,
+		Registry: s.registry,
+		Quota:    s.quota,
+		Webhooks: s.webhooks,
+		Outbound: s.outbound,
+		Events:   s.events,
+	})
+
 	addr := fmt.Sprintf("%s:%s", s.config.Host, s.config.Port)
 
 	var err error
@@ -74,6 +145,36 @@ func (s *Server) Start() error {
 		return fmt.Errorf("failed to start SMTP server: %w", err)
 	}
 
+	if s.config.SpoolDir != "" {
+		s.spool, err = spool.Open(s.config.SpoolDir)
+		if err != nil {
+			s.listener.Close()
+			return err
+		}
+
+		s.wg.Add(1)
+		go s.replaySpool()
+	}
+
+	deadLetterDir := s.config.DeadLetterDir
+	if deadLetterDir == "" && s.config.SpoolDir != "" {
+		deadLetterDir = filepath.Join(s.config.SpoolDir, "deadletter")
+	}
+	if deadLetterDir != "" {
+		s.deadLetters, err = spool.OpenDeadLetters(deadLetterDir, spool.RetryPolicy{
+			MaxAttempts: s.config.DeadLetterMaxAttempts,
+			MinBackoff:  s.config.DeadLetterMinBackoff,
+			MaxBackoff:  s.config.DeadLetterMaxBackoff,
+		})
+		if err != nil {
+			s.listener.Close()
+			return err
+		}
+
+		s.wg.Add(1)
+		go s.retryDeadLetters()
+	}
+
 	s.config.Logger.Info("SMTP server started",
 		"host", s.config.Host,
 		"port", s.config.Port,
@@ -82,6 +183,32 @@ func (s *Server) Start() error {
 	s.wg.Add(1)
 	go s.acceptConnections()
 
+	if s.config.RetentionEnabled {
+		s.janitor = retention.NewJanitor(s.db, retention.Options{
+			Policy: database.RetentionPolicy{
+				DefaultTTL: s.config.RetentionTTL,
+				DomainTTL:  s.config.RetentionDomainTTL,
+			},
+			DeletedGrace: s.config.RetentionDeletedGrace,
+			Interval:     s.config.RetentionInterval,
+			BatchSize:    s.config.RetentionBatchSize,
+			Logger:       s.config.Logger,
+		})
+		s.janitor.Start()
+	}
+
+	if s.webhooks != nil {
+		s.webhooks.Start()
+	}
+	if s.outbound != nil {
+		s.outbound.Start()
+	}
+
+	if err := s.startReaders(); err != nil {
+		s.listener.Close()
+		return err
+	}
+
 	return nil
 }
 
@@ -94,7 +221,9 @@ func (s *Server) acceptConnections() {
 		default:
 			conn, err := s.listener.Accept()
 			if err != nil {
-				s.config.Logger.Error("Error accepting connection", "error", err)
+				if !s.draining.Load() {
+					s.config.Logger.Error("Error accepting connection", "error", err)
+				}
 				return
 			}
 
@@ -106,9 +235,9 @@ func (s *Server) acceptConnections() {
 				continue
 			}
 
-			s.wg.Add(1)
+			s.sessionWG.Add(1)
 			go func(c net.Conn, ip string) {
-				defer s.wg.Done()
+				defer s.sessionWG.Done()
 				defer s.rateLimiter.Release(ip)
 				s.handleConnection(c)
 			}(conn, remoteIP)
@@ -134,7 +263,13 @@ func (s *Server) handleConnection(conn net.Conn) {
 		ctx:        context.Background(),
 	}
 
+	s.trackSession(session, true)
+	defer s.trackSession(session, false)
+
 	greeting := fmt.Sprintf("220 %s ESMTP ready\r\n", s.config.Domain)
+	if reply := s.admission.check(); reply != nil {
+		greeting = fmt.Sprintf("220 %s ESMTP ready, service degraded (%s)\r\n", s.config.Domain, reply.text)
+	}
 	if err := session.writeResponse(greeting); err != nil {
 		s.config.Logger.Error("Failed to send greeting", "error", err, "client", session.remoteAddr)
 		return
@@ -143,20 +278,14 @@ func (s *Server) handleConnection(conn net.Conn) {
 	session.process()
 }
 
-func (s *Server) Stop() error {
-	close(s.shutdown)
-
-	if s.listener != nil {
-		s.listener.Close()
-	}
-
-	s.wg.Wait()
-	return nil
+// Ready reports whether the server can currently accept mail for storage.
+func (s *Server) Ready() bool {
+	return s.dbm.Ready()
 }
 
-func StartServer(config *config.Config, db *sql.DB) (*Server, error) {
+func StartServer(config *config.Config, dbm *database.Manager) (*Server, error) {
 
-	server := NewServer(config, db)
+	server := NewServer(config, dbm)
 	err := server.Start()
 	if err != nil {
 		return nil, err
@@ -5,17 +5,32 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/zeusnotfound04/nano-mail/database"
+	"github.com/zeusnotfound04/nano-mail/internal/api"
 	"github.com/zeusnotfound04/nano-mail/internal/config"
+	"github.com/zeusnotfound04/nano-mail/internal/events"
+	"github.com/zeusnotfound04/nano-mail/internal/imap"
+	"github.com/zeusnotfound04/nano-mail/internal/ingest"
 	"github.com/zeusnotfound04/nano-mail/internal/limiter"
+	"github.com/zeusnotfound04/nano-mail/internal/outbound"
+	"github.com/zeusnotfound04/nano-mail/internal/pop3"
+	"github.com/zeusnotfound04/nano-mail/internal/quota"
+	"github.com/zeusnotfound04/nano-mail/internal/registry"
+	"github.com/zeusnotfound04/nano-mail/internal/retention"
+	"github.com/zeusnotfound04/nano-mail/internal/spool"
+	"github.com/zeusnotfound04/nano-mail/internal/srs"
+	"github.com/zeusnotfound04/nano-mail/internal/webhook"
 	"github.com/zeusnotfound04/nano-mail/pkg/message"
 )
 
@@ -49,12 +64,50 @@ type Server struct {
 
 	listener    net.Listener
 	shutdown    chan struct{}
+	draining    atomic.Bool
 	wg          sync.WaitGroup
+	workerWG    sync.WaitGroup
+	sessionWG   sync.WaitGroup
+	dbm         *database.Manager
 	db          *sql.DB
 	rateLimiter limiter.ConnectionLimiter
 
-	mailQueue chan *message.Message
-	workers   int
+	mailQueue   chan *queuedMail
+	workers     int
+	spool       *spool.Spool
+	deadLetters *spool.DeadLetters
+
+	// stopCtx is cancelled when the shutdown deadline passes, aborting
+	// in-flight storage so Stop can return on time.
+	stopCtx      context.Context
+	abortStorage context.CancelFunc
+
+	admission   *admission
+	ingest      *ingest.Pipeline
+	quota       *quota.Enforcer
+	quotaPolicy quota.Policy
+	registry    *registry.Registry
+	// srs reverses the rewritten senders of forwarded mail when bounces
+	// come back to them; nil when no SRS secret is configured.
+	srs *srs.Rewriter
+
+	sessionsMu sync.Mutex
+	sessions   map[*smtpSession]struct{}
+	drain      drainCounters
+
+	janitor  *retention.Janitor
+	webhooks *webhook.Dispatcher
+	outbound *outbound.Queue
+	pop3     *pop3.Server
+	imap     *imap.Server
+	api      *api.Server
+
+	// events announces each stored message to push subscribers. The relay
+	// feeds it mail stored by other instances, which tag their database
+	// notifications with their instanceID.
+	events     *events.Bus
+	relay      *events.Relay
+	instanceID string
 }
 
 type smtpSession struct {
@@ -66,26 +119,48 @@ type smtpSession struct {
 	helo       string
 	sender     string
 	recipients []string
+	// relays holds the original senders behind SRS recipients; the message
+	// is passed on to them instead of being stored.
+	relays     []string
+	dsn        *message.DSN
+	smtputf8   bool
 	message    *bytes.Buffer
 	remoteAddr string
 	ctx        context.Context
+
+	// inBdat is set from the first BDAT chunk until BDAT LAST or RSET
+	// ends the transfer, which spans several commands.
+	inBdat bool
+
+	// mu orders the inData flag against shutdown's read-deadline nudge, so
+	// a session is never interrupted halfway through a DATA or BDAT
+	// transfer.
+	mu     sync.Mutex
+	inData bool
 }
 
-// extractAddress pulls the email address out of an SMTP path argument such as
-// "<user@example.com> SIZE=4013". It returns the content between the angle
-// brackets when present, otherwise the first whitespace-delimited token, so
-// trailing ESMTP parameters (SIZE, BODY, NOTIFY, ...) are never folded into the
-// address.
-func extractAddress(s string) string {
-	if start := strings.IndexByte(s, '<'); start >= 0 {
-		if end := strings.IndexByte(s[start:], '>'); end >= 0 {
-			return strings.TrimSpace(s[start+1 : start+end])
-		}
+// esmtpParams splits the ESMTP parameters that follow a MAIL or RCPT path,
+// such as SIZE=4013, keyed by upper-cased keyword. Keywords without a value
+// map to "".
+func esmtpParams(s string) map[string]string {
+	params := make(map[string]string)
+	for _, field := range strings.Fields(s) {
+		keyword, value, _ := strings.Cut(field, "=")
+		params[strings.ToUpper(keyword)] = value
 	}
-	if i := strings.IndexAny(s, " \t"); i >= 0 {
-		s = s[:i]
+	return params
+}
+
+// writeAddressError replies to a path that failed to parse. status is the
+// enhanced status code for a mailbox that is not allowed, which differs
+// between senders and recipients.
+func (s *smtpSession) writeAddressError(err error, status string) {
+	var addrErr *message.AddressError
+	if !errors.As(err, &addrErr) || addrErr.Code == 501 {
+		s.writeResponse(fmt.Sprintf("501 5.5.4 %v\r\n", err))
+		return
 	}
-	return strings.TrimSpace(s)
+	s.writeResponse(fmt.Sprintf("553 %s %s\r\n", status, addrErr.Reason))
 }
 
 func (s *smtpSession) writeResponse(response string) error {
@@ -133,7 +208,7 @@ func (s *smtpSession) handleHelo(cmd string, params string) {
 			capabilities = append(capabilities, "250-CHUNKING")
 		}
 
-		capabilities = append(capabilities, "250-PIPELINING", "250-SMTPUTF8")
+		capabilities = append(capabilities, "250-PIPELINING", "250-SMTPUTF8", "250-DSN")
 
 		lastCapability := "250 HELP"
 
@@ -155,25 +230,42 @@ func (s *smtpSession) handleMailFrom(params string) {
 		return
 	}
 
-	addr := extractAddress(strings.TrimSpace(params[5:]))
+	if !strings.HasPrefix(strings.ToUpper(params), "FROM:") {
+		s.writeResponse("501 5.5.4 Syntax: MAIL FROM:<address>\r\n")
+		return
+	}
+
+	// An empty path, "<>", is the null reverse-path of bounces and other
+	// automatic mail that must never be answered (RFC 5321 section 4.5.5).
+	path, rest, err := message.ParsePath(params[5:])
+	if err != nil {
+		s.writeAddressError(err, "5.1.7")
+		return
+	}
 
-	if addr == "" {
-		s.writeResponse("501 Invalid sender address format\r\n")
+	esmtp := esmtpParams(rest)
+	_, smtputf8 := esmtp["SMTPUTF8"]
+	if path.UTF8 && !smtputf8 {
+		s.writeResponse("553 5.6.7 Non-ASCII address requires SMTPUTF8\r\n")
 		return
 	}
 
-	if !strings.Contains(addr, "@") {
-		s.writeResponse("501 Invalid sender address format\r\n")
+	dsn, ok := s.mailDSN(esmtp)
+	if !ok {
 		return
 	}
 
+	addr := path.String()
 	s.sender = addr
+	s.smtputf8 = smtputf8
 	s.state = stateMailFrom
 	s.recipients = nil
+	s.relays = nil
+	s.dsn = dsn
 	s.message.Reset()
 
 	s.writeResponse("250 OK\r\n")
-	logger.Info("Mail from", "sender", addr)
+	logger.Info("Mail from", "sender", "<"+addr+">")
 
 }
 
@@ -190,30 +282,181 @@ func (s *smtpSession) handleRcptTo(params string) {
 		return
 	}
 
-	if len(s.recipients) >= s.server.config.MaxRecipients {
+	if len(s.recipients)+len(s.relays) >= s.server.config.MaxRecipients {
 		s.writeResponse("452 Too many recipients\r\n")
 		return
 	}
 
-	addr := extractAddress(strings.TrimSpace(params[3:]))
+	arg := strings.TrimLeft(params[3:], " \t")
+	// Postmaster must be reachable without a domain (RFC 5321 section
+	// 4.1.1.3).
+	if len(arg) >= 12 && strings.EqualFold(arg[:12], "<postmaster>") {
+		arg = "<postmaster@" + s.server.config.Domain + ">" + arg[12:]
+	}
+
+	path, rest, err := message.ParsePath(arg)
+	if err != nil {
+		s.writeAddressError(err, "5.1.3")
+		return
+	}
+
+	if path.IsNull() {
+		s.writeResponse("501 5.5.4 Empty recipient address\r\n")
+		return
+	}
+
+	if path.UTF8 && !s.smtputf8 {
+		s.writeResponse("553 5.6.7 Non-ASCII address requires SMTPUTF8\r\n")
+		return
+	}
+
+	addr := path.String()
+	rcptDSN, ok := s.rcptDSN(esmtpParams(rest))
+	if !ok {
+		return
+	}
+
+	if reply := s.server.admission.check(); reply != nil {
+		logger.Warn("Recipient deferred, server degraded", "recipient", addr, "reply", reply.Error())
+		s.writeResponse(reply.String())
+		return
+	}
 
-	if addr == "" {
-		s.writeResponse("501 Empty recipient address\r\n")
+	if s.server.srs != nil && s.admitRelay(addr, rcptDSN) {
 		return
 	}
 
-	if !strings.Contains(addr, "@") {
-		s.writeResponse("501 Invalid recipient address format\r\n")
+	addr, ok = s.admitRecipient(addr)
+	if !ok {
 		return
 	}
 
 	s.recipients = append(s.recipients, addr)
+	s.setRecipientDSN(addr, rcptDSN)
 	s.state = stateRcptTo
 
 	s.writeResponse("250 OK\r\n")
 	logger.Info("Recipient added", "recipient", addr)
 }
 
+// mailDSN reads the DSN parameters of a MAIL command, replying to the
+// client itself when they are invalid. It returns nil when there are none.
+func (s *smtpSession) mailDSN(params map[string]string) (*message.DSN, bool) {
+	dsn := &message.DSN{}
+	var err error
+
+	if v, ok := params["RET"]; ok {
+		if dsn.Ret, err = message.ParseRet(v); err != nil {
+			s.writeResponse("501 5.5.4 Invalid RET parameter\r\n")
+			return nil, false
+		}
+	}
+	if v, ok := params["ENVID"]; ok {
+		if dsn.EnvID, err = message.ParseEnvID(v); err != nil {
+			s.writeResponse("501 5.5.4 Invalid ENVID parameter\r\n")
+			return nil, false
+		}
+	}
+
+	if dsn.Ret == "" && dsn.EnvID == "" {
+		return nil, true
+	}
+	return dsn, true
+}
+
+// rcptDSN reads the DSN parameters of a RCPT command, replying to the
+// client itself when they are invalid.
+func (s *smtpSession) rcptDSN(params map[string]string) (message.RecipientDSN, bool) {
+	var rcpt message.RecipientDSN
+	var err error
+
+	if v, ok := params["NOTIFY"]; ok {
+		if rcpt.Notify, err = message.ParseNotify(v); err != nil {
+			s.writeResponse("501 5.5.4 Invalid NOTIFY parameter\r\n")
+			return rcpt, false
+		}
+	}
+	if v, ok := params["ORCPT"]; ok {
+		if rcpt.ORCPT, err = message.ParseORCPT(v); err != nil {
+			s.writeResponse("501 5.5.4 Invalid ORCPT parameter\r\n")
+			return rcpt, false
+		}
+	}
+	return rcpt, true
+}
+
+func (s *smtpSession) setRecipientDSN(rcpt string, params message.RecipientDSN) {
+	if len(params.Notify) == 0 && params.ORCPT == "" {
+		return
+	}
+	if s.dsn == nil {
+		s.dsn = &message.DSN{}
+	}
+	if s.dsn.Recipients == nil {
+		s.dsn.Recipients = make(map[string]message.RecipientDSN)
+	}
+	s.dsn.Recipients[rcpt] = params
+}
+
+// admitRelay handles recipients that are SRS addresses at our domain, the
+// rewritten senders of forwarded mail. Bounces to them are passed on to the
+// original sender; forged and expired ones are refused. It reports whether
+// the recipient was an SRS address, having replied to the client.
+func (s *smtpSession) admitRelay(addr string, rcptDSN message.RecipientDSN) bool {
+	logger := s.server.config.Logger.With("client", s.remoteAddr, "recipient", addr)
+
+	original, err := s.server.srs.Reverse(addr)
+	if errors.Is(err, srs.ErrNotSRS) {
+		return false
+	}
+	if err != nil {
+		logger.Info("Recipient rejected, invalid SRS address", "error", err)
+		s.writeResponse("550 5.7.1 Invalid SRS address\r\n")
+		return true
+	}
+	if s.server.outbound == nil {
+		logger.Info("Recipient rejected, forwarding is disabled")
+		s.writeResponse("550 5.7.1 Relaying disabled\r\n")
+		return true
+	}
+
+	s.relays = append(s.relays, original)
+	s.setRecipientDSN(original, rcptDSN)
+	s.state = stateRcptTo
+
+	s.writeResponse("250 OK\r\n")
+	logger.Info("SRS recipient added", "original", original)
+	return true
+}
+
+// admitRecipient runs a recipient through the ingest admission checks,
+// replying to the client itself when the recipient is refused. Accepted
+// recipients come back in the form they are stored under.
+func (s *smtpSession) admitRecipient(addr string) (string, bool) {
+	logger := s.server.config.Logger.With("client", s.remoteAddr, "recipient", addr)
+
+	ctx, cancel := context.WithTimeout(s.ctx, 2*time.Second)
+	defer cancel()
+
+	canonical, err := s.server.ingest.Admit(ctx, addr)
+	switch {
+	case err == nil:
+		return canonical, true
+	case errors.Is(err, ingest.ErrUnknownRecipient):
+		logger.Info("Recipient rejected, address not registered")
+		s.writeResponse("550 5.1.1 No such mailbox\r\n")
+	case errors.Is(err, ingest.ErrExpiredRecipient):
+		logger.Info("Recipient rejected, address expired")
+		s.writeResponse("550 5.1.1 Mailbox has expired\r\n")
+	case errors.Is(err, ingest.ErrMailboxFull):
+		s.writeResponse("452 4.2.2 Mailbox full\r\n")
+	default:
+		logger.Warn("Address registry lookup failed", "error", err)
+		s.writeResponse("451 4.3.0 Address lookup failed, try again later\r\n")
+	}
+	return "", false
+}
+
 func (s *smtpSession) handleData() {
 	logger := s.server.config.Logger.With("client", s.remoteAddr)
 
@@ -224,6 +467,7 @@ func (s *smtpSession) handleData() {
 
 	s.writeResponse("354 Start mail input; end with <CRLF>.<CRLF>\r\n")
 
+	s.setInData(true)
 	s.state = stateData
 	s.message.Reset()
 
@@ -234,6 +478,10 @@ func (s *smtpSession) handleReset() {
 	s.state = stateHelo
 	s.sender = ""
 	s.recipients = nil
+	s.relays = nil
+	s.dsn = nil
+	s.smtputf8 = false
+	s.endBdat()
 	s.message.Reset()
 
 	s.writeResponse("250 OK\r\n")
@@ -247,35 +495,107 @@ func (s *smtpSession) processMessageData() error {
 		"recipients", strings.Join(s.recipients, ","),
 	)
 
-	messageSize := int64(s.message.Len())
-	rawData := s.message.String()
+	message, parseErr := message.New(s.sender, s.recipients, s.message.Bytes(), time.Now())
+	if parseErr != nil {
+		logger.Debug("Failed to parse message headers", "error", parseErr)
+	}
+	message.DSN = s.dsn
+
+	if reply := s.server.admission.check(); reply != nil {
+		logger.Warn("Message deferred, server degraded", "reply", reply.Error())
+		return reply
+	}
+
+	// The message is handed to storage before it is relayed: a relay
+	// can't be taken back, so nothing may fail after it but the relay
+	// itself.
+	if len(s.recipients) > 0 {
+		if err := s.queueMessage(message, logger); err != nil {
+			return err
+		}
+	}
+
+	if len(s.relays) > 0 {
+		if err := s.relayMessage(); err != nil {
+			logger.Error("Failed to queue message for SRS recipients", "error", err)
+			// Any local copy is already queued; the client's retry is
+			// dropped as a duplicate when it has a Message-ID.
+			return errStorage
+		}
+	}
+	return nil
+}
 
-	message := &message.Message{
-		From: s.sender,
-		To:   s.recipients,
-		Body: rawData,
-		Size: messageSize,
-		Date: time.Now(),
+// queueMessage spools msg, when there is a spool, and passes it to the
+// storage workers. Once it returns nil the message is as good as stored.
+func (s *smtpSession) queueMessage(msg *message.Message, logger *slog.Logger) error {
+	queued := &queuedMail{msg: msg}
+	if s.server.spool != nil {
+		entry, err := s.server.spool.Write(msg)
+		if err != nil {
+			logger.Error("Failed to spool message", "error", err)
+			return errStorage
+		}
+		queued.spoolID = entry.ID
 	}
 
 	select {
-	case s.server.mailQueue <- message:
-		logger.Info("Message queued for processing", "size", messageSize, "recipients", len(s.recipients))
+	case s.server.mailQueue <- queued:
+		logger.Info("Message queued for processing", "size", msg.Size, "recipients", len(s.recipients))
 		return nil
 	default:
-		logger.Warn("Mail queue full, processing synchronously")
-		ctx, cancel := context.WithTimeout(s.ctx, 3*time.Second)
-		defer cancel()
+		if queued.spoolID != "" {
+			s.server.spool.Release(queued.spoolID)
+			logger.Warn("Mail queue full, message left in spool for replay", "spool_id", queued.spoolID)
+			return nil
+		}
 
-		err := database.StoreMail(ctx, s.server.db, message)
-		if err != nil {
-			logger.Error("Failed to store message", "error", err)
-			return err
+		logger.Warn("Mail queue full, deferring message")
+		return errQueueBusy
+	}
+}
+
+// relayMessage queues the message for delivery to the original senders
+// behind the session's SRS recipients.
+func (s *smtpSession) relayMessage() error {
+	ctx, cancel := context.WithTimeout(s.ctx, 10*time.Second)
+	defer cancel()
+
+	body := bytes.Clone(s.message.Bytes())
+	msgs := make([]database.OutboundMessage, 0, len(s.relays))
+	for _, original := range s.relays {
+		m := database.OutboundMessage{
+			Sender:    s.sender,
+			Recipient: original,
+			Body:      body,
+		}
+		if rcptDSN := s.dsn.Recipient(original); rcptDSN.NotifyFailure() {
+			m.ReturnPath = s.sender
+			m.DSNORCPT = rcptDSN.ORCPT
+			if s.dsn != nil {
+				m.DSNRet, m.DSNEnvID = s.dsn.Ret, s.dsn.EnvID
+			}
 		}
+		msgs = append(msgs, m)
+	}
+	if err := s.server.outbound.Enqueue(ctx, msgs); err != nil {
+		return err
+	}
 
-		logger.Info("Message stored synchronously", "size", messageSize, "recipients", len(s.recipients))
-		return nil
+	s.server.config.Logger.Info("Message relayed to SRS originals",
+		"client", s.remoteAddr, "recipients", strings.Join(s.relays, ","))
+	return nil
+}
+
+// writeFailure reports a failed end-of-data, using the error's own reply
+// when it carries one and a permanent 554 otherwise.
+func (s *smtpSession) writeFailure(err error) {
+	var reply *smtpReply
+	if errors.As(err, &reply) {
+		s.writeResponse(reply.String())
+		return
 	}
+	s.writeResponse("554 Transaction failed\r\n")
 }
 
 func (s *smtpSession) handleBdat(params string) {
@@ -306,6 +626,11 @@ func (s *smtpSession) handleBdat(params string) {
 
 	logger.Info("Receiving BDAT chunk", "size", chunkSize, "isLast", isLast)
 
+	if !s.inBdat {
+		s.inBdat = true
+		s.setInData(true)
+	}
+
 	chunk := make([]byte, chunkSize)
 	bytesRead := 0
 
@@ -313,6 +638,7 @@ func (s *smtpSession) handleBdat(params string) {
 		n, err := s.reader.Read(chunk[bytesRead:])
 		if err != nil {
 			logger.Error("Error reading BDAT chunk", "error", err)
+			s.endBdat()
 			s.writeResponse("554 Transaction failed\r\n")
 			return
 		}
@@ -326,23 +652,62 @@ func (s *smtpSession) handleBdat(params string) {
 		s.writeResponse("552 Message size exceeds fixed limit\r\n")
 		s.message.Reset()
 		s.state = stateHelo
+		s.endBdat()
 		return
 	}
 
-	s.writeResponse("250 OK\r\n")
+	if !isLast {
+		s.writeResponse("250 OK\r\n")
+		return
+	}
 
-	if isLast {
-		logger.Info("Processing complete BDAT message")
-		err := s.processMessageData()
-		if err != nil {
-			logger.Error("Failed to process BDAT message data", "error", err)
-			s.writeResponse("554 Transaction failed\r\n")
-			return
-		}
+	logger.Info("Processing complete BDAT message")
+	err = s.processMessageData()
+	s.message.Reset()
+	s.state = stateHelo
+	s.endBdat()
+	if err != nil {
+		logger.Error("Failed to process BDAT message data", "error", err)
+		s.writeFailure(err)
+		return
+	}
 
-		s.state = stateHelo
-		logger.Info("BDAT message accepted successfully")
+	s.writeResponse("250 OK: message accepted\r\n")
+	logger.Info("BDAT message accepted successfully")
+}
+
+// endBdat ends a chunked transfer. The session stays marked in-data until
+// the reply is written, as after DATA, and is cleared before the next read.
+func (s *smtpSession) endBdat() {
+	s.inBdat = false
+}
+
+func (s *smtpSession) setInData(inData bool) {
+	s.mu.Lock()
+	s.inData = inData
+	s.mu.Unlock()
+}
+
+// armDeadlines extends the connection deadlines for the next read. It
+// returns false instead when the server is draining and the session is
+// between transactions, in which case the session should say 421 and close.
+func (s *smtpSession) armDeadlines() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.server.draining.Load() && !s.inData {
+		return false
 	}
+
+	s.conn.SetReadDeadline(time.Now().Add(s.server.config.ReadTimeout))
+	s.conn.SetWriteDeadline(time.Now().Add(s.server.config.WriteTimeout))
+	return true
+}
+
+func (s *smtpSession) closeForShutdown() {
+	s.server.config.Logger.Info("Server shutting down, closing session", "client", s.remoteAddr)
+	s.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	s.writeResponse(fmt.Sprintf("421 %s Service shutting down, closing transmission channel\r\n", s.server.config.Domain))
 }
 
 func (s *smtpSession) process() {
@@ -350,13 +715,23 @@ func (s *smtpSession) process() {
 	logger.Info("Starting new SMTP session")
 
 	for {
+		if s.state != stateData && !s.inBdat {
+			s.setInData(false)
+		}
+
 		logger.Debug("Setting connection deadlines")
-		s.conn.SetReadDeadline(time.Now().Add(s.server.config.ReadTimeout))
-		s.conn.SetWriteDeadline(time.Now().Add(s.server.config.WriteTimeout))
+		if !s.armDeadlines() {
+			s.closeForShutdown()
+			return
+		}
 
 		logger.Debug("Waiting for client command")
 		line, err := s.reader.ReadString('\n')
 		if err != nil {
+			if s.server.draining.Load() {
+				s.closeForShutdown()
+				return
+			}
 			if err != io.EOF {
 				logger.Error("Failed to read command", "error", err)
 			} else {
@@ -376,7 +751,8 @@ func (s *smtpSession) process() {
 				err := s.processMessageData()
 				if err != nil {
 					logger.Error("Failed to process message data", "error", err)
-					s.writeResponse("554 Transaction failed\r\n")
+					s.state = stateHelo
+					s.writeFailure(err)
 					continue
 				}
 
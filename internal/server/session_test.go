@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/internal/config"
+)
+
+// testSession runs an SMTP session over an in-memory connection, without
+// storage, and returns the client's end of it.
+func testSession(t *testing.T) *textproto.Conn {
+	t.Helper()
+	cfg := config.DefaultConfig()
+	cfg.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg.ReadTimeout = 5 * time.Second
+	cfg.WriteTimeout = 5 * time.Second
+
+	client, conn := net.Pipe()
+	s := &smtpSession{
+		server:     &Server{config: cfg},
+		conn:       conn,
+		reader:     bufio.NewReader(conn),
+		writer:     bufio.NewWriter(conn),
+		state:      stateInit,
+		message:    new(bytes.Buffer),
+		remoteAddr: "pipe",
+		ctx:        context.Background(),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer conn.Close()
+		s.process()
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	return textproto.NewConn(client)
+}
+
+func TestMailFromSyntax(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		code int
+	}{
+		{"MAIL", 501},
+		{"MAIL X", 501},
+		{"MAIL FROM", 501},
+		{"MAIL TO:<user@example.com>", 501},
+		{"MAIL FROM:<>", 250},
+		{"mail from:<user@example.com>", 250},
+	}
+
+	for _, tt := range tests {
+		tp := testSession(t)
+		if err := tp.PrintfLine("HELO client.test"); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := tp.ReadResponse(250); err != nil {
+			t.Fatalf("HELO: %v", err)
+		}
+
+		if err := tp.PrintfLine("%s", tt.cmd); err != nil {
+			t.Fatal(err)
+		}
+		code, msg, err := tp.ReadResponse(0)
+		if err != nil && code == 0 {
+			t.Fatalf("%s: %v", tt.cmd, err)
+		}
+		if code != tt.code {
+			t.Errorf("%s: reply %d %s, want %d", tt.cmd, code, msg, tt.code)
+		}
+	}
+}
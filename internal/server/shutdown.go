@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ShutdownReport summarises what happened to accepted mail during Stop.
+type ShutdownReport struct {
+	// Flushed counts messages stored after shutdown began.
+	Flushed int64
+	// Spooled counts messages left unstored but safe in the spool or dead
+	// letter area; they are retried after the next start.
+	Spooled int64
+	// Lost counts accepted messages that were neither stored nor spooled.
+	Lost int64
+	// ForcedSessions counts sessions still open at the deadline, whose
+	// connections were closed under them.
+	ForcedSessions int
+}
+
+type drainCounters struct {
+	flushed atomic.Int64
+	spooled atomic.Int64
+	lost    atomic.Int64
+}
+
+func (s *Server) trackSession(session *smtpSession, open bool) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	if open {
+		s.sessions[session] = struct{}{}
+	} else {
+		delete(s.sessions, session)
+	}
+}
+
+// countDrained records the outcome of a store attempt made while the server
+// is draining; outcomes from normal operation are not part of the report.
+func (s *Server) countDrained(stored, durable bool) {
+	if !s.draining.Load() {
+		return
+	}
+
+	switch {
+	case stored:
+		s.drain.flushed.Add(1)
+	case durable:
+		s.drain.spooled.Add(1)
+	default:
+		s.drain.lost.Add(1)
+	}
+}
+
+// Stop shuts the server down in stages, each bounded by ctx: stop accepting
+// connections, send 421 to idle sessions while letting in-progress DATA
+// finish, then drain the mail queue into storage. Whatever is left when ctx
+// expires is cut off and reported as spooled or lost.
+func (s *Server) Stop(ctx context.Context) (ShutdownReport, error) {
+	var report ShutdownReport
+	logger := s.config.Logger
+
+	s.draining.Store(true)
+	close(s.shutdown)
+
+	if s.listener != nil {
+		s.listener.Close()
+	}
+
+	// The accept loop and spool replay are the only other producers; once
+	// they are gone no new session can register.
+	s.wg.Wait()
+
+	if s.janitor != nil {
+		s.janitor.Stop()
+	}
+
+	s.stopReaders(ctx)
+
+	s.sessionsMu.Lock()
+	for session := range s.sessions {
+		session.mu.Lock()
+		if !session.inData {
+			session.conn.SetReadDeadline(time.Now())
+		}
+		session.mu.Unlock()
+	}
+	s.sessionsMu.Unlock()
+
+	if !waitGroupContext(ctx, &s.sessionWG) {
+		s.sessionsMu.Lock()
+		report.ForcedSessions = len(s.sessions)
+		for session := range s.sessions {
+			session.conn.Close()
+		}
+		s.sessionsMu.Unlock()
+		s.sessionWG.Wait()
+	}
+
+	// Every producer has exited, so closing the queue lets workers finish
+	// the backlog and return.
+	close(s.mailQueue)
+
+	if !waitGroupContext(ctx, &s.workerWG) {
+		s.abortStorage()
+		s.workerWG.Wait()
+	}
+	s.abortStorage()
+
+	// Storage workers were the only source of deliveries; anything still
+	// queued is sent after the next start.
+	if s.webhooks != nil {
+		s.webhooks.Stop()
+	}
+	if s.outbound != nil {
+		s.outbound.Stop()
+	}
+
+	for item := range s.mailQueue {
+		if item.spoolID != "" || item.deadLetter != nil {
+			s.drain.spooled.Add(1)
+		} else {
+			s.drain.lost.Add(1)
+		}
+	}
+
+	s.rateLimiter.Cleanup()
+
+	report.Flushed = s.drain.flushed.Load()
+	report.Spooled = s.drain.spooled.Load()
+	report.Lost = s.drain.lost.Load()
+
+	logger.Info("SMTP server stopped",
+		"flushed", report.Flushed,
+		"spooled", report.Spooled,
+		"lost", report.Lost,
+		"forced_sessions", report.ForcedSessions)
+
+	return report, ctx.Err()
+}
+
+// waitGroupContext waits for wg, returning false if ctx ends first.
+func waitGroupContext(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
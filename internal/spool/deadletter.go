@@ -0,0 +1,286 @@
+package spool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/pkg/message"
+)
+
+const deadLetterSuffix = ".json"
+
+type DeadLetter struct {
+	ID            string           `json:"id"`
+	Message       *message.Message `json:"message"`
+	Attempts      int              `json:"attempts"`
+	LastError     string           `json:"last_error"`
+	FirstFailedAt time.Time        `json:"first_failed_at"`
+	LastAttemptAt time.Time        `json:"last_attempt_at"`
+	// NextRetryAt is zero once the entry has used up its automatic retries;
+	// it then waits for an operator to retry or purge it.
+	NextRetryAt time.Time `json:"next_retry_at"`
+}
+
+// Parked reports whether the entry is no longer retried automatically.
+func (d *DeadLetter) Parked() bool {
+	return d.NextRetryAt.IsZero()
+}
+
+type RetryPolicy struct {
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+}
+
+// next returns when to try again after attempts failures, or the zero time
+// once the entry should be parked.
+func (p RetryPolicy) next(attempts int, now time.Time) time.Time {
+	if p.MaxAttempts > 0 && attempts >= p.MaxAttempts {
+		return time.Time{}
+	}
+
+	backoff := p.MinBackoff
+	for i := 1; i < attempts && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	return now.Add(backoff)
+}
+
+// DeadLetters is a directory of messages whose storage failed. It lives on
+// disk rather than in the database because the database is the usual reason
+// a message ends up here.
+type DeadLetters struct {
+	dir    string
+	policy RetryPolicy
+
+	mu      sync.Mutex
+	claimed map[string]struct{}
+}
+
+func OpenDeadLetters(dir string, policy RetryPolicy) (*DeadLetters, error) {
+	if err := os.MkdirAll(filepath.Join(dir, tmpDir), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create dead letter directory: %w", err)
+	}
+	if policy.MinBackoff <= 0 {
+		policy.MinBackoff = time.Minute
+	}
+	if policy.MaxBackoff < policy.MinBackoff {
+		policy.MaxBackoff = policy.MinBackoff
+	}
+
+	return &DeadLetters{
+		dir:     dir,
+		policy:  policy,
+		claimed: make(map[string]struct{}),
+	}, nil
+}
+
+// Add records a first storage failure for msg.
+func (d *DeadLetters) Add(msg *message.Message, cause error) (*DeadLetter, error) {
+	id, err := newID(msg.Date)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	entry := &DeadLetter{
+		ID:            id,
+		Message:       msg,
+		Attempts:      1,
+		LastError:     cause.Error(),
+		FirstFailedAt: now,
+		LastAttemptAt: now,
+		NextRetryAt:   d.policy.next(1, now),
+	}
+
+	if err := d.write(entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Fail records another failed retry of a claimed entry and releases it.
+func (d *DeadLetters) Fail(entry *DeadLetter, cause error) error {
+	defer d.release(entry.ID)
+
+	now := time.Now()
+	entry.Attempts++
+	entry.LastError = cause.Error()
+	entry.LastAttemptAt = now
+	entry.NextRetryAt = d.policy.next(entry.Attempts, now)
+
+	return d.write(entry)
+}
+
+// Release gives up a claim without recording an attempt, for retries that
+// were cut short by shutdown rather than failed by storage.
+func (d *DeadLetters) Release(id string) {
+	d.release(id)
+}
+
+// Remove deletes an entry, after a successful retry or when purged.
+func (d *DeadLetters) Remove(id string) error {
+	defer d.release(id)
+
+	err := os.Remove(d.path(id))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove dead letter %s: %w", id, err)
+	}
+	return nil
+}
+
+// ClaimDue loads and claims unclaimed entries whose retry time has passed.
+func (d *DeadLetters) ClaimDue(now time.Time) ([]*DeadLetter, error) {
+	all, err := d.List()
+
+	var due []*DeadLetter
+	for _, entry := range all {
+		if entry.Parked() || entry.NextRetryAt.After(now) {
+			continue
+		}
+		if d.claim(entry.ID) {
+			due = append(due, entry)
+		}
+	}
+	return due, err
+}
+
+// List returns every entry oldest first. Unreadable files are skipped and
+// reported in the error.
+func (d *DeadLetters) List() ([]*DeadLetter, error) {
+	names, err := filepath.Glob(filepath.Join(d.dir, "*"+deadLetterSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dead letters: %w", err)
+	}
+	sort.Strings(names)
+
+	entries := make([]*DeadLetter, 0, len(names))
+	var errs []error
+	for _, name := range names {
+		entry, err := readDeadLetter(name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, errors.Join(errs...)
+}
+
+func (d *DeadLetters) Get(id string) (*DeadLetter, error) {
+	if !validID(id) {
+		return nil, fmt.Errorf("invalid dead letter id %q", id)
+	}
+	return readDeadLetter(d.path(id))
+}
+
+// Retry makes an entry due immediately, including parked ones, and resets
+// its attempt budget.
+func (d *DeadLetters) Retry(id string) error {
+	entry, err := d.Get(id)
+	if err != nil {
+		return err
+	}
+
+	entry.Attempts = 0
+	entry.NextRetryAt = time.Now()
+	return d.write(entry)
+}
+
+// Purge removes the given entries, or every entry when ids is empty, and
+// returns how many were removed.
+func (d *DeadLetters) Purge(ids ...string) (int, error) {
+	if len(ids) == 0 {
+		all, err := d.List()
+		if err != nil && len(all) == 0 {
+			return 0, err
+		}
+		for _, entry := range all {
+			ids = append(ids, entry.ID)
+		}
+	}
+
+	removed := 0
+	for _, id := range ids {
+		if !validID(id) {
+			return removed, fmt.Errorf("invalid dead letter id %q", id)
+		}
+		if err := d.Remove(id); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, syncDir(d.dir)
+}
+
+func (d *DeadLetters) Len() int {
+	names, _ := filepath.Glob(filepath.Join(d.dir, "*"+deadLetterSuffix))
+	return len(names)
+}
+
+func (d *DeadLetters) write(entry *DeadLetter) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode dead letter: %w", err)
+	}
+
+	tmpPath := filepath.Join(d.dir, tmpDir, entry.ID+deadLetterSuffix)
+	if err := writeFileSync(tmpPath, data); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, d.path(entry.ID)); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to commit dead letter: %w", err)
+	}
+	return syncDir(d.dir)
+}
+
+func (d *DeadLetters) claim(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, held := d.claimed[id]; held {
+		return false
+	}
+	d.claimed[id] = struct{}{}
+	return true
+}
+
+func (d *DeadLetters) release(id string) {
+	d.mu.Lock()
+	delete(d.claimed, id)
+	d.mu.Unlock()
+}
+
+func (d *DeadLetters) path(id string) string {
+	return filepath.Join(d.dir, id+deadLetterSuffix)
+}
+
+func readDeadLetter(path string) (*DeadLetter, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead letter %s: %w", path, err)
+	}
+
+	var entry DeadLetter
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("failed to decode dead letter %s: %w", path, err)
+	}
+	return &entry, nil
+}
+
+// validID guards admin input that becomes part of a file path.
+func validID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, `/\.`)
+}
@@ -0,0 +1,222 @@
+package spool
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/pkg/message"
+)
+
+const (
+	entrySuffix = ".msg"
+	tmpDir      = "tmp"
+)
+
+type Entry struct {
+	ID      string
+	Message *message.Message
+}
+
+// Spool is a write-ahead directory of accepted messages. A message is written
+// and fsynced before the SMTP 250 reply, and removed only once it is safely
+// in storage, so anything still in the directory at startup was accepted but
+// never stored and must be replayed.
+//
+// Entries are claimed while a worker holds them so the periodic replay never
+// queues the same message twice.
+type Spool struct {
+	dir string
+
+	mu      sync.Mutex
+	claimed map[string]struct{}
+}
+
+func Open(dir string) (*Spool, error) {
+	if err := os.MkdirAll(filepath.Join(dir, tmpDir), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	// Leftover temp files were never renamed into place, so their messages
+	// were never acknowledged to the sender and can be discarded.
+	leftovers, _ := filepath.Glob(filepath.Join(dir, tmpDir, "*"))
+	for _, path := range leftovers {
+		os.Remove(path)
+	}
+
+	return &Spool{
+		dir:     dir,
+		claimed: make(map[string]struct{}),
+	}, nil
+}
+
+// Write durably stores msg and returns its entry, already claimed by the
+// caller. The message is not acknowledged to the client until this returns.
+func (s *Spool) Write(msg *message.Message) (*Entry, error) {
+	id, err := newID(msg.Date)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode spool entry: %w", err)
+	}
+
+	tmpPath := filepath.Join(s.dir, tmpDir, id+entrySuffix)
+	if err := writeFileSync(tmpPath, data); err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+
+	// Claim before the entry becomes visible so a concurrent replay cannot
+	// queue it a second time.
+	s.claim(id)
+	if err := os.Rename(tmpPath, s.path(id)); err != nil {
+		s.Release(id)
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to commit spool entry: %w", err)
+	}
+	if err := syncDir(s.dir); err != nil {
+		os.Remove(s.path(id))
+		s.Release(id)
+		return nil, err
+	}
+
+	return &Entry{ID: id, Message: msg}, nil
+}
+
+// Remove deletes a stored entry and drops its claim.
+func (s *Spool) Remove(id string) error {
+	err := os.Remove(s.path(id))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove spool entry %s: %w", id, err)
+	}
+
+	s.mu.Lock()
+	delete(s.claimed, id)
+	s.mu.Unlock()
+
+	return syncDir(s.dir)
+}
+
+// Release gives up a claim without deleting the entry, making it eligible for
+// the next replay.
+func (s *Spool) Release(id string) {
+	s.mu.Lock()
+	delete(s.claimed, id)
+	s.mu.Unlock()
+}
+
+// ClaimPending loads and claims every entry that nobody currently holds,
+// oldest first. Entries that cannot be decoded are skipped and reported in
+// the error so a single corrupt file does not block replay.
+func (s *Spool) ClaimPending() ([]*Entry, error) {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+entrySuffix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list spool: %w", err)
+	}
+	sort.Strings(names)
+
+	var entries []*Entry
+	var errs []error
+	for _, name := range names {
+		id := strings.TrimSuffix(filepath.Base(name), entrySuffix)
+		if !s.claim(id) {
+			continue
+		}
+
+		msg, err := readEntry(name)
+		if err != nil {
+			s.Release(id)
+			errs = append(errs, err)
+			continue
+		}
+		entries = append(entries, &Entry{ID: id, Message: msg})
+	}
+
+	return entries, errors.Join(errs...)
+}
+
+// Len returns the number of entries on disk, claimed or not.
+func (s *Spool) Len() int {
+	names, _ := filepath.Glob(filepath.Join(s.dir, "*"+entrySuffix))
+	return len(names)
+}
+
+func (s *Spool) claim(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, held := s.claimed[id]; held {
+		return false
+	}
+	s.claimed[id] = struct{}{}
+	return true
+}
+
+func (s *Spool) path(id string) string {
+	return filepath.Join(s.dir, id+entrySuffix)
+}
+
+// newID prefixes a random suffix with the zero-padded receive time, so a
+// lexical sort of the directory replays mail in arrival order.
+func newID(t time.Time) (string, error) {
+	var suffix [8]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		return "", fmt.Errorf("failed to generate spool id: %w", err)
+	}
+	return fmt.Sprintf("%020d-%s", t.UnixNano(), hex.EncodeToString(suffix[:])), nil
+}
+
+func readEntry(path string) (*message.Message, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool entry %s: %w", path, err)
+	}
+
+	var msg message.Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("failed to decode spool entry %s: %w", path, err)
+	}
+	return &msg, nil
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create spool entry: %w", err)
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write spool entry: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync spool entry: %w", err)
+	}
+	return f.Close()
+}
+
+// syncDir makes a rename or unlink in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open spool directory: %w", err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync spool directory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+// Package srs implements the Sender Rewriting Scheme, which lets forwarded
+// mail pass SPF at its destination: the envelope sender is rewritten into
+// an address at the forwarding domain that encodes the original, so that
+// bounces come back to the forwarder and can be routed on.
+//
+// A sender is rewritten as
+//
+//	SRS0=HHHH=TT=example.com=user@forwarder.example
+//
+// where HHHH is a keyed hash and TT a day stamp. An address that is already
+// SRS0 becomes SRS1, which names the first forwarder instead of repeating
+// the whole chain:
+//
+//	SRS1=HHHH=first.example==HHHH=TT=example.com=user@forwarder.example
+package srs
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotSRS    = errors.New("not an SRS address")
+	ErrMalformed = errors.New("malformed SRS address")
+	ErrBadHash   = errors.New("SRS hash does not match")
+	ErrExpired   = errors.New("SRS address has expired")
+)
+
+const (
+	hashLength = 4
+	// Day stamps count days modulo 2^10 in two base32 characters.
+	stampAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	stampModulo   = 1 << 10
+)
+
+// Rewriter rewrites senders under one domain and one secret. Every instance
+// that receives bounces for the domain needs the same secret.
+type Rewriter struct {
+	key    []byte
+	domain string
+	maxAge int
+	now    func() time.Time
+}
+
+// New returns a Rewriter for addresses at domain. Rewritten addresses are
+// honoured for maxAge, rounded up to whole days.
+func New(secret, domain string, maxAge time.Duration) *Rewriter {
+	days := int((maxAge + 24*time.Hour - 1) / (24 * time.Hour))
+	if days <= 0 {
+		days = 21
+	}
+	return &Rewriter{
+		key:    []byte(secret),
+		domain: strings.ToLower(domain),
+		maxAge: days,
+		now:    time.Now,
+	}
+}
+
+func (r *Rewriter) Domain() string {
+	return r.domain
+}
+
+// IsSRS reports whether address has an SRS0 or SRS1 local part.
+func IsSRS(address string) bool {
+	local, _, ok := split(address)
+	if !ok {
+		return false
+	}
+	_, _, ok = srsPrefix(local)
+	return ok
+}
+
+func split(address string) (local, domain string, ok bool) {
+	at := strings.LastIndexByte(address, '@')
+	if at <= 0 || at == len(address)-1 {
+		return "", "", false
+	}
+	return address[:at], address[at+1:], true
+}
+
+// srsPrefix reports whether local starts with SRS0 or SRS1 and a separator,
+// returning the scheme's digit and the rest after the separator.
+func srsPrefix(local string) (kind byte, rest string, ok bool) {
+	if len(local) < 5 || !strings.EqualFold(local[:3], "SRS") {
+		return 0, "", false
+	}
+	kind = local[3]
+	if (kind != '0' && kind != '1') || !isSeparator(local[4]) {
+		return 0, "", false
+	}
+	return kind, local[5:], true
+}
+
+func isSeparator(c byte) bool {
+	return c == '=' || c == '+' || c == '-'
+}
+
+// Forward returns the envelope sender to use when forwarding mail from
+// sender. The null sender, and senders already at the rewriting domain,
+// are returned unchanged.
+func (r *Rewriter) Forward(sender string) (string, error) {
+	if sender == "" {
+		return "", nil
+	}
+	local, domain, ok := split(sender)
+	if !ok {
+		return "", ErrMalformed
+	}
+
+	switch kind, rest, _ := srsPrefix(local); kind {
+	case '0':
+		// The opaque part keeps its leading separator, so Reverse can
+		// rebuild the SRS0 address exactly.
+		opaque := local[4:]
+		return r.srs1(domain, opaque), nil
+	case '1':
+		// Another forwarder's SRS1: keep the first forwarder and the
+		// opaque part, and sign them ourselves.
+		_, firstHost, opaque, err := parseSRS1(rest)
+		if err != nil {
+			return "", err
+		}
+		return r.srs1(firstHost, opaque), nil
+	}
+
+	if strings.EqualFold(domain, r.domain) {
+		return sender, nil
+	}
+	stamp := r.stamp(r.now())
+	hash := r.hash(stamp, domain, local)
+	return "SRS0=" + hash + "=" + stamp + "=" + domain + "=" + local + "@" + r.domain, nil
+}
+
+func (r *Rewriter) srs1(firstHost, opaque string) string {
+	return "SRS1=" + r.hash(firstHost, opaque) + "=" + firstHost + "=" + opaque + "@" + r.domain
+}
+
+// parseSRS1 splits the part of an SRS1 local part after its separator into
+// hash, first forwarder and the SRS0 opaque part, which starts with the
+// original separator.
+func parseSRS1(rest string) (hash, firstHost, opaque string, err error) {
+	fields := strings.SplitN(rest, "=", 3)
+	if len(fields) != 3 || fields[0] == "" || fields[1] == "" || fields[2] == "" || !isSeparator(fields[2][0]) {
+		return "", "", "", ErrMalformed
+	}
+	return fields[0], fields[1], fields[2], nil
+}
+
+// Reverse returns the address an SRS address at the rewriting domain stands
+// for: the original sender for SRS0, and the first forwarder's SRS0
+// address for SRS1. Forged and expired addresses are errors.
+func (r *Rewriter) Reverse(address string) (string, error) {
+	local, domain, ok := split(address)
+	if !ok {
+		return "", ErrNotSRS
+	}
+	kind, rest, ok := srsPrefix(local)
+	if !ok || !strings.EqualFold(domain, r.domain) {
+		return "", ErrNotSRS
+	}
+
+	if kind == '1' {
+		hash, firstHost, opaque, err := parseSRS1(rest)
+		if err != nil {
+			return "", err
+		}
+		if !r.hashValid(hash, firstHost, opaque) {
+			return "", ErrBadHash
+		}
+		return "SRS0" + opaque + "@" + firstHost, nil
+	}
+
+	fields := strings.SplitN(rest, "=", 4)
+	if len(fields) != 4 || fields[2] == "" || fields[3] == "" {
+		return "", ErrMalformed
+	}
+	hash, stamp, origDomain, origLocal := fields[0], fields[1], fields[2], fields[3]
+	if !r.hashValid(hash, stamp, origDomain, origLocal) {
+		return "", ErrBadHash
+	}
+	if !r.stampValid(stamp) {
+		return "", ErrExpired
+	}
+	return origLocal + "@" + origDomain, nil
+}
+
+// hash signs parts, lower-cased since mail systems may change the case of
+// local parts on the way back.
+func (r *Rewriter) hash(parts ...string) string {
+	mac := hmac.New(sha1.New, r.key)
+	for _, p := range parts {
+		mac.Write([]byte(strings.ToLower(p)))
+		mac.Write([]byte{0})
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:hashLength]
+}
+
+func (r *Rewriter) hashValid(hash string, parts ...string) bool {
+	expected := r.hash(parts...)
+	// Compared case-insensitively for the same reason; the hash keeps
+	// enough entropy either way.
+	return hmac.Equal([]byte(strings.ToLower(expected)), []byte(strings.ToLower(hash)))
+}
+
+func (r *Rewriter) stamp(t time.Time) string {
+	day := int(t.Unix()/86400) % stampModulo
+	return string([]byte{stampAlphabet[day>>5], stampAlphabet[day&31]})
+}
+
+func (r *Rewriter) stampValid(stamp string) bool {
+	if len(stamp) != 2 {
+		return false
+	}
+	hi := strings.IndexByte(stampAlphabet, upper(stamp[0]))
+	lo := strings.IndexByte(stampAlphabet, upper(stamp[1]))
+	if hi < 0 || lo < 0 {
+		return false
+	}
+	today := int(r.now().Unix()/86400) % stampModulo
+	age := (today - (hi<<5 | lo) + stampModulo) % stampModulo
+	return age <= r.maxAge
+}
+
+func upper(c byte) byte {
+	if c >= 'a' && c <= 'z' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
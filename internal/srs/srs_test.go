@@ -0,0 +1,217 @@
+package srs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wrapDay is a day whose stamp is two days short of wrapping back to zero.
+const wrapDay = 20*stampModulo + stampModulo - 2
+
+func dayTime(day int) time.Time {
+	return time.Unix(int64(day)*86400+12*3600, 0)
+}
+
+// testRewriter returns a Rewriter for domain whose clock reads now.
+func testRewriter(secret, domain string, now *time.Time) *Rewriter {
+	r := New(secret, domain, 21*24*time.Hour)
+	r.now = func() time.Time { return *now }
+	return r
+}
+
+// field replaces field i of the local part of address, split on '='.
+func field(address string, i int, edit func(string) string) string {
+	local, domain, _ := split(address)
+	fields := strings.Split(local, "=")
+	fields[i] = edit(fields[i])
+	return strings.Join(fields, "=") + "@" + domain
+}
+
+// otherHash changes the first character of a hash to one that differs
+// from it regardless of case.
+func otherHash(hash string) string {
+	if upper(hash[0]) == 'A' {
+		return "B" + hash[1:]
+	}
+	return "A" + hash[1:]
+}
+
+func TestForwardReverse(t *testing.T) {
+	tests := []struct {
+		name   string
+		sender string
+		day    int // the day the sender is rewritten
+		age    int // days until the bounce comes back
+		edit   func(string) string
+		want   string
+		err    error
+	}{
+		{name: "round trip", sender: "user@example.com", want: "user@example.com"},
+		{name: "local part keeps its case", sender: "First.Last@Example.com", want: "First.Last@Example.com"},
+		{name: "upper-cased on the way back", sender: "user@example.com", edit: strings.ToUpper, want: "USER@EXAMPLE.COM"},
+		{name: "lower-cased on the way back", sender: "user@example.com", edit: strings.ToLower, want: "user@example.com"},
+		{name: "within max age", sender: "user@example.com", age: 21, want: "user@example.com"},
+		{name: "past max age", sender: "user@example.com", age: 22, err: ErrExpired},
+		{name: "across the stamp wrap", sender: "user@example.com", day: wrapDay, age: 5, want: "user@example.com"},
+		{name: "expired across the stamp wrap", sender: "user@example.com", day: wrapDay, age: 30, err: ErrExpired},
+		{name: "tampered hash", sender: "user@example.com", edit: func(a string) string { return field(a, 1, otherHash) }, err: ErrBadHash},
+		{name: "tampered stamp", sender: "user@example.com", edit: func(a string) string {
+			return field(a, 2, func(string) string { return "ZZ" })
+		}, err: ErrBadHash},
+		{name: "tampered domain", sender: "user@example.com", edit: func(a string) string {
+			return field(a, 3, func(string) string { return "evil.example" })
+		}, err: ErrBadHash},
+		{name: "tampered local part", sender: "user@example.com", edit: func(a string) string {
+			return field(a, 4, func(string) string { return "admin" })
+		}, err: ErrBadHash},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			day := tt.day
+			if day == 0 {
+				day = 20000
+			}
+			now := dayTime(day)
+			r := testRewriter("secret", "fwd.example", &now)
+
+			rewritten, err := r.Forward(tt.sender)
+			if err != nil {
+				t.Fatalf("Forward(%q): %v", tt.sender, err)
+			}
+			if !strings.HasPrefix(rewritten, "SRS0=") || !strings.HasSuffix(rewritten, "@fwd.example") {
+				t.Fatalf("Forward(%q) = %q, want an SRS0 address at fwd.example", tt.sender, rewritten)
+			}
+			if tt.edit != nil {
+				rewritten = tt.edit(rewritten)
+			}
+
+			now = dayTime(day + tt.age)
+			got, err := r.Reverse(rewritten)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("Reverse(%q) = %q, %v; want %v", rewritten, got, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Reverse(%q): %v", rewritten, err)
+			}
+			if got != tt.want {
+				t.Errorf("Reverse(%q) = %q, want %q", rewritten, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardUnchanged(t *testing.T) {
+	now := dayTime(20000)
+	r := testRewriter("secret", "fwd.example", &now)
+
+	for _, sender := range []string{"", "user@fwd.example", "user@FWD.example"} {
+		got, err := r.Forward(sender)
+		if err != nil || got != sender {
+			t.Errorf("Forward(%q) = %q, %v; want it unchanged", sender, got, err)
+		}
+	}
+	for _, sender := range []string{"user", "user@", "@example.com"} {
+		if _, err := r.Forward(sender); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Forward(%q) error = %v, want %v", sender, err, ErrMalformed)
+		}
+	}
+}
+
+func TestReverseNotSRS(t *testing.T) {
+	now := dayTime(20000)
+	r := testRewriter("secret", "fwd.example", &now)
+	other := testRewriter("secret", "other.example", &now)
+
+	atOther, err := other.Forward("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		address string
+		err     error
+	}{
+		{"user@fwd.example", ErrNotSRS},
+		{"SRS2=abcd=AB=example.com=user@fwd.example", ErrNotSRS},
+		{atOther, ErrNotSRS},
+		{"SRS0=abcd=AB@fwd.example", ErrMalformed},
+		{"SRS0=abcd=AB=example.com=@fwd.example", ErrMalformed},
+		{"SRS1=abcd=first.example@fwd.example", ErrMalformed},
+		{"SRS1=abcd=first.example=x@fwd.example", ErrMalformed},
+	}
+	for _, tt := range tests {
+		if got, err := r.Reverse(tt.address); !errors.Is(err, tt.err) {
+			t.Errorf("Reverse(%q) = %q, %v; want %v", tt.address, got, err, tt.err)
+		}
+	}
+}
+
+// TestSRS1Chain forwards a message through three forwarders, each with its
+// own secret. Bounces go from the last straight back to the first.
+func TestSRS1Chain(t *testing.T) {
+	now := dayTime(20000)
+	first := testRewriter("first-secret", "first.example", &now)
+	second := testRewriter("second-secret", "second.example", &now)
+	third := testRewriter("third-secret", "third.example", &now)
+
+	srs0, err := first.Forward("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srs1, err := second.Forward(srs0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opaque := strings.TrimSuffix(strings.TrimPrefix(srs0, "SRS0"), "@first.example")
+	if !strings.HasPrefix(srs1, "SRS1=") || !strings.HasSuffix(srs1, "=first.example="+opaque+"@second.example") {
+		t.Fatalf("second.Forward(%q) = %q, want an SRS1 address naming first.example", srs0, srs1)
+	}
+	again, err := third.Forward(srs1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(again, "=first.example="+opaque+"@third.example") {
+		t.Fatalf("third.Forward(%q) = %q, want an SRS1 address naming first.example", srs1, again)
+	}
+
+	for _, hop := range []struct {
+		r       *Rewriter
+		address string
+	}{
+		{second, srs1},
+		{third, again},
+		{third, strings.ToUpper(again)},
+	} {
+		got, err := hop.r.Reverse(hop.address)
+		if err != nil {
+			t.Fatalf("%s: Reverse(%q): %v", hop.r.Domain(), hop.address, err)
+		}
+		if !strings.EqualFold(got, srs0) {
+			t.Errorf("%s: Reverse(%q) = %q, want %q", hop.r.Domain(), hop.address, got, srs0)
+		}
+	}
+
+	got, err := first.Reverse(srs0)
+	if err != nil || got != "user@example.com" {
+		t.Errorf("first.Reverse(%q) = %q, %v; want user@example.com", srs0, got, err)
+	}
+
+	tampered := []string{
+		field(srs1, 1, otherHash),
+		field(srs1, 2, func(string) string { return "evil.example" }),
+		field(srs1, 4, otherHash),
+	}
+	for _, address := range tampered {
+		if got, err := second.Reverse(address); !errors.Is(err, ErrBadHash) {
+			t.Errorf("Reverse(%q) = %q, %v; want %v", address, got, err, ErrBadHash)
+		}
+	}
+	if got, err := third.Reverse(srs1); !errors.Is(err, ErrNotSRS) {
+		t.Errorf("third.Reverse(%q) = %q, %v; want %v", srs1, got, err, ErrNotSRS)
+	}
+}
@@ -0,0 +1,357 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/database"
+	"github.com/zeusnotfound04/nano-mail/pkg/message"
+)
+
+type Options struct {
+	DB     *sql.DB
+	Logger *slog.Logger
+	// Client sends deliveries. Redirects are never followed, whatever the
+	// client's policy; a 3xx counts as a failure.
+	Client *http.Client
+	// Timeout bounds one delivery attempt.
+	Timeout time.Duration
+	// PollInterval is how often due retries are looked for. New deliveries
+	// are sent straight away.
+	PollInterval time.Duration
+	// Concurrency caps deliveries in flight from this instance.
+	Concurrency int
+
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	// DisableAfter disables a webhook after this many consecutive failed
+	// attempts, across all its deliveries. Zero never disables.
+	DisableAfter int
+	// LogRetention is how long finished deliveries stay in the log.
+	LogRetention time.Duration
+	// RefreshInterval is how long the list of webhooks is cached, which is
+	// how long a change made elsewhere takes to apply here.
+	RefreshInterval time.Duration
+}
+
+// Dispatcher POSTs stored mail to the registered webhooks. Deliveries are
+// queued in the database, so they survive restarts, and any instance may
+// send any of them.
+type Dispatcher struct {
+	opts Options
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	wake      chan struct{}
+	lastPurge time.Time
+
+	mu      sync.Mutex
+	hooks   []database.Webhook
+	hooksAt time.Time
+}
+
+func NewDispatcher(opts Options) *Dispatcher {
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = 5 * time.Second
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 4
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 10
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 30 * time.Second
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = 6 * time.Hour
+	}
+	if opts.LogRetention <= 0 {
+		opts.LogRetention = 7 * 24 * time.Hour
+	}
+	if opts.RefreshInterval <= 0 {
+		opts.RefreshInterval = 30 * time.Second
+	}
+
+	client := http.Client{Timeout: opts.Timeout}
+	if opts.Client != nil {
+		client = *opts.Client
+	}
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	opts.Client = &client
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Dispatcher{
+		opts:   opts,
+		ctx:    ctx,
+		cancel: cancel,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+func (d *Dispatcher) Start() {
+	d.wg.Add(1)
+	go d.run()
+}
+
+// Stop abandons attempts in flight and waits for them to return. Their
+// deliveries are picked up again once their claim lapses.
+func (d *Dispatcher) Stop() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+// Enqueue queues a delivery of the stored message to every enabled webhook
+// that matches one of its recipients.
+func (d *Dispatcher) Enqueue(ctx context.Context, id int64, msg *message.Message) error {
+	hooks, err := d.activeHooks(ctx)
+	if err != nil {
+		return err
+	}
+
+	var payload *Payload
+	queued := 0
+	for _, hook := range hooks {
+		rcpts := matchRecipients(hook.Pattern, msg.To)
+		if len(rcpts) == 0 {
+			continue
+		}
+		if payload == nil {
+			p := newPayload(id, msg)
+			payload = &p
+		}
+
+		p := *payload
+		p.Envelope.To = rcpts
+		body, err := json.Marshal(p)
+		if err != nil {
+			return fmt.Errorf("failed to encode webhook payload: %w", err)
+		}
+		if err := database.EnqueueWebhookDelivery(ctx, d.opts.DB, hook.ID, id, body); err != nil {
+			return err
+		}
+		queued++
+	}
+
+	if queued > 0 {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// matchRecipients returns the recipients pattern selects; an empty pattern
+// selects all of them.
+func matchRecipients(pattern string, rcpts []string) []string {
+	if pattern == "" {
+		return rcpts
+	}
+	var matched []string
+	for _, rcpt := range rcpts {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(rcpt)); ok {
+			matched = append(matched, rcpt)
+		}
+	}
+	return matched
+}
+
+func (d *Dispatcher) activeHooks(ctx context.Context) ([]database.Webhook, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.hooksAt.IsZero() && time.Since(d.hooksAt) < d.opts.RefreshInterval {
+		return d.hooks, nil
+	}
+	hooks, err := database.ListWebhooks(ctx, d.opts.DB, true)
+	if err != nil {
+		return nil, err
+	}
+	d.hooks, d.hooksAt = hooks, time.Now()
+	return hooks, nil
+}
+
+func (d *Dispatcher) run() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.opts.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		d.dispatchDue()
+		d.purgeLog()
+
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-d.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatchDue sends due deliveries until none are left. Each claim is one
+// round of concurrent attempts, so no claimed delivery waits behind others
+// long enough for its lease to run out.
+func (d *Dispatcher) dispatchDue() {
+	// The claim outlasts the attempt, with room to record its outcome.
+	lease := d.opts.Timeout + 30*time.Second
+
+	for d.ctx.Err() == nil {
+		claimed, err := database.ClaimWebhookDeliveries(d.ctx, d.opts.DB, d.opts.Concurrency, lease)
+		if err != nil {
+			if d.ctx.Err() == nil {
+				d.opts.Logger.Error("Failed to claim webhook deliveries", "error", err)
+			}
+			return
+		}
+
+		var wg sync.WaitGroup
+		for _, delivery := range claimed {
+			wg.Add(1)
+			go func(delivery database.ClaimedDelivery) {
+				defer wg.Done()
+				d.deliver(delivery)
+			}(delivery)
+		}
+		wg.Wait()
+
+		if len(claimed) < d.opts.Concurrency {
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(delivery database.ClaimedDelivery) {
+	attempt := d.send(delivery)
+	if d.ctx.Err() != nil {
+		// Cut off by shutdown, which is not the endpoint's fault; the
+		// claim lapses and another attempt is made later.
+		return
+	}
+
+	if !attempt.Delivered {
+		attempt.RetryAt = d.retryAt(delivery.Attempts + 1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	disabled, err := database.RecordWebhookAttempt(ctx, d.opts.DB, delivery, attempt, d.opts.DisableAfter)
+	if err != nil {
+		d.opts.Logger.Error("Failed to record webhook delivery", "error", err, "delivery_id", delivery.ID)
+		return
+	}
+
+	logger := d.opts.Logger.With(
+		"webhook_id", delivery.WebhookID,
+		"delivery_id", delivery.ID,
+		"email_id", delivery.EmailID,
+		"attempt", delivery.Attempts+1,
+		"status", attempt.Status)
+	switch {
+	case attempt.Delivered:
+		logger.Debug("Webhook delivered")
+	case attempt.RetryAt.IsZero():
+		logger.Warn("Webhook delivery failed, giving up", "error", attempt.Error)
+	default:
+		logger.Info("Webhook delivery failed, will retry", "error", attempt.Error, "retry_at", attempt.RetryAt)
+	}
+	if disabled {
+		d.opts.Logger.Warn("Webhook disabled after repeated failures",
+			"webhook_id", delivery.WebhookID,
+			"url", delivery.URL,
+			"failures", d.opts.DisableAfter)
+	}
+}
+
+func (d *Dispatcher) send(delivery database.ClaimedDelivery) database.WebhookAttempt {
+	ctx, cancel := context.WithTimeout(d.ctx, d.opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return database.WebhookAttempt{Error: err.Error()}
+	}
+
+	now := time.Now()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "NanoMail-Webhook/1.0")
+	req.Header.Set("X-NanoMail-Event", EventMailStored)
+	req.Header.Set("X-NanoMail-Delivery", strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set("X-NanoMail-Timestamp", strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set("X-NanoMail-Signature", Sign(delivery.Secret, now, delivery.Payload))
+
+	resp, err := d.opts.Client.Do(req)
+	if err != nil {
+		return database.WebhookAttempt{Error: err.Error()}
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return database.WebhookAttempt{Status: resp.StatusCode, Error: "unexpected status " + resp.Status}
+	}
+	return database.WebhookAttempt{Delivered: true, Status: resp.StatusCode}
+}
+
+// retryAt returns when to try again after attempts failures, or the zero
+// time once the delivery should be given up.
+func (d *Dispatcher) retryAt(attempts int) time.Time {
+	if attempts >= d.opts.MaxAttempts {
+		return time.Time{}
+	}
+
+	backoff := d.opts.MinBackoff
+	for i := 1; i < attempts && backoff < d.opts.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > d.opts.MaxBackoff {
+		backoff = d.opts.MaxBackoff
+	}
+	return time.Now().Add(backoff)
+}
+
+// purgeLog trims finished deliveries past the retention, at most hourly.
+func (d *Dispatcher) purgeLog() {
+	if time.Since(d.lastPurge) < time.Hour {
+		return
+	}
+	d.lastPurge = time.Now()
+
+	cutoff := time.Now().Add(-d.opts.LogRetention)
+	for d.ctx.Err() == nil {
+		n, err := database.PurgeWebhookDeliveries(d.ctx, d.opts.DB, cutoff, 1000)
+		if err != nil {
+			if d.ctx.Err() == nil {
+				d.opts.Logger.Error("Failed to purge webhook delivery log", "error", err)
+			}
+			return
+		}
+		if n < 1000 {
+			return
+		}
+	}
+}
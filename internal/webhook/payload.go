@@ -0,0 +1,114 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"github.com/zeusnotfound04/nano-mail/pkg/message"
+)
+
+// EventMailStored is the only event sent so far.
+const EventMailStored = "mail.stored"
+
+// Payload is the JSON body POSTed to a webhook.
+type Payload struct {
+	Event string `json:"event"`
+	// ID is the message's storage id, as used by the mailbox API.
+	ID       int64    `json:"id"`
+	Envelope Envelope `json:"envelope"`
+
+	Headers     map[string][]string `json:"headers"`
+	Subject     string              `json:"subject"`
+	From        string              `json:"from,omitempty"`
+	To          []string            `json:"to,omitempty"`
+	Cc          []string            `json:"cc,omitempty"`
+	Date        *time.Time          `json:"date,omitempty"`
+	MessageID   string              `json:"message_id,omitempty"`
+	Text        string              `json:"text"`
+	HTML        string              `json:"html"`
+	Attachments []Attachment        `json:"attachments"`
+}
+
+// Envelope is the SMTP envelope. A webhook registered for a recipient
+// pattern only sees the recipients it matched, so it cannot learn about
+// Bcc'd addresses elsewhere. From is empty for bounces, which have the null
+// sender.
+type Envelope struct {
+	From       string    `json:"from"`
+	To         []string  `json:"to"`
+	Size       int64     `json:"size"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// Attachment describes an attachment; its content is not sent and can be
+// fetched through the mailbox API by index.
+type Attachment struct {
+	Index       int    `json:"index"`
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type"`
+	ContentID   string `json:"content_id,omitempty"`
+	Inline      bool   `json:"inline"`
+	Size        int    `json:"size"`
+}
+
+// newPayload builds the payload for a stored message. Envelope.To is left
+// for the caller to fill in per webhook.
+func newPayload(id int64, msg *message.Message) Payload {
+	p := Payload{
+		Event:   EventMailStored,
+		ID:      id,
+		Subject: msg.Subject,
+		Envelope: Envelope{
+			From:       msg.From,
+			Size:       msg.Size,
+			ReceivedAt: msg.Date,
+		},
+		Attachments: []Attachment{},
+	}
+
+	parsed, err := message.Parse([]byte(msg.Body))
+	if err != nil {
+		// Unparseable mail is still announced, with its raw body as text.
+		p.Text = msg.Body
+		return p
+	}
+
+	p.Headers = parsed.Header
+	p.Subject = parsed.Subject
+	p.From = parsed.From
+	p.To = parsed.To
+	p.Cc = parsed.Cc
+	p.MessageID = parsed.MessageID
+	p.Text = parsed.Text
+	p.HTML = parsed.HTML
+	if !parsed.Date.IsZero() {
+		p.Date = &parsed.Date
+	}
+	for i, a := range parsed.Attachments {
+		p.Attachments = append(p.Attachments, Attachment{
+			Index:       i,
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			ContentID:   a.ContentID,
+			Inline:      a.Inline,
+			Size:        a.Size,
+		})
+	}
+	return p
+}
+
+// Sign computes the X-NanoMail-Signature value for body sent at timestamp.
+// The timestamp is signed with the body, as "<unix seconds>.<body>", so a
+// captured request cannot be replayed later under a fresh timestamp.
+// Receivers should recompute it, compare in constant time and reject stale
+// timestamps.
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
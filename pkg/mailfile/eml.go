@@ -0,0 +1,27 @@
+// Package mailfile reads and writes messages in the file formats other mail
+// tools exchange: single .eml files, mbox and Maildir.
+package mailfile
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// WriteEML writes raw as an RFC 5322 message file. Line endings are made
+// CRLF throughout, whichever mix the message was stored with.
+func WriteEML(w io.Writer, raw []byte) error {
+	bw := bufio.NewWriter(w)
+	for len(raw) > 0 {
+		line := raw
+		next := len(raw)
+		if i := bytes.IndexByte(raw, '\n'); i >= 0 {
+			line, next = raw[:i], i+1
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		bw.Write(line)
+		bw.WriteString("\r\n")
+		raw = raw[next:]
+	}
+	return bw.Flush()
+}
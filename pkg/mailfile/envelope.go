@@ -0,0 +1,86 @@
+package mailfile
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+)
+
+// HeaderEnvelope rebuilds the SMTP envelope of a message from its headers,
+// for archives that did not keep it. The sender comes from Return-Path,
+// where "<>" is the null sender, or else From. Recipients come from the
+// Delivered-To and X-Original-To headers a delivery agent adds, or else
+// To, Cc and Bcc.
+func HeaderEnvelope(raw []byte) (sender string, recipients []string) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return "", nil
+	}
+	h := msg.Header
+
+	if rp, ok := h["Return-Path"]; ok && len(rp) > 0 {
+		sender = strings.Trim(strings.TrimSpace(rp[0]), "<>")
+	} else if from := h.Get("From"); from != "" {
+		sender = firstAddress(from)
+	}
+
+	seen := make(map[string]bool)
+	add := func(addr string) {
+		addr = strings.Trim(strings.TrimSpace(addr), "<>")
+		if addr == "" || seen[strings.ToLower(addr)] {
+			return
+		}
+		seen[strings.ToLower(addr)] = true
+		recipients = append(recipients, addr)
+	}
+
+	for _, name := range []string{"Delivered-To", "X-Original-To"} {
+		for _, v := range h[name] {
+			add(v)
+		}
+	}
+	if len(recipients) > 0 {
+		return sender, recipients
+	}
+
+	for _, name := range []string{"To", "Cc", "Bcc"} {
+		for _, v := range h[name] {
+			for _, addr := range addressList(v) {
+				add(addr)
+			}
+		}
+	}
+	return sender, recipients
+}
+
+func firstAddress(v string) string {
+	if list := addressList(v); len(list) > 0 {
+		return list[0]
+	}
+	return ""
+}
+
+// addressList parses an address header, falling back to taking whatever
+// looks like an address out of each comma separated item when the header
+// isn't valid RFC 5322.
+func addressList(v string) []string {
+	if list, err := mail.ParseAddressList(v); err == nil {
+		addrs := make([]string, len(list))
+		for i, a := range list {
+			addrs[i] = a.Address
+		}
+		return addrs
+	}
+
+	var addrs []string
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if i := strings.LastIndexByte(item, '<'); i >= 0 {
+			item = strings.TrimSuffix(item[i+1:], ">")
+		}
+		if strings.Contains(item, "@") && !strings.ContainsAny(item, " \t") {
+			addrs = append(addrs, item)
+		}
+	}
+	return addrs
+}
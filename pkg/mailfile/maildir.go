@@ -0,0 +1,86 @@
+package mailfile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaildirReader reads every message in a Maildir tree: the cur and new
+// directories of the root and of any folder below it, as Maildir++ and
+// nested layouts keep them. Messages still being delivered, in tmp, are
+// skipped.
+type MaildirReader struct {
+	files []string
+	next  int
+}
+
+func NewMaildirReader(root string) (*MaildirReader, error) {
+	var files []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			if dir := filepath.Base(filepath.Dir(path)); dir == "cur" || dir == "new" {
+				files = append(files, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan maildir: %w", err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no maildir messages under %s", root)
+	}
+
+	// Unique names start with the delivery time, so this is roughly
+	// arrival order within each folder.
+	sort.Strings(files)
+	return &MaildirReader{files: files}, nil
+}
+
+func (m *MaildirReader) Next() (*Entry, error) {
+	if m.next >= len(m.files) {
+		return nil, io.EOF
+	}
+	path := m.files[m.next]
+	m.next++
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &Entry{Source: path, Received: maildirTime(path)}
+	var raw bytes.Buffer
+	raw.Grow(len(data) + len(data)/40)
+	if err := WriteEML(&raw, data); err != nil {
+		return nil, err
+	}
+	entry.Raw = raw.Bytes()
+	return entry, nil
+}
+
+// maildirTime reads the delivery time from a unique name, which starts with
+// "seconds." by convention, falling back to the file's modification time.
+func maildirTime(path string) time.Time {
+	name := filepath.Base(path)
+	if secs, _, ok := strings.Cut(name, "."); ok {
+		if n, err := strconv.ParseInt(secs, 10, 64); err == nil && n > 0 {
+			return time.Unix(n, 0)
+		}
+	}
+	if info, err := os.Stat(path); err == nil {
+		return info.ModTime()
+	}
+	return time.Time{}
+}
@@ -0,0 +1,257 @@
+package mailfile
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fromLineDate is the asctime layout of the date on a From_ line.
+const fromLineDate = "Mon Jan _2 15:04:05 2006"
+
+// MboxWriter writes messages in the mboxrd format: each one starts with a
+// "From sender date" line, has LF line endings, and has every line matching
+// ">*From " quoted with one more ">", which readers undo exactly.
+type MboxWriter struct {
+	w *bufio.Writer
+}
+
+func NewMboxWriter(w io.Writer) *MboxWriter {
+	return &MboxWriter{w: bufio.NewWriter(w)}
+}
+
+// WriteMessage appends one message. sender is the envelope sender, with
+// the null sender written as MAILER-DAEMON as is customary.
+func (m *MboxWriter) WriteMessage(sender string, received time.Time, raw []byte) error {
+	if sender == "" {
+		sender = "MAILER-DAEMON"
+	}
+	// The From_ line is space separated; a space in a quoted local part
+	// would shift the date.
+	sender = strings.ReplaceAll(sender, " ", "_")
+
+	m.w.WriteString("From ")
+	m.w.WriteString(sender)
+	m.w.WriteString(" ")
+	m.w.WriteString(received.UTC().Format(fromLineDate))
+	m.w.WriteString("\n")
+
+	for len(raw) > 0 {
+		line := raw
+		next := len(raw)
+		if i := bytes.IndexByte(raw, '\n'); i >= 0 {
+			line, next = raw[:i], i+1
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if isFromLine(line) {
+			m.w.WriteByte('>')
+		}
+		m.w.Write(line)
+		m.w.WriteByte('\n')
+		raw = raw[next:]
+	}
+
+	// A blank line separates messages.
+	m.w.WriteByte('\n')
+	return m.w.Flush()
+}
+
+// isFromLine reports whether line is "From " behind any number of ">".
+func isFromLine(line []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From "))
+}
+
+// Entry is a message read from an archive, with whatever the archive records
+// about its delivery.
+type Entry struct {
+	// Sender is the envelope sender from an mbox From_ line. It is empty
+	// when the archive has none, or gives MAILER-DAEMON.
+	Sender string
+	// Received is when the archive says the message arrived, or zero.
+	Received time.Time
+	// Raw is the message with CRLF line endings, as received over SMTP.
+	Raw []byte
+	// Source locates the message in the archive, for error messages.
+	Source string
+}
+
+// Reader reads the messages of an archive one at a time, returning io.EOF
+// after the last.
+type Reader interface {
+	Next() (*Entry, error)
+}
+
+// MboxReader reads mboxrd or mboxcl2 files.
+type MboxReader struct {
+	r   *bufio.Reader
+	cl2 bool
+	// fromLine is the next message's From_ line, already read while
+	// looking for the end of the previous one.
+	fromLine []byte
+	count    int
+}
+
+// NewMboxrdReader reads mboxrd, where messages end at the next From_ line
+// and body lines matching ">*From " carry one extra ">".
+func NewMboxrdReader(r io.Reader) *MboxReader {
+	return &MboxReader{r: bufio.NewReader(r)}
+}
+
+// NewMboxcl2Reader reads mboxcl2, where a Content-Length header gives each
+// body's length and nothing is quoted. A message without the header ends at
+// the next From_ line.
+func NewMboxcl2Reader(r io.Reader) *MboxReader {
+	return &MboxReader{r: bufio.NewReader(r), cl2: true}
+}
+
+func (m *MboxReader) Next() (*Entry, error) {
+	from := m.fromLine
+	m.fromLine = nil
+	for from == nil {
+		line, err := m.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			continue
+		}
+		if !bytes.HasPrefix(line, []byte("From ")) {
+			return nil, fmt.Errorf("not an mbox file: message %d does not start with a From_ line", m.count+1)
+		}
+		from = line
+	}
+
+	m.count++
+	entry := &Entry{Source: fmt.Sprintf("message %d", m.count)}
+	entry.Sender, entry.Received = parseFromLine(from)
+
+	var lines [][]byte
+	var err error
+	if m.cl2 {
+		lines, err = m.readCl2()
+	} else {
+		lines, err = m.readUntilFrom(true)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", entry.Source, err)
+	}
+
+	var raw bytes.Buffer
+	for _, line := range lines {
+		raw.Write(line)
+		raw.WriteString("\r\n")
+	}
+	entry.Raw = raw.Bytes()
+	return entry, nil
+}
+
+// readLine returns the next line without its line ending, and io.EOF only
+// when nothing at all is left.
+func (m *MboxReader) readLine() ([]byte, error) {
+	line, err := m.r.ReadBytes('\n')
+	if len(line) == 0 && err != nil {
+		return nil, err
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r")), nil
+}
+
+// readUntilFrom reads lines up to the next From_ line or the end of the
+// file. The blank line that separates messages is not part of either.
+func (m *MboxReader) readUntilFrom(unquote bool) ([][]byte, error) {
+	var lines [][]byte
+	for {
+		line, err := m.readLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(line, []byte("From ")) {
+			m.fromLine = line
+			break
+		}
+		if unquote && len(line) > 0 && line[0] == '>' && isFromLine(line) {
+			line = line[1:]
+		}
+		lines = append(lines, line)
+	}
+
+	if n := len(lines); n > 0 && len(lines[n-1]) == 0 {
+		lines = lines[:n-1]
+	}
+	return lines, nil
+}
+
+func (m *MboxReader) readCl2() ([][]byte, error) {
+	var lines [][]byte
+	contentLength := -1
+	for {
+		line, err := m.readLine()
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+		if len(line) == 0 {
+			break
+		}
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if ok && strings.EqualFold(string(bytes.TrimSpace(name)), "Content-Length") {
+			if n, err := strconv.Atoi(string(bytes.TrimSpace(value))); err == nil && n >= 0 {
+				contentLength = n
+			}
+		}
+	}
+
+	if contentLength < 0 {
+		rest, err := m.readUntilFrom(false)
+		return append(lines, rest...), err
+	}
+
+	body := make([]byte, contentLength)
+	if _, err := io.ReadFull(m.r, body); err != nil {
+		return nil, fmt.Errorf("body shorter than its Content-Length: %w", err)
+	}
+	body = bytes.TrimSuffix(body, []byte("\n"))
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		lines = append(lines, bytes.TrimSuffix(line, []byte("\r")))
+	}
+	return lines, nil
+}
+
+// fromLineDates are the date layouts seen on From_ lines in the wild.
+var fromLineDates = []string{
+	fromLineDate,
+	"Mon Jan _2 15:04:05 2006 -0700",
+	"Mon Jan _2 15:04:05 MST 2006",
+	"Mon Jan _2 15:04 2006",
+}
+
+func parseFromLine(line []byte) (sender string, received time.Time) {
+	rest := strings.TrimSpace(string(line[len("From "):]))
+	sender, date, _ := strings.Cut(rest, " ")
+	if sender == "MAILER-DAEMON" {
+		sender = ""
+	}
+
+	date = strings.Join(strings.Fields(date), " ")
+	for _, layout := range fromLineDates {
+		// Fields collapsed the padding space of single-digit days.
+		layout = strings.ReplaceAll(layout, "_2", "2")
+		if t, err := time.Parse(layout, date); err == nil {
+			return sender, t
+		}
+	}
+	return sender, time.Time{}
+}
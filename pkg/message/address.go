@@ -0,0 +1,334 @@
+package message
+
+import (
+	"net/netip"
+	"strings"
+	"unicode/utf8"
+)
+
+// Size limits on the parts of a path (RFC 5321 section 4.5.3.1).
+const (
+	maxLocalPartLength = 64
+	maxDomainLength    = 255
+	maxPathLength      = 256
+)
+
+// Address is a mailbox parsed from an SMTP path (RFC 5321, with the UTF-8
+// addresses of RFC 6531). The zero Address is the null reverse-path, "<>".
+type Address struct {
+	// Local is the local part with any quoting removed; its case is kept,
+	// as only the receiving host may interpret it.
+	Local string
+	// Domain is the domain in lower case, with internationalized labels
+	// as A-labels, or an address literal such as "[192.0.2.1]" or
+	// "[IPv6:2001:db8::1]".
+	Domain string
+	// Literal is set when Domain is an address literal.
+	Literal bool
+	// Route is the obsolete source route of the path, "@a,@b:", which is
+	// parsed but otherwise ignored (RFC 5321 section 4.1.1.3).
+	Route []string
+	// UTF8 is set when the path was written with non-ASCII characters,
+	// which are only allowed in SMTPUTF8 transactions.
+	UTF8 bool
+}
+
+// AddressError is an address that cannot be accepted. Code is the SMTP
+// reply it calls for: 501 when the path around the mailbox is malformed,
+// 553 when the mailbox itself is not allowed.
+type AddressError struct {
+	Code   int
+	Reason string
+}
+
+func (e *AddressError) Error() string {
+	return e.Reason
+}
+
+func syntaxError(reason string) error {
+	return &AddressError{Code: 501, Reason: reason}
+}
+
+func mailboxError(reason string) error {
+	return &AddressError{Code: 553, Reason: reason}
+}
+
+// IsNull reports whether a is the null reverse-path.
+func (a Address) IsNull() bool {
+	return a.Local == "" && a.Domain == ""
+}
+
+// String returns the address in the form it is stored and sent under:
+// local part quoted only if it must be, and the ASCII domain.
+func (a Address) String() string {
+	if a.IsNull() {
+		return ""
+	}
+	return quoteLocal(a.Local) + "@" + a.Domain
+}
+
+// Unicode returns the address with its domain's A-labels converted back to
+// Unicode, for display.
+func (a Address) Unicode() string {
+	if a.IsNull() || a.Literal {
+		return a.String()
+	}
+	return quoteLocal(a.Local) + "@" + DomainToUnicode(a.Domain)
+}
+
+// ParsePath parses the argument of MAIL FROM or RCPT TO, a path in angle
+// brackets followed by optional ESMTP parameters, which are returned
+// unparsed. "<>" gives the zero Address. A bare mailbox without brackets is
+// accepted too, as many clients send one.
+func ParsePath(arg string) (Address, string, error) {
+	arg = strings.TrimLeft(arg, " \t")
+	if arg == "" {
+		return Address{}, "", syntaxError("Missing address")
+	}
+
+	var path, params string
+	bracketed := arg[0] == '<'
+	if bracketed {
+		end := pathEnd(arg)
+		if end < 0 {
+			return Address{}, "", syntaxError("Unterminated path")
+		}
+		path, params = arg[1:end], arg[end+1:]
+		if params != "" && params[0] != ' ' && params[0] != '\t' {
+			return Address{}, "", syntaxError("Unexpected characters after path")
+		}
+	} else {
+		path, params = arg, ""
+		if i := strings.IndexAny(arg, " \t"); i >= 0 {
+			path, params = arg[:i], arg[i:]
+		}
+	}
+	params = strings.TrimSpace(params)
+
+	if len(path)+2 > maxPathLength {
+		return Address{}, "", syntaxError("Path too long")
+	}
+	if path == "" {
+		return Address{}, params, nil
+	}
+
+	var route []string
+	if bracketed && path[0] == '@' {
+		colon := strings.IndexByte(path, ':')
+		if colon < 0 {
+			return Address{}, "", syntaxError("Invalid source route")
+		}
+		for _, hop := range strings.Split(path[:colon], ",") {
+			if len(hop) < 2 || hop[0] != '@' {
+				return Address{}, "", syntaxError("Invalid source route")
+			}
+			domain, err := parseDomain(hop[1:])
+			if err != nil {
+				return Address{}, "", syntaxError("Invalid source route")
+			}
+			route = append(route, domain)
+		}
+		path = path[colon+1:]
+	}
+
+	addr, err := ParseAddress(path)
+	if err != nil {
+		return Address{}, "", err
+	}
+	addr.Route = route
+	return addr, params, nil
+}
+
+// pathEnd returns the index of the '>' closing the path that starts arg,
+// skipping any inside a quoted local part, or -1.
+func pathEnd(arg string) int {
+	quoted := false
+	for i := 1; i < len(arg); i++ {
+		switch c := arg[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == '>' && !quoted:
+			return i
+		}
+	}
+	return -1
+}
+
+// ParseAddress parses a bare mailbox, local-part@domain.
+func ParseAddress(s string) (Address, error) {
+	if s == "" {
+		return Address{}, mailboxError("Empty address")
+	}
+	if !utf8.ValidString(s) {
+		return Address{}, mailboxError("Address is not valid UTF-8")
+	}
+	addr := Address{UTF8: !isASCII(s)}
+
+	var rest string
+	if s[0] == '"' {
+		local, n, err := parseQuoted(s)
+		if err != nil {
+			return Address{}, err
+		}
+		addr.Local, rest = local, s[n:]
+	} else {
+		at := strings.IndexByte(s, '@')
+		if at < 0 {
+			return Address{}, mailboxError("Address has no domain")
+		}
+		if err := checkDotString(s[:at]); err != nil {
+			return Address{}, err
+		}
+		addr.Local, rest = s[:at], s[at:]
+	}
+	if len(addr.Local) > maxLocalPartLength {
+		return Address{}, mailboxError("Local part too long")
+	}
+
+	if rest == "" {
+		return Address{}, mailboxError("Address has no domain")
+	}
+	if rest[0] != '@' {
+		return Address{}, mailboxError("Invalid local part")
+	}
+	rest = rest[1:]
+	if rest == "" {
+		return Address{}, mailboxError("Address has no domain")
+	}
+
+	var err error
+	if strings.HasPrefix(rest, "[") {
+		addr.Domain, err = parseAddressLiteral(rest)
+		addr.Literal = true
+	} else {
+		addr.Domain, err = parseDomain(rest)
+	}
+	if err != nil {
+		return Address{}, err
+	}
+	return addr, nil
+}
+
+// parseQuoted parses the quoted local part at the start of s, returning it
+// unquoted along with the number of bytes it took.
+func parseQuoted(s string) (string, int, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			return b.String(), i + 1, nil
+		case c == '\\':
+			i++
+			if i >= len(s) || s[i] < ' ' || s[i] > '~' {
+				return "", 0, mailboxError("Invalid quoted local part")
+			}
+			b.WriteByte(s[i])
+		case c >= ' ' && c <= '~', c >= utf8.RuneSelf:
+			b.WriteByte(c)
+		default:
+			return "", 0, mailboxError("Invalid quoted local part")
+		}
+	}
+	return "", 0, mailboxError("Unterminated quoted local part")
+}
+
+func checkDotString(local string) error {
+	if local == "" {
+		return mailboxError("Empty local part")
+	}
+	for _, atom := range strings.Split(local, ".") {
+		if atom == "" {
+			return mailboxError("Invalid dots in local part")
+		}
+		for i := 0; i < len(atom); i++ {
+			if !isAtext(atom[i]) {
+				return mailboxError("Invalid character in local part")
+			}
+		}
+	}
+	return nil
+}
+
+// isAtext reports whether c may appear unquoted in a local part. Bytes of
+// UTF-8 sequences are allowed (RFC 6531 section 3.3).
+func isAtext(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	case c >= utf8.RuneSelf:
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) >= 0
+}
+
+// quoteLocal quotes a local part that is not a valid dot-string.
+func quoteLocal(local string) string {
+	if checkDotString(local) == nil {
+		return local
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(local); i++ {
+		if local[i] == '"' || local[i] == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(local[i])
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// parseDomain validates a domain name and returns its lower-case ASCII
+// form.
+func parseDomain(domain string) (string, error) {
+	ascii, err := DomainToASCII(domain)
+	if err != nil {
+		return "", mailboxError("Invalid internationalized domain")
+	}
+	if len(ascii) > maxDomainLength {
+		return "", mailboxError("Domain too long")
+	}
+	for _, label := range strings.Split(ascii, ".") {
+		if label == "" || len(label) > 63 {
+			return "", mailboxError("Invalid domain")
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return "", mailboxError("Invalid domain")
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return "", mailboxError("Invalid domain")
+			}
+		}
+	}
+	return ascii, nil
+}
+
+// parseAddressLiteral validates an address literal such as "[192.0.2.1]"
+// or "[IPv6:2001:db8::1]" and returns it in canonical form. General
+// address literals (RFC 5321 section 4.1.3) are refused, as no standard
+// tags are in use.
+func parseAddressLiteral(literal string) (string, error) {
+	if len(literal) < 3 || literal[len(literal)-1] != ']' {
+		return "", mailboxError("Invalid address literal")
+	}
+	inner := literal[1 : len(literal)-1]
+
+	if len(inner) > 5 && strings.EqualFold(inner[:5], "IPv6:") {
+		ip, err := netip.ParseAddr(inner[5:])
+		if err != nil || !ip.Is6() || ip.Zone() != "" {
+			return "", mailboxError("Invalid IPv6 address literal")
+		}
+		return "[IPv6:" + ip.String() + "]", nil
+	}
+
+	ip, err := netip.ParseAddr(inner)
+	if err != nil || !ip.Is4() {
+		return "", mailboxError("Invalid address literal")
+	}
+	return "[" + ip.String() + "]", nil
+}
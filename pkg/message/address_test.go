@@ -0,0 +1,78 @@
+package message
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		arg    string
+		want   string // Address.String, when the path parses
+		code   int    // AddressError.Code, when it does not
+		params string
+		check  func(Address) bool
+	}{
+		{arg: "<>", want: ""},
+		{arg: "<user@example.com>", want: "user@example.com"},
+		{arg: "user@example.com", want: "user@example.com"},
+		{arg: "<User@EXAMPLE.com>", want: "User@example.com"},
+		{arg: "<user@example.com> SIZE=1000 BODY=8BITMIME", want: "user@example.com", params: "SIZE=1000 BODY=8BITMIME"},
+		{arg: `<"a b"@x>`, want: `"a b"@x`, check: func(a Address) bool { return a.Local == "a b" }},
+		{arg: `<"a>b"@x>`, want: `"a>b"@x`},
+		{arg: "<user@[192.0.2.1]>", want: "user@[192.0.2.1]", check: func(a Address) bool { return a.Literal }},
+		{arg: "<user@[ipv6:2001:DB8:0:0::1]>", want: "user@[IPv6:2001:db8::1]", check: func(a Address) bool { return a.Literal }},
+		{arg: "<@a.example,@b.example:user@c.example>", want: "user@c.example", check: func(a Address) bool {
+			return slices.Equal(a.Route, []string{"a.example", "b.example"})
+		}},
+		{arg: "<user@bücher.example>", want: "user@xn--bcher-kva.example", check: func(a Address) bool { return a.UTF8 }},
+
+		// The path around the mailbox is malformed.
+		{arg: "", code: 501},
+		{arg: "<@@>", code: 501},
+		{arg: "<@a,b:user@x>", code: 501},
+		{arg: "<@-a:user@x>", code: 501},
+		{arg: "<user@x", code: 501},
+		{arg: "<user@x>junk", code: 501},
+
+		// The mailbox itself is not allowed.
+		{arg: "@@", code: 553},
+		{arg: "<user>", code: 553},
+		{arg: "<user@>", code: 553},
+		{arg: "<a..b@x>", code: 553},
+		{arg: "<user@-x.com>", code: 553},
+		{arg: "<user@x..com>", code: 553},
+		{arg: "<user@[300.1.1.1]>", code: 553},
+		{arg: "<user@[IPv6:192.0.2.1]>", code: 553},
+		{arg: `<"a b@x>`, code: 501},
+	}
+
+	for _, tt := range tests {
+		addr, params, err := ParsePath(tt.arg)
+		if tt.code != 0 {
+			var addrErr *AddressError
+			if !errors.As(err, &addrErr) {
+				t.Errorf("ParsePath(%q) error = %v, want an *AddressError", tt.arg, err)
+				continue
+			}
+			if addrErr.Code != tt.code {
+				t.Errorf("ParsePath(%q) code = %d (%s), want %d", tt.arg, addrErr.Code, addrErr.Reason, tt.code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParsePath(%q): %v", tt.arg, err)
+			continue
+		}
+		if got := addr.String(); got != tt.want {
+			t.Errorf("ParsePath(%q) = %q, want %q", tt.arg, got, tt.want)
+		}
+		if params != tt.params {
+			t.Errorf("ParsePath(%q) params = %q, want %q", tt.arg, params, tt.params)
+		}
+		if tt.check != nil && !tt.check(addr) {
+			t.Errorf("ParsePath(%q) = %+v", tt.arg, addr)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package message
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Values of the RET and NOTIFY parameters of RFC 3461.
+const (
+	RetFull    = "FULL"
+	RetHeaders = "HDRS"
+
+	NotifyNever   = "NEVER"
+	NotifySuccess = "SUCCESS"
+	NotifyFailure = "FAILURE"
+	NotifyDelay   = "DELAY"
+)
+
+var ErrInvalidDSN = errors.New("invalid DSN parameter")
+
+// DSN holds the delivery status notification parameters given with an
+// envelope (RFC 3461).
+type DSN struct {
+	// Ret asks for the whole message or only its headers to be returned in
+	// failure reports; empty leaves the choice to us.
+	Ret   string
+	EnvID string
+	// Recipients holds the per-recipient parameters, keyed by recipient as
+	// in Message.To.
+	Recipients map[string]RecipientDSN
+}
+
+type RecipientDSN struct {
+	// Notify is NEVER, or any of SUCCESS, FAILURE and DELAY; empty asks
+	// for the default, failure reports only.
+	Notify []string
+	// ORCPT is the original recipient as given by the client, such as
+	// "rfc822;user@example.com", with its xtext decoded.
+	ORCPT string
+}
+
+// Recipient returns the parameters given for rcpt. It is safe to call on a
+// nil DSN.
+func (d *DSN) Recipient(rcpt string) RecipientDSN {
+	if d == nil {
+		return RecipientDSN{}
+	}
+	return d.Recipients[rcpt]
+}
+
+// NotifyFailure reports whether the client wants to hear of a failed
+// delivery to the recipient.
+func (r RecipientDSN) NotifyFailure() bool {
+	if len(r.Notify) == 0 {
+		return true
+	}
+	for _, n := range r.Notify {
+		if n == NotifyFailure {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseRet validates a RET parameter, returning it upper-cased.
+func ParseRet(v string) (string, error) {
+	switch v = strings.ToUpper(v); v {
+	case RetFull, RetHeaders:
+		return v, nil
+	}
+	return "", ErrInvalidDSN
+}
+
+// ParseNotify splits a NOTIFY parameter, which is NEVER on its own or a
+// comma separated list of SUCCESS, FAILURE and DELAY.
+func ParseNotify(v string) ([]string, error) {
+	values := strings.Split(strings.ToUpper(v), ",")
+	seen := make(map[string]bool, len(values))
+	for _, n := range values {
+		switch n {
+		case NotifyNever:
+			if len(values) > 1 {
+				return nil, ErrInvalidDSN
+			}
+		case NotifySuccess, NotifyFailure, NotifyDelay:
+		default:
+			return nil, ErrInvalidDSN
+		}
+		if seen[n] {
+			return nil, ErrInvalidDSN
+		}
+		seen[n] = true
+	}
+	return values, nil
+}
+
+// ParseORCPT validates an ORCPT parameter, "addr-type;xtext", returning it
+// with the xtext decoded.
+func ParseORCPT(v string) (string, error) {
+	addrType, addr, ok := strings.Cut(v, ";")
+	if !ok || addrType == "" || addr == "" {
+		return "", ErrInvalidDSN
+	}
+	decoded, err := DecodeXText(addr)
+	if err != nil {
+		return "", err
+	}
+	return addrType + ";" + decoded, nil
+}
+
+// ParseEnvID validates an ENVID parameter, returning it with the xtext
+// decoded.
+func ParseEnvID(v string) (string, error) {
+	if v == "" || len(v) > 100 {
+		return "", ErrInvalidDSN
+	}
+	return DecodeXText(v)
+}
+
+// DecodeXText decodes the xtext encoding of RFC 3461, in which "+XX" stands
+// for the byte with hex value XX. Control characters are refused, as the
+// decoded text ends up in report headers.
+func DecodeXText(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '+' {
+			if i+2 >= len(s) {
+				return "", ErrInvalidDSN
+			}
+			n, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", ErrInvalidDSN
+			}
+			c = byte(n)
+			i += 2
+		}
+		if c < ' ' || c == 0x7f {
+			return "", ErrInvalidDSN
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), nil
+}
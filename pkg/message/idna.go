@@ -0,0 +1,232 @@
+package message
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var errPunycode = errors.New("invalid punycode")
+
+// Punycode parameters (RFC 3492 section 5).
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+	punyMaxInt      = 1<<31 - 1
+)
+
+const acePrefix = "xn--"
+
+// DomainToASCII converts an internationalized domain name to its ASCII
+// form, with every non-ASCII label lower-cased and encoded as an A-label
+// ("xn--..."). ASCII labels are only lower-cased. Full IDNA mapping and
+// normalization are not applied, so names should be given in NFC.
+func DomainToASCII(domain string) (string, error) {
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		label = strings.ToLower(label)
+		if isASCII(label) {
+			labels[i] = label
+			continue
+		}
+		if !utf8.ValidString(label) {
+			return "", errPunycode
+		}
+		encoded, err := punyEncode(label)
+		if err != nil {
+			return "", err
+		}
+		labels[i] = acePrefix + encoded
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// DomainToUnicode converts the A-labels of domain back to Unicode. Labels
+// that do not decode are left as they are.
+func DomainToUnicode(domain string) string {
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if len(label) <= len(acePrefix) || !strings.EqualFold(label[:len(acePrefix)], acePrefix) {
+			continue
+		}
+		if decoded, err := punyDecode(strings.ToLower(label[len(acePrefix):])); err == nil {
+			labels[i] = decoded
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func punyAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+func punyThreshold(k, bias int) int {
+	switch t := k - bias; {
+	case t < punyTMin:
+		return punyTMin
+	case t > punyTMax:
+		return punyTMax
+	default:
+		return t
+	}
+}
+
+func punyEncodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyDecodeDigit(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c-'0') + 26
+	case c >= 'a' && c <= 'z':
+		return int(c - 'a')
+	case c >= 'A' && c <= 'Z':
+		return int(c - 'A')
+	}
+	return -1
+}
+
+// punyEncode encodes s as punycode, without the ACE prefix.
+func punyEncode(s string) (string, error) {
+	runes := []rune(s)
+	out := make([]byte, 0, len(s))
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	handled := basic
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := punyInitialN, 0, punyInitialBias
+	for handled < len(runes) {
+		m := punyMaxInt
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		if (m - n) > (punyMaxInt-delta)/(handled+1) {
+			return "", errPunycode
+		}
+		delta += (m - n) * (handled + 1)
+		n = m
+
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+				if delta == punyMaxInt {
+					return "", errPunycode
+				}
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := punyThreshold(k, bias)
+				if q < t {
+					break
+				}
+				out = append(out, punyEncodeDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyEncodeDigit(q))
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(out), nil
+}
+
+// punyDecode decodes punycode without its ACE prefix.
+func punyDecode(s string) (string, error) {
+	var output []rune
+	pos := 0
+	if b := strings.LastIndexByte(s, '-'); b > 0 {
+		for i := 0; i < b; i++ {
+			if s[i] >= utf8.RuneSelf {
+				return "", errPunycode
+			}
+			output = append(output, rune(s[i]))
+		}
+		pos = b + 1
+	}
+
+	n, i, bias := punyInitialN, 0, punyInitialBias
+	for pos < len(s) {
+		oldi, w := i, 1
+		for k := punyBase; ; k += punyBase {
+			if pos >= len(s) {
+				return "", errPunycode
+			}
+			digit := punyDecodeDigit(s[pos])
+			pos++
+			if digit < 0 || digit > (punyMaxInt-i)/w {
+				return "", errPunycode
+			}
+			i += digit * w
+			t := punyThreshold(k, bias)
+			if digit < t {
+				break
+			}
+			if w > punyMaxInt/(punyBase-t) {
+				return "", errPunycode
+			}
+			w *= punyBase - t
+		}
+
+		length := len(output) + 1
+		bias = punyAdapt(i-oldi, length, oldi == 0)
+		if i/length > punyMaxInt-n {
+			return "", errPunycode
+		}
+		n += i / length
+		i %= length
+		if n > unicode.MaxRune || (n >= 0xD800 && n <= 0xDFFF) {
+			return "", errPunycode
+		}
+
+		output = append(output, 0)
+		copy(output[i+1:], output[i:])
+		output[i] = rune(n)
+		i++
+	}
+	return string(output), nil
+}
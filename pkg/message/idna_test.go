@@ -0,0 +1,61 @@
+package message
+
+import (
+	"strings"
+	"testing"
+)
+
+// punycodeVectors are the samples of RFC 3492 section 7.1. Upper-case
+// letters in the encoded forms are case annotations, which the encoder
+// does not produce and the decoder ignores.
+var punycodeVectors = []struct {
+	name    string
+	decoded string
+	encoded string
+}{
+	{"A", "ليهمابتكلموشعربي؟", "egbpdaj6bu4bxfgehfvwxn"},
+	{"B", "他们为什么不说中文", "ihqwcrb4cv8a8dqg056pqjye"},
+	{"C", "他們爲什麽不說中文", "ihqwctvzc91f659drss3x8bo0yb"},
+	{"D", "Pročprostěnemluvíčesky", "Proprostnemluvesky-uyb24dma41a"},
+	{"E", "למההםפשוטלאמדבריםעברית", "4dbcagdahymbxekheh6e0a7fei0b"},
+	{"F", "यहलोगहिन्दीक्योंनहींबोलसकतेहैं", "i1baa7eci9glrd9b2ae1bj0hfcgg6iyaf8o0a1dig0cd"},
+	{"G", "なぜみんな日本語を話してくれないのか", "n8jok5ay5dzabd5bym9f0cm5685rrjetr6pdxa"},
+	{"H", "세계의모든사람들이한국어를이해한다면얼마나좋을까", "989aomsvi5e83db1d2a355cv1e0vak1dwrv93d5xbh15a0dt30a5jpsd879ccm6fea98c"},
+	{"I", "почемужеонинеговорятпорусски", "b1abfaaepdrnnbgefbaDotcwatmq2g4l"},
+	{"J", "PorquénopuedensimplementehablarenEspañol", "PorqunopuedensimplementehablarenEspaol-fmd56a"},
+	{"K", "TạisaohọkhôngthểchỉnóitiếngViệt", "TisaohkhngthchnitingVit-kjcr8268qyxafd2f1b9g"},
+	{"L", "3年B組金八先生", "3B-ww4c5e180e575a65lsy2b"},
+	{"M", "安室奈美恵-with-SUPER-MONKEYS", "-with-SUPER-MONKEYS-pc58ag80a8qai00g7n9n"},
+	{"N", "Hello-Another-Way-それぞれの場所", "Hello-Another-Way--fc4qua05auwb3674vfr0b"},
+	{"O", "ひとつ屋根の下2", "2-u9tlzr9756bt3uc0v"},
+	{"P", "MajiでKoiする5秒前", "MajiKoi5-783gue6qz075azm5e"},
+	{"Q", "パフィーdeルンバ", "de-jg4avhby1noc0d"},
+	{"R", "そのスピードで", "d9juau41awczczp"},
+	{"S", "-> $1.00 <-", "-> $1.00 <--"},
+}
+
+func TestPunyEncode(t *testing.T) {
+	for _, v := range punycodeVectors {
+		got, err := punyEncode(v.decoded)
+		if err != nil {
+			t.Errorf("(%s) punyEncode: %v", v.name, err)
+			continue
+		}
+		if !strings.EqualFold(got, v.encoded) {
+			t.Errorf("(%s) punyEncode = %q, want %q", v.name, got, v.encoded)
+		}
+	}
+}
+
+func TestPunyDecode(t *testing.T) {
+	for _, v := range punycodeVectors {
+		got, err := punyDecode(v.encoded)
+		if err != nil {
+			t.Errorf("(%s) punyDecode: %v", v.name, err)
+			continue
+		}
+		if got != v.decoded {
+			t.Errorf("(%s) punyDecode = %q, want %q", v.name, got, v.decoded)
+		}
+	}
+}
@@ -4,11 +4,41 @@ import (
 	"time"
 )
 
+// Message is a received message with its envelope. An empty From is the null
+// reverse-path: the message is a bounce or other automatic reply, and no
+// failure report may be sent for it.
 type Message struct {
-	From    string
-	To      []string
-	Subject string
-	Body    string
-	Size    int64
-	Date    time.Time
+	From      string
+	To        []string
+	Subject   string
+	Body      string
+	TextBody  string
+	MessageID string
+	Size      int64
+	Date      time.Time
+	// DSN holds the delivery status notification parameters given with
+	// the envelope; nil when there were none.
+	DSN *DSN
+}
+
+// New builds the Message stored for raw, received with the given envelope.
+// A message whose headers cannot be parsed is still returned, without the
+// fields taken from them, along with the parse error.
+func New(from string, to []string, raw []byte, received time.Time) (*Message, error) {
+	msg := &Message{
+		From: from,
+		To:   to,
+		Body: string(raw),
+		Size: int64(len(raw)),
+		Date: received,
+	}
+
+	parsed, err := Parse(raw)
+	if err != nil {
+		return msg, err
+	}
+	msg.Subject = parsed.Subject
+	msg.TextBody = parsed.Text
+	msg.MessageID = parsed.MessageID
+	return msg, nil
 }
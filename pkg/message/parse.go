@@ -0,0 +1,216 @@
+package message
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxPartDepth bounds multipart nesting so a hostile message cannot recurse
+// the parser indefinitely.
+const maxPartDepth = 16
+
+type Attachment struct {
+	Filename    string
+	ContentType string
+	ContentID   string
+	Inline      bool
+	Size        int
+	Content     []byte
+}
+
+// Parsed is the decoded view of a raw RFC 5322 message: the top-level headers
+// with encoded words resolved, the first text/plain and text/html bodies, and
+// every other leaf part as an attachment.
+type Parsed struct {
+	Header      mail.Header
+	Subject     string
+	From        string
+	To          []string
+	Cc          []string
+	Date        time.Time
+	MessageID   string
+	Text        string
+	HTML        string
+	Attachments []Attachment
+}
+
+var wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// Parse decodes raw message data. Malformed parts are skipped rather than
+// failing the whole message, since stored mail must stay readable even when
+// the sender's MIME is broken; only unreadable top-level headers are an error.
+func Parse(raw []byte) (*Parsed, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message headers: %w", err)
+	}
+
+	p := &Parsed{
+		Header:    msg.Header,
+		Subject:   DecodeHeader(msg.Header.Get("Subject")),
+		From:      DecodeHeader(msg.Header.Get("From")),
+		To:        addressList(msg.Header, "To"),
+		Cc:        addressList(msg.Header, "Cc"),
+		MessageID: strings.Trim(strings.TrimSpace(msg.Header.Get("Message-Id")), "<>"),
+	}
+	if date, err := msg.Header.Date(); err == nil {
+		p.Date = date
+	}
+
+	p.walk(textprotoHeader(msg.Header), msg.Body, 0)
+	return p, nil
+}
+
+// DecodeHeader resolves RFC 2047 encoded words, returning the input unchanged
+// when it cannot be decoded.
+func DecodeHeader(v string) string {
+	decoded, err := wordDecoder.DecodeHeader(v)
+	if err != nil {
+		return strings.TrimSpace(v)
+	}
+	return strings.TrimSpace(decoded)
+}
+
+func addressList(h mail.Header, key string) []string {
+	list, err := h.AddressList(key)
+	if err != nil {
+		return nil
+	}
+
+	addrs := make([]string, 0, len(list))
+	for _, a := range list {
+		addrs = append(addrs, a.Address)
+	}
+	return addrs
+}
+
+type partHeader interface {
+	Get(key string) string
+}
+
+type textprotoHeader mail.Header
+
+func (h textprotoHeader) Get(key string) string {
+	return mail.Header(h).Get(key)
+}
+
+func (p *Parsed) walk(h partHeader, body io.Reader, depth int) {
+	if depth > maxPartDepth {
+		return
+	}
+
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		boundary := params["boundary"]
+		if boundary == "" {
+			return
+		}
+		mr := multipart.NewReader(body, boundary)
+		for {
+			part, err := mr.NextRawPart()
+			if err != nil {
+				return
+			}
+			p.walk(part.Header, part, depth+1)
+		}
+	}
+
+	content, err := decodeTransfer(h.Get("Content-Transfer-Encoding"), body)
+	if err != nil {
+		return
+	}
+
+	disposition, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	filename := DecodeHeader(dparams["filename"])
+	if filename == "" {
+		filename = DecodeHeader(params["name"])
+	}
+	isAttachment := disposition == "attachment" || filename != ""
+
+	switch {
+	case mediaType == "text/plain" && !isAttachment && p.Text == "":
+		p.Text = toUTF8(content, params["charset"])
+	case mediaType == "text/html" && !isAttachment && p.HTML == "":
+		p.HTML = toUTF8(content, params["charset"])
+	default:
+		p.Attachments = append(p.Attachments, Attachment{
+			Filename:    filename,
+			ContentType: mediaType,
+			ContentID:   strings.Trim(h.Get("Content-Id"), "<>"),
+			Inline:      disposition == "inline",
+			Size:        len(content),
+			Content:     content,
+		})
+	}
+}
+
+func decodeTransfer(encoding string, r io.Reader) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return io.ReadAll(base64.NewDecoder(base64.StdEncoding, &base64Cleaner{r: r}))
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(r))
+	default:
+		return io.ReadAll(r)
+	}
+}
+
+// base64Cleaner drops line breaks and other whitespace that senders wrap
+// base64 bodies with, which encoding/base64 would otherwise reject.
+type base64Cleaner struct {
+	r io.Reader
+}
+
+func (c *base64Cleaner) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	j := 0
+	for i := 0; i < n; i++ {
+		switch p[i] {
+		case '\r', '\n', ' ', '\t':
+		default:
+			p[j] = p[i]
+			j++
+		}
+	}
+	return j, err
+}
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(toUTF8(data, charset)), nil
+}
+
+// toUTF8 converts the charsets the standard library can handle without
+// external tables. Anything else is passed through with invalid sequences
+// replaced, which keeps the text indexable even if some glyphs are lost.
+func toUTF8(data []byte, charset string) string {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "iso-8859-1", "latin1", "latin-1", "us-ascii", "ascii":
+		if utf8.Valid(data) {
+			return string(data)
+		}
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	default:
+		return strings.ToValidUTF8(string(data), "�")
+	}
+}
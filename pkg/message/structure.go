@@ -0,0 +1,161 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	"net/textproto"
+	"strings"
+)
+
+// Part is one node of a message's MIME tree with its bytes left exactly as
+// received, for protocols that address parts by position and serve them
+// verbatim.
+type Part struct {
+	Header textproto.MIMEHeader
+	// RawHeader is the header block including the blank line ending it.
+	RawHeader []byte
+	// Body is the content after the header, still transfer-encoded.
+	Body []byte
+
+	MediaType string
+	Params    map[string]string
+
+	// Parts holds the children of a multipart part.
+	Parts []*Part
+	// Message is the embedded message of a message/rfc822 part.
+	Message *Part
+}
+
+// ParseStructure splits raw into its MIME tree. Like Parse it never fails on
+// malformed content: an unreadable header yields an empty one, a missing
+// boundary leaves a multipart part without children, and nesting deeper
+// than maxPartDepth is not expanded.
+func ParseStructure(raw []byte) *Part {
+	return parsePart(raw, "text/plain", 0)
+}
+
+func parsePart(raw []byte, defaultType string, depth int) *Part {
+	rawHeader, body := splitHeader(raw)
+
+	p := &Part{
+		Header:    readMIMEHeader(rawHeader),
+		RawHeader: rawHeader,
+		Body:      body,
+	}
+
+	mediaType, params, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+	if err != nil || mediaType == "" {
+		mediaType = defaultType
+		params = map[string]string{}
+		if defaultType == "text/plain" {
+			params["charset"] = "us-ascii"
+		}
+	}
+	p.MediaType, p.Params = mediaType, params
+
+	if depth >= maxPartDepth {
+		return p
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		if params["boundary"] == "" {
+			return p
+		}
+		childType := "text/plain"
+		if mediaType == "multipart/digest" {
+			childType = "message/rfc822"
+		}
+		for _, child := range splitMultipart(body, params["boundary"]) {
+			p.Parts = append(p.Parts, parsePart(child, childType, depth+1))
+		}
+	case mediaType == "message/rfc822":
+		p.Message = parsePart(body, "text/plain", depth+1)
+	}
+
+	return p
+}
+
+// Decoded returns the part's body with its transfer encoding removed.
+func (p *Part) Decoded() ([]byte, error) {
+	return decodeTransfer(p.Header.Get("Content-Transfer-Encoding"), bytes.NewReader(p.Body))
+}
+
+// splitHeader cuts raw at the first empty line. A message with no empty
+// line is all header.
+func splitHeader(raw []byte) (header, body []byte) {
+	if bytes.HasPrefix(raw, []byte("\r\n")) {
+		return raw[:2], raw[2:]
+	}
+	if bytes.HasPrefix(raw, []byte("\n")) {
+		return raw[:1], raw[1:]
+	}
+
+	crlf := bytes.Index(raw, []byte("\r\n\r\n"))
+	lf := bytes.Index(raw, []byte("\n\n"))
+	switch {
+	case crlf >= 0 && (lf < 0 || crlf < lf):
+		return raw[:crlf+4], raw[crlf+4:]
+	case lf >= 0:
+		return raw[:lf+2], raw[lf+2:]
+	default:
+		return raw, nil
+	}
+}
+
+func readMIMEHeader(raw []byte) textproto.MIMEHeader {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw)))
+	// ReadMIMEHeader returns what it parsed before an error, which is the
+	// best available for a damaged header.
+	h, _ := r.ReadMIMEHeader()
+	if h == nil {
+		h = textproto.MIMEHeader{}
+	}
+	return h
+}
+
+// splitMultipart returns the raw content of each body part between the
+// boundary delimiters, without the line break that belongs to the next
+// delimiter. The preamble and epilogue are dropped; a missing close
+// delimiter leaves the last part running to the end of body.
+func splitMultipart(body []byte, boundary string) [][]byte {
+	delim := []byte("--" + boundary)
+
+	var parts [][]byte
+	start := -1
+	pos := 0
+	for pos < len(body) {
+		next := len(body)
+		line := body[pos:]
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i]
+			next = pos + i + 1
+		}
+
+		trimmed := bytes.TrimRight(line, " \t\r")
+		if rest, ok := bytes.CutPrefix(trimmed, delim); ok && (len(rest) == 0 || string(rest) == "--") {
+			if start >= 0 {
+				end := pos
+				if end > start && body[end-1] == '\n' {
+					end--
+					if end > start && body[end-1] == '\r' {
+						end--
+					}
+				}
+				parts = append(parts, body[start:end])
+			}
+			if len(rest) > 0 {
+				return parts
+			}
+			start = next
+		}
+
+		pos = next
+	}
+
+	if start >= 0 {
+		parts = append(parts, body[start:])
+	}
+	return parts
+}
@@ -4,6 +4,8 @@
 import {prisma} from "@/lib/prisma";
 import { cleanSenderEmail } from "./mailParser";
 import { simpleParser } from "mailparser";
+import { INBOX_DOMAIN } from "@/lib/inbox";
+import { verifyInboxToken } from "./inbox";
 
 // Manual parser for quoted-printable encoded content
 function decodeQuotedPrintable(encoded: string): string {
@@ -77,26 +79,31 @@ type PrismaEmail = {
   created_at: Date | null;
 }
 
-export async function searchEmails(rcptQuery: string) {
+export async function searchEmails(rcptQuery: string, token: string) {
+  const sanitizedQuery = rcptQuery.trim();
+  if (!sanitizedQuery) {
+    console.error("Empty recipient query");
+    return [];
+  }
+
+  const username = sanitizedQuery.includes('@')
+    ? sanitizedQuery.split('@')[0]
+    : sanitizedQuery;
+  const mailbox = `${username}@${INBOX_DOMAIN}`;
+
+  // Checked outside the try below so that a rejected token reaches the
+  // caller as an error rather than looking like an empty inbox.
+  if (!(await verifyInboxToken(mailbox, token))) {
+    throw new Error("Invalid inbox token");
+  }
+
   try {
     if (!prisma) {
       console.error("Prisma client is not initialized");
       throw new Error("Database connection error");
     }
-    
-    const sanitizedQuery = rcptQuery.trim().toLowerCase();
-    if (!sanitizedQuery) {
-      console.error("Empty recipient query");
-      return [];
-    }
-    
-    const username = sanitizedQuery.includes('@')
-      ? sanitizedQuery.split('@')[0]
-      : sanitizedQuery;
 
-    const emailVariants = [
-      `${username}@zeus.nanomail.in`,
-    ];
+    const emailVariants = [mailbox];
 
     try {
       const emails = await prisma.emails.findMany({
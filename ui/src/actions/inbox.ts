@@ -0,0 +1,57 @@
+"use server";
+
+import { createHash } from "crypto";
+import { prisma } from "@/lib/prisma";
+import { INBOX_DOMAIN } from "@/lib/inbox";
+
+const apiURL = process.env.NANOMAIL_API_URL ?? "http://localhost:8080";
+// Only admins may choose an address, so the UI registers the names its users
+// pick with the server's admin token. It stays on the server, never reaching
+// the browser.
+const adminToken = process.env.ADDRESS_ADMIN_TOKEN ?? "";
+
+export type CreateInboxResult =
+  | { ok: true; address: string; token: string }
+  | { ok: false; error: string };
+
+// Registers the inbox with the mail server, which hands back its access
+// token. The token is only ever returned here, so the caller must keep it.
+export async function createInbox(username: string): Promise<CreateInboxResult> {
+  const address = `${username.trim()}@${INBOX_DOMAIN}`;
+
+  try {
+    const res = await fetch(`${apiURL}/api/v1/addresses`, {
+      method: "POST",
+      headers: {
+        "Content-Type": "application/json",
+        Authorization: `Bearer ${adminToken}`,
+      },
+      body: JSON.stringify({ address }),
+      cache: "no-store",
+    });
+    const body = await res.json();
+
+    if (!res.ok) {
+      return { ok: false, error: body.error ?? `registration failed (${res.status})` };
+    }
+    return { ok: true, address: body.address, token: body.token };
+  } catch (error) {
+    console.error("Failed to register inbox:", error);
+    return { ok: false, error: "mail server unavailable" };
+  }
+}
+
+// Checks a token against the hashes the mail server stored for mailbox.
+export async function verifyInboxToken(mailbox: string, token: string): Promise<boolean> {
+  if (!token) return false;
+
+  const found = await prisma.inbox_tokens.findFirst({
+    where: {
+      mailbox,
+      token_hash: createHash("sha256").update(token).digest(),
+      revoked_at: null,
+    },
+    select: { id: true },
+  });
+  return found !== null;
+}
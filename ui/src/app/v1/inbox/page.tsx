@@ -10,6 +10,8 @@ import EmailDetail from "@/components/EmailDetail";
 import CopyEmailButton from "@/components/CopyEmailButton";
 import EmailParticleBackground from "@/components/EmailParticleBackground";
 import LoadingAnimation from "@/components/LoadingAnimation";
+import TokenPrompt from "@/components/TokenPrompt";
+import { getInboxToken, setInboxToken } from "@/lib/inbox";
 import { motion } from "framer-motion";
 import { useEmails, type Email } from "@/hooks/useEmails";
 
@@ -22,6 +24,7 @@ function InboxContent() {
   const [selectedEmail, setSelectedEmail] = useState<Email | null>(null);
   const [mobileView, setMobileView] = useState<"list" | "detail">("list");
   const [readEmails, setReadEmails] = useState<string[]>([]);
+  const [token, setToken] = useState<string>("");
 
   useEffect(() => {
     if (!decodedUsername) return;
@@ -61,7 +64,17 @@ function InboxContent() {
     return readEmails.includes(String(emailId));
   };
 
-  const { data: emails = [], isLoading, isError, refetch } = useEmails(decodedUsername);
+  useEffect(() => {
+    if (!decodedUsername) return;
+    setToken(getInboxToken(decodedUsername));
+  }, [decodedUsername]);
+
+  const handleTokenSubmit = (newToken: string) => {
+    setInboxToken(decodedUsername, newToken);
+    setToken(newToken);
+  };
+
+  const { data: emails = [], isLoading, isError, refetch } = useEmails(decodedUsername, token);
 
   console.log('Inbox State:', { decodedUsername, emailCount: emails.length, isLoading });
 
@@ -326,7 +339,9 @@ function InboxContent() {
             </div>
           )}
 
-          {isLoading ? (
+          {!token || isError ? (
+            <TokenPrompt rejected={!!token && isError} onSubmit={handleTokenSubmit} />
+          ) : isLoading ? (
             <LoadingAnimation />
           ) : (
             <div className="grid grid-cols-1 md:grid-cols-3 gap-6">
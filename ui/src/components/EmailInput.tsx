@@ -174,7 +174,7 @@ export default function EmailInput({ username, setUsername, onSubmit }: EmailInp
         <input
           type="text"
           value={username}
-          onChange={(e) => setUsername(e.target.value.toLowerCase().replace(/[^a-z0-9-_.]/g, ''))}
+          onChange={(e) => setUsername(e.target.value.replace(/[^A-Za-z0-9-_.]/g, ''))}
           placeholder="username"
           onFocus={() => setIsInputFocused(true)}
           onBlur={() => setIsInputFocused(false)}
@@ -8,6 +8,8 @@ import EmailInput from "@/components/EmailInput";
 import CreateInboxButton from "@/components/CreateInboxButton";
 import { useRouter } from "next/navigation";
 import { encodeQueryParam } from "@/lib/queryEncoding";
+import { setInboxToken } from "@/lib/inbox";
+import { createInbox } from "@/actions/inbox";
 import BrandingTag from "./BrandingTag";
 import GithubStar from "./GithubStar";
 
@@ -20,11 +22,21 @@ export default function HeroSection() {
     setBlurAnimationComplete(true);
   }, []);
 
-  const handleCreateInbox = useCallback(() => {
-    if (username.trim()) {
-      const encodedUsername = encodeQueryParam(username.toLowerCase());
-      router.push(`/v1/inbox?q=${encodedUsername}`);
+  const handleCreateInbox = useCallback(async () => {
+    const name = username.trim();
+    if (!name) return;
+
+    // An inbox that is already registered opens too; the inbox page asks
+    // for its token if this browser does not have it.
+    const result = await createInbox(name);
+    if (result.ok) {
+      setInboxToken(name, result.token);
+    } else {
+      console.warn(`Inbox not registered: ${result.error}`);
     }
+
+    const encodedUsername = encodeQueryParam(name);
+    router.push(`/v1/inbox?q=${encodedUsername}`);
   }, [username, router]);
 
   return (
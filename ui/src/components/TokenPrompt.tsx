@@ -0,0 +1,54 @@
+"use client";
+import React, { useState } from "react";
+import { motion } from "framer-motion";
+
+interface TokenPromptProps {
+  rejected: boolean;
+  onSubmit: (token: string) => void;
+}
+
+// Asks for an inbox's access token when this browser does not hold a
+// working one, e.g. for an inbox created elsewhere.
+const TokenPrompt: React.FC<TokenPromptProps> = ({ rejected, onSubmit }) => {
+  const [token, setToken] = useState("");
+
+  const handleSubmit = (e: React.FormEvent) => {
+    e.preventDefault();
+    if (token.trim()) {
+      onSubmit(token.trim());
+    }
+  };
+
+  return (
+    <motion.form
+      initial={{ opacity: 0, y: 10 }}
+      animate={{ opacity: 1, y: 0 }}
+      transition={{ duration: 0.4 }}
+      onSubmit={handleSubmit}
+      className="mx-auto max-w-md bg-black/30 backdrop-blur-md p-6 rounded-xl border border-[#00D8FF]/30 text-white"
+    >
+      <h2 className="text-lg font-medium mb-2">This inbox is locked</h2>
+      <p className="text-white/70 text-sm mb-4">
+        {rejected
+          ? "That access token was not accepted. It may have been rotated or revoked."
+          : "Enter the access token you were given when the inbox was created."}
+      </p>
+      <input
+        type="password"
+        value={token}
+        onChange={(e) => setToken(e.target.value)}
+        placeholder="Access token"
+        autoComplete="off"
+        className="w-full px-3 py-2 mb-4 bg-black/40 border border-[#00D8FF]/30 rounded-md text-white placeholder-white/40 focus:outline-none focus:border-[#00D8FF]/70"
+      />
+      <button
+        type="submit"
+        className="px-4 py-2 bg-black/40 hover:bg-black/60 border border-[#00D8FF]/30 rounded-md text-white/90 hover:text-[#00D8FF] transition-colors"
+      >
+        Open inbox
+      </button>
+    </motion.form>
+  );
+};
+
+export default TokenPrompt;
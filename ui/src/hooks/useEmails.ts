@@ -11,19 +11,20 @@ export interface Email {
   read: boolean;
 }
 
-export function useEmails(username: string) {
+export function useEmails(username: string, token: string) {
   return useQuery({
-    queryKey: ['emails', username],
+    queryKey: ['emails', username, token],
     queryFn: async () => {
       if (!username) return [];
       
-      const fetchedEmails = await searchEmails(username);
+      const fetchedEmails = await searchEmails(username, token);
       console.log(`📧 Fetched ${fetchedEmails.length} pre-parsed emails from server`);
       
       // Emails are already parsed on server side
       return fetchedEmails.map((email) => ({
         id: String(email.id),
-        from: email.mail_from || "",
+        // Bounces come from the null sender.
+        from: email.mail_from || "MAILER-DAEMON",
         subject: email.subject || "",
         content: email.textContent || "",
         htmlContent: email.htmlContent || "",
@@ -31,7 +32,9 @@ export function useEmails(username: string) {
         read: false,
       }));
     },
-    enabled: !!username,
+    enabled: !!username && !!token,
+    // A rejected token will not start working on retry.
+    retry: false,
     staleTime: 0,
     gcTime: 1000 * 60 * 10,
     refetchInterval: 1000 * 30,
@@ -0,0 +1,19 @@
+export const INBOX_DOMAIN = "zeus.nanomail.in";
+
+// Inbox tokens live only in this browser, keyed by username.
+
+export function getInboxToken(username: string): string {
+  try {
+    return localStorage.getItem(`inbox_token_${username}`) ?? "";
+  } catch {
+    return "";
+  }
+}
+
+export function setInboxToken(username: string, token: string) {
+  try {
+    localStorage.setItem(`inbox_token_${username}`, token);
+  } catch (error) {
+    console.error("Error saving inbox token", error);
+  }
+}